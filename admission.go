@@ -0,0 +1,340 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// an AdmissionPolicy protects a worker from unbounded queueing when its
+// database can't keep up. Once either threshold is exceeded the worker is
+// considered overloaded and writes are sampled at SampleRate, with the
+// remainder rejected with ErrBufferFull. A zero threshold is disabled.
+type AdmissionPolicy struct {
+	// the number of flushes which have been handed to the database but
+	// haven't been applied yet
+	MaxPendingFlushes int
+
+	// the time the most recent flush took to be applied
+	MaxApplyLatency time.Duration
+
+	// the fraction of writes admitted while overloaded, between 0 and 1.
+	// Writes which are sampled out are dropped without an error.
+	SampleRate float64
+
+	// while overloaded, metrics above this quantile of the recent values,
+	// eg: 0.99, are always admitted, and the rest are sampled at
+	// SampleRate with each admitted metric counted for those sampled out,
+	// or rejected without a SampleRate. The tail, and so the high
+	// percentiles, stay accurate however much of the body is shed. Zero
+	// treats every metric alike, without reweighting.
+	TailQuantile float64
+}
+
+type AdmissionStats struct {
+	Admitted uint64
+	Sampled  uint64
+	Rejected uint64
+	// admitted while overloaded for being in the tail, see TailQuantile
+	Tail uint64
+
+	PendingFlushes int
+	ApplyLatency   time.Duration
+
+	// the most recent overload episodes, oldest first, ending with the
+	// current one if the worker is overloaded
+	Episodes []OverloadEpisode
+}
+
+// the most overload episodes kept, beyond which the oldest are forgotten
+const maxOverloadEpisodes = 64
+
+// an OverloadEpisode is a period during which the worker was overloaded,
+// and so sampling or rejecting writes, so a postmortem can tell exactly
+// when metrics were lost and how many
+type OverloadEpisode struct {
+	Start time.Time
+	// zero while the episode is ongoing
+	End time.Time
+
+	// the writes made during the episode, see AdmissionStats
+	Admitted uint64
+	Sampled  uint64
+	Rejected uint64
+	Tail     uint64
+
+	// the worst the backlog got during the episode
+	PeakPendingFlushes int
+	PeakApplyLatency   time.Duration
+}
+
+// Dropped returns the number of writes lost during the episode, whether
+// sampled out or rejected.
+func (e OverloadEpisode) Dropped() uint64 {
+	return e.Sampled + e.Rejected
+}
+
+type admissionController struct {
+	policy AdmissionPolicy
+
+	pendingFlushes int64
+	applyLatency   int64
+
+	admitted uint64
+	sampled  uint64
+	rejected uint64
+	tailed   uint64
+
+	// set with a TailQuantile
+	tail *tailEstimator
+
+	// set while overloaded, so the episodes are only locked by the writes
+	// and flushes which change it
+	overloading int32
+	episodes    overloadEpisodes
+
+	// overridden in tests to control the passing of time
+	now func() time.Time
+}
+
+// the overload episodes of a controller
+type overloadEpisodes struct {
+	sync.Mutex
+
+	history []OverloadEpisode
+	current *OverloadEpisode
+
+	// the controller's counters when the current episode started
+	started AdmissionStats
+}
+
+func (a *admissionController) overloaded() bool {
+	if a.policy.MaxPendingFlushes > 0 && atomic.LoadInt64(&a.pendingFlushes) >= int64(a.policy.MaxPendingFlushes) {
+		return true
+	}
+
+	if a.policy.MaxApplyLatency > 0 && time.Duration(atomic.LoadInt64(&a.applyLatency)) > a.policy.MaxApplyLatency {
+		return true
+	}
+
+	return false
+}
+
+// decides whether a write should be buffered, returning the metric to
+// buffer, which is reweighted if it stands in for sampled out metrics.
+// When it shouldn't, a nil error means the write was sampled out rather
+// than rejected.
+func (a *admissionController) admit(metric Metric) (Metric, bool, error) {
+	_, multi := metric.(MultiMetric)
+	tailed := a.tail != nil && !multi
+	if tailed {
+		a.tail.observe(metric.Value())
+	}
+
+	if !a.track() {
+		atomic.AddUint64(&a.admitted, 1)
+		return metric, true, nil
+	}
+
+	if tailed && a.tail.inTail(metric.Value()) {
+		atomic.AddUint64(&a.admitted, 1)
+		atomic.AddUint64(&a.tailed, 1)
+		return metric, true, nil
+	}
+
+	if a.policy.SampleRate > 0 && a.tail != nil {
+		// the body is sampled 1 in weight, so the admitted metric can
+		// stand in for the rest
+		weight := sampleWeight(a.policy.SampleRate)
+		if weight == 1 || rand.Intn(weight) == 0 {
+			atomic.AddUint64(&a.admitted, 1)
+			if weight > 1 {
+				metric = weightedMetric{Metric: metric, weight: weight}
+			}
+			return metric, true, nil
+		}
+
+		atomic.AddUint64(&a.sampled, 1)
+		return nil, false, nil
+	} else if a.policy.SampleRate > 0 {
+		if rand.Float64() < a.policy.SampleRate {
+			atomic.AddUint64(&a.admitted, 1)
+			return metric, true, nil
+		}
+
+		atomic.AddUint64(&a.sampled, 1)
+		return nil, false, nil
+	}
+
+	atomic.AddUint64(&a.rejected, 1)
+	return nil, false, fmt.Errorf("worker overloaded with %d pending flushes: %w", atomic.LoadInt64(&a.pendingFlushes), ErrBufferFull)
+}
+
+// the recent values the tail is estimated from, and how often the estimate
+// is refreshed from them
+const (
+	tailEstimatorSize    = 1024
+	tailEstimatorRefresh = 128
+)
+
+// a tailEstimator estimates a quantile of the recent values, so the tail
+// can be told apart from the body before anything has been flushed
+type tailEstimator struct {
+	sync.Mutex
+
+	quantile float64
+	recent   []int
+	next     int
+	observed int
+
+	// the estimated quantile, once there have been enough values
+	threshold int
+	ready     bool
+}
+
+func newTailEstimator(quantile float64) *tailEstimator {
+	return &tailEstimator{quantile: quantile, recent: make([]int, 0, tailEstimatorSize)}
+}
+
+func (t *tailEstimator) observe(value int) {
+	t.Lock()
+	defer t.Unlock()
+
+	if len(t.recent) < tailEstimatorSize {
+		t.recent = append(t.recent, value)
+	} else {
+		t.recent[t.next] = value
+		t.next = (t.next + 1) % tailEstimatorSize
+	}
+
+	// refreshed every so often rather than on every value, as it sorts
+	t.observed++
+	if t.observed%tailEstimatorRefresh == 0 {
+		sorted := append([]int{}, t.recent...)
+		sort.Ints(sorted)
+		t.threshold, t.ready = sorted[nearestRank(t.quantile, len(sorted))-1], true
+	}
+}
+
+// reports whether the value is above the estimated quantile, which no
+// value is until there is an estimate
+func (t *tailEstimator) inTail(value int) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.ready && value > t.threshold
+}
+
+// the backlog only changes as flushes start and finish, so that is when
+// the peak of an episode is recorded
+func (a *admissionController) flushStarted() {
+	atomic.AddInt64(&a.pendingFlushes, 1)
+	if a.track() {
+		a.peak()
+	}
+}
+
+func (a *admissionController) flushFinished(latency time.Duration) {
+	atomic.AddInt64(&a.pendingFlushes, -1)
+	atomic.StoreInt64(&a.applyLatency, int64(latency))
+	if a.track() {
+		a.peak()
+	}
+}
+
+// reports whether the worker is overloaded, starting or ending an
+// overload episode if that has changed
+func (a *admissionController) track() bool {
+	overloaded := a.overloaded()
+	if overloaded == (atomic.LoadInt32(&a.overloading) == 1) {
+		return overloaded
+	}
+
+	a.episodes.Lock()
+	defer a.episodes.Unlock()
+
+	// another write or flush may have got here first
+	if overloaded && a.episodes.current == nil {
+		a.episodes.current = &OverloadEpisode{
+			Start:              a.clock(),
+			PeakPendingFlushes: int(atomic.LoadInt64(&a.pendingFlushes)),
+			PeakApplyLatency:   time.Duration(atomic.LoadInt64(&a.applyLatency)),
+		}
+		a.episodes.started = a.counters()
+		atomic.StoreInt32(&a.overloading, 1)
+	} else if !overloaded && a.episodes.current != nil {
+		episode := a.progress()
+		episode.End = a.clock()
+		a.episodes.history = append(a.episodes.history, episode)
+		if len(a.episodes.history) > maxOverloadEpisodes {
+			a.episodes.history = a.episodes.history[len(a.episodes.history)-maxOverloadEpisodes:]
+		}
+		a.episodes.current = nil
+		atomic.StoreInt32(&a.overloading, 0)
+	}
+
+	return overloaded
+}
+
+func (a *admissionController) clock() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+
+	return time.Now()
+}
+
+// records the backlog against the current episode, if it is the worst yet
+func (a *admissionController) peak() {
+	pending := int(atomic.LoadInt64(&a.pendingFlushes))
+	latency := time.Duration(atomic.LoadInt64(&a.applyLatency))
+
+	a.episodes.Lock()
+	defer a.episodes.Unlock()
+
+	if episode := a.episodes.current; episode != nil {
+		episode.PeakPendingFlushes = max(episode.PeakPendingFlushes, pending)
+		episode.PeakApplyLatency = max(episode.PeakApplyLatency, latency)
+	}
+}
+
+// the current episode with the writes made since it started, must be
+// called with the lock held
+func (a *admissionController) progress() OverloadEpisode {
+	episode, started, now := *a.episodes.current, a.episodes.started, a.counters()
+	episode.Admitted = now.Admitted - started.Admitted
+	episode.Sampled = now.Sampled - started.Sampled
+	episode.Rejected = now.Rejected - started.Rejected
+	episode.Tail = now.Tail - started.Tail
+
+	return episode
+}
+
+// the write counters, without the backlog or episodes
+func (a *admissionController) counters() AdmissionStats {
+	return AdmissionStats{
+		Admitted: atomic.LoadUint64(&a.admitted),
+		Sampled:  atomic.LoadUint64(&a.sampled),
+		Rejected: atomic.LoadUint64(&a.rejected),
+		Tail:     atomic.LoadUint64(&a.tailed),
+	}
+}
+
+func (a *admissionController) stats() AdmissionStats {
+	stats := a.counters()
+	stats.PendingFlushes = int(atomic.LoadInt64(&a.pendingFlushes))
+	stats.ApplyLatency = time.Duration(atomic.LoadInt64(&a.applyLatency))
+
+	a.episodes.Lock()
+	defer a.episodes.Unlock()
+
+	stats.Episodes = append([]OverloadEpisode{}, a.episodes.history...)
+	if a.episodes.current != nil {
+		stats.Episodes = append(stats.Episodes, a.progress())
+	}
+
+	return stats
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestAdmissionControlRejectsWhenBacklogged(t *testing.T) {
+	release := make(chan bool)
+	db := newMockDatabase(t, func(bulkMetrics []*BulkMetric) {
+		<-release
+	})
+
+	// every write is flushed immediately, and every flush blocks
+	worker := NewBufferedWorker(1, time.Minute, db, WithAdmissionControl(AdmissionPolicy{
+		MaxPendingFlushes: 2,
+	}))
+	worker.Start()
+
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		err = worker.Write(NewIntMetric(i))
+		time.Sleep(time.Millisecond)
+	}
+
+	if !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+
+	stats := worker.AdmissionStats()
+	if stats.Admitted != 2 || stats.Rejected != 1 || stats.PendingFlushes != 2 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// unblock the database and let the final flush through
+	close(release)
+	worker.Stop()
+}
+
+func TestAdmissionControlSamplesWhenOverloaded(t *testing.T) {
+	admission := &admissionController{
+		policy: AdmissionPolicy{MaxApplyLatency: time.Millisecond, SampleRate: 0.5},
+	}
+	admission.flushStarted()
+	admission.flushFinished(time.Second)
+
+	for i := 0; i < 1000; i++ {
+		if _, _, err := admission.admit(NewIntMetric(i)); err != nil {
+			t.Fatalf("sampled writes shouldn't error, got %v", err)
+		}
+	}
+
+	stats := admission.stats()
+	if stats.Rejected != 0 || stats.Sampled < 350 || stats.Sampled > 650 {
+		t.Fatalf("expected roughly half of writes to be sampled, got %+v", stats)
+	}
+}
+
+func TestAdmissionControlKeepsTheTail(t *testing.T) {
+	admission := &admissionController{
+		policy: AdmissionPolicy{MaxApplyLatency: time.Millisecond, SampleRate: 0.01, TailQuantile: 0.95},
+		tail:   newTailEstimator(0.95),
+	}
+
+	// warm the estimate up before overloading
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < tailEstimatorSize; i++ {
+		admission.admit(NewIntMetric(random.Intn(10000)))
+	}
+	admission.flushStarted()
+	admission.flushFinished(time.Second)
+
+	expected, sampled := NewSyncMedianDatabase(), NewSyncMedianDatabase()
+	for i := 0; i < 100000; i++ {
+		value := random.Intn(10000)
+		expected.BulkWrite([]*BulkMetric{{value: value, count: 1}})
+
+		metric, admit, err := admission.admit(NewIntMetric(value))
+		if err != nil {
+			t.Fatalf("sampled writes shouldn't error, got %v", err)
+		} else if !admit {
+			continue
+		}
+
+		// written as the worker would, standing in for those sampled out
+		weight := 1
+		if weighted, ok := metric.(weightedMetric); ok {
+			weight = weighted.weight
+		}
+		sampled.BulkWrite([]*BulkMetric{{value: metric.Value(), count: weight}})
+	}
+
+	stats := admission.stats()
+	if stats.Tail < 4000 || stats.Sampled < 90000 {
+		t.Fatalf("expected the tail kept and the body sampled, got %+v", stats)
+	}
+
+	want, _ := expected.Snapshot()
+	got, _ := sampled.Snapshot()
+	if count := got.Count(); count < 90000 || count > 110000 {
+		t.Fatalf("expected reweighted counts near %d, got %d", want.Count(), count)
+	}
+	if p99, actual := got.GetPercentile(0.99), want.GetPercentile(0.99); abs(p99-actual) > 50 {
+		t.Fatalf("expected p99 near %d, got %d", actual, p99)
+	}
+}
+
+func TestAdmissionControlRecordsOverloadEpisodes(t *testing.T) {
+	clock := newTestClock()
+	admission := &admissionController{
+		policy: AdmissionPolicy{MaxPendingFlushes: 2},
+		now:    clock.now,
+	}
+
+	admission.admit(NewIntMetric(1))
+	admission.flushStarted()
+	clock.advance(time.Second)
+	admission.flushStarted()
+	start := clock.now()
+
+	// rejected while two flushes are pending, and worse with a third
+	for i := 0; i < 5; i++ {
+		admission.admit(NewIntMetric(i))
+	}
+	admission.flushStarted()
+	if episodes := admission.stats().Episodes; len(episodes) != 1 || !episodes[0].End.IsZero() || episodes[0].Rejected != 5 {
+		t.Fatalf("expected an ongoing episode, got %+v", episodes)
+	}
+
+	clock.advance(3 * time.Second)
+	admission.flushFinished(time.Second)
+	admission.flushFinished(time.Second)
+	admission.admit(NewIntMetric(1))
+
+	stats := admission.stats()
+	expected := OverloadEpisode{Start: start, End: clock.now(), Rejected: 5, PeakPendingFlushes: 3, PeakApplyLatency: time.Second}
+	if len(stats.Episodes) != 1 || stats.Episodes[0] != expected || stats.Episodes[0].Dropped() != 5 {
+		t.Fatalf("expected %+v, got %+v", expected, stats.Episodes)
+	}
+	if stats.Admitted != 2 || stats.Rejected != 5 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// only the most recent episodes are kept
+	for i := 0; i < maxOverloadEpisodes+5; i++ {
+		admission.flushStarted()
+		admission.flushFinished(0)
+	}
+	if episodes := admission.stats().Episodes; len(episodes) != maxOverloadEpisodes || episodes[0] == expected {
+		t.Fatalf("expected the %d most recent episodes, got %d", maxOverloadEpisodes, len(episodes))
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// the longest process or series name an agent message can carry
+const maxAgentNameLength = 1024
+
+// an Agent aggregates the distributions of many processes on a host before
+// they are collected centrally. Each process pushes the latest snapshot of
+// each of its series, usually over a unix socket with WriteAgentSnapshot,
+// and the agent keeps the latest one from every process, so re-pushing a
+// cumulative snapshot replaces what it pushed before rather than counting
+// it twice. Every series is registered with the agent's registry as the
+// merge of its processes' snapshots, and so can be queried like any other
+// with NewRegistryHandler.
+type Agent struct {
+	sync.Mutex
+
+	registry *Registry
+	series   map[string]*agentSeries
+
+	// how long a process' snapshot is kept without being pushed again
+	expiry time.Duration
+
+	// overridden in tests to control the passing of time
+	now func() time.Time
+}
+
+// NewAgent creates an agent registering the series pushed to it with
+// registry. A process' snapshot is dropped once it hasn't been pushed for
+// expiry, eg: because the process exited, or kept for good if expiry is 0.
+func NewAgent(registry *Registry, expiry time.Duration) *Agent {
+	return &Agent{
+		registry: registry,
+		series:   make(map[string]*agentSeries),
+		expiry:   expiry,
+		now:      time.Now,
+	}
+}
+
+// WriteAgentSnapshot pushes the snapshot of a series to an agent, eg: from
+// WithSnapshotInterval with a connection to the agent's socket. Each
+// message is laid out as:
+//
+//	uvarint length of the process, then the process
+//	uvarint length of the series, then the series
+//	the snapshot, see WriteSnapshot
+//
+// where the process identifies the pushing process, eg: by its pid, for as
+// long as its snapshots are cumulative.
+func WriteAgentSnapshot(w io.Writer, process, series string, snapshot Snapshot) error {
+	buf := make([]byte, 0, 2*binary.MaxVarintLen64+len(process)+len(series))
+	buf = binary.AppendUvarint(buf, uint64(len(process)))
+	buf = append(buf, process...)
+	buf = binary.AppendUvarint(buf, uint64(len(series)))
+	buf = append(buf, series...)
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	return WriteSnapshot(w, snapshot)
+}
+
+// reads a message written with WriteAgentSnapshot, returning io.EOF if r
+// is exhausted between messages
+func readAgentSnapshot(r *bufio.Reader) (string, string, Snapshot, error) {
+	process, err := readAgentName(r)
+	if err != nil {
+		return "", "", Snapshot{}, err
+	}
+	series, err := readAgentName(r)
+	if err == io.EOF {
+		return "", "", Snapshot{}, ErrSnapshotCorrupt
+	} else if err != nil {
+		return "", "", Snapshot{}, err
+	}
+	if series == "" {
+		return "", "", Snapshot{}, fmt.Errorf("process %s pushed an unnamed series: %w", process, ErrSnapshotCorrupt)
+	}
+
+	snapshot, err := ReadSnapshot(r)
+	if err == io.EOF {
+		return "", "", Snapshot{}, ErrSnapshotCorrupt
+	} else if err != nil {
+		return "", "", Snapshot{}, err
+	}
+
+	return process, series, snapshot, nil
+}
+
+func readAgentName(r *bufio.Reader) (string, error) {
+	length, err := binary.ReadUvarint(r)
+	if err == io.EOF {
+		return "", io.EOF
+	} else if err != nil || length > maxAgentNameLength {
+		return "", ErrSnapshotCorrupt
+	}
+
+	name := make([]byte, length)
+	if _, err := io.ReadFull(r, name); err != nil {
+		return "", ErrSnapshotCorrupt
+	}
+
+	return string(name), nil
+}
+
+// Push replaces the snapshot of a series last pushed by the process,
+// registering the series the first time any process pushes it.
+func (a *Agent) Push(process, series string, snapshot Snapshot) error {
+	a.Lock()
+	merged, ok := a.series[series]
+	if !ok {
+		merged = &agentSeries{contributions: make(map[string]agentContribution), agent: a}
+		if err := a.registry.Register(series, merged); err != nil {
+			a.Unlock()
+			return err
+		}
+		a.series[series] = merged
+	}
+	a.Unlock()
+
+	merged.push(process, snapshot, a.now())
+	return nil
+}
+
+// Serve reads pushed snapshots from every connection accepted by the
+// listener, eg: a unix socket, until it is closed. Each connection is
+// read until it is closed or pushes a corrupt message, which is logged.
+func (a *Agent) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		go func() {
+			defer conn.Close()
+			if err := a.serveConn(conn); err != nil {
+				log.Printf("agent: %v", err)
+			}
+		}()
+	}
+}
+
+func (a *Agent) serveConn(conn io.Reader) error {
+	reader := bufio.NewReader(conn)
+	for {
+		process, series, snapshot, err := readAgentSnapshot(reader)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := a.Push(process, series, snapshot); err != nil {
+			return fmt.Errorf("process %s: %w", process, err)
+		}
+	}
+}
+
+// the latest snapshot a process pushed
+type agentContribution struct {
+	snapshot Snapshot
+	pushed   time.Time
+}
+
+// an agentSeries is the merge of the latest snapshots of a series pushed
+// by each process. It can't be written to directly.
+type agentSeries struct {
+	sync.Mutex
+
+	agent         *Agent
+	contributions map[string]agentContribution
+
+	// merged on the first query after a push or an expiry
+	merged *Snapshot
+}
+
+func (s *agentSeries) push(process string, snapshot Snapshot, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.contributions[process] = agentContribution{snapshot: snapshot, pushed: now}
+	s.merged = nil
+}
+
+func (s *agentSeries) Open()  {}
+func (s *agentSeries) Close() {}
+
+// BulkWrite always fails, as the series is only ever pushed to.
+func (s *agentSeries) BulkWrite([]*BulkMetric) error {
+	return fmt.Errorf("agent series are only pushed to: %w", ErrClosed)
+}
+
+// Snapshot merges the latest snapshot of every process which pushed one
+// within the agent's expiry.
+func (s *agentSeries) Snapshot() (Snapshot, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.agent.now()
+	for process, contribution := range s.contributions {
+		if s.agent.expiry > 0 && now.Sub(contribution.pushed) >= s.agent.expiry {
+			delete(s.contributions, process)
+			s.merged = nil
+		}
+	}
+
+	if s.merged == nil {
+		snapshots := make([]Snapshot, 0, len(s.contributions))
+		for _, contribution := range s.contributions {
+			snapshots = append(snapshots, contribution.snapshot)
+		}
+		merged := mergeSnapshots(snapshots...)
+		s.merged = &merged
+	}
+
+	return *s.merged, nil
+}
+
+func (s *agentSeries) GetMedian() int {
+	snapshot, _ := s.Snapshot()
+	return snapshot.GetMedian()
+}
+
+func (s *agentSeries) GetMedianAndCount() (int64, int64) {
+	snapshot, _ := s.Snapshot()
+	return int64(snapshot.GetMedian()), int64(snapshot.Count())
+}
+
+func init() {
+	commands["agent"] = command{
+		usage: "merge the snapshots pushed by local processes, and serve them",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("agent", flag.ContinueOnError)
+			socket := flags.String("socket", "/tmp/multisort-median.sock", "the unix socket processes push snapshots to")
+			listen := flags.String("listen", ":8080", "where the registry handler is served")
+			expiry := flags.Duration("expiry", 5*time.Minute, "how long a process' snapshot is kept without being pushed again, or 0 to keep it")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+
+			// a socket left behind by an agent which didn't exit cleanly
+			if err := os.Remove(*socket); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			listener, err := net.Listen("unix", *socket)
+			if err != nil {
+				return err
+			}
+			defer listener.Close()
+
+			registry := NewRegistry()
+			agent := NewAgent(registry, *expiry)
+			go func() {
+				if err := agent.Serve(listener); err != nil {
+					log.Printf("agent: %v", err)
+				}
+			}()
+
+			fmt.Fprintf(os.Stderr, "merging snapshots pushed to %s, serving on %s\n", *socket, *listen)
+			return http.ListenAndServe(*listen, NewRegistryHandler(registry))
+		},
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAgentMergesLatestSnapshots(t *testing.T) {
+	clock := newTestClock()
+	registry := NewRegistry()
+	agent := NewAgent(registry, time.Minute)
+	agent.now = clock.now
+
+	listener, err := net.Listen("unix", filepath.Join(t.TempDir(), "agent.sock"))
+	if err != nil {
+		t.Fatalf("expected listener, got %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- agent.Serve(listener) }()
+
+	// the second push from process a replaces its first
+	pushes := []struct {
+		process string
+		metrics []*BulkMetric
+	}{
+		{"a", buildBulkMetrics(0, 10)},
+		{"a", buildBulkMetrics(0, 20)},
+		{"b", buildBulkMetrics(100, 110)},
+	}
+	conn, err := net.Dial("unix", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected connection, got %v", err)
+	}
+	for _, push := range pushes {
+		snapshot := Snapshot{FrozenDatabase: newFrozenDatabase(push.metrics, nil)}
+		if err := WriteAgentSnapshot(conn, push.process, "api.latency", snapshot); err != nil {
+			t.Fatalf("expected push, got %v", err)
+		}
+	}
+	conn.Close()
+
+	var snapshot Snapshot
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if database, ok := registry.Get("api.latency"); ok {
+			if snapshot, _ = database.(Snapshotter).Snapshot(); snapshot.Count() == 30 {
+				break
+			}
+		}
+	}
+	if snapshot.Count() != 30 || snapshot.GetPercentile(1) != 109 {
+		t.Fatalf("expected the latest snapshot of each process merged, got %d metrics", snapshot.Count())
+	}
+
+	// served like any other series
+	recorder := httptest.NewRecorder()
+	NewRegistryHandler(registry).ServeHTTP(recorder, httptest.NewRequest("GET", "/series/api.latency/median", nil))
+	response := medianResponse{}
+	if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || response.Count != 30 {
+		t.Fatalf("expected the merged median served, got %+v, %v", response, err)
+	}
+
+	// process b stops pushing and expires
+	clock.advance(30 * time.Second)
+	agent.Push("a", "api.latency", Snapshot{FrozenDatabase: newFrozenDatabase(buildBulkMetrics(0, 20), nil)})
+	clock.advance(30 * time.Second)
+	database, _ := registry.Get("api.latency")
+	if snapshot, _ := database.(Snapshotter).Snapshot(); snapshot.Count() != 20 {
+		t.Fatalf("expected only process a's snapshot, got %d metrics", snapshot.Count())
+	}
+
+	listener.Close()
+	if err := <-served; err != nil {
+		t.Fatalf("expected serving to stop cleanly, got %v", err)
+	}
+}
+
+func TestReadAgentSnapshotCorrupt(t *testing.T) {
+	message := new(bytes.Buffer)
+	WriteAgentSnapshot(message, "a", "api.latency", Snapshot{FrozenDatabase: newFrozenDatabase(buildBulkMetrics(0, 10), nil)})
+	data := message.Bytes()
+
+	if _, series, _, err := readAgentSnapshot(bufio.NewReader(bytes.NewReader(data))); err != nil || series != "api.latency" {
+		t.Fatalf("expected the message read, got %q, %v", series, err)
+	}
+	if _, _, _, err := readAgentSnapshot(bufio.NewReader(bytes.NewReader(data[:len(data)-3]))); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected a truncated message to be corrupt, got %v", err)
+	}
+}
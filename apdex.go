@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Apdex scores the stored values against a pair of thresholds: values at
+// or below satisfied count fully, values at or below tolerating count for
+// half, and anything slower counts for nothing. The score is between 0 and
+// 1, and zero when nothing is stored.
+func (f *FrozenDatabase) Apdex(satisfied, tolerating int) float64 {
+	count := f.Count()
+	if count == 0 {
+		return 0
+	}
+
+	satisfiedCount := f.Rank(satisfied)
+	toleratingCount := f.Rank(tolerating) - satisfiedCount
+
+	return (float64(satisfiedCount) + float64(toleratingCount)/2) / float64(count)
+}
+
+// GetApdex returns the Apdex score of the metrics written within the last
+// window, eg: with satisfied at 500ms and tolerating at 2s for an SLA of
+// the form "Apdex(500ms) over 5m". The window is rounded out to the
+// resolution like GetWindow.
+func (w *WindowedDatabase) GetApdex(satisfied, tolerating int, window time.Duration) (float64, error) {
+	if tolerating < satisfied {
+		return 0, fmt.Errorf("tolerating threshold %d is below the satisfied threshold %d", tolerating, satisfied)
+	}
+
+	snapshot := w.GetWindow(window)
+	if snapshot.Count() == 0 {
+		return 0, ErrEmpty
+	}
+
+	return snapshot.Apdex(satisfied, tolerating), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestGetApdex(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, time.Hour)
+	database.now = clock.now
+
+	if _, err := database.GetApdex(100, 400, time.Minute); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	// an hour ago every request was satisfied
+	database.BulkWrite(buildBulkMetrics(1, 101))
+	clock.advance(30 * time.Minute)
+
+	// now half are tolerating and half frustrated
+	database.BulkWrite(buildBulkMetrics(101, 301))
+
+	apdex, err := database.GetApdex(100, 200, time.Minute)
+	if err != nil || apdex != 0.25 {
+		t.Fatalf("expected an apdex of 0.25, got %v (%v)", apdex, err)
+	}
+
+	apdex, err = database.GetApdex(100, 200, time.Hour)
+	if err != nil || apdex != 0.5 {
+		t.Fatalf("expected an apdex of 0.5 over the hour, got %v (%v)", apdex, err)
+	}
+
+	if _, err := database.GetApdex(200, 100, time.Hour); err == nil {
+		t.Fatalf("expected an error for inverted thresholds")
+	}
+}
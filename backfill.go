@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// the number of batches backfilled each time the lock is taken, so that
+// live writes can interleave with a long backfill
+const backfillChunkSize = 1024
+
+// a TimedBatch is a batch of metrics observed at the same time
+type TimedBatch struct {
+	Time    time.Time
+	Metrics []*BulkMetric
+}
+
+// a BackfillIterator yields historical batches, eg: read from WAL segments,
+// files or a Kafka topic. Next returns io.EOF once there are none left.
+type BackfillIterator interface {
+	Next() (TimedBatch, error)
+}
+
+type BackfillStats struct {
+	Batches int
+	// metrics written into their buckets, and metrics dropped because
+	// they were older than the retention
+	Applied int
+	Dropped int
+}
+
+// Backfill ingests historical batches straight into their time buckets,
+// bypassing the late policy and the watermark so that live writes carry on
+// as if nothing happened: no windows are corrected or finalized. Batches
+// older than the retention, or rejected by the skew policy, are dropped. It
+// stops early, returning what was ingested so far, if the context is done or
+// the iterator fails.
+func (w *WindowedDatabase) Backfill(ctx context.Context, iterator BackfillIterator) (BackfillStats, error) {
+	stats := BackfillStats{}
+	chunk := make([]TimedBatch, 0, backfillChunkSize)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+
+		chunk = chunk[:0]
+		var iterErr error
+		for len(chunk) < backfillChunkSize {
+			batch, err := iterator.Next()
+			if err != nil {
+				iterErr = err
+				break
+			}
+
+			for _, metric := range batch.Metrics {
+				if metric == nil || metric.Count() < 1 {
+					return stats, fmt.Errorf("bulk metric %v at %v: %w", metric, batch.Time, ErrInvalidMetric)
+				}
+			}
+			chunk = append(chunk, batch)
+		}
+
+		if err := w.backfill(chunk, &stats); err != nil {
+			return stats, err
+		}
+
+		if errors.Is(iterErr, io.EOF) {
+			return stats, nil
+		} else if iterErr != nil {
+			return stats, iterErr
+		}
+	}
+}
+
+func (w *WindowedDatabase) backfill(chunk []TimedBatch, stats *BackfillStats) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	now := w.reference()
+	for _, batch := range chunk {
+		stats.Batches++
+
+		count := 0
+		for _, metric := range batch.Metrics {
+			count += metric.Count()
+		}
+
+		observed, err := w.correctSkew(batch.Time, count)
+		start := observed.Truncate(w.resolution)
+		if err != nil || !start.Add(w.resolution).After(now.Add(-w.retention)) {
+			stats.Dropped += count
+			continue
+		}
+
+		bucket := w.bucket(start, now)
+		for _, metric := range batch.Metrics {
+			bucket.add(metric.Value(), metric.Count())
+			stats.Applied += metric.Count()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// yields the batches, failing with err once they run out
+type sliceIterator struct {
+	batches []TimedBatch
+	err     error
+}
+
+func (s *sliceIterator) Next() (TimedBatch, error) {
+	if len(s.batches) == 0 {
+		return TimedBatch{}, s.err
+	}
+
+	batch := s.batches[0]
+	s.batches = s.batches[1:]
+	return batch, nil
+}
+
+func TestWindowedDatabaseBackfill(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute)
+	database.now = clock.now
+
+	iterator := &sliceIterator{err: io.EOF}
+	for i := 0; i < 3000; i++ {
+		// a batch a second going back 50 minutes, most of which is
+		// beyond the retention
+		iterator.batches = append(iterator.batches, TimedBatch{
+			Time:    clock.now().Add(-time.Duration(i) * time.Second),
+			Metrics: buildBulkMetrics(i%10, i%10+1),
+		})
+	}
+
+	stats, err := database.Backfill(context.Background(), iterator)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the live window and the ten before it are retained, and late
+	// metrics aren't dropped as they would be when written live
+	if stats.Batches != 3000 || stats.Applied != 601 || stats.Dropped != 2399 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if count := database.GetWindow(time.Hour).Count(); count != 601 {
+		t.Fatalf("expected 601 metrics, got %d", count)
+	}
+	if late := database.LatenessStats(); late.Dropped != 0 {
+		t.Fatalf("unexpected lateness stats %+v", late)
+	}
+}
+
+func TestWindowedDatabaseBackfillErrors(t *testing.T) {
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute)
+	failure := errors.New("segment corrupt")
+
+	iterator := &sliceIterator{
+		batches: []TimedBatch{{Time: time.Now(), Metrics: buildBulkMetrics(0, 10)}},
+		err:     failure,
+	}
+	if stats, err := database.Backfill(context.Background(), iterator); err != failure || stats.Applied != 10 {
+		t.Fatalf("expected the iterator's error after 10 metrics, got %v after %+v", err, stats)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := database.Backfill(ctx, &sliceIterator{err: io.EOF}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var defaultBandQuantiles = []float64{0.1, 0.5, 0.9, 0.99}
+
+type Band struct {
+	Quantile float64 `json:"quantile"`
+	Value    int     `json:"value"`
+}
+
+// Bands are the quantiles of the values written during a single interval
+type Bands struct {
+	Time  time.Time `json:"time"`
+	Count int       `json:"count"`
+	Sum   float64   `json:"sum"`
+	Bands []Band    `json:"bands"`
+}
+
+type BandSink interface {
+	EmitBands(Bands) error
+}
+
+// BandSinkFunc adapts a function into a BandSink
+type BandSinkFunc func(Bands) error
+
+func (f BandSinkFunc) EmitBands(bands Bands) error {
+	return f(bands)
+}
+
+// a BandEmitter periodically publishes the quantile bands of the values
+// written to a database since the last interval, eg: p10/p50/p90/p99, to
+// each of its sinks. Only values added between snapshots are counted, so
+// evictions from a windowed or rolling database don't show up as bands.
+type BandEmitter struct {
+	// held while emitting, so intervals never overlap
+	sync.Mutex
+
+	source    Snapshotter
+	interval  time.Duration
+	quantiles []float64
+	sinks     []BandSink
+
+	// the snapshot the next interval is measured from
+	previous Snapshot
+
+	quitCh  chan struct{}
+	doneCh  chan struct{}
+	errCh   chan error
+	started int32
+}
+
+// NewBandEmitter creates an emitter for the quantiles, which are fractions
+// between 0 and 1, defaulting to p10/p50/p90/p99 if none are given.
+func NewBandEmitter(source Snapshotter, interval time.Duration, quantiles []float64, sinks ...BandSink) *BandEmitter {
+	if len(quantiles) == 0 {
+		quantiles = defaultBandQuantiles
+	}
+
+	return &BandEmitter{
+		source:    source,
+		interval:  interval,
+		quantiles: quantiles,
+		sinks:     sinks,
+		previous:  Snapshot{FrozenDatabase: newFrozenDatabase(nil, nil)},
+		quitCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+		errCh:     make(chan error, errorChannelSize),
+	}
+}
+
+// Start emits bands every interval until stopped.
+func (b *BandEmitter) Start() {
+	atomic.StoreInt32(&b.started, 1)
+	go func() {
+		defer close(b.doneCh)
+
+		ticker := time.NewTicker(b.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				reportError(b.errCh, b.Emit())
+			case <-b.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops emitting, without emitting the partial interval.
+func (b *BandEmitter) Stop() {
+	close(b.quitCh)
+	if atomic.LoadInt32(&b.started) == 1 {
+		<-b.doneCh
+	}
+}
+
+// Errors returns a channel of errors from taking snapshots or emitting to
+// a sink. Errors are dropped if the channel isn't drained.
+func (b *BandEmitter) Errors() <-chan error {
+	return b.errCh
+}
+
+// Emit publishes the bands of the values written since the last emit to
+// every sink, returning the last error.
+func (b *BandEmitter) Emit() error {
+	b.Lock()
+	defer b.Unlock()
+
+	snapshot, err := b.source.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[int]int)
+	for _, delta := range Diff(b.previous, snapshot).Deltas {
+		if delta.Delta > 0 {
+			counts[delta.Value] = delta.Delta
+		}
+	}
+	b.previous = snapshot
+
+	interval := newSnapshotFromCounts(counts, snapshot.Time)
+	bands := Bands{
+		Time:  snapshot.Time,
+		Count: interval.Count(),
+		Sum:   interval.Sum(),
+		Bands: make([]Band, 0, len(b.quantiles)),
+	}
+	for _, quantile := range b.quantiles {
+		bands.Bands = append(bands.Bands, Band{Quantile: quantile, Value: interval.GetPercentile(quantile)})
+	}
+
+	var lastErr error
+	for _, sink := range b.sinks {
+		if err := sink.EmitBands(bands); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+// a PrometheusBandSink serves the latest bands as a Prometheus summary. As
+// Prometheus expects, the count and sum accumulate across every interval
+// while the quantiles only cover the latest one.
+type PrometheusBandSink struct {
+	sync.Mutex
+
+	name   string
+	help   string
+	labels map[string]string
+
+	latest Bands
+	count  int
+	sum    float64
+}
+
+func NewPrometheusBandSink(name, help string, labels map[string]string) *PrometheusBandSink {
+	return &PrometheusBandSink{
+		name:   name,
+		help:   help,
+		labels: labels,
+	}
+}
+
+func (p *PrometheusBandSink) EmitBands(bands Bands) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.latest = bands
+	p.count += bands.Count
+	p.sum += bands.Sum
+
+	return nil
+}
+
+func (p *PrometheusBandSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.Lock()
+	defer p.Unlock()
+
+	quantiles := make([]float64, 0, len(p.latest.Bands))
+	values := make([]float64, 0, len(p.latest.Bands))
+	for _, band := range p.latest.Bands {
+		quantiles = append(quantiles, band.Quantile)
+		values = append(values, float64(band.Value))
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeSummary(w, p.name, p.help, p.labels, quantiles, values, p.sum, p.count)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandEmitter(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	var emitted []Bands
+	prometheus := NewPrometheusBandSink("latency", "", nil)
+	emitter := NewBandEmitter(database, time.Hour, []float64{0.5, 0.9}, prometheus, BandSinkFunc(func(bands Bands) error {
+		emitted = append(emitted, bands)
+		return nil
+	}))
+
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 101))
+	emitter.Emit()
+
+	// the second interval only covers what was written since the first
+	<-database.BulkWriteAcked(buildBulkMetrics(1000, 1010))
+	emitter.Emit()
+
+	if len(emitted) != 2 {
+		t.Fatalf("expected 2 intervals, got %d", len(emitted))
+	}
+	if bands := emitted[0]; bands.Count != 100 || bands.Bands[0].Value != 50 || bands.Bands[1].Value != 90 {
+		t.Fatalf("unexpected first interval %+v", bands)
+	}
+	if bands := emitted[1]; bands.Count != 10 || bands.Bands[0].Value != 1004 || bands.Bands[1].Value != 1008 {
+		t.Fatalf("unexpected second interval %+v", bands)
+	}
+
+	recorder := httptest.NewRecorder()
+	prometheus.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	if !strings.Contains(body, `latency{quantile="0.5"} 1004`) || !strings.Contains(body, "latency_count 110\n") {
+		t.Fatalf("unexpected metrics:\n%s", body)
+	}
+}
+
+func TestBandEmitterInterval(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+	<-database.BulkWriteAcked(buildBulkMetrics(0, 10))
+
+	emitted := make(chan Bands, 10)
+	emitter := NewBandEmitter(database, 10*time.Millisecond, nil, BandSinkFunc(func(bands Bands) error {
+		emitted <- bands
+		return nil
+	}))
+	emitter.Start()
+	defer emitter.Stop()
+
+	select {
+	case bands := <-emitted:
+		if len(bands.Bands) != 4 || bands.Count != 10 {
+			t.Fatalf("unexpected bands %+v", bands)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
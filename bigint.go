@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math/big"
+)
+
+// a BigIntDatabase stores arbitrary precision integers, for inputs such as
+// financial or scientific values which can exceed an int64. Values are
+// copied on the way in and out, so callers are free to reuse them.
+type BigIntDatabase struct {
+	ordered *OrderedDatabase[*big.Int]
+}
+
+func NewBigIntDatabase() *BigIntDatabase {
+	return &BigIntDatabase{
+		ordered: NewOrderedDatabase(func(a, b *big.Int) int {
+			return a.Cmp(b)
+		}),
+	}
+}
+
+func (b *BigIntDatabase) Write(values ...*big.Int) error {
+	for _, value := range values {
+		if err := b.WriteCount(value, 1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WriteCount writes the value count times.
+func (b *BigIntDatabase) WriteCount(value *big.Int, count int) error {
+	if value == nil {
+		return ErrInvalidMetric
+	}
+
+	return b.ordered.WriteCount(new(big.Int).Set(value), count)
+}
+
+func (b *BigIntDatabase) Count() int {
+	return b.ordered.Count()
+}
+
+// GetMedian returns the median, which is the average of the two middle
+// values truncated towards zero when there is an even number of values,
+// or ErrEmpty before anything is written.
+func (b *BigIntDatabase) GetMedian() (*big.Int, error) {
+	b.ordered.RLock()
+	defer b.ordered.RUnlock()
+
+	count := b.ordered.count
+	if count == 0 {
+		return nil, ErrEmpty
+	}
+	if count%2 == 1 {
+		return new(big.Int).Set(b.ordered.rank((count + 1) / 2)), nil
+	}
+
+	median := new(big.Int).Add(b.ordered.rank(count/2), b.ordered.rank(count/2+1))
+	return median.Quo(median, big.NewInt(2)), nil
+}
+
+// GetPercentile returns the value at the p percentile, where p is a
+// fraction between 0 and 1, using the nearest rank.
+func (b *BigIntDatabase) GetPercentile(p float64) (*big.Int, error) {
+	value, err := b.ordered.GetPercentile(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).Set(value), nil
+}
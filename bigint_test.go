@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+)
+
+func TestBigIntDatabase(t *testing.T) {
+	database := NewBigIntDatabase()
+
+	if _, err := database.GetMedian(); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	// values well beyond an int64
+	huge, _ := new(big.Int).SetString("100000000000000000000000", 10)
+	value := new(big.Int)
+	for i := int64(1); i <= 4; i++ {
+		database.Write(value.Mul(huge, big.NewInt(i)))
+	}
+
+	// the written value was copied, so reusing it changes nothing
+	value.SetInt64(0)
+
+	expected, _ := new(big.Int).SetString("250000000000000000000000", 10)
+	if median, _ := database.GetMedian(); median.Cmp(expected) != 0 {
+		t.Fatalf("expected a median of %v, got %v", expected, median)
+	}
+
+	expected.Mul(huge, big.NewInt(4))
+	if max, _ := database.GetPercentile(1); max.Cmp(expected) != 0 {
+		t.Fatalf("expected a max of %v, got %v", expected, max)
+	}
+
+	if err := database.Write(nil); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+}
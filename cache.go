@@ -0,0 +1,63 @@
+package main
+
+import (
+	"sync"
+)
+
+// a queryCache holds the results of expensive queries for as long as no
+// write has been applied since they were computed. Results are keyed by
+// the generation they were computed at, which every applied batch moves
+// on, so they are invalidated by the next write without it having to
+// touch the cache.
+type queryCache struct {
+	sync.Mutex
+
+	generation uint64
+	results    map[string]interface{}
+}
+
+// WithQueryCache caches snapshots and reports until the next write is
+// applied, so dashboards polling a quiet database every second don't copy
+// and summarize the same contents over and over. Cached snapshots keep
+// the Time they were taken at.
+func WithQueryCache() DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.cache = &queryCache{results: make(map[string]interface{})}
+	}
+}
+
+// returns the result cached under key at the generation, computing it if
+// there isn't one. Results which fail aren't cached.
+func (c *queryCache) get(generation uint64, key string, compute func() (interface{}, error)) (interface{}, error) {
+	if c == nil {
+		return compute()
+	}
+
+	c.Lock()
+	if c.generation != generation {
+		c.generation = generation
+		c.results = make(map[string]interface{})
+	}
+	result, ok := c.results[key]
+	c.Unlock()
+
+	if ok {
+		return result, nil
+	}
+
+	// computed outside of the lock, as it may have to wait on the worker
+	result, err := compute()
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	// a write applied while computing may have moved the cache on, and
+	// the result would then be cached as of a generation it isn't from
+	if c.generation == generation {
+		c.results[key] = result
+	}
+	c.Unlock()
+
+	return result, nil
+}
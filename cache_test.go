@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestQueryCache(t *testing.T) {
+	database := NewMedianDatabase(WithQueryCache())
+	database.Open()
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 101))
+
+	first, _ := database.Snapshot()
+	second, _ := database.Snapshot()
+	if first.FrozenDatabase != second.FrozenDatabase {
+		t.Fatalf("expected the snapshot to be cached between writes")
+	}
+	if report, _ := database.Report(); report.Count != 100 {
+		t.Fatalf("expected a report of 100 metrics, got %+v", report)
+	}
+
+	// a write invalidates every cached result
+	<-database.BulkWriteAcked(buildBulkMetrics(101, 201))
+	third, _ := database.Snapshot()
+	if third.FrozenDatabase == first.FrozenDatabase || third.Count() != 200 {
+		t.Fatalf("expected a new snapshot of 200 metrics, got %d", third.Count())
+	}
+	if report, _ := database.Report(); report.Count != 200 || report.Max != 200 {
+		t.Fatalf("expected the report to be recomputed, got %+v", report)
+	}
+
+	database.Close()
+	if _, err := database.Snapshot(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed once closed, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sync/atomic"
+)
+
+// an OutlierPolicy decides what happens to values outside of the range a
+// worker was created WithValueRange
+type OutlierPolicy int
+
+const (
+	// outliers are stored as the nearest value in the range
+	ClampOutliers OutlierPolicy = iota
+	// outliers are dropped
+	DropOutliers
+)
+
+type OutlierStats struct {
+	Clamped uint64
+	Dropped uint64
+}
+
+type outlierFilter struct {
+	low    int
+	high   int
+	policy OutlierPolicy
+
+	clamped uint64
+	dropped uint64
+}
+
+// WithValueRange keeps the values a worker writes within [low, high], so
+// sentinel values like -1 or math.MaxInt can't wreck the percentiles.
+// Values outside of it are clamped or dropped by the policy, and counted
+// in OutlierStats. Clamped raw observations are stored as the clamped
+// value too, so they can't skew the aggregate either.
+func WithValueRange(low, high int, policy OutlierPolicy) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.outliers = &outlierFilter{
+			low:    low,
+			high:   high,
+			policy: policy,
+		}
+	}
+}
+
+// returns the value to store count metrics at, and whether they should be
+// stored at all
+func (o *outlierFilter) filter(value, count int) (int, bool) {
+	if o == nil || (value >= o.low && value <= o.high) {
+		return value, true
+	}
+
+	if o.policy == DropOutliers {
+		atomic.AddUint64(&o.dropped, uint64(count))
+		return value, false
+	}
+
+	atomic.AddUint64(&o.clamped, uint64(count))
+	if value < o.low {
+		return o.low, true
+	}
+
+	return o.high, true
+}
+
+// OutlierStats reports how many metrics were clamped or dropped for being
+// outside of the worker's value range.
+func (b *BufferedWorker) OutlierStats() OutlierStats {
+	if b.outliers == nil {
+		return OutlierStats{}
+	}
+
+	return OutlierStats{
+		Clamped: atomic.LoadUint64(&b.outliers.clamped),
+		Dropped: atomic.LoadUint64(&b.outliers.dropped),
+	}
+}
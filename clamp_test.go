@@ -0,0 +1,46 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestWorkerValueRange(t *testing.T) {
+	for _, policy := range []OutlierPolicy{ClampOutliers, DropOutliers} {
+		database := NewMedianDatabase()
+		database.Open()
+
+		worker := NewBufferedWorker(100, time.Hour, database, WithValueRange(0, 1000, policy))
+		worker.Start()
+
+		worker.Write(NewIntMetric(-1))
+		worker.Write(NewIntMetric(math.MaxInt))
+		worker.Write(NewHistogramMetric(map[int]int{-1: 2, 10: 3, 5000: 1}))
+		for i := 1; i <= 4; i++ {
+			worker.Write(NewIntMetric(i * 100))
+		}
+		worker.Stop()
+
+		stats := worker.OutlierStats()
+		snapshot, _ := database.Snapshot()
+		database.Close()
+
+		switch policy {
+		case ClampOutliers:
+			if stats.Clamped != 5 || stats.Dropped != 0 {
+				t.Fatalf("expected 5 outliers to be clamped, got %+v", stats)
+			}
+			if snapshot.Count() != 12 || snapshot.Min() != 0 || snapshot.Max() != 1000 {
+				t.Fatalf("expected 12 metrics within the range, got %d in [%d, %d]", snapshot.Count(), snapshot.Min(), snapshot.Max())
+			}
+		case DropOutliers:
+			if stats.Clamped != 0 || stats.Dropped != 5 {
+				t.Fatalf("expected 5 outliers to be dropped, got %+v", stats)
+			}
+			if snapshot.Count() != 7 || snapshot.Min() != 10 || snapshot.Max() != 400 {
+				t.Fatalf("expected the 7 metrics within the range, got %d in [%d, %d]", snapshot.Count(), snapshot.Min(), snapshot.Max())
+			}
+		}
+	}
+}
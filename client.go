@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a Client is a Database backed by a remote database served by NewHandler.
+// Every BulkWrite is a round trip, so most callers want the batching
+// client from NewBatchingClient instead.
+type Client struct {
+	sync.Mutex
+
+	url    string
+	client *http.Client
+
+	// the write credits the server last advertised, or -1 if it doesn't
+	// flow control writes, and until when it asked us to back off
+	credits      int
+	blockedUntil time.Time
+
+	// the codec to compress writes with, and whether the server last
+	// advertised that it accepts it
+	compression string
+	compressing bool
+
+	// sent with every write, see WithClientID
+	clientID string
+}
+
+type ClientOption func(*Client)
+
+// WithCompression compresses writes with the named codec, eg: gzip, once
+// the server has advertised that it accepts it, so the first write is
+// always sent as is. Clients of servers which don't accept the codec keep
+// sending writes as is.
+func WithCompression(codecName string) ClientOption {
+	return func(c *Client) {
+		c.compression = codecName
+	}
+}
+
+// NewClient creates a client for the handler mounted at url.
+func NewClient(url string, options ...ClientOption) *Client {
+	c := &Client{
+		url:     strings.TrimSuffix(url, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		credits: -1,
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c
+}
+
+func (c *Client) Open()  {}
+func (c *Client) Close() {}
+
+// BulkWrite sends the metrics to the remote database as a single frame.
+// While the server has asked the client to back off, writes fail with
+// ErrBufferFull without a round trip.
+func (c *Client) BulkWrite(bulkMetrics []*BulkMetric) error {
+	for _, metric := range bulkMetrics {
+		if metric == nil || metric.Count() < 1 {
+			return fmt.Errorf("bulk metric %v: %w", metric, ErrInvalidMetric)
+		}
+	}
+	if c.Throttled() {
+		return fmt.Errorf("server asked to back off: %w", ErrBufferFull)
+	}
+
+	// sorted batches keep the value deltas, and so the frame, small
+	body := EncodeFrame(Frame{Metrics: BulkMetrics(bulkMetrics).Merge()})
+	request, err := c.writeRequest(body)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	c.updateCredits(resp)
+	c.updateCompression(resp)
+	return responseError(resp)
+}
+
+// returns the request writing the frames, compressed if the server
+// accepts it
+func (c *Client) writeRequest(body []byte) (*http.Request, error) {
+	c.Lock()
+	compression := ""
+	if c.compressing {
+		compression = c.compression
+	}
+	c.Unlock()
+
+	var encoding string
+	if compression != "" {
+		buf := &bytes.Buffer{}
+		codec, err := lookupCodec(compression)
+		if err != nil {
+			return nil, err
+		}
+		writer, err := codec.NewWriter(buf)
+		if err != nil {
+			return nil, err
+		}
+		writer.Write(body)
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		body, encoding = buf.Bytes(), compression
+	}
+
+	request, err := http.NewRequest(http.MethodPost, c.url+"/write", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/octet-stream")
+	if c.clientID != "" {
+		request.Header.Set(clientIDHeader, c.clientID)
+	}
+	if encoding != "" {
+		request.Header.Set("Content-Encoding", encoding)
+	}
+
+	return request, nil
+}
+
+// records whether the server accepts the client's compression
+func (c *Client) updateCompression(resp *http.Response) {
+	if c.compression == "" {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.compressing = false
+	for _, encoding := range strings.Split(resp.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(encoding) == c.compression {
+			c.compressing = true
+		}
+	}
+}
+
+// records the flow control state advertised by a write response
+func (c *Client) updateCredits(resp *http.Response) {
+	c.Lock()
+	defer c.Unlock()
+
+	if credits, err := strconv.Atoi(resp.Header.Get(creditsHeader)); err == nil {
+		c.credits = credits
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err != nil || seconds < 1 {
+			seconds = 1
+		}
+		c.blockedUntil = time.Now().Add(time.Duration(seconds) * time.Second)
+	}
+}
+
+// Throttled reports whether the server has asked the client to back off.
+func (c *Client) Throttled() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	return time.Now().Before(c.blockedUntil)
+}
+
+// Credits returns the write credits the server last advertised, or -1 if
+// it doesn't flow control writes.
+func (c *Client) Credits() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.credits
+}
+
+// GetMedian returns the remote median, or zero if it can't be reached.
+func (c *Client) GetMedian() int {
+	median, _ := c.GetMedianAndCount()
+	return int(median)
+}
+
+// GetMedianAndCount returns the remote median and count, or zeros if they
+// can't be reached.
+func (c *Client) GetMedianAndCount() (int64, int64) {
+	resp, err := c.client.Get(c.url + "/median")
+	if err != nil {
+		return 0, 0
+	}
+	defer resp.Body.Close()
+
+	response := medianResponse{}
+	if responseError(resp) != nil || json.NewDecoder(resp.Body).Decode(&response) != nil {
+		return 0, 0
+	}
+
+	return int64(response.Median), response.Count
+}
+
+// maps an error response back onto the error the handler was given
+func responseError(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	message := strings.TrimSpace(string(body))
+
+	switch resp.StatusCode {
+	case http.StatusBadRequest:
+		return fmt.Errorf("%s: %w", message, ErrInvalidMetric)
+	case http.StatusTooManyRequests:
+		return fmt.Errorf("%s: %w", message, ErrBufferFull)
+	case http.StatusServiceUnavailable:
+		return fmt.Errorf("%s: %w", message, ErrClosed)
+	}
+
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, message)
+}
+
+// NewBatchingClient returns a started BufferedWorker which writes to the
+// remote database served at url, so callers can write single metrics and
+// have them sent in batches once bufferSize metrics are buffered or the
+// flush interval passes. Writes are acknowledged before they are sent, so
+// failed sends are reported on the worker's Errors channel, and WriteAcked
+// can be used for metrics which mustn't be lost silently. While the server
+// is pushing back, flushes are held and metrics keep being buffered
+// locally, where admission control can sample or reject them.
+func NewBatchingClient(url string, bufferSize int, flushInterval time.Duration, options ...WorkerOption) *BufferedWorker {
+	return NewClient(url).Batching(bufferSize, flushInterval, options...)
+}
+
+// Batching returns a started BufferedWorker which writes to the client in
+// batches, see NewBatchingClient, eg: for a client created
+// WithCompression.
+func (c *Client) Batching(bufferSize int, flushInterval time.Duration, options ...WorkerOption) *BufferedWorker {
+	worker := NewBufferedWorker(bufferSize, flushInterval, c, options...)
+
+	beforeFlush := worker.beforeFlush
+	worker.beforeFlush = func(info FlushInfo) bool {
+		if c.Throttled() {
+			return false
+		}
+
+		return beforeFlush == nil || beforeFlush(info)
+	}
+
+	afterFlush := worker.afterFlush
+	worker.afterFlush = func(info FlushInfo) {
+		if info.Err != nil {
+			reportError(worker.errCh, info.Err)
+		}
+		if afterFlush != nil {
+			afterFlush(info)
+		}
+	}
+
+	worker.Start()
+	return worker
+}
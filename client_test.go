@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	server := httptest.NewServer(NewHandler(database))
+	defer server.Close()
+
+	client := NewClient(server.URL + "/")
+	if err := client.BulkWrite(buildBulkMetrics(1, 101)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := client.BulkWrite([]*BulkMetric{{value: 1}}); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+
+	// writes are applied by the worker in the background
+	database.Snapshot()
+	if median, count := client.GetMedianAndCount(); median != 50 || count != 100 {
+		t.Fatalf("expected a median of 50 over 100, got %d over %d", median, count)
+	}
+
+	database.Freeze()
+	if err := client.BulkWrite(buildBulkMetrics(1, 2)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBatchingClient(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	server := httptest.NewServer(NewHandler(database))
+
+	flushes := int32(0)
+	client := NewBatchingClient(server.URL, 10, time.Hour, WithAfterFlush(func(FlushInfo) {
+		atomic.AddInt32(&flushes, 1)
+	}))
+	for i := 0; i < 25; i++ {
+		client.Write(NewIntMetric(i))
+	}
+	// acknowledged once the final flush on stop has been sent
+	ack := client.WriteAcked(NewIntMetric(25))
+	client.Stop()
+	if err := <-ack; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	database.Snapshot()
+	if _, count := database.GetMedianAndCount(); count != 26 {
+		t.Fatalf("expected 26 metrics, got %d", count)
+	}
+	// two full buffers, then the rest on stop
+	if flushes := atomic.LoadInt32(&flushes); flushes != 3 {
+		t.Fatalf("expected 3 flushes, got %d", flushes)
+	}
+
+	// failed sends are reported asynchronously
+	server.Close()
+	client = NewBatchingClient(server.URL, 1, time.Hour)
+	defer client.Stop()
+	client.Write(NewIntMetric(1))
+	select {
+	case err := <-client.Errors():
+		if err == nil {
+			t.Fatalf("expected an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the failed send to be reported")
+	}
+}
+
+func TestCompressedWrites(t *testing.T) {
+	database := NewSyncMedianDatabase()
+	handler := NewHandler(database)
+
+	encodings := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// the first write is sent as is, until the server advertises gzip
+	client := NewClient(server.URL, WithCompression("gzip"))
+	for i := 0; i < 3; i++ {
+		if err := client.BulkWrite(buildBulkMetrics(i*100, i*100+100)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(encodings, []string{"", "gzip", "gzip"}) {
+		t.Fatalf("unexpected encodings %v", encodings)
+	}
+	if median, count := database.GetMedianAndCount(); median != 149 || count != 300 {
+		t.Fatalf("expected a median of 149 over 300, got %d over %d", median, count)
+	}
+
+	// codecs the server doesn't accept are never used
+	encodings = encodings[:0]
+	client = NewClient(server.URL, WithCompression("snappy"))
+	client.BulkWrite(buildBulkMetrics(0, 10))
+	client.BulkWrite(buildBulkMetrics(0, 10))
+	if !reflect.DeepEqual(encodings, []string{"", ""}) {
+		t.Fatalf("unexpected encodings %v", encodings)
+	}
+
+	request := httptest.NewRequest("POST", "/write", strings.NewReader("compressed"))
+	request.Header.Set("Content-Encoding", "snappy")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusUnsupportedMediaType || recorder.Header().Get("Accept-Encoding") != "flate, gzip" {
+		t.Fatalf("expected 415 advertising flate and gzip, got %d advertising %q", recorder.Code, recorder.Header().Get("Accept-Encoding"))
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// compressed streams start with this magic, followed by the length of the
+// codec's name and the name itself, so readers know how to decompress them
+var compressedMagic = []byte("MSZ1")
+
+// a Codec compresses snapshots, frame logs and replication streams. Only
+// codecs in the standard library are built in; others, eg: zstd or snappy,
+// can be added by other packages with RegisterCodec.
+type Codec interface {
+	Name() string
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = make(map[string]Codec)
+)
+
+// RegisterCodec makes a codec available by name. It panics if the name is
+// already registered.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+
+	if _, ok := codecs[codec.Name()]; ok {
+		panic("codec " + codec.Name() + " registered twice")
+	}
+	codecs[codec.Name()] = codec
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("codec %q: %w", name, ErrUnknownCodec)
+	}
+
+	return codec, nil
+}
+
+// the names of every codec which actually compresses, sorted
+func compressingCodecs() []string {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	names := make([]string, 0, len(codecs))
+	for name := range codecs {
+		if name != "none" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// writes to a handler can be compressed with any registered codec, named
+// in the Content-Encoding header. Every write response advertises the
+// codecs the handler accepts in the Accept-Encoding header, so clients
+// created WithCompression know whether they can compress their next write.
+
+// advertises the codecs writes can be compressed with
+func advertiseEncodings(w http.ResponseWriter) {
+	w.Header().Set("Accept-Encoding", strings.Join(compressingCodecs(), ", "))
+}
+
+// returns the request's body, decompressed by its Content-Encoding
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	encoding := r.Header.Get("Content-Encoding")
+	if encoding == "" || encoding == "identity" {
+		return r.Body, nil
+	}
+
+	codec, err := lookupCodec(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.NewReader(r.Body)
+}
+
+// writes a 415 and returns false if the request's body can't be read
+func readableBody(w http.ResponseWriter, r *http.Request) (io.ReadCloser, bool) {
+	body, err := requestBody(r)
+	if err != nil {
+		advertiseEncodings(w)
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return nil, false
+	}
+
+	return body, true
+}
+
+// a compressedWriter closes the codec's writer, but not the underlying
+// writer, and can be flushed if the codec supports it
+type compressedWriter struct {
+	io.WriteCloser
+}
+
+// Flush pushes everything written so far to the underlying writer, eg:
+// after each frame of a replication stream so replicas don't lag behind.
+func (c compressedWriter) Flush() error {
+	if flusher, ok := c.WriteCloser.(interface{ Flush() error }); ok {
+		return flusher.Flush()
+	}
+
+	return nil
+}
+
+// NewCompressedWriter returns a writer which compresses everything written
+// to it with the named codec. Close must be called to finish the stream.
+func NewCompressedWriter(w io.Writer, codecName string) (io.WriteCloser, error) {
+	codec, err := lookupCodec(codecName)
+	if err != nil {
+		return nil, err
+	}
+	if len(codecName) > 255 {
+		return nil, fmt.Errorf("codec name %q is too long", codecName)
+	}
+
+	header := append(append([]byte{}, compressedMagic...), byte(len(codecName)))
+	if _, err := w.Write(append(header, codecName...)); err != nil {
+		return nil, err
+	}
+
+	writer, err := codec.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+
+	return compressedWriter{writer}, nil
+}
+
+// NewCompressedReader returns a reader which decompresses a stream written
+// by NewCompressedWriter, with whichever codec it was written with.
+func NewCompressedReader(r io.Reader) (io.ReadCloser, error) {
+	header := make([]byte, len(compressedMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("compressed header: %w", ErrSnapshotCorrupt)
+	}
+	if string(header[:len(compressedMagic)]) != string(compressedMagic) {
+		return nil, fmt.Errorf("compressed header: %w", ErrSnapshotCorrupt)
+	}
+
+	name := make([]byte, header[len(compressedMagic)])
+	if _, err := io.ReadFull(r, name); err != nil {
+		return nil, fmt.Errorf("compressed header: %w", ErrSnapshotCorrupt)
+	}
+
+	codec, err := lookupCodec(string(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return codec.NewReader(r)
+}
+
+// WriteCompressedSnapshot writes the snapshot like WriteSnapshot,
+// compressed with the named codec.
+func WriteCompressedSnapshot(w io.Writer, snapshot Snapshot, codecName string) error {
+	compressed, err := NewCompressedWriter(w, codecName)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteSnapshot(compressed, snapshot); err != nil {
+		return err
+	}
+
+	return compressed.Close()
+}
+
+// ReadCompressedSnapshot reads a snapshot written with
+// WriteCompressedSnapshot.
+func ReadCompressedSnapshot(r io.Reader) (Snapshot, error) {
+	decompressed, err := NewCompressedReader(r)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer decompressed.Close()
+
+	return ReadSnapshot(decompressed)
+}
+
+// stores streams as is, eg: when the network isn't the bottleneck
+type noneCodec struct{}
+
+func (noneCodec) Name() string {
+	return "none"
+}
+
+func (noneCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return nopWriteCloser{w}, nil
+}
+
+func (noneCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string {
+	return "gzip"
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("gzip: %v: %w", err, ErrSnapshotCorrupt)
+	}
+
+	return reader, nil
+}
+
+// raw deflate, which skips gzip's header and trailer
+type flateCodec struct{}
+
+func (flateCodec) Name() string {
+	return "flate"
+}
+
+func (flateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, flate.DefaultCompression)
+}
+
+func (flateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+func init() {
+	RegisterCodec(noneCodec{})
+	RegisterCodec(gzipCodec{})
+	RegisterCodec(flateCodec{})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestCompressedSnapshot(t *testing.T) {
+	// long runs of a few values, as latency distributions tend to be
+	metrics := make([]*BulkMetric, 0, 5000)
+	for i := 0; i < 5000; i++ {
+		metric := NewBulkMetric(i)
+		metric.IncrBy(999)
+		metrics = append(metrics, metric)
+	}
+	snapshot := Snapshot{FrozenDatabase: newFrozenDatabase(metrics, nil), Sequence: 7}
+
+	plain := new(bytes.Buffer)
+	WriteSnapshot(plain, snapshot)
+
+	for _, codec := range []string{"none", "gzip", "flate"} {
+		buf := new(bytes.Buffer)
+		if err := WriteCompressedSnapshot(buf, snapshot, codec); err != nil {
+			t.Fatalf("%s: unexpected error: %v", codec, err)
+		}
+		if codec != "none" && buf.Len() >= plain.Len()/2 {
+			t.Fatalf("%s: expected better than 2x compression, got %d bytes from %d", codec, buf.Len(), plain.Len())
+		}
+
+		read, err := ReadCompressedSnapshot(buf)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", codec, err)
+		}
+		if read.Count() != snapshot.Count() || read.Sequence != 7 || read.GetMedian() != snapshot.GetMedian() {
+			t.Fatalf("%s: snapshot didn't round trip", codec)
+		}
+	}
+
+	if err := WriteCompressedSnapshot(new(bytes.Buffer), snapshot, "zstd"); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("expected ErrUnknownCodec, got %v", err)
+	}
+	if _, err := ReadCompressedSnapshot(plain); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected an uncompressed snapshot to be rejected, got %v", err)
+	}
+}
+
+func TestCompressedReplicationStream(t *testing.T) {
+	stream := new(bytes.Buffer)
+	writer, _ := NewCompressedWriter(stream, "gzip")
+
+	// each frame is flushed, so it can be read before the stream ends
+	WriteFrame(writer, Frame{Sequence: 1, Metrics: buildBulkMetrics(0, 10)})
+	writer.(interface{ Flush() error }).Flush()
+
+	reader, err := NewCompressedReader(bytes.NewReader(stream.Bytes()))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame, err := ReadFrame(reader); err != nil || frame.Sequence != 1 || len(frame.Metrics) != 10 {
+		t.Fatalf("unexpected frame %+v (%v)", frame, err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+)
+
+// a ServerConfig describes everything the serve command runs, read from a
+// JSON file with ParseServerConfig:
+//
+//	{
+//	  "listen": ":8080",
+//	  "series": [
+//	    {"name": "api.latency", "backend": "windowed", "config": {"retention": "24h"}, "metadata": {"unit": "ms"}}
+//	  ],
+//	  "remote_write": {
+//	    "backend": "median",
+//	    "max_series": 1000,
+//	    "rules": [{"match": "http_request_duration_seconds", "scale": 1000}]
+//	  }
+//	}
+type ServerConfig struct {
+	// the address the registry handler is served on, see
+	// NewRegistryHandler
+	Listen string         `json:"listen"`
+	Series []SeriesConfig `json:"series"`
+
+	// accepts Prometheus remote write requests if set
+	RemoteWrite *RemoteWriteConfig `json:"remote_write,omitempty"`
+}
+
+// a SeriesConfig is a database registered under its name, created with
+// NewBackend
+type SeriesConfig struct {
+	Name     string         `json:"name"`
+	Backend  string         `json:"backend"`
+	Config   BackendConfig  `json:"config,omitempty"`
+	Metadata SeriesMetadata `json:"metadata,omitempty"`
+}
+
+// a RemoteWriteConfig serves NewRemoteWriteHandler, writing into a series
+// database whose series are created with the backend, unless an override
+// says otherwise
+type RemoteWriteConfig struct {
+	// /api/v1/write by default
+	Path      string            `json:"path,omitempty"`
+	Backend   string            `json:"backend"`
+	Config    BackendConfig     `json:"config,omitempty"`
+	MaxSeries int               `json:"max_series,omitempty"`
+	Overrides []SeriesOverride  `json:"overrides,omitempty"`
+	Rules     []RemoteWriteRule `json:"rules"`
+}
+
+// ParseServerConfig reads a config, failing on malformed JSON or any
+// field it doesn't know, so a misspelt setting isn't silently ignored.
+// The config still needs validating, see ValidateConfig.
+func ParseServerConfig(r io.Reader) (ServerConfig, error) {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+
+	config := ServerConfig{}
+	if err := decoder.Decode(&config); err != nil {
+		return ServerConfig{}, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return config, nil
+}
+
+// a server is everything built from a ServerConfig, with nothing opened
+// or listening yet
+type server struct {
+	registry  *Registry
+	databases map[string]Database
+	handler   http.Handler
+}
+
+// ValidateConfig builds everything the config describes, every backend,
+// window, rule and override, without opening any database or listening,
+// and returns every problem with it at once, joined, rather than only the
+// first. A config which validates can only fail to serve at runtime, eg:
+// if its address is already in use.
+func ValidateConfig(config ServerConfig) error {
+	_, err := config.build()
+	return err
+}
+
+func (c ServerConfig) build() (*server, error) {
+	errs := make([]error, 0)
+
+	if _, err := net.ResolveTCPAddr("tcp", c.Listen); err != nil || c.Listen == "" {
+		errs = append(errs, fmt.Errorf("listen %q: must be an address such as :8080", c.Listen))
+	}
+
+	s := &server{
+		registry:  NewRegistry(),
+		databases: make(map[string]Database),
+	}
+	named := make(map[string]bool)
+	for i, series := range c.Series {
+		if series.Name == "" {
+			errs = append(errs, fmt.Errorf("series %d: must be named", i))
+			continue
+		}
+		if named[series.Name] {
+			errs = append(errs, fmt.Errorf("series %s: configured twice", series.Name))
+			continue
+		}
+		named[series.Name] = true
+
+		database, err := NewBackend(series.Backend, series.Config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("series %s: %w", series.Name, err))
+			continue
+		}
+		if err := s.registry.Register(series.Name, database); err != nil {
+			errs = append(errs, fmt.Errorf("series %s: %w", series.Name, err))
+			continue
+		}
+		s.registry.SetMetadata(series.Name, series.Metadata)
+		s.databases[series.Name] = database
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/", NewRegistryHandler(s.registry))
+	if c.RemoteWrite != nil {
+		handler, path, err := c.RemoteWrite.build()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			mux.Handle(path, handler)
+		}
+	}
+	s.handler = mux
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (r RemoteWriteConfig) build() (http.Handler, string, error) {
+	errs := make([]error, 0)
+
+	path := r.Path
+	if path == "" {
+		path = "/api/v1/write"
+	} else if path[0] != '/' {
+		errs = append(errs, fmt.Errorf("remote write path %q: must start with /", path))
+	}
+
+	if _, err := NewBackend(r.Backend, r.Config); err != nil {
+		errs = append(errs, fmt.Errorf("remote write: %w", err))
+	}
+	if r.MaxSeries < 0 {
+		errs = append(errs, fmt.Errorf("remote write max_series: must not be negative"))
+	}
+	for _, override := range r.Overrides {
+		if err := override.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("remote write: %w", err))
+		}
+	}
+
+	if len(r.Rules) == 0 {
+		errs = append(errs, fmt.Errorf("remote write: needs at least one rule"))
+	}
+	rules := append([]RemoteWriteRule{}, r.Rules...)
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			errs = append(errs, fmt.Errorf("remote write rule %d: %w", i, err))
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, "", err
+	}
+
+	// validated above, so the backend can't fail
+	series := NewSeriesDatabase(r.MaxSeries, func() Database {
+		database, _ := NewBackend(r.Backend, r.Config)
+		return database
+	}, WithSeriesOverrides(r.Overrides...))
+
+	return NewRemoteWriteHandler(series, rules...), path, nil
+}
+
+func init() {
+	commands["serve"] = command{
+		usage: "serve the series described by a config file",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+			path := flags.String("config", "config.json", "the config file, see ServerConfig")
+			validate := flags.Bool("validate-config", false, "only check the config, reporting every problem with it, eg: in CI")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+
+			file, err := os.Open(*path)
+			if err != nil {
+				return err
+			}
+			config, err := ParseServerConfig(file)
+			file.Close()
+			if err != nil {
+				return err
+			}
+
+			s, err := config.build()
+			if err != nil {
+				return fmt.Errorf("%s:\n%w", *path, err)
+			}
+			if *validate {
+				fmt.Fprintf(os.Stderr, "%s: ok, %d series\n", *path, len(s.databases))
+				return nil
+			}
+
+			for _, database := range s.databases {
+				database.Open()
+				defer database.Close()
+			}
+
+			listener, err := net.Listen("tcp", config.Listen)
+			if err != nil {
+				return err
+			}
+
+			// tell a service manager such as systemd that the series
+			// are open and requests are being accepted, and keep its
+			// watchdog fed if it has one
+			if err := notifyServiceManager("READY=1"); err != nil {
+				fmt.Fprintf(os.Stderr, "%v\n", err)
+			}
+			if interval := watchdogInterval(); interval > 0 {
+				stop := make(chan struct{})
+				defer close(stop)
+				go runWatchdog(interval, stop)
+			}
+
+			fmt.Fprintf(os.Stderr, "serving %d series on %s\n", len(s.databases), config.Listen)
+			return http.Serve(listener, s.handler)
+		},
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	config, err := ParseServerConfig(strings.NewReader(`{
+		"listen": ":8080",
+		"series": [
+			{"name": "api.latency", "backend": "windowed", "config": {"retention": "24h"}, "metadata": {"unit": "ms"}},
+			{"name": "jobs", "backend": "histogram", "config": {"resolutions": "10,100"}}
+		],
+		"remote_write": {"backend": "median", "max_series": 100, "rules": [{"match": "http_request_duration_seconds", "scale": 1000}]}
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := ValidateConfig(config); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	s, _ := config.build()
+	if s.registry.Metadata("api.latency").Unit != "ms" || len(s.registry.Names()) != 2 {
+		t.Fatalf("expected both series to be registered, got %v", s.registry.Names())
+	}
+
+	// nothing is listening, but the handlers are all in place
+	recorder := httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/api/v1/write", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected the remote write handler to be served, got %d", recorder.Code)
+	}
+	recorder = httptest.NewRecorder()
+	s.handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/series", nil))
+	if recorder.Code != http.StatusOK || !strings.Contains(recorder.Body.String(), "api.latency") {
+		t.Fatalf("expected the registry to be served, got %d: %s", recorder.Code, recorder.Body)
+	}
+}
+
+func TestValidateConfigErrors(t *testing.T) {
+	if _, err := ParseServerConfig(strings.NewReader(`{"listen": ":8080", "seires": []}`)); err == nil {
+		t.Fatalf("expected a misspelt field to be rejected")
+	}
+
+	config, err := ParseServerConfig(strings.NewReader(`{
+		"listen": "nowhere",
+		"series": [
+			{"name": "api", "backend": "windowed", "config": {"resolution": "1h", "retention": "1m"}},
+			{"name": "api", "backend": "median"},
+			{"name": "db", "backend": "btree"},
+			{"backend": "median"},
+			{"name": "ok", "backend": "median"}
+		],
+		"remote_write": {"path": "write", "backend": "rolling", "overrides": [{"pattern": "[", "backend": "median"}], "rules": [{"match": "api{"}]}
+	}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = ValidateConfig(config)
+	if !errors.Is(err, ErrUnknownBackend) {
+		t.Fatalf("expected the unknown backend to be reported, got %v", err)
+	}
+
+	// every problem is reported, not only the first
+	for _, expected := range []string{
+		`listen "nowhere"`,
+		"series api: backend config retention",
+		"series api: configured twice",
+		"series db: backend \"btree\"",
+		"series 3: must be named",
+		`remote write path "write"`,
+		"remote write: backend config capacity",
+		`override "["`,
+		"remote write rule 0",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("expected %q to be reported, got:\n%v", expected, err)
+		}
+	}
+	if strings.Contains(err.Error(), "series ok") {
+		t.Fatalf("expected only the invalid series to be reported, got:\n%v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// the most distinct correlation IDs a batch carries, beyond which the
+// rest of the batch's IDs are dropped
+const maxBatchCorrelations = 32
+
+type correlationKey struct{}
+
+// WithCorrelationID returns a context carrying the ID, eg: of the request
+// producing a metric, along with any IDs ctx already carries. Metrics
+// written with BufferedWorker.WriteContext carry the IDs through their
+// batch into the database and its replication sink, and into the errors
+// of the batch, so a lost or corrupt batch can be traced back to the
+// requests which produced it.
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	ids := CorrelationIDs(ctx)
+	return context.WithValue(ctx, correlationKey{}, append(ids[:len(ids):len(ids)], id))
+}
+
+// CorrelationIDs returns the IDs carried by the context, oldest first.
+func CorrelationIDs(ctx context.Context) []string {
+	ids, _ := ctx.Value(correlationKey{}).([]string)
+	return ids
+}
+
+// TraceparentCorrelation extracts the trace ID from a W3C traceparent
+// header, eg: 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01, for
+// correlating batches with traces. It returns nothing for malformed
+// headers.
+func TraceparentCorrelation(traceparent string) string {
+	fields := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(fields) < 4 || len(fields[0]) != 2 || len(fields[1]) != 32 || strings.Trim(fields[1], "0") == "" {
+		return ""
+	}
+	for _, r := range fields[1] {
+		if !strings.ContainsRune("0123456789abcdef", r) {
+			return ""
+		}
+	}
+
+	return fields[1]
+}
+
+// WithCorrelation replaces how the worker finds the correlation IDs of a
+// write from its context, eg: to use the trace ID of whichever tracing
+// library the caller uses. By default it uses CorrelationIDs.
+func WithCorrelation(extract func(context.Context) []string) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.correlate = extract
+	}
+}
+
+// WriteContext writes the metric like Write, carrying the correlation IDs
+// of ctx with the batch the metric is flushed in.
+func (b *BufferedWorker) WriteContext(ctx context.Context, metric Metric) error {
+	return b.named(b.enqueueRequest(metricRequest{metric: metric, correlations: b.correlate(ctx)}))
+}
+
+// a CorrelatedDatabase is told the correlation IDs of each batch, and
+// acknowledges them like an AckedDatabase
+type CorrelatedDatabase interface {
+	BulkWriteCorrelated(bulkMetrics []*BulkMetric, correlationIDs []string) <-chan error
+}
+
+// BulkWriteCorrelated is BulkWriteAcked for a batch carrying correlation
+// IDs, which are passed to the replication sink with the batch's frame
+// and added to any error applying it.
+func (m *MedianDatabase) BulkWriteCorrelated(bulkMetrics []*BulkMetric, correlationIDs []string) <-chan error {
+	// batches from a worker are already sorted with unique values
+	sorted := true
+	for i := 1; i < len(bulkMetrics) && sorted; i++ {
+		sorted = bulkMetrics[i-1] != nil && bulkMetrics[i] != nil && bulkMetrics[i-1].Value() < bulkMetrics[i].Value()
+	}
+
+	ack := make(chan error, 1)
+	if err := m.submit(writeRequest{metrics: bulkMetrics, ack: ack, sorted: sorted, correlations: correlationIDs}); err != nil {
+		ack <- correlated(err, correlationIDs)
+	}
+
+	return ack
+}
+
+// adds any distinct IDs to the batch's, up to maxBatchCorrelations
+func addCorrelations(batch []string, ids []string) []string {
+	for _, id := range ids {
+		if len(batch) >= maxBatchCorrelations {
+			break
+		}
+
+		seen := false
+		for _, existing := range batch {
+			if seen = existing == id; seen {
+				break
+			}
+		}
+		if !seen && id != "" {
+			batch = append(batch, id)
+		}
+	}
+
+	return batch
+}
+
+// adds the correlation IDs of a batch to an error applying it
+func correlated(err error, ids []string) error {
+	if err == nil || len(ids) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("%w (correlation ids: %s)", err, strings.Join(ids, ", "))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCorrelationIDs(t *testing.T) {
+	frames := make(chan Frame, 10)
+	database := NewMedianDatabase(WithReplicationSink(func(frame Frame) { frames <- frame }))
+	database.Open()
+	defer database.Close()
+
+	flushes := make(chan FlushInfo, 10)
+	worker := NewBufferedWorker(100, time.Hour, database, WithAfterFlush(func(info FlushInfo) { flushes <- info }))
+	worker.Start()
+
+	ctx := WithCorrelationID(context.Background(), "req-1")
+	worker.WriteContext(ctx, NewBulkMetric(1))
+	worker.WriteContext(WithCorrelationID(ctx, "req-2"), NewBulkMetric(2))
+	worker.WriteContext(ctx, NewBulkMetric(3))
+	worker.Write(NewBulkMetric(4))
+	worker.Stop()
+
+	expected := []string{"req-1", "req-2"}
+	if frame := <-frames; !reflect.DeepEqual(frame.CorrelationIDs, expected) {
+		t.Fatalf("expected the replicated frame to carry %v, got %v", expected, frame.CorrelationIDs)
+	}
+	if info := <-flushes; !reflect.DeepEqual(info.CorrelationIDs, expected) || info.Err != nil {
+		t.Fatalf("unexpected flush %+v", info)
+	}
+
+	// a batch which fails is reported with the IDs which produced it
+	database.Freeze()
+	worker = NewBufferedWorker(100, time.Hour, database, WithAfterFlush(func(info FlushInfo) { flushes <- info }))
+	worker.Start()
+	worker.WriteContext(WithCorrelationID(context.Background(), "req-3"), NewBulkMetric(5))
+	worker.Stop()
+	if info := <-flushes; !errors.Is(info.Err, ErrClosed) || !strings.Contains(info.Err.Error(), "correlation ids: req-3") {
+		t.Fatalf("expected the error to carry req-3, got %v", info.Err)
+	}
+}
+
+func TestTraceparentCorrelation(t *testing.T) {
+	if id := TraceparentCorrelation("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"); id != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("unexpected trace id %q", id)
+	}
+
+	for _, header := range []string{"", "00-4bf92f35-00f067aa0ba902b7-01", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"} {
+		if id := TraceparentCorrelation(header); id != "" {
+			t.Fatalf("expected %q to be rejected, got %q", header, id)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// a countMinSketch estimates how often each value was seen in a fixed
+// amount of memory. Estimates never undercount, and overcount by at most
+// e/width of the total count with a probability of 1 - e^-depth.
+type countMinSketch struct {
+	width  int
+	counts [][]uint64
+}
+
+func newCountMinSketch(width, depth int) *countMinSketch {
+	counts := make([][]uint64, depth)
+	for i := range counts {
+		counts[i] = make([]uint64, width)
+	}
+
+	return &countMinSketch{
+		width:  width,
+		counts: counts,
+	}
+}
+
+// splitmix64, seeded differently for each row of the sketch
+func (c *countMinSketch) index(row, value int) int {
+	hash := uint64(value) + uint64(row+1)*0x9e3779b97f4a7c15
+	hash = (hash ^ (hash >> 30)) * 0xbf58476d1ce4e5b9
+	hash = (hash ^ (hash >> 27)) * 0x94d049bb133111eb
+	hash = hash ^ (hash >> 31)
+
+	return int(hash % uint64(c.width))
+}
+
+// adds count occurrences of the value, returning its new estimate
+func (c *countMinSketch) add(value int, count uint64) uint64 {
+	estimate := ^uint64(0)
+	for row := range c.counts {
+		index := c.index(row, value)
+		c.counts[row][index] += count
+		if c.counts[row][index] < estimate {
+			estimate = c.counts[row][index]
+		}
+	}
+
+	return estimate
+}
+
+func (c *countMinSketch) estimate(value int) uint64 {
+	estimate := ^uint64(0)
+	for row := range c.counts {
+		if count := c.counts[row][c.index(row, value)]; count < estimate {
+			estimate = count
+		}
+	}
+
+	return estimate
+}
+
+type ValueCount struct {
+	Value int    `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// a HeavyHitterDatabase pairs any database with a count-min sketch, so the
+// approximate frequency of any value and the most frequent values are
+// known even when the database doesn't keep exact runs, eg: a histogram.
+type HeavyHitterDatabase struct {
+	Database
+
+	sync.Mutex
+	sketch *countMinSketch
+
+	// the values with the highest estimates seen so far, which are the
+	// candidates for GetTopK
+	candidates    map[int]uint64
+	maxCandidates int
+}
+
+// NewHeavyHitterDatabase wraps the database with a sketch of width by
+// depth counters, tracking up to maxCandidates heavy hitters.
+func NewHeavyHitterDatabase(database Database, width, depth, maxCandidates int) *HeavyHitterDatabase {
+	return &HeavyHitterDatabase{
+		Database:      database,
+		sketch:        newCountMinSketch(width, depth),
+		candidates:    make(map[int]uint64, maxCandidates),
+		maxCandidates: maxCandidates,
+	}
+}
+
+func (h *HeavyHitterDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	if err := h.Database.BulkWrite(bulkMetrics); err != nil {
+		return err
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	for _, metric := range bulkMetrics {
+		estimate := h.sketch.add(metric.Value(), uint64(metric.Count()))
+		h.track(metric.Value(), estimate)
+	}
+
+	return nil
+}
+
+// keeps the value as a candidate if it is one of the heaviest seen
+func (h *HeavyHitterDatabase) track(value int, estimate uint64) {
+	if _, ok := h.candidates[value]; ok || len(h.candidates) < h.maxCandidates {
+		h.candidates[value] = estimate
+		return
+	}
+
+	lightest, lightestEstimate := 0, ^uint64(0)
+	for candidate, count := range h.candidates {
+		// of equally light candidates the largest value is evicted, so
+		// the candidates don't depend on the map's iteration order
+		if count < lightestEstimate || (count == lightestEstimate && candidate > lightest) {
+			lightest, lightestEstimate = candidate, count
+		}
+	}
+	if estimate > lightestEstimate {
+		delete(h.candidates, lightest)
+		h.candidates[value] = estimate
+	}
+}
+
+// GetCountOf returns the approximate number of times the value was
+// written, which is never less than the true count.
+func (h *HeavyHitterDatabase) GetCountOf(value int) uint64 {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.sketch.estimate(value)
+}
+
+// GetTopK returns up to k of the most frequently written values, most
+// frequent first, with their approximate counts. k is limited to the
+// number of candidates the database tracks.
+func (h *HeavyHitterDatabase) GetTopK(k int) []ValueCount {
+	h.Lock()
+	defer h.Unlock()
+
+	top := make([]ValueCount, 0, len(h.candidates))
+	for value, count := range h.candidates {
+		top = append(top, ValueCount{Value: value, Count: count})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Value < top[j].Value
+	})
+
+	if k < len(top) {
+		top = top[:k]
+	}
+
+	return top
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHeavyHitterDatabase(t *testing.T) {
+	database := NewHeavyHitterDatabase(newTestHistogramDatabase(100), 1024, 4, 10)
+	database.Open()
+	defer database.Close()
+
+	// a long tail of values seen once, and three heavy hitters
+	database.BulkWrite(buildBulkMetrics(0, 5000))
+	for value, count := range map[int]int{42: 500, 7: 300, 1234: 200} {
+		metric := NewBulkMetric(value)
+		metric.IncrBy(count - 1)
+		database.BulkWrite([]*BulkMetric{metric})
+	}
+
+	// estimates never undercount
+	if count := database.GetCountOf(42); count < 501 || count > 520 {
+		t.Fatalf("expected roughly 501 42s, got %d", count)
+	}
+
+	top := database.GetTopK(3)
+	values := []int{top[0].Value, top[1].Value, top[2].Value}
+	if !reflect.DeepEqual(values, []int{42, 7, 1234}) {
+		t.Fatalf("unexpected heavy hitters %+v", top)
+	}
+
+	// the wrapped database still answers, from its 100 wide buckets
+	if median := database.GetMedian(); median != 1950 {
+		t.Fatalf("expected a median of 1950, got %d", median)
+	}
+}
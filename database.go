@@ -1,85 +1,579 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"runtime/pprof"
 	"sort"
 	"sync/atomic"
+	"time"
 )
 
 type Database interface {
-	BulkWrite([]*BulkMetric)
+	BulkWrite([]*BulkMetric) error
 	Open()
 	Close()
 	GetMedian() int
 }
 
 type MedianDatabase struct {
-	writeCh chan []*BulkMetric
+	writeCh chan writeRequest
 	quitCh  chan bool
+	queryCh chan func(left, right []*BulkMetric)
+	doneCh  chan struct{}
+	errCh   chan error
+	frozen  int32
+	failed  int32
+	closed  int32
 
-	// used to keep the left and right in sync!
-	left   []BulkMetric
-	right  []BulkMetric
-	size   int
-	median int32
+	// the number of writes and queries waiting to be handed to the worker
+	queued int64
+
+	// the sequence number of the last applied batch, only ever written
+	// by the worker
+	sequence uint64
+
+	// the number of batches applied, which unlike the sequence never
+	// moves backwards or skips, eg: when seeded from a snapshot
+	generation uint64
+
+	name          string
+	metadata      SeriesMetadata
+	registry      *Registry
+	scale         Scale
+	restartPolicy RestartPolicy
+	replicate     func(Frame)
+
+	// every query of the latest write is answered from a single stats
+	// block, published atomically by the worker, so readers never contend
+	// with each other or the worker and can never pair a median with the
+	// count of a different write
+	stats atomic.Value
+
+	history       *medianHistory
+	trendLookback time.Duration
+
+	// sorted, see WithThresholds
+	thresholds []int
+
+	observers    []observer
+	observerPool *observerPool
+
+	staleAfter  time.Duration
+	stalePolicy StalePolicy
+
+	snapshotInterval time.Duration
+	onSnapshot       func(Snapshot)
+
+	// caches expensive queries, if enabled
+	cache *queryCache
+
+	// the stats are published to shared memory at sharedPath, if set
+	sharedPath string
+	shared     *sharedStatsSegment
+
+	// every applied batch is recorded, if set
+	recorder *Recorder
+
+	// the report of the last Restore, if any
+	recovery atomic.Value
+
+	// applied when the database is opened, see WithSeed
+	coldStart *Snapshot
+}
+
+// a batch queued for the worker, along with an optional channel which is
+// sent the result once the batch has been applied
+type writeRequest struct {
+	metrics []*BulkMetric
+	ack     chan error
+
+	// batches without a sequence are assigned the next one. Sequenced
+	// batches are applied exactly once, in order, unless they seed the
+	// database in which case the sequence is taken as is
+	sequence uint64
+	seed     bool
+
+	// the caller guarantees the metrics are sorted with unique values
+	sorted bool
+
+	// passed to the replication sink, and added to any error
+	correlations []string
+}
+
+func (w writeRequest) acknowledge(err error) {
+	if w.ack != nil {
+		w.ack <- err
+	}
+}
+
+type medianStats struct {
+	median int64
+	count  int64
+
+	// the generation the stats were calculated at
+	generation uint64
+
+	// the median without truncating the average of the two middle values
+	medianFloat float64
+
+	// the number of runs stored across the left and right side
+	runs int
+
+	// the raw observations behind every metric written so far
+	aggregate Aggregate
+
+	// the number of metrics at or below each threshold
+	thresholdCounts []int64
+
+	// when the median was last recalculated
+	updated time.Time
+}
+
+type DatabaseOption func(*MedianDatabase)
+
+// WithName names the database, eg: after the series it holds. The name
+// prefixes every error the database returns or reports, and labels its
+// worker goroutine in pprof profiles, so that one of the many databases
+// in a process can be told apart from the rest.
+func WithName(name string) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.name = name
+	}
 }
 
-func NewMedianDatabase() *MedianDatabase {
-	return &MedianDatabase{
-		writeCh: make(chan []*BulkMetric),
+// WithRegistry registers the database with the registry, under its name,
+// while it is open. Registration errors, eg: a database without a name or
+// with the same name as another, are reported on Errors.
+func WithRegistry(registry *Registry) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.registry = registry
+	}
+}
+
+// WithMetadata describes the database, eg: the unit of its metrics, for
+// the registry and anything else which lists it.
+func WithMetadata(metadata SeriesMetadata) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.metadata = metadata
+	}
+}
+
+// WithHistorySize sets how many recalculated medians are retained for
+// History; a size of zero disables the history entirely.
+func WithHistorySize(size int) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.history = newMedianHistory(size)
+	}
+}
+
+// WithTrendLookback sets how far back GetMedianTrend looks, one minute by
+// default.
+func WithTrendLookback(lookback time.Duration) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.trendLookback = lookback
+	}
+}
+
+// WithRestartPolicy configures whether the database worker is restarted
+// after a panic. By default it is never restarted, and the database rejects
+// all writes and queries with ErrClosed once it has panicked.
+func WithRestartPolicy(policy RestartPolicy) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.restartPolicy = policy
+	}
+}
+
+// WithReplicationSink registers a function which is called from the worker
+// with every batch once it has been applied, so that it can be shipped to
+// replicas. The sink must not block, as it holds up all other writes.
+func WithReplicationSink(sink func(Frame)) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.replicate = sink
+	}
+}
+
+func NewMedianDatabase(options ...DatabaseOption) *MedianDatabase {
+	m := &MedianDatabase{
+		writeCh: make(chan writeRequest),
 		quitCh:  make(chan bool),
-		median:  0,
+		queryCh: make(chan func(left, right []*BulkMetric)),
+		doneCh:  make(chan struct{}),
+		errCh:   make(chan error, errorChannelSize),
+		history: newMedianHistory(defaultHistorySize),
+
+		trendLookback: defaultTrendLookback,
+	}
+
+	for _, option := range options {
+		option(m)
 	}
+
+	m.stats.Store(&medianStats{updated: time.Now()})
+	return m
 }
 
 func (m *MedianDatabase) Open() {
+	if m.registry != nil {
+		if err := m.registry.Register(m.name, m); err != nil {
+			reportError(m.errCh, err)
+		}
+	}
+
+	if m.sharedPath != "" {
+		shared, err := createSharedStats(m.sharedPath)
+		if err != nil {
+			reportError(m.errCh, m.named(err))
+		} else {
+			m.shared = shared
+			m.shared.publish(m.stats.Load().(*medianStats))
+		}
+	}
+
+	m.startObservers()
+	if m.onSnapshot != nil && m.snapshotInterval > 0 {
+		go m.snapshotEvery(m.snapshotInterval, m.onSnapshot)
+	}
 	go func() {
-		m.worker()
+		if m.name == "" {
+			m.worker()
+			return
+		}
+
+		pprof.Do(context.Background(), pprof.Labels("database", m.name), func(context.Context) {
+			m.worker()
+		})
 	}()
+	m.seedColdStart()
+}
+
+// Name returns the name the database was created with, if any.
+func (m *MedianDatabase) Name() string {
+	return m.name
+}
+
+// Metadata returns the metadata the database was created with, if any.
+func (m *MedianDatabase) Metadata() SeriesMetadata {
+	return m.metadata
+}
+
+// prefixes the error with the database's name
+func (m *MedianDatabase) named(err error) error {
+	if err == nil || m.name == "" {
+		return err
+	}
+
+	return fmt.Errorf("database %s: %w", m.name, err)
 }
 
 func (m *MedianDatabase) Close() {
+	m.CloseContext(context.Background())
+}
+
+// CloseWithTimeout closes the database like CloseContext, giving up once
+// the timeout has passed.
+func (m *MedianDatabase) CloseWithTimeout(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return m.CloseContext(ctx)
+}
+
+// CloseContext closes the database, waiting for the worker to finish what
+// it is doing. If the context is done first, eg: because the worker is
+// wedged in a query or replication sink, the database is abandoned instead:
+// every queued and future write or query fails with ErrClosed, and the
+// worker exits as soon as it is unblocked. The returned error wraps
+// ErrTimeout and reports how many writes and queries were still queued.
+func (m *MedianDatabase) CloseContext(ctx context.Context) error {
 	// signal the database to close itself
-	m.quitCh <- true
+	select {
+	case m.quitCh <- true:
+	case <-m.doneCh:
+		return nil
+	case <-ctx.Done():
+		return m.abandon(ctx.Err())
+	}
 
 	// wait for the database to finish processing
-	<-m.quitCh
-	close(m.quitCh)
-	close(m.writeCh)
+	select {
+	case <-m.quitCh:
+	case <-ctx.Done():
+		return m.abandon(ctx.Err())
+	}
+
+	m.release()
+	return nil
+}
+
+// gives up on the worker after a close timed out
+func (m *MedianDatabase) abandon(cause error) error {
+	queued := atomic.LoadInt64(&m.queued)
+	atomic.StoreInt32(&m.failed, 1)
+	m.release()
+
+	return m.named(fmt.Errorf("closing database with %d writes and queries still queued (%v): %w", queued, cause, ErrTimeout))
+}
+
+// any writes or queries still waiting on the worker are released with
+// ErrClosed, as is the worker itself if it was abandoned
+func (m *MedianDatabase) release() {
+	if atomic.CompareAndSwapInt32(&m.closed, 0, 1) {
+		close(m.doneCh)
+		if m.registry != nil {
+			m.registry.unregister(m.name, m)
+		}
+		if m.shared != nil {
+			m.shared.close()
+		}
+	}
+}
+
+// Errors returns a channel of errors which happen in the background, such
+// as a recovered panic. Errors are dropped if the channel isn't drained.
+func (m *MedianDatabase) Errors() <-chan error {
+	return m.errCh
+}
+
+// runs the query inside of the worker goroutine, where it has exclusive
+// access to the left and right side
+func (m *MedianDatabase) query(query func(left, right []*BulkMetric)) error {
+	if atomic.LoadInt32(&m.failed) == 1 {
+		return m.named(fmt.Errorf("database worker failed: %w", ErrClosed))
+	}
+
+	atomic.AddInt64(&m.queued, 1)
+	defer atomic.AddInt64(&m.queued, -1)
+
+	select {
+	case m.queryCh <- query:
+		return nil
+	case <-m.doneCh:
+		return m.named(ErrClosed)
+	}
+}
+
+// Freeze stops the database from accepting any further writes and returns
+// an immutable, query-optimized copy of its contents. Any BulkWrite calls
+// made after Freeze returns fail with ErrClosed.
+func (m *MedianDatabase) Freeze() (*FrozenDatabase, error) {
+	frozenCh := make(chan *FrozenDatabase, 1)
+
+	err := m.query(func(left, right []*BulkMetric) {
+		// mark the database as frozen from within the worker so that
+		// no write can land between the copy and the flag being set
+		atomic.StoreInt32(&m.frozen, 1)
+		frozenCh <- newFrozenDatabase(left, right)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return <-frozenCh, nil
+}
+
+// History returns up to the last n recalculated medians, oldest first.
+func (m *MedianDatabase) History(n int) []TimedMedian {
+	return m.history.last(n)
+}
+
+// GetMedianTrend returns how fast the median is changing, in change per
+// minute over the trend lookback, so alerts can fire on a median which is
+// rising fast rather than only on absolute thresholds. The trend is taken
+// from the history, so a lookback spanning more writes than the history
+// holds only covers the writes which are still in it.
+func (m *MedianDatabase) GetMedianTrend() float64 {
+	return medianTrend(m.history.last(len(m.history.entries)), m.trendLookback)
+}
+
+// Snapshot returns a consistent, point in time copy of the database which
+// can be queried while the database continues to accept writes. With
+// WithQueryCache, the same snapshot is returned until the next write.
+func (m *MedianDatabase) Snapshot() (Snapshot, error) {
+	// a closed database mustn't keep answering from the cache
+	if atomic.LoadInt32(&m.closed) == 1 {
+		return m.snapshot()
+	}
+
+	result, err := m.cache.get(m.Generation(), "snapshot", func() (interface{}, error) {
+		return m.snapshot()
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return result.(Snapshot), nil
+}
+
+func (m *MedianDatabase) snapshot() (Snapshot, error) {
+	snapshotCh := make(chan Snapshot, 1)
+
+	err := m.query(func(left, right []*BulkMetric) {
+		snapshotCh <- Snapshot{
+			FrozenDatabase: newFrozenDatabase(left, right),
+			Time:           time.Now(),
+			Sequence:       atomic.LoadUint64(&m.sequence),
+		}
+	})
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return <-snapshotCh, nil
+}
+
+// GetMedian returns the current median, which is zero once the database
+// is stale if it was created WithStaleAfter and ZeroStale.
+func (m *MedianDatabase) GetMedian() int {
+	// the median is calculated from ints, so it always fits back into one
+	return int(m.currentStats().median)
+}
+
+// GetMedianAndCount returns the current median along with the number of
+// metrics it was calculated from, both from the same write.
+func (m *MedianDatabase) GetMedianAndCount() (int64, int64) {
+	stats := m.currentStats()
+	return stats.median, stats.count
+}
+
+// GetMedianFloat returns the median without truncating the average of the
+// two middle values when there is an even number of metrics.
+func (m *MedianDatabase) GetMedianFloat() float64 {
+	return m.currentStats().medianFloat
+}
+
+// GetAggregate returns the count, sum, min and max of every raw observation
+// written to the database, so the exact mean and extremes are known even
+// when the values themselves were bucketed, eg: with FloatMetric.
+func (m *MedianDatabase) GetAggregate() Aggregate {
+	return m.stats.Load().(*medianStats).aggregate
+}
+
+// GetMedianStale returns the last published median along with how long ago
+// it was recalculated, so callers can tell a fresh median from one which
+// was calculated before writes stopped arriving, or the worker stalled.
+// Before the first write, the age is the time since the database was
+// created.
+func (m *MedianDatabase) GetMedianStale() (int64, time.Duration) {
+	stats := m.stats.Load().(*medianStats)
+	return stats.median, time.Since(stats.updated)
+}
+
+// BulkWrite queues the metrics to be written by the worker; they are not
+// necessarily applied by the time it returns. Use BulkWriteAcked to wait.
+func (m *MedianDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	return m.submit(writeRequest{metrics: bulkMetrics})
+}
+
+// BulkWriteAcked queues the metrics like BulkWrite, but returns a channel
+// which receives a single result once they have actually been applied, so
+// a caller can read its own writes.
+func (m *MedianDatabase) BulkWriteAcked(bulkMetrics []*BulkMetric) <-chan error {
+	ack := make(chan error, 1)
+	if err := m.submit(writeRequest{metrics: bulkMetrics, ack: ack}); err != nil {
+		ack <- err
+	}
+
+	return ack
+}
+
+// BulkWriteSorted queues the metrics like BulkWrite, but skips sorting and
+// merging them because the caller guarantees they are already sorted by
+// value with no duplicates. A batch which breaks that guarantee is rejected
+// with ErrInvalidMetric rather than corrupting the database.
+func (m *MedianDatabase) BulkWriteSorted(bulkMetrics []*BulkMetric) error {
+	return m.submit(writeRequest{metrics: bulkMetrics, sorted: true})
 }
 
-func (m MedianDatabase) GetMedian() int {
-	// load the median value, ensuring that if this happens at the same
-	// time an update is happening that invalid data isn't accidentally
-	// returned
-	median := atomic.LoadInt32(&(m.median))
+// BulkWriteSortedAcked is BulkWriteSorted, acknowledged like BulkWriteAcked.
+func (m *MedianDatabase) BulkWriteSortedAcked(bulkMetrics []*BulkMetric) <-chan error {
+	ack := make(chan error, 1)
+	if err := m.submit(writeRequest{metrics: bulkMetrics, ack: ack, sorted: true}); err != nil {
+		ack <- err
+	}
 
-	// by default int will correspond to the size of the current OS in go.
-	// Thus, it is safe to assume that this call will operate normally
-	// unless we are on a 16bit system (which is likely to cause much
-	// bigger problems elsewhere)
-	return int(median)
+	return ack
 }
 
-func (m *MedianDatabase) BulkWrite(bulkMetrics []*BulkMetric) {
-	// NOTE this is totally slow an unoptimized in every way possible; this
-	// is the quickest implementation to sort this sort of set and we want
-	// to keep it out of the critical path of `worker`.
-	sortedKeys := make([]int, 0, len(bulkMetrics))
-	keyToMetrics := make(map[int]*BulkMetric)
+// ApplyFrame applies a sequenced batch, eg: one replicated from another
+// database or replayed from a log, and waits for it to be applied. Frames
+// which were already applied are skipped so that replays and retries never
+// double count, and a frame which skips ahead of the next expected sequence
+// is rejected with ErrSequenceGap. Frames without a sequence are always
+// applied.
+func (m *MedianDatabase) ApplyFrame(frame Frame) error {
+	return m.applyAndWait(writeRequest{metrics: frame.Metrics, sequence: frame.Sequence})
+}
 
-	for _, bulkMetric := range bulkMetrics {
-		sortedKeys = append(sortedKeys, bulkMetric.Value())
-		keyToMetrics[bulkMetric.Value()] = bulkMetric
+// seeds the database with a snapshot, taking on its sequence number
+func (m *MedianDatabase) seed(snapshot Snapshot) error {
+	return m.applyAndWait(writeRequest{metrics: snapshot.metrics(), sequence: snapshot.Sequence, seed: true})
+}
+
+func (m *MedianDatabase) applyAndWait(request writeRequest) error {
+	request.ack = make(chan error, 1)
+	if err := m.submit(request); err != nil {
+		return err
 	}
-	sort.Ints(sortedKeys)
 
-	// TODO implement a nicer type around `[]*BulkMetric` which implements
-	// the Sort interface
-	for i, key := range sortedKeys {
-		bulkMetrics[i] = keyToMetrics[key]
+	return <-request.ack
+}
+
+// Generation returns the number of batches applied to the database, so
+// caches and replicas can cheaply tell whether anything has changed since
+// they last read it.
+func (m *MedianDatabase) Generation() uint64 {
+	return atomic.LoadUint64(&m.generation)
+}
+
+// Sequence returns the sequence number of the last applied batch.
+func (m *MedianDatabase) Sequence() uint64 {
+	return atomic.LoadUint64(&m.sequence)
+}
+
+func (m *MedianDatabase) submit(request writeRequest) error {
+	return m.named(m.enqueue(request))
+}
+
+// validates the request and hands it to the worker
+func (m *MedianDatabase) enqueue(request writeRequest) error {
+	bulkMetrics := request.metrics
+
+	if atomic.LoadInt32(&m.frozen) == 1 {
+		return fmt.Errorf("database is frozen: %w", ErrClosed)
+	}
+	if atomic.LoadInt32(&m.failed) == 1 {
+		return fmt.Errorf("database worker failed: %w", ErrClosed)
+	}
+
+	for i, metric := range bulkMetrics {
+		if metric == nil || metric.Count() < 1 {
+			return fmt.Errorf("bulk metric %v: %w", metric, ErrInvalidMetric)
+		}
+		if request.sorted && i > 0 && bulkMetrics[i-1].Value() >= metric.Value() {
+			return fmt.Errorf("bulk metric %v out of order: %w", metric, ErrInvalidMetric)
+		}
+	}
+
+	// sort and merge duplicate values here, to keep it out of the
+	// critical path of `worker` which expects a sorted batch with unique
+	// values. Either way the worker gets its own copy, since it mutates
+	// the metrics it stores.
+	if request.sorted {
+		request.metrics = copyMetrics(bulkMetrics)
+	} else {
+		request.metrics = BulkMetrics(bulkMetrics).Merge()
 	}
 
-	m.writeCh <- bulkMetrics
+	atomic.AddInt64(&m.queued, 1)
+	defer atomic.AddInt64(&m.queued, -1)
+
+	select {
+	case m.writeCh <- request:
+		return nil
+	case <-m.doneCh:
+		return ErrClosed
+	}
 }
 
 func (m *MedianDatabase) worker() {
@@ -91,6 +585,12 @@ func (m *MedianDatabase) worker() {
 	left := make([]*BulkMetric, 0, 1000)
 	right := make([]*BulkMetric, 0, 1000)
 	totalLength := 0
+	leftLength := 0
+	aggregate := Aggregate{}
+
+	// the metrics up to each threshold, and above the last one, which are
+	// summed into cumulative counts when the stats are published
+	thresholdBuckets := make([]int64, len(m.thresholds)+1)
 
 	// accepts a list of BulkMetrics and inserts them into specified array
 	insert := func(metrics []*BulkMetric, output []*BulkMetric) (int, []*BulkMetric, []*BulkMetric) {
@@ -102,12 +602,12 @@ func (m *MedianDatabase) worker() {
 
 		offset := 0
 		index := 0
-		for _, metric := range metrics {
+		for i, metric := range metrics {
 			for {
 				// we've gotten to the end of the output and can't place anymore.
 				// Specifically, we don't append to the end of an array because we'd like to handle that downstream to simplify this part
 				if index >= len(output) {
-					return offset, metrics, output
+					return offset, metrics[i:], output
 				}
 
 				current := output[index]
@@ -129,10 +629,13 @@ func (m *MedianDatabase) worker() {
 						// prepend the item
 						output = append([]*BulkMetric{metric}, output...)
 					} else {
-						// inject the item at this place in the array
-						head := append(output[:index], metric)
-						output = append(head, output[index:]...)
+						// inject the item at this place in the array. NOTE
+						// the tail is copied first, otherwise appending to
+						// output[:index] overwrites output[index] in place
+						tail := append([]*BulkMetric{metric}, output[index:]...)
+						output = append(output[:index], tail...)
 					}
+					index = index + 1
 					break
 				} else {
 					// keep looking, the current metric is greater than the value we're at in the existing array
@@ -153,120 +656,204 @@ func (m *MedianDatabase) worker() {
 		leftTail := left[len(left)-1].Value()
 
 		// if total is odd then we grab the last item from the left array
-		if totalLength%2 == 1 {
-			m.median = int32(leftTail)
-			return
+		median := leftTail
+		medianFloat := float64(leftTail)
+		if totalLength%2 == 0 {
+			rightTail := right[0].Value()
+			median = midpoint(leftTail, rightTail)
+			medianFloat = (float64(rightTail) + float64(leftTail)) / 2
 		}
 
-		rightTail := right[0].Value()
-		median := (rightTail + leftTail) / 2
-		m.median = int32(median)
-	}
-
-	// take items from left and move them right until the two arrays are balanced!
-	rebalanceRight := func(l, r []*BulkMetric, offset int) ([]*BulkMetric, []*BulkMetric) {
-		for {
-			if offset < 1 || len(l) < 1 {
-				break
-			}
-
-			// if the head of right is greater than offset then we
-			// can't pop it completely so we split it between the two lists until they are equal
-			lTail := l[len(l)-1]
-			if lTail.Count() > offset {
-				// remove the offset from the rHead
-				lTail.DecrBy(offset)
-
-				// create a new tail for l
-				rHead := NewBulkMetric(lTail.Value())
-				// bulkMetric defaults to 1 so we need to account for that when setting its value
-				rHead.IncrBy(offset - 1)
-
-				// finally we add this as the new head of the r array
-				r = append([]*BulkMetric{rHead}, r...)
-				break
+		var thresholdCounts []int64
+		if len(m.thresholds) > 0 {
+			thresholdCounts = make([]int64, len(m.thresholds))
+			cumulative := int64(0)
+			for i := range thresholdCounts {
+				cumulative += thresholdBuckets[i]
+				thresholdCounts[i] = cumulative
 			}
-
-			// the head of r is less than the offset, so we can pop the whole node off of r and put it on l
-			offset -= lTail.Count()
-			r = append([]*BulkMetric{lTail}, r...)
-			l = l[:len(l)-1]
 		}
 
-		return l, r
-	}
-
-	// take items from right and move them left until the two arrays are balanced!
-	rebalanceLeft := func(l, r []*BulkMetric, offset int) ([]*BulkMetric, []*BulkMetric) {
-		for {
-			if offset < 1 || len(r) < 1 {
-				break
-			}
-
-			// if the head of right is greater than offset then we
-			// can't pop it completely so we split it between the two lists until they are equal
-			if r[0].Count() > offset {
-				// remove the offset from the rHead
-				r[0].DecrBy(offset)
-
-				// create a new tail for l
-				lTail := NewBulkMetric(r[0].Value())
-				// bulkMetric defaults to 1 so we need to account for that when setting its value
-				lTail.IncrBy(offset - 1)
-
-				// finally we add this new tail to the l array
-				l = append(l, lTail)
-				break
-			}
-
-			// the head of r is less than the offset, so we can pop the whole node off of r and put it on l
-			offset -= r[0].Count()
-			l = append(l, r[0])
-			r = r[1:]
+		stats := &medianStats{
+			generation:      atomic.LoadUint64(&m.generation),
+			median:          int64(median),
+			medianFloat:     medianFloat,
+			count:           int64(totalLength),
+			runs:            len(left) + len(right),
+			aggregate:       aggregate,
+			thresholdCounts: thresholdCounts,
+			updated:         time.Now(),
 		}
-
-		return l, r
+		m.stats.Store(stats)
+		m.history.add(median)
+		if m.shared != nil {
+			m.shared.publish(stats)
+		}
+		m.notify(stats)
 	}
 
-	write := func(bulkMetrics []*BulkMetric) {
-		if len(bulkMetrics) == 0 {
-			return
+	// stores a sorted batch with unique values across the left and right
+	// side, rebalancing them around the median. It only ever moves
+	// metrics, the stats are recalculated by apply once the whole batch
+	// is stored.
+	store := func(bulkMetrics []*BulkMetric) {
+		// the raw observations are only tracked in total, as they can't
+		// be kept accurate once runs are split across the boundary
+		for _, metric := range bulkMetrics {
+			aggregate.merge(metric.Aggregate())
+			metric.aggregate = nil
+		}
+		if len(m.thresholds) > 0 {
+			for _, metric := range bulkMetrics {
+				thresholdBuckets[sort.SearchInts(m.thresholds, metric.Value())] += int64(metric.Count())
+			}
 		}
 
 		// write as many elements as we can into the left side
 		leftOffset, remaining, newLeft := insert(bulkMetrics, left)
 		left = newLeft
 
-		// write as many elements as we can into the right side
-		rightOffset, remaining, newRight := insert(bulkMetrics, right)
+		// write whatever didn't fit on the left side into the right side
+		_, remaining, newRight := insert(remaining, right)
 		right = newRight
 
 		// at this point, only elements that were greater than the
 		// right most value and can be inserted naively to the end of
 		// the right list
 		for _, metric := range remaining {
-			rightOffset = rightOffset + metric.Count()
 			totalLength += metric.Count()
 		}
 		right = append(right, remaining...)
 
-		// now we need to rebalance the arrays to take care of the offset
-		if leftOffset > rightOffset { // we put more elements on the left side, move some right
-			left, right = rebalanceRight(left, right, (leftOffset-rightOffset)/2)
-		} else if leftOffset < rightOffset { // we put more elements on the right side, move some left
-			left, right = rebalanceLeft(left, right, (rightOffset-leftOffset)/2)
+		// now we need to rebalance the arrays so that the left side
+		// holds exactly half of the elements, rounded up, which keeps
+		// the median of an odd total at the tail of the left side
+		leftLength += leftOffset
+		target := (totalLength + 1) / 2
+		if leftLength > target { // we put more elements on the left side, move some right
+			left, right = rebalance(left, right, leftLength-target, towardsRight)
+		} else if leftLength < target { // we put more elements on the right side, move some left
+			left, right = rebalance(left, right, target-leftLength, towardsLeft)
+		}
+		leftLength = target
+	}
+
+	write := func(bulkMetrics []*BulkMetric, sequence uint64, correlations []string) error {
+		// writes which were queued before the database was frozen are
+		// dropped too, otherwise the frozen copy would be out of date
+		if atomic.LoadInt32(&m.frozen) == 1 {
+			return fmt.Errorf("database is frozen: %w", ErrClosed)
+		}
+		if len(bulkMetrics) == 0 {
+			return nil
+		}
+
+		if m.recorder != nil {
+			if err := m.recorder.Record(time.Now(), Frame{Sequence: sequence, Metrics: bulkMetrics}); err != nil {
+				reportError(m.errCh, m.named(err))
+			}
+		}
+
+		// the batch's metrics end up stored in, and mutated by, the
+		// left and right side so replicas get their own copy
+		if m.replicate != nil {
+			defer m.replicate(Frame{Sequence: sequence, Metrics: copyMetrics(bulkMetrics), CorrelationIDs: correlations})
 		}
 
+		// the median is recalculated exactly once per batch, here and
+		// nowhere else, however the batch was stored
+		store(bulkMetrics)
+		atomic.AddUint64(&m.generation, 1)
 		recalculate()
+		return nil
 	}
 
-	for {
-		select {
-		case bulkMetrics := <-m.writeCh:
-			write(bulkMetrics)
-		case <-m.quitCh:
-			m.quitCh <- true
+	// applies a request in sequence order, skipping requests which were
+	// already applied
+	apply := func(request writeRequest) error {
+		current := atomic.LoadUint64(&m.sequence)
+		next := current + 1
+
+		if request.sequence != 0 && !request.seed {
+			if request.sequence <= current {
+				return nil
+			}
+			if request.sequence > next {
+				return fmt.Errorf("expected sequence %d, got %d: %w", next, request.sequence, ErrSequenceGap)
+			}
+		}
+		if request.sequence != 0 {
+			next = request.sequence
+		} else if len(request.metrics) == 0 {
+			// don't burn sequence numbers on empty flushes
+			return write(request.metrics, current, request.correlations)
+		}
+
+		if err := write(request.metrics, next, request.correlations); err != nil {
+			return err
+		}
+
+		atomic.StoreUint64(&m.sequence, next)
+		return nil
+	}
+
+	// run the loop until we are closed, or until something panics. All of
+	// the state above lives outside of the loop, so a restarted loop picks
+	// up exactly where the last one left off.
+	closed := false
+	var pending *writeRequest
+	loop := func() {
+		for {
+			select {
+			case request := <-m.writeCh:
+				pending = &request
+				err := apply(request)
+				pending = nil
+				request.acknowledge(m.named(correlated(err, request.correlations)))
+			case query := <-m.queryCh:
+				query(left, right)
+			case <-m.quitCh:
+				closed = true
+				// nobody is waiting for us if the close timed out
+				select {
+				case m.quitCh <- true:
+				case <-m.doneCh:
+				}
+				return
+			case <-m.doneCh:
+				// we were abandoned by a close which timed out
+				closed = true
+				return
+			}
+		}
+	}
+
+	for restarts := 0; ; restarts++ {
+		err := recoverPanic(loop)
+		if closed {
 			return
 		}
+
+		err = m.named(err)
+		reportError(m.errCh, err)
+		// don't leave the writer of the batch we panicked on waiting
+		if pending != nil {
+			pending.acknowledge(err)
+			pending = nil
+		}
+		if !m.restartPolicy.allows(restarts) {
+			break
+		}
+	}
+
+	// we can't safely keep going, so reject everything until we are closed
+	atomic.StoreInt32(&m.failed, 1)
+	select {
+	case <-m.quitCh:
+		select {
+		case m.quitCh <- true:
+		case <-m.doneCh:
+		}
+	case <-m.doneCh:
 	}
 }
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func buildBulkMetrics(h, t int) []*BulkMetric {
@@ -28,3 +33,362 @@ func TestMedianDatabaseRebalancing(t *testing.T) {
 
 	// TODO: verify medians are ballpark correct
 }
+
+func TestMedianDatabaseDuplicateValues(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// a batch where the same value is repeated must count every copy
+	batch := append(buildBulkMetrics(0, 3), NewBulkMetric(9), NewBulkMetric(9), NewBulkMetric(9))
+	database.BulkWrite(batch)
+
+	frozen, err := database.Freeze()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frozen.Count() != 6 {
+		t.Fatalf("expected 6 metrics, got %d", frozen.Count())
+	}
+	// [0 1 2 9 9 9 ]
+	if frozen.GetMedian() != 5 {
+		t.Fatalf("expected median of 5, got %d", frozen.GetMedian())
+	}
+}
+
+func TestMedianDatabaseGetMedianAndCount(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	if median, count := database.GetMedianAndCount(); median != 0 || count != 0 {
+		t.Fatalf("expected an empty database, got median %d and count %d", median, count)
+	}
+
+	database.BulkWrite(buildBulkMetrics(0, 9))
+	database.Snapshot()
+
+	if median, count := database.GetMedianAndCount(); median != 4 || count != 9 {
+		t.Fatalf("expected median 4 and count 9, got median %d and count %d", median, count)
+	}
+}
+
+func TestMedianDatabaseErrors(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+
+	if err := database.BulkWrite([]*BulkMetric{{value: 1, count: 0}}); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+	if err := database.BulkWrite([]*BulkMetric{nil}); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+
+	database.Close()
+
+	if err := database.BulkWrite(buildBulkMetrics(0, 1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if _, err := database.Snapshot(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestMedianDatabaseGetMedianStale(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	database.BulkWrite(buildBulkMetrics(0, 9))
+	database.Snapshot()
+
+	median, age := database.GetMedianStale()
+	if median != 4 || age > time.Second {
+		t.Fatalf("expected a fresh median of 4, got %d from %v ago", median, age)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if _, older := database.GetMedianStale(); older < 20*time.Millisecond || older <= age {
+		t.Fatalf("expected the median to age, got %v", older)
+	}
+}
+
+func TestMedianDatabaseBulkWriteAcked(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := <-database.BulkWriteAcked(buildBulkMetrics(i, i+1)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		// the write has been applied once it is acknowledged
+		if _, count := database.GetMedianAndCount(); count != int64(i+1) {
+			t.Fatalf("expected a count of %d, got %d", i+1, count)
+		}
+	}
+
+	if err := <-database.BulkWriteAcked([]*BulkMetric{nil}); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+}
+
+func TestMedianDatabaseBoundaryCompaction(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// writing a value on alternating sides of a repeated value keeps
+	// splitting it across the boundary and moving it back again
+	fives := NewBulkMetric(5)
+	fives.IncrBy(2)
+	database.BulkWrite([]*BulkMetric{fives})
+	for i := 0; i < 10; i++ {
+		database.BulkWrite(buildBulkMetrics(1, 2))
+		database.BulkWrite(buildBulkMetrics(9, 10))
+	}
+
+	runs := make(chan int, 1)
+	database.query(func(left, right []*BulkMetric) {
+		runs <- len(left) + len(right)
+	})
+
+	// [1 5 | 5 9 ] is the most runs three values can take
+	if actual := <-runs; actual > 4 {
+		t.Fatalf("expected at most 4 runs, got %d", actual)
+	}
+
+	snapshot, _ := database.Snapshot()
+	if snapshot.GetMedian() != 5 || snapshot.Count() != 23 {
+		t.Fatalf("expected a median of 5 over 23 metrics, got %d over %d", snapshot.GetMedian(), snapshot.Count())
+	}
+}
+
+func TestMedianDatabaseGetMedianFloat(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	<-database.BulkWriteAcked(buildBulkMetrics(0, 4))
+	if database.GetMedian() != 1 || database.GetMedianFloat() != 1.5 {
+		t.Fatalf("expected medians of 1 and 1.5, got %d and %v", database.GetMedian(), database.GetMedianFloat())
+	}
+
+	snapshot, _ := database.Snapshot()
+	if snapshot.GetMedianFloat() != 1.5 {
+		t.Fatalf("expected a snapshot median of 1.5, got %v", snapshot.GetMedianFloat())
+	}
+}
+
+func TestMedianDatabaseBulkWriteSorted(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	if err := <-database.BulkWriteSortedAcked(buildBulkMetrics(0, 9)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if median, count := database.GetMedianAndCount(); median != 4 || count != 9 {
+		t.Fatalf("expected a median of 4 over 9 metrics, got %d over %d", median, count)
+	}
+
+	unsorted := []*BulkMetric{NewBulkMetric(3), NewBulkMetric(1)}
+	if err := database.BulkWriteSorted(unsorted); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric for an unsorted batch, got %v", err)
+	}
+
+	duplicated := []*BulkMetric{NewBulkMetric(1), NewBulkMetric(1)}
+	if err := database.BulkWriteSorted(duplicated); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric for duplicate values, got %v", err)
+	}
+}
+
+func TestMedianDatabaseCloseWithTimeout(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+
+	// wedge the worker in a query
+	unblock := make(chan struct{})
+	database.query(func(left, right []*BulkMetric) {
+		<-unblock
+	})
+	defer close(unblock)
+
+	queued := make(chan error, 1)
+	go func() {
+		queued <- database.BulkWrite(buildBulkMetrics(0, 10))
+	}()
+	for atomic.LoadInt64(&database.queued) != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	err := database.CloseWithTimeout(20 * time.Millisecond)
+	if !errors.Is(err, ErrTimeout) || !strings.Contains(err.Error(), "1 writes and queries") {
+		t.Fatalf("expected ErrTimeout reporting the queued write, got %v", err)
+	}
+
+	// everything waiting on the wedged worker is released
+	if err := <-queued; !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed for the queued write, got %v", err)
+	}
+	if err := database.BulkWrite(buildBulkMetrics(0, 10)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+
+	// closing again doesn't block
+	database.Close()
+}
+
+func TestMedianDatabaseName(t *testing.T) {
+	database := NewMedianDatabase(WithName("checkout.latency"))
+	database.Open()
+	database.Close()
+
+	err := database.BulkWrite(buildBulkMetrics(0, 10))
+	if !errors.Is(err, ErrClosed) || err.Error() != "database checkout.latency: closed" {
+		t.Fatalf("expected a named ErrClosed, got %v", err)
+	}
+	if database.Name() != "checkout.latency" {
+		t.Fatalf("unexpected name %s", database.Name())
+	}
+}
+
+// readers only ever load the published stats, so reads should scale with
+// the number of readers, and not slow down while writes are applied
+func BenchmarkMedianDatabaseGetMedian(b *testing.B) {
+	for _, readers := range []int{1, 8, 64} {
+		b.Run(fmt.Sprintf("readers=%d", readers), func(b *testing.B) {
+			database := NewMedianDatabase()
+			database.Open()
+			defer database.Close()
+			<-database.BulkWriteAcked(buildBulkMetrics(0, 10000))
+
+			// keep the worker busy for the duration of the benchmark
+			stop := make(chan struct{})
+			defer close(stop)
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+						database.BulkWrite(buildBulkMetrics(i%10000, i%10000+10))
+					}
+				}
+			}()
+
+			b.SetParallelism(readers)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					database.GetMedian()
+				}
+			})
+		})
+	}
+}
+
+func TestMedianDatabaseGeneration(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	if generation := database.Generation(); generation != 0 {
+		t.Fatalf("expected generation 0 before any writes, got %d", generation)
+	}
+
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 11))
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 11))
+	if generation := database.Generation(); generation != 2 {
+		t.Fatalf("expected generation 2, got %d", generation)
+	}
+
+	// neither empty batches nor replayed frames change anything
+	<-database.BulkWriteAcked(nil)
+	database.ApplyFrame(Frame{Sequence: 1, Metrics: buildBulkMetrics(1, 11)})
+	if generation := database.Generation(); generation != 2 {
+		t.Fatalf("expected generation to stay at 2, got %d", generation)
+	}
+
+	// seeding can move the sequence back, but never the generation
+	database.seed(Snapshot{FrozenDatabase: newFrozenDatabase(buildBulkMetrics(1, 2), nil), Sequence: 1})
+	if database.Sequence() != 1 || database.Generation() != 3 {
+		t.Fatalf("expected sequence 1 at generation 3, got %d at %d", database.Sequence(), database.Generation())
+	}
+}
+
+// the median should be recalculated once per applied batch whichever way
+// it was rebalanced, and not at all for batches which change nothing
+func TestMedianDatabaseRecalculatesOncePerBatch(t *testing.T) {
+	recalculations := int64(0)
+	database := NewMedianDatabase(WithObserver(func(StatsUpdate) {
+		atomic.AddInt64(&recalculations, 1)
+	}))
+	database.Open()
+	defer database.Close()
+
+	batches := []struct {
+		name    string
+		metrics []*BulkMetric
+	}{
+		{"into an empty database", buildBulkMetrics(0, 10)},
+		{"towards the right", buildBulkMetrics(-100, -80)},
+		{"towards the left", buildBulkMetrics(1000, 1040)},
+		{"without rebalancing", []*BulkMetric{{value: -1000, count: 1}, {value: 5000, count: 1}}},
+		{"many runs at once", buildBulkMetrics(-5000, 5000)},
+		{"nothing", []*BulkMetric{}},
+	}
+	expected := int64(0)
+	for _, batch := range batches {
+		if err := <-database.BulkWriteAcked(batch.metrics); err != nil {
+			t.Fatalf("%s: expected write, got %v", batch.name, err)
+		}
+		if len(batch.metrics) > 0 {
+			expected++
+		}
+
+		if count := atomic.LoadInt64(&recalculations); count != expected {
+			t.Fatalf("%s: expected %d recalculations, got %d", batch.name, expected, count)
+		}
+	}
+
+	// already applied batches are skipped without recalculating
+	database.ApplyFrame(Frame{Sequence: 1, Metrics: buildBulkMetrics(0, 10)})
+	if count := atomic.LoadInt64(&recalculations); count != expected {
+		t.Fatalf("expected a duplicate frame not to recalculate, got %d", count)
+	}
+}
+
+// the cost of applying a batch, which should grow with the number of runs
+// it touches rather than recalculate once per metric in it
+func BenchmarkMedianDatabaseRecalculation(b *testing.B) {
+	for _, runs := range []int{100, 10000, 100000} {
+		for _, batch := range []int{1, 100, 1000} {
+			if batch > runs {
+				continue
+			}
+			b.Run(fmt.Sprintf("runs=%d/batch=%d", runs, batch), func(b *testing.B) {
+				recalculations := int64(0)
+				database := NewMedianDatabase(WithObserver(func(StatsUpdate) {
+					atomic.AddInt64(&recalculations, 1)
+				}))
+				database.Open()
+				defer database.Close()
+				<-database.BulkWriteAcked(buildBulkMetrics(0, runs))
+				atomic.StoreInt64(&recalculations, 0)
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					// spread across the existing runs, so batches land
+					// either side of the median and are rebalanced
+					start := (i * 7919) % (runs - batch + 1)
+					<-database.BulkWriteAcked(buildBulkMetrics(start, start+batch))
+				}
+				b.StopTimer()
+
+				b.ReportMetric(float64(atomic.LoadInt64(&recalculations))/float64(b.N), "recalculations/op")
+			})
+		}
+	}
+}
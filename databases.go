@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a Registry tracks the open databases in a process by name, so that a
+// process hosting hundreds of series can be inspected in one place.
+// Databases can be registered by hand, or register themselves while they
+// are open with WithRegistry.
+type Registry struct {
+	sync.RWMutex
+
+	databases map[string]Database
+	metadata  map[string]SeriesMetadata
+	workers   map[string]*BufferedWorker
+
+	// see WithConcurrency
+	concurrency int
+}
+
+// SeriesMetadata describes a series, so that the dashboards and alerts
+// built on it can describe themselves
+type SeriesMetadata struct {
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+}
+
+func NewRegistry(options ...RegistryOption) *Registry {
+	r := &Registry{
+		databases:   make(map[string]Database),
+		metadata:    make(map[string]SeriesMetadata),
+		workers:     make(map[string]*BufferedWorker),
+		concurrency: runtime.GOMAXPROCS(0),
+	}
+
+	for _, option := range options {
+		option(r)
+	}
+
+	return r
+}
+
+// Register adds the database under name, failing if the name is taken.
+// Databases which describe themselves, eg: a MedianDatabase created
+// WithMetadata, are registered with their metadata.
+func (r *Registry) Register(name string, database Database) error {
+	if name == "" {
+		return fmt.Errorf("databases must be named to be registered")
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.databases[name]; ok {
+		return fmt.Errorf("database %s already registered", name)
+	}
+	r.databases[name] = database
+	if described, ok := database.(interface{ Metadata() SeriesMetadata }); ok {
+		r.metadata[name] = described.Metadata()
+	}
+
+	return nil
+}
+
+func (r *Registry) Unregister(name string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.databases, name)
+	delete(r.metadata, name)
+	delete(r.workers, name)
+}
+
+// SetMetadata replaces the metadata of a registered database.
+func (r *Registry) SetMetadata(name string, metadata SeriesMetadata) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.databases[name]; !ok {
+		return fmt.Errorf("database %s isn't registered", name)
+	}
+	r.metadata[name] = metadata
+
+	return nil
+}
+
+// AttachWorker reports the backlog of the worker writing to a registered
+// database in its stats, so a database which can't keep up can be spotted
+// from the registry.
+func (r *Registry) AttachWorker(name string, worker *BufferedWorker) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.databases[name]; !ok {
+		return fmt.Errorf("database %s isn't registered", name)
+	}
+	r.workers[name] = worker
+
+	return nil
+}
+
+// Metadata returns the metadata of a registered database, which is empty
+// if it was never set.
+func (r *Registry) Metadata(name string) SeriesMetadata {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.metadata[name]
+}
+
+// removes the database under name only if it is still the one registered,
+// so a database closing late can't remove its replacement
+func (r *Registry) unregister(name string, database Database) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.databases[name] == database {
+		delete(r.databases, name)
+		delete(r.metadata, name)
+		delete(r.workers, name)
+	}
+}
+
+func (r *Registry) worker(name string) *BufferedWorker {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.workers[name]
+}
+
+func (r *Registry) Get(name string) (Database, bool) {
+	r.RLock()
+	defer r.RUnlock()
+
+	database, ok := r.databases[name]
+	return database, ok
+}
+
+// Names returns the name of every registered database, sorted.
+func (r *Registry) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+
+	names := make([]string, 0, len(r.databases))
+	for name := range r.databases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+type DatabaseStats struct {
+	Name   string `json:"name"`
+	Median int    `json:"median"`
+	// only known for databases which track their count
+	Count int64 `json:"count,omitempty"`
+	// only known for databases which track when they were last written
+	IdleSeconds float64 `json:"idle_seconds,omitempty"`
+	Stale       bool    `json:"stale,omitempty"`
+	// only known for databases which count their writes
+	Generation uint64 `json:"generation,omitempty"`
+	// only known for databases with an attached worker, see AttachWorker
+	PendingFlushes int `json:"pending_flushes,omitempty"`
+}
+
+type RegistryStats struct {
+	Databases int   `json:"databases"`
+	Count     int64 `json:"count"`
+	// every database's stats, sorted by name
+	Series []DatabaseStats `json:"series"`
+}
+
+// Stats returns the stats of every registered database along with their
+// totals, see WithConcurrency.
+func (r *Registry) Stats() RegistryStats {
+	names := r.Names()
+	series := make([]*DatabaseStats, len(names))
+	r.each(names, func(i int, name string, database Database) {
+		stats := DatabaseStats{Name: name, Median: database.GetMedian()}
+		if counted, ok := database.(interface{ GetMedianAndCount() (int64, int64) }); ok {
+			median, count := counted.GetMedianAndCount()
+			stats.Median, stats.Count = int(median), count
+		}
+		if idle, ok := database.(idleDatabase); ok {
+			stats.IdleSeconds, stats.Stale = idle.Idle().Seconds(), idle.Stale()
+		}
+		if generational, ok := database.(interface{ Generation() uint64 }); ok {
+			stats.Generation = generational.Generation()
+		}
+		if worker := r.worker(name); worker != nil {
+			stats.PendingFlushes = worker.AdmissionStats().PendingFlushes
+		}
+		series[i] = &stats
+	})
+
+	stats := RegistryStats{
+		Series: make([]DatabaseStats, 0, len(series)),
+	}
+	for _, database := range series {
+		// unregistered since the names were listed
+		if database == nil {
+			continue
+		}
+
+		stats.Databases++
+		stats.Count += database.Count
+		stats.Series = append(stats.Series, *database)
+	}
+
+	return stats
+}
+
+// NewRegistryHandler returns an http.Handler serving every registered
+// database. The paths are:
+//
+//	GET /stats           the RegistryStats
+//	GET /series          the name, tags and metadata of every database,
+//	                     or those matching a SeriesMatcher
+//	GET /series/<name>/metadata, PUT to replace it with a SeriesMetadata
+//	GET /series/<name>/  any path served by NewHandler, for that database
+//	GET /query           a Query across many series, see ParseQuery
+//	POST /query/batch    many queries at once, see serveQueryBatch
+func NewRegistryHandler(registry *Registry) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, registry.Stats())
+	})
+
+	mux.HandleFunc("/query", func(w http.ResponseWriter, r *http.Request) {
+		serveQuery(w, r, registry)
+	})
+
+	mux.HandleFunc("/query/batch", func(w http.ResponseWriter, r *http.Request) {
+		serveQueryBatch(w, r, registry)
+	})
+
+	mux.HandleFunc("/series", func(w http.ResponseWriter, r *http.Request) {
+		matcher, err := ParseSeriesMatcher(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, registry.ListSeries(matcher))
+	})
+
+	mux.HandleFunc("/series/", func(w http.ResponseWriter, r *http.Request) {
+		// names can contain slashes, so the database's own path is
+		// whatever follows the longest registered name, which always
+		// sorts after any shorter name it starts with
+		rest := strings.TrimPrefix(r.URL.Path, "/series/")
+		names := registry.Names()
+		for i := len(names) - 1; i >= 0; i-- {
+			name := names[i]
+			if !strings.HasPrefix(rest, name+"/") {
+				continue
+			}
+
+			database, ok := registry.Get(name)
+			if !ok {
+				continue
+			}
+
+			if rest == name+"/metadata" {
+				serveMetadata(w, r, registry, name)
+				return
+			}
+
+			http.StripPrefix("/series/"+name, NewHandler(database)).ServeHTTP(w, r)
+			return
+		}
+
+		http.NotFound(w, r)
+	})
+
+	return mux
+}
+
+func serveMetadata(w http.ResponseWriter, r *http.Request, registry *Registry, name string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, registry.Metadata(name))
+	case http.MethodPut:
+		metadata := SeriesMetadata{}
+		if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+			http.Error(w, fmt.Sprintf("invalid metadata: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := registry.SetMetadata(name, metadata); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, metadata)
+	default:
+		http.Error(w, "metadata can only be read or PUT", http.StatusMethodNotAllowed)
+	}
+}
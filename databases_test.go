@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry()
+
+	api := NewMedianDatabase(WithName("api"), WithRegistry(registry), WithMetadata(SeriesMetadata{Unit: "ms", Owner: "edge"}))
+	api.Open()
+	defer api.Close()
+	<-api.BulkWriteAcked(buildBulkMetrics(1, 101))
+
+	nested := NewMedianDatabase(WithName("api/v2"), WithRegistry(registry))
+	nested.Open()
+	<-nested.BulkWriteAcked(buildBulkMetrics(1, 4))
+
+	if err := registry.Register("histogram", newTestHistogramDatabase(1)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.Register("histogram", newTestHistogramDatabase(1)); err == nil {
+		t.Fatalf("expected a duplicate name to be rejected")
+	}
+
+	duplicate := NewMedianDatabase(WithName("api"), WithRegistry(registry))
+	duplicate.Open()
+	if err := <-duplicate.Errors(); err == nil {
+		t.Fatalf("expected a duplicate registration to be reported")
+	}
+	// closing the duplicate mustn't unregister the original
+	duplicate.Close()
+
+	stats := registry.Stats()
+	if stats.Databases != 3 || stats.Count != 103 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.Series[0].Name != "api" || stats.Series[0].Median != 50 || stats.Series[1].Name != "api/v2" {
+		t.Fatalf("unexpected series %+v", stats.Series)
+	}
+
+	server := httptest.NewServer(NewRegistryHandler(registry))
+	defer server.Close()
+
+	get := func(path string, expectedStatus int) []byte {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d for %s, got %d", expectedStatus, path, response.StatusCode)
+		}
+
+		body, _ := io.ReadAll(response.Body)
+		return body
+	}
+
+	var listing []SeriesListing
+	json.Unmarshal(get("/series", http.StatusOK), &listing)
+	if len(listing) != 3 || listing[0].Name != "api" || listing[0].Metadata.Unit != "ms" || listing[2].Metadata.Unit != "" {
+		t.Fatalf("unexpected series %+v", listing)
+	}
+
+	request, _ := http.NewRequest(http.MethodPut, server.URL+"/series/histogram/metadata", strings.NewReader(`{"unit": "bytes", "description": "payload sizes"}`))
+	response, err := http.DefaultClient.Do(request)
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %v: %v", response, err)
+	}
+	response.Body.Close()
+
+	var metadata SeriesMetadata
+	json.Unmarshal(get("/series/histogram/metadata", http.StatusOK), &metadata)
+	if metadata.Unit != "bytes" || metadata.Description != "payload sizes" {
+		t.Fatalf("unexpected metadata %+v", metadata)
+	}
+	if err := registry.SetMetadata("missing", metadata); err == nil {
+		t.Fatalf("expected metadata for an unregistered database to be rejected")
+	}
+
+	result, err := registry.Query(Query{Selector: Selector{Name: "api"}, Quantiles: []float64{0.5}})
+	if err != nil || result.Metadata["api"].Owner != "edge" {
+		t.Fatalf("expected the query result to carry the metadata, got %+v: %v", result, err)
+	}
+
+	var median medianResponse
+	json.Unmarshal(get("/series/api/v2/median", http.StatusOK), &median)
+	if median.Median != 2 || median.Count != 3 {
+		t.Fatalf("expected the median of api/v2, got %+v", median)
+	}
+	get("/series/missing/median", http.StatusNotFound)
+
+	nested.Close()
+	if _, ok := registry.Get("api/v2"); ok {
+		t.Fatalf("expected a closed database to be unregistered")
+	}
+}
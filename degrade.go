@@ -0,0 +1,165 @@
+package main
+
+import (
+	"sync"
+)
+
+// a rough estimate of the memory used by each run in a MedianDatabase: the
+// pointer in the left or right slice plus the BulkMetric it points at
+const bytesPerRun = 8 + 16
+
+// a DegradationPolicy decides when a DegradingDatabase gives up on exact
+// answers. A zero limit is disabled.
+type DegradationPolicy struct {
+	// the number of distinct values stored
+	MaxDistinctValues int
+	// the estimated memory used by the stored values
+	MaxBytes int
+	// the bucket width of the histogram the database degrades into
+	Resolution int
+
+	// warns as either limit nears, before the database degrades
+	Soft SoftLimit
+}
+
+// a DegradingDatabase stores metrics exactly in a MedianDatabase until the
+// number of distinct values, or their memory, crosses the policy's limits.
+// It then converts itself into a HistogramDatabase, which keeps answering
+// with bounded error rather than growing without bound. Note that once
+// degraded, the median of an even number of metrics is the lower of the
+// middle two rather than the midpoint between them, as the histogram's
+// GetMedian is a nearest-rank percentile like GetPercentile.
+type DegradingDatabase struct {
+	// writes hold the read lock so they can proceed concurrently, the
+	// conversion holds the write lock so that no write is lost
+	sync.RWMutex
+
+	policy    DegradationPolicy
+	exact     *MedianDatabase
+	histogram *HistogramDatabase
+	softLimit *softLimiter
+}
+
+func NewDegradingDatabase(policy DegradationPolicy) *DegradingDatabase {
+	if policy.Resolution < 1 {
+		policy.Resolution = 1
+	}
+
+	return &DegradingDatabase{
+		policy:    policy,
+		exact:     NewMedianDatabase(),
+		softLimit: newSoftLimiter(policy.Soft),
+	}
+}
+
+func (d *DegradingDatabase) Open() {
+	d.exact.Open()
+}
+
+func (d *DegradingDatabase) Close() {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.histogram != nil {
+		d.histogram.Close()
+		return
+	}
+	d.exact.Close()
+}
+
+// Degraded reports whether the database has converted to a histogram.
+func (d *DegradingDatabase) Degraded() bool {
+	d.RLock()
+	defer d.RUnlock()
+	return d.histogram != nil
+}
+
+func (d *DegradingDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	d.RLock()
+	if d.histogram != nil {
+		defer d.RUnlock()
+		return d.histogram.BulkWrite(bulkMetrics)
+	}
+
+	err := d.exact.BulkWrite(bulkMetrics)
+	d.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	if d.overLimit() {
+		return d.degrade()
+	}
+
+	return nil
+}
+
+func (d *DegradingDatabase) overLimit() bool {
+	// NOTE the stats are published once the worker applies a write, so
+	// this can lag slightly behind the writes made so far
+	runs := d.exact.stats.Load().(*medianStats).runs
+	d.softLimit.check("distinct values", "", runs, d.policy.MaxDistinctValues)
+	d.softLimit.check("bytes", "", runs*bytesPerRun, d.policy.MaxBytes)
+
+	if d.policy.MaxDistinctValues > 0 && runs > d.policy.MaxDistinctValues {
+		return true
+	}
+
+	return d.policy.MaxBytes > 0 && runs*bytesPerRun > d.policy.MaxBytes
+}
+
+// converts the exact database into a histogram
+func (d *DegradingDatabase) degrade() error {
+	d.Lock()
+	defer d.Unlock()
+
+	// another write may have beaten us to it
+	if d.histogram != nil {
+		return nil
+	}
+
+	snapshot, err := d.exact.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	histogram, err := NewHistogramDatabase(d.policy.Resolution)
+	if err != nil {
+		return err
+	}
+	if err := histogram.BulkWrite(snapshot.metrics()); err != nil {
+		return err
+	}
+
+	d.exact.Close()
+	d.histogram = histogram
+	return nil
+}
+
+// GetPercentileWithError returns the percentile along with its error
+// bounds, which are exact until the database has degraded.
+func (d *DegradingDatabase) GetPercentileWithError(p float64) (Estimate, error) {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.histogram != nil {
+		return d.histogram.GetPercentileWithError(p, d.policy.Resolution)
+	}
+
+	snapshot, err := d.exact.Snapshot()
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	return snapshot.GetPercentileWithError(p)
+}
+
+func (d *DegradingDatabase) GetMedian() int {
+	d.RLock()
+	defer d.RUnlock()
+
+	if d.histogram != nil {
+		return d.histogram.GetMedian()
+	}
+	return d.exact.GetMedian()
+}
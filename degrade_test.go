@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDegradingDatabaseConvertsToHistogram(t *testing.T) {
+	database := NewDegradingDatabase(DegradationPolicy{
+		MaxDistinctValues: 100,
+		Resolution:        10,
+	})
+	database.Open()
+	defer database.Close()
+
+	database.BulkWrite(buildBulkMetrics(0, 50))
+	// round trip through the worker so the stats are published
+	database.exact.Snapshot()
+	if database.Degraded() {
+		t.Fatalf("expected the database to still be exact")
+	}
+
+	database.BulkWrite(buildBulkMetrics(50, 200))
+	database.exact.Snapshot()
+	// the limit is checked after each write, so it takes one more
+	database.BulkWrite(buildBulkMetrics(200, 201))
+	if !database.Degraded() {
+		t.Fatalf("expected the database to have degraded")
+	}
+
+	// nothing written before the conversion is lost
+	database.BulkWrite(buildBulkMetrics(201, 1001))
+	if median := database.GetMedian(); median < 495 || median > 505 {
+		t.Fatalf("expected a median within 5 of 500, got %d", median)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+// WithSignificantDigits rounds every value the worker buffers to digits
+// significant digits, eg: with 2, 1234 is stored as 1200 and 56789 as
+// 57000. Wide ranging data then has far fewer distinct values to store,
+// while each is off by at most half a unit in the last kept digit. The
+// exact values are kept in the aggregate, so the mean is unaffected.
+func WithSignificantDigits(digits int) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.significantDigits = digits
+	}
+}
+
+// rounds the value half away from zero to digits significant digits,
+// leaving it as is if digits isn't positive
+func roundSignificant(value, digits int) int {
+	if digits < 1 {
+		return value
+	}
+
+	negative := value < 0
+	magnitude := uint64(value)
+	if negative {
+		magnitude = uint64(-value)
+	}
+
+	// the power of ten of the first digit which is rounded away
+	scale := uint64(1)
+	for limit := magnitude; limit >= pow10(digits); limit /= 10 {
+		scale *= 10
+	}
+	if scale == 1 {
+		return value
+	}
+
+	rounded := (magnitude + scale/2) / scale * scale
+	// rounding up the largest values would overflow
+	if rounded > uint64(1<<63-1) {
+		rounded -= scale
+	}
+
+	if negative {
+		return -int(rounded)
+	}
+
+	return int(rounded)
+}
+
+func pow10(n int) uint64 {
+	power := uint64(1)
+	for i := 0; i < n && power <= 1e18; i++ {
+		power *= 10
+	}
+
+	return power
+}
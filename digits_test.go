@@ -0,0 +1,55 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRoundSignificant(t *testing.T) {
+	cases := []struct {
+		value, digits, expected int
+	}{
+		{1234, 2, 1200},
+		{1250, 2, 1300},
+		{56789, 2, 57000},
+		{-56789, 2, -57000},
+		{99, 2, 99},
+		{999, 2, 1000},
+		{1234, 0, 1234},
+		{math.MaxInt, 1, 9000000000000000000},
+		{math.MaxInt, 25, math.MaxInt},
+	}
+
+	for _, c := range cases {
+		if actual := roundSignificant(c.value, c.digits); actual != c.expected {
+			t.Fatalf("expected %d to %d digits to be %d, got %d", c.value, c.digits, c.expected, actual)
+		}
+	}
+}
+
+func TestWorkerSignificantDigits(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	worker := NewBufferedWorker(100000, time.Hour, database, WithSignificantDigits(1))
+	worker.Start()
+	for i := 1; i <= 10000; i++ {
+		worker.Write(NewIntMetric(i))
+	}
+	worker.Stop()
+
+	snapshot, _ := database.Snapshot()
+	if snapshot.Count() != 10000 || len(snapshot.values) != 37 {
+		t.Fatalf("expected 10000 metrics in 37 values, 9 per power of ten,, got %d in %d", snapshot.Count(), len(snapshot.values))
+	}
+	if median := snapshot.GetMedian(); median != 5000 {
+		t.Fatalf("expected a median of 5000, got %d", median)
+	}
+
+	// the exact values are kept for the mean
+	if mean := database.GetAggregate().Mean(); mean != 5000.5 {
+		t.Fatalf("expected an exact mean of 5000.5, got %v", mean)
+	}
+}
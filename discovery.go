@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/url"
+	"strings"
+)
+
+// a SeriesMatcher picks out the registered series a dashboard offers, by
+// their tags and the start of their name, eg: every api.* series in
+// region eu. The zero SeriesMatcher matches every series.
+type SeriesMatcher struct {
+	// the series' name, without its tags, must start with the prefix
+	Prefix string
+
+	// a selector the series must match, see ParseSelector
+	Selector Selector
+}
+
+// ParseSeriesMatcher parses a matcher from its query parameters:
+//
+//	prefix  the start of the series' names, eg: api.
+//	match   a selector, eg: {region=eu,host!=a} or api.latency{region=eu}
+//
+// both are optional, so no parameters lists every series.
+func ParseSeriesMatcher(values url.Values) (SeriesMatcher, error) {
+	matcher := SeriesMatcher{Prefix: values.Get("prefix")}
+	if match := values.Get("match"); match != "" {
+		selector, err := ParseSelector(match)
+		if err != nil {
+			return SeriesMatcher{}, err
+		}
+		matcher.Selector = selector
+	}
+
+	return matcher, nil
+}
+
+// Matches reports whether the series, named with its tags, is matched.
+func (m SeriesMatcher) Matches(series string) bool {
+	name, _ := parseSeriesName(series)
+	return strings.HasPrefix(name, m.Prefix) && m.Selector.Matches(series)
+}
+
+// a SeriesListing describes a registered series
+type SeriesListing struct {
+	Name     string            `json:"name"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	Metadata SeriesMetadata    `json:"metadata"`
+}
+
+// ListSeries returns every registered series the matcher matches, sorted
+// by name, so a dashboard can offer them without knowing their names.
+func (r *Registry) ListSeries(matcher SeriesMatcher) []SeriesListing {
+	listing := make([]SeriesListing, 0)
+	for _, name := range r.Names() {
+		if !matcher.Matches(name) {
+			continue
+		}
+
+		_, tags := parseSeriesName(name)
+		if len(tags) == 0 {
+			tags = nil
+		}
+		listing = append(listing, SeriesListing{Name: name, Tags: tags, Metadata: r.Metadata(name)})
+	}
+
+	return listing
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestListSeries(t *testing.T) {
+	registry := NewRegistry()
+	for _, name := range []string{"api.latency{region=eu,host=a}", "api.latency{region=us,host=b}", "api.errors{region=eu}", "db.latency{region=eu}", "jobs"} {
+		if err := registry.Register(name, NewSyncMedianDatabase()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	registry.SetMetadata("jobs", SeriesMetadata{Unit: "s"})
+
+	names := func(listing []SeriesListing) []string {
+		names := make([]string, 0, len(listing))
+		for _, series := range listing {
+			names = append(names, series.Name)
+		}
+		return names
+	}
+
+	cases := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"api.errors{region=eu}", "api.latency{region=eu,host=a}", "api.latency{region=us,host=b}", "db.latency{region=eu}", "jobs"}},
+		{"prefix=api.", []string{"api.errors{region=eu}", "api.latency{region=eu,host=a}", "api.latency{region=us,host=b}"}},
+		{"match={region=eu}", []string{"api.errors{region=eu}", "api.latency{region=eu,host=a}", "db.latency{region=eu}"}},
+		{"prefix=api.&match={region!=eu}", []string{"api.latency{region=us,host=b}"}},
+		{"match=api.latency{host=a}", []string{"api.latency{region=eu,host=a}"}},
+		// the prefix is of the name, never its tags
+		{"prefix=jobs{", []string{}},
+	}
+	for _, c := range cases {
+		values, _ := url.ParseQuery(c.query)
+		matcher, err := ParseSeriesMatcher(values)
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %v", c.query, err)
+		}
+		if actual := names(registry.ListSeries(matcher)); !reflect.DeepEqual(actual, c.expected) {
+			t.Fatalf("%q: expected %v, got %v", c.query, c.expected, actual)
+		}
+	}
+
+	listing := registry.ListSeries(SeriesMatcher{Prefix: "api.latency"})
+	if listing[0].Tags["host"] != "a" || listing[1].Tags["region"] != "us" {
+		t.Fatalf("expected the series' tags to be listed, got %+v", listing)
+	}
+
+	server := httptest.NewServer(NewRegistryHandler(registry))
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/series?prefix=jo")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	listing = nil
+	json.NewDecoder(response.Body).Decode(&listing)
+	response.Body.Close()
+	if len(listing) != 1 || listing[0].Name != "jobs" || listing[0].Tags != nil || listing[0].Metadata.Unit != "s" {
+		t.Fatalf("unexpected listing %+v", listing)
+	}
+
+	response, err = http.Get(server.URL + "/series?match=" + url.QueryEscape("api{region}"))
+	if err != nil || response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a malformed matcher to be rejected, got %v: %v", response, err)
+	}
+	response.Body.Close()
+}
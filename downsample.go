@@ -0,0 +1,136 @@
+package main
+
+import (
+	"time"
+)
+
+// a WindowSummary is what is kept of a window once its metrics are
+// discarded: enough to chart and alert on over days or weeks, at a tiny
+// fraction of the memory of the distribution
+type WindowSummary struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Count  int       `json:"count"`
+	Median int       `json:"median"`
+	P90    int       `json:"p90"`
+	P99    int       `json:"p99"`
+}
+
+func summarize(start, end time.Time, counts map[int]int) WindowSummary {
+	snapshot := newSnapshotFromCounts(counts, end)
+	return WindowSummary{
+		Start:  start,
+		End:    end,
+		Count:  snapshot.Count(),
+		Median: snapshot.GetMedian(),
+		P90:    snapshot.GetPercentile(0.9),
+		P99:    snapshot.GetPercentile(0.99),
+	}
+}
+
+// a downsampler summarizes buckets as they age out of the retention, one
+// summary per interval. The buckets of an interval expire one at a time,
+// so they are merged into pending until the first bucket of the next
+// interval expires.
+type downsampler struct {
+	interval  time.Duration
+	retention time.Duration
+
+	summaries    []WindowSummary
+	pendingStart time.Time
+	pending      map[int]int
+}
+
+// WithDownsampling keeps a summary of every interval for retention after
+// its metrics age out of the database's own retention, eg: hourly
+// summaries for 30 days alongside a day of minute by minute metrics. The
+// interval should be a multiple of the resolution. Summaries answers
+// queries across both.
+func WithDownsampling(interval, retention time.Duration) WindowOption {
+	return func(w *WindowedDatabase) {
+		w.downsampled = &downsampler{
+			interval:  interval,
+			retention: retention,
+		}
+	}
+}
+
+func (d *downsampler) add(bucket *windowBucket, now time.Time) {
+	start := bucket.start.Truncate(d.interval)
+	if d.pending != nil && !start.Equal(d.pendingStart) {
+		d.flush()
+	}
+	if d.pending == nil {
+		d.pendingStart = start
+		d.pending = make(map[int]int)
+	}
+
+	for value, count := range bucket.counts {
+		d.pending[value] += count
+	}
+
+	expired := 0
+	for expired < len(d.summaries) && !d.summaries[expired].End.After(now.Add(-d.retention)) {
+		expired++
+	}
+	d.summaries = append(d.summaries[:0], d.summaries[expired:]...)
+}
+
+func (d *downsampler) flush() {
+	d.summaries = append(d.summaries, summarize(d.pendingStart, d.pendingStart.Add(d.interval), d.pending))
+	d.pending = nil
+}
+
+// the summaries which end after since, including the interval still
+// being merged, oldest first
+func (d *downsampler) since(since time.Time) []WindowSummary {
+	summaries := make([]WindowSummary, 0, len(d.summaries)+1)
+	for _, summary := range d.summaries {
+		if summary.End.After(since) {
+			summaries = append(summaries, summary)
+		}
+	}
+
+	if d.pending != nil && d.pendingStart.Add(d.interval).After(since) {
+		summaries = append(summaries, summarize(d.pendingStart, d.pendingStart.Add(d.interval), d.pending))
+	}
+
+	return summaries
+}
+
+// Summaries returns a summary of each window with metrics written within
+// the last window, oldest first. Windows still in the retention are
+// summarized at the resolution, and older windows are taken from the
+// downsampled summaries, if the database was created WithDownsampling.
+// The interval being downsampled can overlap the first raw window, as its
+// latest buckets may not have aged out yet.
+func (w *WindowedDatabase) Summaries(window time.Duration) []WindowSummary {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.summaries(w.reference().Add(-window), time.Time{})
+}
+
+// summarizes the windows which end after since and start before until,
+// or every later window if until is zero
+func (w *WindowedDatabase) summaries(since, until time.Time) []WindowSummary {
+	summaries := make([]WindowSummary, 0, len(w.buckets))
+	if w.downsampled != nil {
+		for _, summary := range w.downsampled.since(since) {
+			if until.IsZero() || summary.Start.Before(until) {
+				summaries = append(summaries, summary)
+			}
+		}
+	}
+
+	for _, bucket := range w.buckets {
+		end := bucket.start.Add(w.resolution)
+		if !end.After(since) || bucket.count == 0 || (!until.IsZero() && !bucket.start.Before(until)) {
+			continue
+		}
+
+		summaries = append(summaries, summarize(bucket.start, end, bucket.counts))
+	}
+
+	return summaries
+}
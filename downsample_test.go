@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDownsampling(t *testing.T) {
+	clock := newTestClock()
+	// line up with the five minute intervals
+	clock.advance(3 * time.Minute)
+	start := clock.now()
+
+	database := newTestWindowedDatabase(time.Minute, 5*time.Minute, WithDownsampling(5*time.Minute, time.Hour))
+	database.now = clock.now
+
+	for i := 0; i < 15; i++ {
+		database.BulkWrite([]*BulkMetric{{value: i, count: 10}})
+		if i < 14 {
+			clock.advance(time.Minute)
+		}
+	}
+
+	// the first interval is summarized, the second is still being merged
+	// as its buckets age out, and the rest are summarized from the buckets
+	summaries := database.Summaries(time.Hour)
+	if len(summaries) != 8 {
+		t.Fatalf("expected 8 summaries, got %+v", summaries)
+	}
+	first := summaries[0]
+	if !first.Start.Equal(start) || !first.End.Equal(start.Add(5*time.Minute)) || first.Count != 50 || first.Median != 2 || first.P99 != 4 {
+		t.Fatalf("unexpected first summary %+v", first)
+	}
+	if summaries[1].Count != 40 || !summaries[2].Start.Equal(start.Add(9*time.Minute)) || summaries[2].Median != 9 {
+		t.Fatalf("unexpected summaries %+v", summaries[1:3])
+	}
+
+	total := 0
+	for _, summary := range summaries {
+		total += summary.Count
+	}
+	if total != 150 {
+		t.Fatalf("expected every metric to be summarized once, got %d", total)
+	}
+
+	// the raw metrics are only kept for the retention
+	if count := database.GetWindow(time.Hour).Count(); count != 60 {
+		t.Fatalf("expected 60 metrics in the retention, got %d", count)
+	}
+
+	// served as JSON
+	recorder := httptest.NewRecorder()
+	NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/summaries?window=1h", nil))
+	served := []WindowSummary{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil || len(served) != 8 || served[0].Median != 2 {
+		t.Fatalf("expected the summaries to be served, got %s", recorder.Body.String())
+	}
+
+	// summaries older than their retention are discarded too
+	clock.advance(2 * time.Hour)
+	database.BulkWrite(buildBulkMetrics(0, 10))
+	if summaries := database.Summaries(time.Hour); len(summaries) != 1 || summaries[0].Count != 10 {
+		t.Fatalf("expected only the latest window, got %+v", summaries)
+	}
+	if len(database.downsampled.summaries) != 0 {
+		t.Fatalf("expected expired summaries to be discarded, got %+v", database.downsampled.summaries)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// PercentileEdges decides how percentiles are answered at the edges, p0 and
+// p100, and over datasets too small to tell a percentile from the min or
+// max. SLO tools disagree on these, so reports only line up with another
+// tool's when the same semantics are used.
+type PercentileEdges int
+
+const (
+	// the nearest rank, which is the min at p0 and the max at p100, as
+	// GetPercentile answers
+	NearestRankEdges PercentileEdges = iota
+	// percentiles with less than a whole value below or above them, eg:
+	// the p99 of fewer than 100 values, are rejected with
+	// ErrInsufficientData rather than answered with the min or max
+	RejectEdges
+	// interpolated linearly between the closest ranks, like numpy's
+	// default and spreadsheets' PERCENTILE.INC
+	InterpolateEdges
+)
+
+// GetPercentileWithEdges returns the percentile for p, where p is a
+// fraction between 0 and 1, with the given edge semantics. It fails with
+// ErrEmpty when nothing is stored.
+func (f *FrozenDatabase) GetPercentileWithEdges(p float64, edges PercentileEdges) (float64, error) {
+	count := f.Count()
+	if count == 0 {
+		return 0, ErrEmpty
+	}
+	p = math.Max(0, math.Min(1, p))
+
+	switch edges {
+	case RejectEdges:
+		// allowing for 1 - 0.9 not quite being 0.1
+		below, above := p*float64(count), (1-p)*float64(count)
+		if below < 1-1e-9 || above < 1-1e-9 {
+			return 0, fmt.Errorf("p%g of %d values: %w", p*100, count, ErrInsufficientData)
+		}
+		return float64(f.GetPercentile(p)), nil
+	case InterpolateEdges:
+		// the 1-indexed rank, which falls between two values unless it
+		// is whole
+		rank := p*float64(count-1) + 1
+		lower := int(rank)
+		value := float64(f.rank(lower))
+		if lower < count {
+			value += (rank - float64(lower)) * float64(f.rank(lower+1)-f.rank(lower))
+		}
+		return value, nil
+	default:
+		return float64(f.GetPercentile(p)), nil
+	}
+}
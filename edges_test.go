@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPercentileEdges(t *testing.T) {
+	frozen := newFrozenDatabase(buildBulkMetrics(1, 11), nil)
+
+	tests := []struct {
+		p     float64
+		edges PercentileEdges
+		value float64
+		err   error
+	}{
+		{0, NearestRankEdges, 1, nil},
+		{1, NearestRankEdges, 10, nil},
+		{0.99, NearestRankEdges, 10, nil},
+		{0.5, NearestRankEdges, 5, nil},
+
+		{0, RejectEdges, 0, ErrInsufficientData},
+		{1, RejectEdges, 0, ErrInsufficientData},
+		{0.99, RejectEdges, 0, ErrInsufficientData},
+		{0.9, RejectEdges, 9, nil},
+		{0.5, RejectEdges, 5, nil},
+
+		{0, InterpolateEdges, 1, nil},
+		{1, InterpolateEdges, 10, nil},
+		{0.5, InterpolateEdges, 5.5, nil},
+		{0.99, InterpolateEdges, 9.91, nil},
+	}
+
+	for _, test := range tests {
+		value, err := frozen.GetPercentileWithEdges(test.p, test.edges)
+		if !errors.Is(err, test.err) || (err == nil && (value < test.value-1e-9 || value > test.value+1e-9)) {
+			t.Fatalf("p%g with edges %d: expected %g (%v), got %g (%v)", test.p*100, test.edges, test.value, test.err, value, err)
+		}
+	}
+
+	// a single value is every interpolated percentile
+	single := newFrozenDatabase(buildBulkMetrics(7, 8), nil)
+	if value, err := single.GetPercentileWithEdges(0.99, InterpolateEdges); err != nil || value != 7 {
+		t.Fatalf("expected 7, got %g (%v)", value, err)
+	}
+
+	if _, err := newFrozenDatabase(nil, nil).GetPercentileWithEdges(0.5, InterpolateEdges); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+}
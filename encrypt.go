@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// encrypted streams start with this magic, followed by the length of the
+// key id and the id itself, so readers know which key to ask for. The rest
+// of the stream is a run of chunks, each laid out as:
+//
+//	uint32  length of the sealed chunk (big endian)
+//	[]byte  nonce
+//	[]byte  AES-GCM sealed data
+//
+// every chunk is authenticated along with the header, its index and
+// whether it is the last one, so chunks can't be reordered, swapped
+// between streams or dropped from the end without the reader noticing.
+var encryptedMagic = []byte("MSE1")
+
+const encryptedChunkSize = 64 << 10
+
+// a KeyProvider returns the AES key for a key id, eg: by calling out to a
+// KMS. Keys must be 16, 24 or 32 bytes long, for AES-128, 192 or 256.
+type KeyProvider func(keyID string) ([]byte, error)
+
+// StaticKey returns a KeyProvider which only knows a single key, eg: one
+// which was read from config.
+func StaticKey(keyID string, key []byte) KeyProvider {
+	return func(id string) ([]byte, error) {
+		if id != keyID {
+			return nil, fmt.Errorf("unknown key %q", id)
+		}
+
+		return key, nil
+	}
+}
+
+func newGCM(keyID string, keys KeyProvider) (cipher.AEAD, error) {
+	key, err := keys(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", keyID, err)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %w", keyID, err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encryptedHeader(keyID string) []byte {
+	header := append(append([]byte{}, encryptedMagic...), byte(len(keyID)))
+	return append(header, keyID...)
+}
+
+// returns the additional data which the chunk at index is sealed with
+func chunkData(header []byte, index uint64, last bool) []byte {
+	data := make([]byte, len(header)+9)
+	copy(data, header)
+	binary.BigEndian.PutUint64(data[len(header):], index)
+	if last {
+		data[len(data)-1] = 1
+	}
+
+	return data
+}
+
+type encryptedWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint64
+	err    error
+}
+
+// NewEncryptedWriter returns a writer which encrypts everything written to
+// it with the key keyID. Close must be called to finish the stream, and
+// doesn't close w. Encryption can be combined with compression by
+// compressing into the encrypted writer, never the other way around.
+func NewEncryptedWriter(w io.Writer, keyID string, keys KeyProvider) (io.WriteCloser, error) {
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("key id %q is too long", keyID)
+	}
+
+	gcm, err := newGCM(keyID, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	header := encryptedHeader(keyID)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &encryptedWriter{
+		w:      w,
+		gcm:    gcm,
+		header: header,
+		buf:    make([]byte, 0, encryptedChunkSize),
+	}, nil
+}
+
+func (e *encryptedWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data arrives, since the
+		// last chunk has to be sealed differently
+		if len(e.buf) == encryptedChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(e.buf[len(e.buf):encryptedChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (e *encryptedWriter) seal(last bool) error {
+	nonce := make([]byte, e.gcm.NonceSize(), e.gcm.NonceSize()+len(e.buf)+e.gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		e.err = err
+		return err
+	}
+
+	sealed := e.gcm.Seal(nonce, nonce, e.buf, chunkData(e.header, e.index, last))
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := e.w.Write(append(length[:], sealed...)); err != nil {
+		e.err = err
+		return err
+	}
+
+	e.buf = e.buf[:0]
+	e.index++
+	return nil
+}
+
+func (e *encryptedWriter) Close() error {
+	if e.err != nil {
+		return e.err
+	}
+
+	if err := e.seal(true); err != nil {
+		return err
+	}
+
+	e.err = ErrClosed
+	return nil
+}
+
+type encryptedReader struct {
+	r      io.Reader
+	gcm    cipher.AEAD
+	header []byte
+	buf    []byte
+	index  uint64
+	done   bool
+}
+
+// NewEncryptedReader returns a reader which decrypts a stream written by
+// NewEncryptedWriter, asking keys for whichever key it was written with.
+// Reads fail with ErrSnapshotCorrupt if the stream was tampered with,
+// truncated or encrypted with a different key.
+func NewEncryptedReader(r io.Reader, keys KeyProvider) (io.Reader, error) {
+	header := make([]byte, len(encryptedMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("encrypted header: %w", ErrSnapshotCorrupt)
+	}
+	if string(header[:len(encryptedMagic)]) != string(encryptedMagic) {
+		return nil, fmt.Errorf("encrypted header: %w", ErrSnapshotCorrupt)
+	}
+
+	keyID := make([]byte, header[len(encryptedMagic)])
+	if _, err := io.ReadFull(r, keyID); err != nil {
+		return nil, fmt.Errorf("encrypted header: %w", ErrSnapshotCorrupt)
+	}
+
+	gcm, err := newGCM(string(keyID), keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptedReader{
+		r:      r,
+		gcm:    gcm,
+		header: append(header, keyID...),
+	}, nil
+}
+
+func (e *encryptedReader) Read(p []byte) (int, error) {
+	for len(e.buf) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, e.buf)
+	e.buf = e.buf[n:]
+	return n, nil
+}
+
+// reads and decrypts the next chunk
+func (e *encryptedReader) open() error {
+	var length [4]byte
+	if _, err := io.ReadFull(e.r, length[:]); err != nil {
+		return fmt.Errorf("encrypted chunk %d missing: %w", e.index, ErrSnapshotCorrupt)
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size < uint32(e.gcm.NonceSize()+e.gcm.Overhead()) || size > encryptedChunkSize+1024 {
+		return fmt.Errorf("encrypted chunk %d: %w", e.index, ErrSnapshotCorrupt)
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(e.r, sealed); err != nil {
+		return fmt.Errorf("encrypted chunk %d truncated: %w", e.index, ErrSnapshotCorrupt)
+	}
+
+	nonce, ciphertext := sealed[:e.gcm.NonceSize()], sealed[e.gcm.NonceSize():]
+
+	// the writer doesn't record which chunk is last, so try both. Open
+	// can clobber its destination on failure, so never decrypt in place
+	for _, last := range []bool{false, true} {
+		plain, err := e.gcm.Open(nil, nonce, ciphertext, chunkData(e.header, e.index, last))
+		if err == nil {
+			e.buf = plain
+			e.done = last
+			e.index++
+			return nil
+		}
+	}
+
+	return fmt.Errorf("encrypted chunk %d failed authentication: %w", e.index, ErrSnapshotCorrupt)
+}
+
+// WriteEncryptedSnapshot writes the snapshot like WriteSnapshot, encrypted
+// with the key keyID.
+func WriteEncryptedSnapshot(w io.Writer, snapshot Snapshot, keyID string, keys KeyProvider) error {
+	encrypted, err := NewEncryptedWriter(w, keyID, keys)
+	if err != nil {
+		return err
+	}
+
+	if err := WriteSnapshot(encrypted, snapshot); err != nil {
+		return err
+	}
+
+	return encrypted.Close()
+}
+
+// ReadEncryptedSnapshot reads a snapshot written with
+// WriteEncryptedSnapshot.
+func ReadEncryptedSnapshot(r io.Reader, keys KeyProvider) (Snapshot, error) {
+	decrypted, err := NewEncryptedReader(r, keys)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	return ReadSnapshot(decrypted)
+}
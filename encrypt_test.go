@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestEncryptedSnapshot(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	keys := StaticKey("tenant-a", key)
+	snapshot := Snapshot{FrozenDatabase: newFrozenDatabase(buildBulkMetrics(0, 1000), nil), Sequence: 3}
+
+	buf := new(bytes.Buffer)
+	if err := WriteEncryptedSnapshot(buf, snapshot, "tenant-a", keys); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	encrypted := buf.Bytes()
+
+	read, err := ReadEncryptedSnapshot(bytes.NewReader(encrypted), keys)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if read.Count() != 1000 || read.Sequence != 3 || read.GetMedian() != snapshot.GetMedian() {
+		t.Fatalf("snapshot didn't round trip")
+	}
+
+	// the wrong key for the id
+	if _, err := ReadEncryptedSnapshot(bytes.NewReader(encrypted), StaticKey("tenant-a", make([]byte, 32))); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+
+	// a key which isn't available
+	if _, err := ReadEncryptedSnapshot(bytes.NewReader(encrypted), StaticKey("tenant-b", key)); err == nil {
+		t.Fatalf("expected an error for an unknown key")
+	}
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := ReadEncryptedSnapshot(bytes.NewReader(tampered), keys); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+}
+
+func TestEncryptedStreamChunks(t *testing.T) {
+	keys := StaticKey("k", bytes.Repeat([]byte{1}, 16))
+	plain := bytes.Repeat([]byte("multisort"), 3*encryptedChunkSize/9+5)
+
+	buf := new(bytes.Buffer)
+	writer, err := NewEncryptedWriter(buf, "k", keys)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	writer.Write(plain)
+	if err := writer.Close(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	encrypted := buf.Bytes()
+
+	reader, _ := NewEncryptedReader(bytes.NewReader(encrypted), keys)
+	decrypted, err := io.ReadAll(reader)
+	if err != nil || !bytes.Equal(decrypted, plain) {
+		t.Fatalf("stream didn't round trip: %v", err)
+	}
+
+	// dropping the last chunk must not look like a shorter stream
+	lastChunk := len(encrypted) - (4 + 12 + 16 + len(plain)%encryptedChunkSize)
+	reader, _ = NewEncryptedReader(bytes.NewReader(encrypted[:lastChunk]), keys)
+	if _, err := io.ReadAll(reader); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+)
+
+// errors returned across the database, worker and network layers. They may
+// be wrapped with additional context, so callers should compare them with
+// errors.Is rather than ==.
+var (
+	// the database or worker has been closed, or no longer accepts writes
+	ErrClosed = errors.New("closed")
+
+	// a write was rejected because there was no capacity to buffer it
+	ErrBufferFull = errors.New("buffer full")
+
+	// a query was made which can't be answered without any metrics
+	ErrEmpty = errors.New("empty")
+
+	// a query needs more metrics than have been written to be meaningful
+	ErrInsufficientData = errors.New("insufficient data")
+
+	// a metric was nil or carried a count which can't be stored
+	ErrInvalidMetric = errors.New("invalid metric")
+
+	// an operation didn't complete within its deadline
+	ErrTimeout = errors.New("timeout")
+
+	// persisted or transmitted data failed its integrity checks
+	ErrSnapshotCorrupt = errors.New("snapshot corrupt")
+
+	// a sequenced batch arrived before the batches preceding it
+	ErrSequenceGap = errors.New("sequence gap")
+
+	// no backend is registered under the requested name
+	ErrUnknownBackend = errors.New("unknown backend")
+
+	// a compressed stream, or a config, names a codec which isn't
+	// registered
+	ErrUnknownCodec = errors.New("unknown codec")
+
+	// a metric was timestamped further ahead of the clock than the skew
+	// tolerance allows
+	ErrClockSkew = errors.New("clock skew")
+
+	// a write would create a series beyond its tenant's quota
+	ErrSeriesQuota = errors.New("series quota")
+)
@@ -0,0 +1,36 @@
+package main
+
+// an Estimate is an answer from a database which may be approximate, along
+// with the range the true answer is guaranteed to lie in, so that callers
+// can display their confidence or allow for it in alerts. Exact answers
+// have a range of just the value itself.
+type Estimate struct {
+	Value int `json:"value"`
+	Low   int `json:"low"`
+	High  int `json:"high"`
+}
+
+// Exact reports whether the estimate is known to be the true answer.
+func (e Estimate) Exact() bool {
+	return e.Low == e.High
+}
+
+// MaxError returns the furthest the true answer can be from the value.
+func (e Estimate) MaxError() int {
+	if e.Value-e.Low > e.High-e.Value {
+		return e.Value - e.Low
+	}
+
+	return e.High - e.Value
+}
+
+// GetPercentileWithError returns the exact percentile as an Estimate, so
+// that snapshots can be used interchangeably with approximate backends.
+func (f *FrozenDatabase) GetPercentileWithError(p float64) (Estimate, error) {
+	if f.Count() == 0 {
+		return Estimate{}, ErrEmpty
+	}
+
+	value := f.GetPercentile(p)
+	return Estimate{Value: value, Low: value, High: value}, nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestGetPercentileWithError(t *testing.T) {
+	histogram := newTestHistogramDatabase(1, 100)
+	if _, err := histogram.GetPercentileWithError(0.5, 100); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	histogram.BulkWrite(buildBulkMetrics(0, 1000))
+
+	estimate, _ := histogram.GetPercentileWithError(0.99, 100)
+	if estimate != (Estimate{Value: 950, Low: 900, High: 999}) || estimate.MaxError() != 50 || estimate.Exact() {
+		t.Fatalf("unexpected estimate %+v", estimate)
+	}
+
+	// the true p99 is within the bounds
+	if exact, _ := histogram.GetPercentileWithError(0.99, 1); !exact.Exact() || exact.Value < estimate.Low || exact.Value > estimate.High {
+		t.Fatalf("unexpected exact estimate %+v", exact)
+	}
+
+	database := NewDegradingDatabase(DegradationPolicy{MaxDistinctValues: 500, Resolution: 10})
+	database.Open()
+	defer database.Close()
+
+	<-database.exact.BulkWriteAcked(buildBulkMetrics(0, 100))
+	if estimate, _ := database.GetPercentileWithError(0.5); estimate != (Estimate{Value: 49, Low: 49, High: 49}) {
+		t.Fatalf("expected an exact estimate before degrading, got %+v", estimate)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a TracedMetric is a metric observed while serving a traced request, so
+// that a percentile can be drilled down to example traces
+type TracedMetric interface {
+	Metric
+	TraceID() string
+}
+
+type tracedMetric struct {
+	value   int
+	traceID string
+}
+
+func (t tracedMetric) Value() int      { return t.value }
+func (t tracedMetric) TraceID() string { return t.traceID }
+
+// NewTracedMetric creates a metric carrying the ID of the trace it was
+// observed in.
+func NewTracedMetric(value int, traceID string) TracedMetric {
+	return tracedMetric{value: value, traceID: traceID}
+}
+
+// an Exemplar is a single traced metric kept as an example of its value
+type Exemplar struct {
+	Value   int       `json:"value"`
+	TraceID string    `json:"trace_id"`
+	Time    time.Time `json:"time"`
+}
+
+// a uniform sample of the traced metrics a worker has seen, kept with
+// reservoir sampling so that every traced metric is equally likely to be
+// an exemplar however many there have been
+type exemplarReservoir struct {
+	sync.Mutex
+
+	samples []Exemplar
+	size    int
+	seen    uint64
+	random  *rand.Rand
+}
+
+// WithExemplars keeps a reservoir of up to size traced metrics written to
+// the worker, see NewTracedMetric and WriteOpenMetricsSummary.
+func WithExemplars(size int) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.exemplars = &exemplarReservoir{
+			samples: make([]Exemplar, 0, size),
+			size:    size,
+			random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+		}
+	}
+}
+
+func (e *exemplarReservoir) add(exemplar Exemplar) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.seen++
+	if len(e.samples) < e.size {
+		e.samples = append(e.samples, exemplar)
+	} else if i := e.random.Int63n(int64(e.seen)); i < int64(e.size) {
+		e.samples[i] = exemplar
+	}
+}
+
+// Exemplars returns the reservoir of traced metrics, sorted by value. It is
+// empty unless the worker was created WithExemplars.
+func (b *BufferedWorker) Exemplars() []Exemplar {
+	if b.exemplars == nil {
+		return []Exemplar{}
+	}
+
+	b.exemplars.Lock()
+	defer b.exemplars.Unlock()
+
+	exemplars := append([]Exemplar{}, b.exemplars.samples...)
+	sort.SliceStable(exemplars, func(i, j int) bool {
+		return exemplars[i].Value < exemplars[j].Value
+	})
+
+	return exemplars
+}
+
+// returns the exemplar closest to value, preferring the latest of equally
+// close ones
+func nearestExemplar(exemplars []Exemplar, value int) (Exemplar, bool) {
+	best, found := Exemplar{}, false
+	for _, exemplar := range exemplars {
+		distance := abs(exemplar.Value - value)
+		if !found || distance < abs(best.Value-value) || (distance == abs(best.Value-value) && exemplar.Time.After(best.Time)) {
+			best, found = exemplar, true
+		}
+	}
+
+	return best, found
+}
+
+func abs(value int) int {
+	if value < 0 {
+		return -value
+	}
+
+	return value
+}
+
+// WriteOpenMetricsSummary renders the snapshot as a summary in the
+// OpenMetrics text format, with each quantile annotated with the exemplar
+// closest to its value, so a p99 spike can be followed to example traces:
+//
+//	api_latency{quantile="0.99"} 950 # {trace_id="4bf92f35"} 948 1700000000.123
+//
+// Exemplars on quantiles go beyond the OpenMetrics spec, which only
+// defines them for counters and histogram buckets, so only scrapers which
+// accept them should be sent this format. The exposition must still be
+// ended with "# EOF" once every family has been written.
+func WriteOpenMetricsSummary(w io.Writer, name, help string, labels map[string]string, snapshot Snapshot, quantiles []float64, exemplars []Exemplar) error {
+	if len(quantiles) == 0 {
+		quantiles = defaultSummaryQuantiles
+	}
+
+	values := make([]float64, 0, len(quantiles))
+	annotations := make([]string, 0, len(quantiles))
+	for _, quantile := range quantiles {
+		value := 0
+		if snapshot.Count() > 0 {
+			value = snapshot.GetPercentile(quantile)
+		}
+		values = append(values, float64(value))
+
+		annotation := ""
+		if exemplar, ok := nearestExemplar(exemplars, value); ok && snapshot.Count() > 0 {
+			annotation = fmt.Sprintf(` # {trace_id="%s"} %d %.3f`, escapeLabelValue(exemplar.TraceID), exemplar.Value,
+				float64(exemplar.Time.UnixMilli())/1000)
+		}
+		annotations = append(annotations, annotation)
+	}
+
+	return writeSummaryAnnotated(w, name, help, labels, quantiles, values, annotations, snapshot.Sum(), snapshot.Count())
+}
+
+// WithExemplarSource annotates the quantiles served on /metrics with
+// exemplars from source, eg: the BufferedWorker writing to the database,
+// for scrapers which accept OpenMetrics.
+func WithExemplarSource(source interface{ Exemplars() []Exemplar }) HandlerOption {
+	return func(h *handlerConfig) {
+		h.exemplars = source
+	}
+}
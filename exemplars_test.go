@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteOpenMetricsSummary(t *testing.T) {
+	snapshot := Snapshot{FrozenDatabase: newFrozenDatabase(buildBulkMetrics(1, 101), nil)}
+	observed := time.Unix(1700000000, 500*int64(time.Millisecond))
+	exemplars := []Exemplar{
+		{Value: 48, TraceID: "slow-start", Time: observed},
+		{Value: 52, TraceID: "median", Time: observed},
+		{Value: 97, TraceID: "tail", Time: observed},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := WriteOpenMetricsSummary(buf, "api_latency", "", map[string]string{"region": "eu"}, snapshot, []float64{0.5, 0.99}, exemplars); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `# TYPE api_latency summary
+api_latency{region="eu",quantile="0.5"} 50 # {trace_id="slow-start"} 48 1700000000.500
+api_latency{region="eu",quantile="0.99"} 99 # {trace_id="tail"} 97 1700000000.500
+api_latency_sum{region="eu"} 5050
+api_latency_count{region="eu"} 100
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
+
+func TestWorkerExemplars(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	worker := NewBufferedWorker(1000, time.Hour, database, WithExemplars(10))
+	worker.Start()
+	for i := 1; i <= 100; i++ {
+		worker.Write(NewTracedMetric(i, fmt.Sprintf("trace-%d", i)))
+		worker.Write(NewIntMetric(i))
+	}
+	worker.Stop()
+
+	exemplars := worker.Exemplars()
+	if len(exemplars) != 10 {
+		t.Fatalf("expected a reservoir of 10, got %d", len(exemplars))
+	}
+	for i, exemplar := range exemplars {
+		if exemplar.TraceID != fmt.Sprintf("trace-%d", exemplar.Value) || (i > 0 && exemplar.Value < exemplars[i-1].Value) {
+			t.Fatalf("unexpected exemplars %+v", exemplars)
+		}
+	}
+
+	// only scrapers which ask for OpenMetrics get exemplars
+	handler := NewHandler(database, WithExemplarSource(worker))
+	request := httptest.NewRequest("GET", "/metrics?name=api_latency", nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	if strings.Contains(recorder.Body.String(), "trace_id") {
+		t.Fatalf("expected no exemplars in the Prometheus format, got %s", recorder.Body.String())
+	}
+
+	request.Header.Set("Accept", "application/openmetrics-text; version=1.0.0")
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	body := recorder.Body.String()
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "application/openmetrics-text") || strings.Count(body, "# {trace_id=") != 3 || !strings.HasSuffix(body, "# EOF\n") {
+		t.Fatalf("expected exemplars in the OpenMetrics format, got %s", body)
+	}
+
+	if exemplars := NewBufferedWorker(1, time.Hour, database).Exemplars(); len(exemplars) != 0 {
+		t.Fatalf("expected no exemplars without a reservoir, got %+v", exemplars)
+	}
+}
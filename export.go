@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Distribution returns how many times each value was written between
+// since and until, sorted by value. Only the buckets still in the
+// retention keep their distribution, so older parts of the range are
+// missing, see SummariesBetween. Like Range, the range is rounded out to
+// the resolution.
+func (w *WindowedDatabase) Distribution(since, until time.Time) []ValueCount {
+	w.Lock()
+	defer w.Unlock()
+
+	metrics := w.between(since, until, until).metrics()
+	distribution := make([]ValueCount, 0, len(metrics))
+	for _, metric := range metrics {
+		distribution = append(distribution, ValueCount{Value: metric.Value(), Count: uint64(metric.Count())})
+	}
+
+	return distribution
+}
+
+// SummariesBetween returns a summary of each window with metrics written
+// between since and until, oldest first, see Summaries.
+func (w *WindowedDatabase) SummariesBetween(since, until time.Time) []WindowSummary {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.summaries(since, until)
+}
+
+// parses the since and until parameters of a request, where until
+// defaults to now
+func parseTimeRange(r *http.Request) (time.Time, time.Time, error) {
+	since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("since must be an RFC 3339 time")
+	}
+
+	until := time.Now()
+	if raw := r.URL.Query().Get("until"); raw != "" {
+		if until, err = time.Parse(time.RFC3339, raw); err != nil || until.Before(since) {
+			return time.Time{}, time.Time{}, fmt.Errorf("until must be an RFC 3339 time after since")
+		}
+	}
+
+	return since, until, nil
+}
+
+func writeDistributionCSV(w io.Writer, distribution []ValueCount) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"value", "count"})
+	for _, point := range distribution {
+		writer.Write([]string{strconv.Itoa(point.Value), strconv.FormatUint(point.Count, 10)})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+func writeSummariesCSV(w io.Writer, summaries []WindowSummary) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"start", "end", "count", "median", "p90", "p99"})
+	for _, summary := range summaries {
+		writer.Write([]string{
+			summary.Start.Format(time.RFC3339),
+			summary.End.Format(time.RFC3339),
+			strconv.Itoa(summary.Count),
+			strconv.Itoa(summary.Median),
+			strconv.Itoa(summary.P90),
+			strconv.Itoa(summary.P99),
+		})
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// serves the distribution or the summaries of a windowed database between
+// since and until, as JSON or CSV
+func exportHandler(database Database) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		windowed, ok := database.(interface {
+			Distribution(time.Time, time.Time) []ValueCount
+			SummariesBetween(time.Time, time.Time) []WindowSummary
+		})
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T isn't windowed", database), http.StatusNotImplemented)
+			return
+		}
+
+		since, until, err := parseTimeRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		format := r.URL.Query().Get("format")
+		if format != "" && format != "json" && format != "csv" {
+			http.Error(w, "format must be json or csv", http.StatusBadRequest)
+			return
+		}
+
+		switch kind := r.URL.Query().Get("kind"); kind {
+		case "", "distribution":
+			distribution := windowed.Distribution(since, until)
+			if format == "csv" {
+				w.Header().Set("Content-Type", "text/csv")
+				writeDistributionCSV(w, distribution)
+				return
+			}
+			writeJSON(w, distribution)
+		case "summaries":
+			summaries := windowed.SummariesBetween(since, until)
+			if format == "csv" {
+				w.Header().Set("Content-Type", "text/csv")
+				writeSummariesCSV(w, summaries)
+				return
+			}
+			writeJSON(w, summaries)
+		default:
+			http.Error(w, "kind must be distribution or summaries", http.StatusBadRequest)
+		}
+	}
+}
+
+func init() {
+	commands["export"] = command{
+		usage: "export a server's distribution or summaries for a time range, eg: -from 2024-01-01T00:00:00Z -kind summaries",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("export", flag.ContinueOnError)
+			server := flags.String("url", "http://localhost:8080", "where the database's handler is served")
+			from := flags.String("from", "", "the RFC 3339 time to export from, or a duration back from now, eg: 24h")
+			to := flags.String("to", "", "the RFC 3339 time to export until, by default now")
+			kind := flags.String("kind", "distribution", "what to export, distribution or summaries")
+			format := flags.String("format", "csv", "the output format, csv or json")
+			output := flags.String("o", "", "the file to write to, by default stdout")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+
+			since := *from
+			if ago, err := time.ParseDuration(*from); err == nil {
+				since = time.Now().Add(-ago).Format(time.RFC3339)
+			} else if since == "" {
+				return fmt.Errorf("expected -from")
+			}
+
+			values := url.Values{"since": {since}, "kind": {*kind}, "format": {*format}}
+			if *to != "" {
+				values.Set("until", *to)
+			}
+
+			resp, err := http.Get(strings.TrimSuffix(*server, "/") + "/export?" + values.Encode())
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+			}
+
+			var w io.Writer = os.Stdout
+			if *output != "" {
+				file, err := os.Create(*output)
+				if err != nil {
+					return err
+				}
+				defer file.Close()
+				w = file
+			}
+
+			_, err = io.Copy(w, resp.Body)
+			return err
+		},
+	}
+}
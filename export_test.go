@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) {
+	clock := newTestClock()
+	clock.advance(3 * time.Minute)
+	start := clock.now()
+
+	database := newTestWindowedDatabase(time.Minute, 5*time.Minute, WithDownsampling(5*time.Minute, time.Hour))
+	database.now = clock.now
+	for i := 0; i < 15; i++ {
+		database.BulkWrite([]*BulkMetric{{value: i, count: 10}})
+		if i < 14 {
+			clock.advance(time.Minute)
+		}
+	}
+
+	// only the buckets in the retention keep their distribution
+	distribution := database.Distribution(start, clock.now())
+	if len(distribution) != 6 || distribution[0] != (ValueCount{Value: 9, Count: 10}) || distribution[5].Value != 14 {
+		t.Fatalf("unexpected distribution %+v", distribution)
+	}
+
+	// the two downsampled intervals, then the first bucket in the
+	// retention
+	summaries := database.SummariesBetween(start, start.Add(10*time.Minute))
+	if len(summaries) != 3 || !summaries[0].Start.Equal(start) || !summaries[2].Start.Equal(start.Add(9*time.Minute)) {
+		t.Fatalf("unexpected summaries %+v", summaries)
+	}
+
+	since, until := start.Format(time.RFC3339), clock.now().Format(time.RFC3339)
+	recorder := httptest.NewRecorder()
+	NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/export?kind=summaries&format=csv&since="+since+"&until="+until, nil))
+	lines := strings.Split(strings.TrimSpace(recorder.Body.String()), "\n")
+	if recorder.Code != 200 || len(lines) != 8 || lines[0] != "start,end,count,median,p90,p99" {
+		t.Fatalf("unexpected export %d %q", recorder.Code, recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/export?since="+since, nil))
+	exported := []ValueCount{}
+	if err := json.NewDecoder(recorder.Body).Decode(&exported); err != nil || len(exported) != 6 {
+		t.Fatalf("unexpected export %v %+v", err, exported)
+	}
+
+	for _, query := range []string{"kind=raw&since=" + since, "format=xml&since=" + since, "since=yesterday"} {
+		recorder = httptest.NewRecorder()
+		NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/export?"+query, nil))
+		if recorder.Code != 400 {
+			t.Fatalf("expected %s to be rejected, got %d", query, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+type RegistryOption func(*Registry)
+
+// WithConcurrency bounds how many databases registry wide operations, eg:
+// Stats, Query and SnapshotAll, touch at once. By default it is
+// GOMAXPROCS, so a process with thousands of series takes its snapshots a
+// few at a time rather than all at once.
+func WithConcurrency(concurrency int) RegistryOption {
+	return func(r *Registry) {
+		if concurrency > 0 {
+			r.concurrency = concurrency
+		}
+	}
+}
+
+// calls fn with every named database which is still registered, on at
+// most the registry's concurrency goroutines at once. fn is passed the
+// index of the name, so results can be kept in the same order.
+func (r *Registry) each(names []string, fn func(i int, name string, database Database)) {
+	workers := min(r.concurrency, len(names))
+	if workers <= 1 {
+		for i, name := range names {
+			if database, ok := r.Get(name); ok {
+				fn(i, name, database)
+			}
+		}
+		return
+	}
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for worker := 0; worker < workers; worker++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if database, ok := r.Get(names[i]); ok {
+					fn(i, names[i], database)
+				}
+			}
+		}()
+	}
+
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
+
+// a SeriesSnapshot is the snapshot of a single registered database, or why
+// it couldn't be taken
+type SeriesSnapshot struct {
+	Name     string
+	Snapshot Snapshot
+	Err      error
+}
+
+// SnapshotAll snapshots every registered database which supports
+// snapshots, sorted by name, see WithConcurrency.
+func (r *Registry) SnapshotAll() []SeriesSnapshot {
+	names := r.Names()
+	snapshots := make([]SeriesSnapshot, len(names))
+	r.each(names, func(i int, name string, database Database) {
+		snapshot, err := querySnapshot(name, database, 0)
+		snapshots[i] = SeriesSnapshot{Name: name, Snapshot: snapshot, Err: err}
+	})
+
+	taken := make([]SeriesSnapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		// skipped for being unregistered, or unable to snapshot at all
+		if snapshot.Name == "" || errors.Is(snapshot.Err, errUnsupportedQuery) {
+			continue
+		}
+		taken = append(taken, snapshot)
+	}
+
+	return taken
+}
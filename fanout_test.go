@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a database which counts how many snapshots of it and its siblings are
+// being taken at once
+type countingSnapshotter struct {
+	*SyncMedianDatabase
+	inFlight    *int32
+	maxInFlight *int32
+}
+
+func (c *countingSnapshotter) Snapshot() (Snapshot, error) {
+	current := atomic.AddInt32(c.inFlight, 1)
+	defer atomic.AddInt32(c.inFlight, -1)
+	for {
+		max := atomic.LoadInt32(c.maxInFlight)
+		if current <= max || atomic.CompareAndSwapInt32(c.maxInFlight, max, current) {
+			break
+		}
+	}
+
+	time.Sleep(time.Millisecond)
+	return c.SyncMedianDatabase.Snapshot()
+}
+
+func TestRegistryConcurrency(t *testing.T) {
+	inFlight, maxInFlight := int32(0), int32(0)
+	registry := NewRegistry(WithConcurrency(3))
+	for i := 0; i < 20; i++ {
+		database := &countingSnapshotter{NewSyncMedianDatabase(), &inFlight, &maxInFlight}
+		database.BulkWrite(buildBulkMetrics(i, i+1))
+		registry.Register(fmt.Sprintf("latency{shard=%02d}", i), database)
+	}
+	// databases which can't be snapshotted are skipped
+	registry.Register("unsnapshotted", newMockDatabase(t, nil))
+
+	snapshots := registry.SnapshotAll()
+	if len(snapshots) != 20 {
+		t.Fatalf("expected 20 snapshots, got %d", len(snapshots))
+	}
+	for i, snapshot := range snapshots {
+		if snapshot.Name != fmt.Sprintf("latency{shard=%02d}", i) || snapshot.Err != nil || snapshot.Snapshot.GetMedian() != i {
+			t.Fatalf("unexpected snapshot %d: %+v", i, snapshot)
+		}
+	}
+	if maxInFlight > 3 {
+		t.Fatalf("expected at most 3 snapshots at once, got %d", maxInFlight)
+	}
+
+	// queries merge every series, in the same order, however they were taken
+	result, err := registry.Query(Query{Selector: Selector{Name: "latency"}, Quantiles: []float64{0.5}})
+	if err != nil || result.Count != 20 || len(result.Series) != 20 || result.Series[19] != "latency{shard=19}" {
+		t.Fatalf("unexpected result %+v: %v", result, err)
+	}
+	if maxInFlight > 3 {
+		t.Fatalf("expected at most 3 snapshots at once, got %d", maxInFlight)
+	}
+}
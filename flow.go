@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// writes are flow controlled with credits: a handler created
+// WithWriteCredits has a pool of credits, one per metric, which each write
+// takes for as long as it is being applied. Every response to a write
+// advertises the credits left in the header below, and a write which
+// needs more credits than are left is rejected with 429 and a Retry-After,
+// so clients know to back off and buffer or sample locally rather than
+// finding out from timeouts.
+const creditsHeader = "X-Write-Credits"
+
+type creditPool struct {
+	sync.Mutex
+
+	total      int
+	available  int
+	retryAfter time.Duration
+}
+
+// takes credits for n metrics, if there are enough. A write larger than
+// the whole pool is let through once the pool is idle, otherwise it could
+// never be written at all.
+func (c *creditPool) acquire(n int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if n > c.available && (n <= c.total || c.available < c.total) {
+		return false
+	}
+
+	c.available -= n
+	return true
+}
+
+func (c *creditPool) release(n int) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.available += n
+}
+
+func (c *creditPool) remaining() int {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.available < 0 {
+		return 0
+	}
+
+	return c.available
+}
+
+// the Retry-After header value, in whole seconds
+func (c *creditPool) retryAfterHeader() string {
+	return retryAfterSeconds(c.retryAfter)
+}
+
+// the Retry-After header value for a wait, rounded up to whole seconds
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	return strconv.Itoa(seconds)
+}
+
+type handlerConfig struct {
+	credits *creditPool
+
+	// annotates /metrics, if set, see WithExemplarSource
+	exemplars interface{ Exemplars() []Exemplar }
+
+	// records every written batch, if set, see WithProvenance
+	provenance *ProvenanceLog
+}
+
+type HandlerOption func(*handlerConfig)
+
+// WithWriteCredits flow controls writes to at most credits metrics being
+// applied at once. Clients which are refused are asked to retry after
+// retryAfter.
+func WithWriteCredits(credits int, retryAfter time.Duration) HandlerOption {
+	return func(h *handlerConfig) {
+		h.credits = &creditPool{
+			total:      credits,
+			available:  credits,
+			retryAfter: retryAfter,
+		}
+	}
+}
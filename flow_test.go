@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteCredits(t *testing.T) {
+	entered := make(chan bool)
+	release := make(chan bool)
+	database := newMockDatabase(t, func(metrics []*BulkMetric) {
+		if len(metrics) == 8 {
+			entered <- true
+			<-release
+		}
+	})
+
+	server := httptest.NewServer(NewHandler(database, WithWriteCredits(10, time.Second)))
+	defer server.Close()
+
+	// a slow write holds 8 of the 10 credits
+	slow := NewClient(server.URL)
+	done := make(chan error)
+	go func() {
+		done <- slow.BulkWrite(buildBulkMetrics(0, 8))
+	}()
+	<-entered
+
+	fast := NewClient(server.URL)
+	if err := fast.BulkWrite(buildBulkMetrics(0, 5)); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+	if !fast.Throttled() || fast.Credits() != 2 {
+		t.Fatalf("expected to be throttled with 2 credits, got %v with %d", fast.Throttled(), fast.Credits())
+	}
+
+	release <- true
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// back off without a round trip until the server's retry after
+	if err := fast.BulkWrite(buildBulkMetrics(0, 5)); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+	fast.blockedUntil = time.Now()
+	if err := fast.BulkWrite(buildBulkMetrics(0, 5)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if fast.Credits() != 10 {
+		t.Fatalf("expected 10 credits once idle, got %d", fast.Credits())
+	}
+
+	// a write larger than every credit still goes through once idle
+	if err := fast.BulkWrite(buildBulkMetrics(0, 20)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestBatchingClientHoldsFlushesWhileThrottled(t *testing.T) {
+	written := make(chan int, 10)
+	database := newMockDatabase(t, func(metrics []*BulkMetric) {
+		written <- len(metrics)
+	})
+
+	server := httptest.NewServer(NewHandler(database, WithWriteCredits(10, time.Second)))
+	defer server.Close()
+
+	worker := NewBatchingClient(server.URL, 2, time.Hour)
+	client := worker.database.(*Client)
+	client.blockedUntil = time.Now().Add(time.Hour)
+
+	// full buffers aren't flushed while the server is pushing back
+	for i := 0; i < 5; i++ {
+		worker.Write(NewIntMetric(i))
+	}
+	select {
+	case <-written:
+		t.Fatalf("expected flushes to be held")
+	default:
+	}
+
+	client.Lock()
+	client.blockedUntil = time.Time{}
+	client.Unlock()
+	worker.Write(NewIntMetric(5))
+	if count := <-written; count != 6 {
+		t.Fatalf("expected everything buffered to be flushed at once, got %d", count)
+	}
+	worker.Stop()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// the flushes a worker queues for its database by default, beyond which
+// the overflow policy applies
+const defaultFlushQueueDepth = 16
+
+// a FlushOverflowPolicy decides what a worker does with a flush when its
+// flush queue is full, ie: when the database has fallen behind
+type FlushOverflowPolicy int
+
+const (
+	// the worker waits for room in the queue, and writes wait on the
+	// worker, pushing back on writers
+	BlockFlushes FlushOverflowPolicy = iota
+	// the flush is dropped, and its metrics are lost. Writes never
+	// wait on the database, acks are sent ErrBufferFull and the drop is
+	// reported on Errors.
+	DropFlushes
+)
+
+// WithFlushQueue bounds the flushes waiting to be applied to the database
+// at depth, and sets what happens to flushes once it is full. Flushes are
+// applied one at a time, in order, by a single goroutine, so a stalled
+// database holds on to the flush it is applying and at most depth more,
+// rather than a goroutine and a batch per flush. Stop waits for whatever
+// is still queued to be applied, unless it is called while a flush is
+// being applied, eg: by the database or a hook, in which case the rest are
+// applied once that flush returns. By default the depth is 16 and flushes
+// block.
+func WithFlushQueue(depth int, policy FlushOverflowPolicy) WorkerOption {
+	return func(b *BufferedWorker) {
+		if depth < 1 {
+			depth = 1
+		}
+
+		b.flushQueueDepth = depth
+		b.flushOverflow = policy
+	}
+}
+
+// a buffer handed to the flusher, along with the acks waiting on it
+type flushJob struct {
+	metrics      []*BulkMetric
+	acks         []chan error
+	info         FlushInfo
+	correlations []string
+}
+
+// applies queued flushes until the queue is closed
+func (b *BufferedWorker) flusher(queue <-chan flushJob) {
+	for job := range queue {
+		atomic.StoreInt32(&b.applying, 1)
+		b.apply(job)
+		atomic.StoreInt32(&b.applying, 0)
+	}
+}
+
+// reports whether the flusher is applying a flush, in which case Stop
+// mustn't wait on it: the database or a hook may be the one calling Stop
+func (b *BufferedWorker) flushApplying() bool {
+	return atomic.LoadInt32(&b.applying) == 1
+}
+
+func (b *BufferedWorker) apply(job flushJob) {
+	start := time.Now()
+	// the buffer holds a single metric per value, so once sorted the
+	// database doesn't need to sort or merge them
+	sort.Sort(BulkMetrics(job.metrics))
+	err := b.named(applyBulkWrite(b.database, job.metrics, job.correlations))
+	b.admission.flushFinished(time.Since(start))
+	atomic.StoreInt64(&b.lastFlushTook, int64(time.Since(start)))
+
+	b.finish(job, err, time.Since(start))
+}
+
+// acknowledges the flush and passes it to the after flush hook
+func (b *BufferedWorker) finish(job flushJob, err error, took time.Duration) {
+	for _, ack := range job.acks {
+		ack <- err
+	}
+
+	if b.afterFlush != nil {
+		job.info.Duration = took
+		job.info.Err = err
+		b.afterFlush(job.info)
+	}
+}
+
+// queues the flush according to the overflow policy
+func (b *BufferedWorker) queueFlush(queue chan<- flushJob, job flushJob) {
+	if b.flushOverflow == DropFlushes {
+		select {
+		case queue <- job:
+			b.admission.flushStarted()
+			b.checkFlushQueue()
+		default:
+			err := b.named(correlated(fmt.Errorf("flush queue full, dropped %d metrics: %w", job.info.Count, ErrBufferFull), job.correlations))
+			reportError(b.errCh, err)
+			b.finish(job, err, 0)
+		}
+		return
+	}
+
+	// counted before it is queued, so the flusher can't finish it first
+	b.admission.flushStarted()
+	b.checkFlushQueue()
+	queue <- job
+}
+
+// warns if the flushes waiting on the database near the queue's depth
+func (b *BufferedWorker) checkFlushQueue() {
+	b.softLimit.check("flush queue", b.name, int(atomic.LoadInt64(&b.admission.pendingFlushes)), b.flushQueueDepth)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a database which blocks every write until it is released
+type stalledDatabase struct {
+	release chan struct{}
+	applied chan int
+}
+
+func newStalledDatabase() *stalledDatabase {
+	return &stalledDatabase{
+		release: make(chan struct{}),
+		applied: make(chan int, 10000),
+	}
+}
+
+func (s *stalledDatabase) Open()          {}
+func (s *stalledDatabase) Close()         {}
+func (s *stalledDatabase) GetMedian() int { return 0 }
+
+func (s *stalledDatabase) BulkWrite(metrics []*BulkMetric) error {
+	<-s.release
+	for _, metric := range metrics {
+		s.applied <- metric.Count()
+	}
+	return nil
+}
+
+func TestFlushQueueDropsWhenFull(t *testing.T) {
+	database := newStalledDatabase()
+	goroutines := runtime.NumGoroutine()
+
+	// every write is flushed straight away
+	worker := NewBufferedWorker(1, time.Hour, database, WithFlushQueue(4, DropFlushes))
+	worker.Start()
+
+	acks := make([]<-chan error, 0, 1000)
+	for i := 0; i < 1000; i++ {
+		acks = append(acks, worker.WriteAcked(NewIntMetric(i)))
+	}
+	if extra := runtime.NumGoroutine() - goroutines; extra > 2 {
+		t.Fatalf("expected the worker and its flusher only, got %d goroutines", extra)
+	}
+
+	// the worker may not have got to the last write yet
+	time.Sleep(50 * time.Millisecond)
+	close(database.release)
+	worker.Stop()
+
+	// four flushes queued, and one more if the flusher took the first
+	// before the rest arrived
+	applied, dropped := 0, 0
+	for _, ack := range acks {
+		if err := <-ack; errors.Is(err, ErrBufferFull) {
+			dropped++
+		} else if err == nil {
+			applied++
+		}
+	}
+	if applied < 4 || applied > 5 || applied+dropped != 1000 {
+		t.Fatalf("expected 4 or 5 flushes applied and the rest dropped, got %d and %d", applied, dropped)
+	}
+	if len(database.applied) != applied {
+		t.Fatalf("expected %d metrics in the database, got %d", applied, len(database.applied))
+	}
+}
+
+func TestFlushQueueBlocksWhenFull(t *testing.T) {
+	database := newStalledDatabase()
+	worker := NewBufferedWorker(1, time.Hour, database, WithFlushQueue(2, BlockFlushes))
+	worker.Start()
+
+	written := make(chan (<-chan error), 10)
+	go func() {
+		for i := 0; i < 10; i++ {
+			written <- worker.WriteAcked(NewIntMetric(i))
+		}
+	}()
+
+	// one flush is being applied, if the flusher got to it, and two are
+	// queued, and the worker waits to hand over the next, which holds up
+	// the write after it
+	time.Sleep(50 * time.Millisecond)
+	if len(written) < 3 || len(written) > 4 {
+		t.Fatalf("expected writes to be held up after 3 or 4, got %d", len(written))
+	}
+
+	// nothing is lost once the database recovers
+	close(database.release)
+	for i := 0; i < 10; i++ {
+		if err := <-<-written; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	worker.Stop()
+	if len(database.applied) != 10 {
+		t.Fatalf("expected every write to be applied, got %d", len(database.applied))
+	}
+}
+
+// a stalled database which records the most writes it applied at once
+type overlapDatabase struct {
+	*stalledDatabase
+	writing, overlap int32
+}
+
+func (o *overlapDatabase) BulkWrite(metrics []*BulkMetric) error {
+	writing := atomic.AddInt32(&o.writing, 1)
+	defer atomic.AddInt32(&o.writing, -1)
+	for {
+		overlap := atomic.LoadInt32(&o.overlap)
+		if writing <= overlap || atomic.CompareAndSwapInt32(&o.overlap, overlap, writing) {
+			break
+		}
+	}
+
+	return o.stalledDatabase.BulkWrite(metrics)
+}
+
+func TestStopWaitsForTheFlusher(t *testing.T) {
+	database := &overlapDatabase{stalledDatabase: newStalledDatabase()}
+	close(database.release)
+	worker := NewBufferedWorker(2, time.Hour, database)
+	worker.Start()
+
+	// the flushes are applied and the last write is still buffered when
+	// Stop is called
+	var ack <-chan error
+	for i := 0; i < 99; i++ {
+		if i == 97 {
+			ack = worker.WriteAcked(NewIntMetric(i))
+		} else {
+			worker.Write(NewIntMetric(i))
+		}
+	}
+	if err := <-ack; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for worker.flushApplying() {
+		time.Sleep(time.Millisecond)
+	}
+	worker.Stop()
+
+	if len(database.applied) != 99 {
+		t.Fatalf("expected every write applied by the time Stop returned, got %d", len(database.applied))
+	}
+	if overlap := atomic.LoadInt32(&database.overlap); overlap != 1 {
+		t.Fatalf("expected flushes to be applied one at a time, got %d at once", overlap)
+	}
+}
+
+func TestStopDuringAFlush(t *testing.T) {
+	database := &overlapDatabase{stalledDatabase: newStalledDatabase()}
+	worker := NewBufferedWorker(2, time.Hour, database)
+	worker.Start()
+
+	// the first flush is stalled in the database while the last write is
+	// still buffered when Stop is called, so Stop can't tell it apart
+	// from the database stopping the worker and doesn't wait
+	first := worker.WriteAcked(NewIntMetric(1))
+	worker.Write(NewIntMetric(2))
+	last := worker.WriteAcked(NewIntMetric(3))
+	for atomic.LoadInt32(&database.writing) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	worker.Stop()
+
+	// the rest are applied, in order, once the stalled flush returns
+	close(database.release)
+	for _, ack := range []<-chan error{first, last} {
+		if err := <-ack; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(database.applied) != 3 {
+		t.Fatalf("expected every write applied, got %d", len(database.applied))
+	}
+	if overlap := atomic.LoadInt32(&database.overlap); overlap != 1 {
+		t.Fatalf("expected flushes to be applied one at a time, got %d at once", overlap)
+	}
+}
+
+func TestStopFromAFlush(t *testing.T) {
+	database := newStalledDatabase()
+	close(database.release)
+
+	var worker *BufferedWorker
+	flushed := make(chan FlushInfo, 10)
+	worker = NewBufferedWorker(1, time.Hour, database, WithAfterFlush(func(info FlushInfo) {
+		if info.Count > 0 && len(flushed) == 0 {
+			worker.Stop()
+		}
+		flushed <- info
+	}))
+	worker.Start()
+
+	worker.Write(NewIntMetric(1))
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected Stop from the after flush hook not to deadlock")
+	}
+	if err := worker.Write(NewIntMetric(2)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected the worker to be stopped, got %v", err)
+	}
+}
+
+// reports how many goroutines and how much memory a worker holds on to
+// while its database is stalled, which stay flat however many flushes
+// back up
+func BenchmarkBufferedWorkerStalledDatabase(b *testing.B) {
+	database := newStalledDatabase()
+	goroutines := runtime.NumGoroutine()
+
+	worker := NewBufferedWorker(100, time.Hour, database, WithFlushQueue(16, DropFlushes))
+	worker.Start()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		worker.Write(NewIntMetric(i % 1000))
+	}
+	b.StopTimer()
+
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(runtime.NumGoroutine()-goroutines), "goroutines")
+	b.ReportMetric(float64(int64(after.HeapInuse)-int64(before.HeapInuse))/1024, "heap-KiB")
+
+	close(database.release)
+	worker.Stop()
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// a frame log is a file of wire format frames, eg: a segment of writes to
+// replay on startup. Each frame carries its own checksum, and the log is
+// laid out as:
+//
+//	[4]byte "MSL1"
+//	frames
+//	[4]byte "MSLF"
+//	uint64  number of frames (big endian)
+//	uint32  crc32 (IEEE) of every frame's bytes (big endian)
+//
+// the footer is only written when the log is closed cleanly, so a log
+// without one was torn, eg: by a crash part way through a write.
+
+var (
+	frameLogMagic  = []byte("MSL1")
+	frameLogFooter = []byte("MSLF")
+)
+
+const frameLogFooterSize = 16
+
+type FrameLogWriter struct {
+	w      io.Writer
+	crc    hash.Hash32
+	frames uint64
+	err    error
+}
+
+// NewFrameLogWriter writes the log's header to w.
+func NewFrameLogWriter(w io.Writer) (*FrameLogWriter, error) {
+	if _, err := w.Write(frameLogMagic); err != nil {
+		return nil, err
+	}
+
+	return &FrameLogWriter{
+		w:   w,
+		crc: crc32.NewIEEE(),
+	}, nil
+}
+
+// Append writes a frame to the log. Once a write has failed the log can't
+// be trusted, so every later call returns the same error.
+func (f *FrameLogWriter) Append(frame Frame) error {
+	if f.err != nil {
+		return f.err
+	}
+
+	encoded := EncodeFrame(frame)
+	if _, err := f.w.Write(encoded); err != nil {
+		f.err = err
+		return err
+	}
+
+	f.crc.Write(encoded)
+	f.frames++
+	return nil
+}
+
+// Close writes the footer, it doesn't close the underlying writer.
+func (f *FrameLogWriter) Close() error {
+	if f.err != nil {
+		return f.err
+	}
+
+	footer := make([]byte, frameLogFooterSize)
+	copy(footer, frameLogFooter)
+	binary.BigEndian.PutUint64(footer[4:12], f.frames)
+	binary.BigEndian.PutUint32(footer[12:], f.crc.Sum32())
+
+	_, f.err = f.w.Write(footer)
+	if f.err == nil {
+		f.err = ErrClosed
+		return nil
+	}
+
+	return f.err
+}
+
+// a CorruptRegion is a run of bytes in a frame log which didn't decode to
+// valid frames
+type CorruptRegion struct {
+	Offset int64
+	Length int64
+}
+
+type FrameLogRecovery struct {
+	// every frame which passed its checksum, in the order they were
+	// written
+	Frames  []Frame
+	Corrupt []CorruptRegion
+
+	// whether the footer was found and matched the frames, which is only
+	// true if nothing was lost
+	Complete bool
+}
+
+// Skipped returns the number of bytes which were skipped as corrupt.
+func (f FrameLogRecovery) Skipped() int64 {
+	skipped := int64(0)
+	for _, region := range f.Corrupt {
+		skipped += region.Length
+	}
+
+	return skipped
+}
+
+// RecoverFrameLog reads every valid frame from a frame log. Rather than
+// stopping at the first corrupt frame, it scans forward for the next one
+// which passes its checksum, reporting the bytes it skipped, so that a
+// single bad sector or torn write doesn't lose the rest of the log. An
+// error is only returned if r can't be read or isn't a frame log at all.
+func RecoverFrameLog(r io.Reader) (FrameLogRecovery, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return FrameLogRecovery{}, err
+	}
+	if !bytes.HasPrefix(data, frameLogMagic) {
+		return FrameLogRecovery{}, fmt.Errorf("missing frame log header: %w", ErrSnapshotCorrupt)
+	}
+
+	recovery := FrameLogRecovery{
+		Frames:  make([]Frame, 0),
+		Corrupt: make([]CorruptRegion, 0),
+	}
+	crc := crc32.NewIEEE()
+
+	corruptFrom := -1
+	markValid := func(pos int) {
+		if corruptFrom >= 0 {
+			recovery.Corrupt = append(recovery.Corrupt, CorruptRegion{
+				Offset: int64(corruptFrom),
+				Length: int64(pos - corruptFrom),
+			})
+			corruptFrom = -1
+		}
+	}
+
+	pos := len(frameLogMagic)
+	for pos < len(data) {
+		if len(data)-pos == frameLogFooterSize && bytes.HasPrefix(data[pos:], frameLogFooter) {
+			markValid(pos)
+			footer := data[pos:]
+			recovery.Complete = len(recovery.Corrupt) == 0 &&
+				binary.BigEndian.Uint64(footer[4:12]) == uint64(len(recovery.Frames)) &&
+				binary.BigEndian.Uint32(footer[12:]) == crc.Sum32()
+			return recovery, nil
+		}
+
+		frame, n, ok := parseFrame(data[pos:])
+		if !ok {
+			if corruptFrom < 0 {
+				corruptFrom = pos
+			}
+			pos++
+			continue
+		}
+
+		markValid(pos)
+		crc.Write(data[pos : pos+n])
+		recovery.Frames = append(recovery.Frames, frame)
+		pos += n
+	}
+
+	markValid(pos)
+	return recovery, nil
+}
+
+// ReadFrameLog reads every frame from a frame log, failing if any part of
+// it is corrupt or it was never closed.
+func ReadFrameLog(r io.Reader) ([]Frame, error) {
+	recovery, err := RecoverFrameLog(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(recovery.Corrupt) > 0 {
+		region := recovery.Corrupt[0]
+		return nil, fmt.Errorf("%d bytes at offset %d: %w", region.Length, region.Offset, ErrSnapshotCorrupt)
+	}
+	if !recovery.Complete {
+		return nil, fmt.Errorf("frame log footer missing or mismatched: %w", ErrSnapshotCorrupt)
+	}
+
+	return recovery.Frames, nil
+}
+
+// decodes the frame at the start of data, returning its encoded length
+func parseFrame(data []byte) (Frame, int, bool) {
+	if len(data) < 8 {
+		return Frame{}, 0, false
+	}
+
+	length := binary.BigEndian.Uint32(data)
+	if length > maxFrameSize || uint64(len(data)) < uint64(length)+8 {
+		return Frame{}, 0, false
+	}
+
+	payload := data[4 : 4+length]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(data[4+length:]) {
+		return Frame{}, 0, false
+	}
+
+	frame, err := decodePayload(payload)
+	if err != nil {
+		return Frame{}, 0, false
+	}
+
+	// a checksum can collide on garbage, so never trust a count which
+	// couldn't have been written
+	for _, metric := range frame.Metrics {
+		if metric.Count() < 1 {
+			return Frame{}, 0, false
+		}
+	}
+
+	return frame, int(length) + 8, true
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func writeTestFrameLog(t *testing.T, frames int, close bool) []byte {
+	buf := new(bytes.Buffer)
+	log, err := NewFrameLogWriter(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i := 0; i < frames; i++ {
+		if err := log.Append(Frame{Sequence: uint64(i + 1), Metrics: buildBulkMetrics(i*10, i*10+10)}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	if close {
+		if err := log.Close(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := log.Append(Frame{}); !errors.Is(err, ErrClosed) {
+			t.Fatalf("expected ErrClosed, got %v", err)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+func TestFrameLogRoundTrip(t *testing.T) {
+	data := writeTestFrameLog(t, 3, true)
+
+	frames, err := ReadFrameLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(frames))
+	}
+	for i, frame := range frames {
+		if frame.Sequence != uint64(i+1) || len(frame.Metrics) != 10 || frame.Metrics[0].Value() != i*10 {
+			t.Fatalf("unexpected frame %+v", frame)
+		}
+	}
+}
+
+func TestFrameLogRecoversAroundCorruption(t *testing.T) {
+	data := writeTestFrameLog(t, 3, true)
+	frameSize := len(EncodeFrame(Frame{Sequence: 1, Metrics: buildBulkMetrics(0, 10)}))
+
+	// flip a bit in the middle of the second frame
+	data[len(frameLogMagic)+frameSize+frameSize/2] ^= 0x01
+
+	if _, err := ReadFrameLog(bytes.NewReader(data)); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+
+	recovery, err := RecoverFrameLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recovery.Frames) != 2 || recovery.Frames[0].Sequence != 1 || recovery.Frames[1].Sequence != 3 {
+		t.Fatalf("unexpected frames %+v", recovery.Frames)
+	}
+	if recovery.Complete {
+		t.Fatalf("expected an incomplete recovery")
+	}
+	if len(recovery.Corrupt) != 1 || recovery.Corrupt[0].Offset != int64(len(frameLogMagic)+frameSize) {
+		t.Fatalf("unexpected corrupt regions %+v", recovery.Corrupt)
+	}
+	if recovery.Skipped() != int64(frameSize) {
+		t.Fatalf("expected %d bytes skipped, got %d", frameSize, recovery.Skipped())
+	}
+}
+
+func TestFrameLogTornWrite(t *testing.T) {
+	data := writeTestFrameLog(t, 2, false)
+	// lose the end of the last frame, as if the process crashed mid write
+	data = data[:len(data)-5]
+
+	recovery, err := RecoverFrameLog(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(recovery.Frames) != 1 || recovery.Complete || len(recovery.Corrupt) != 1 {
+		t.Fatalf("unexpected recovery %+v", recovery)
+	}
+
+	if _, err := RecoverFrameLog(bytes.NewReader([]byte("garbage"))); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+}
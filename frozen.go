@@ -0,0 +1,192 @@
+package main
+
+import (
+	"sort"
+)
+
+// a FrozenDatabase is an immutable copy of a MedianDatabase. Values are
+// stored in a contiguous, sorted array alongside a prefix sum of their
+// counts, which makes any percentile query a single binary search.
+type FrozenDatabase struct {
+	values []int
+	counts []int
+}
+
+func newFrozenDatabase(left, right []*BulkMetric) *FrozenDatabase {
+	frozen := &FrozenDatabase{
+		values: make([]int, 0, len(left)+len(right)),
+		counts: make([]int, 0, len(left)+len(right)),
+	}
+
+	total := 0
+	for _, side := range [][]*BulkMetric{left, right} {
+		for _, metric := range side {
+			total += metric.Count()
+
+			// rebalancing can split a single value across the left and
+			// right side, so merge them back into a single entry here
+			last := len(frozen.values) - 1
+			if last >= 0 && frozen.values[last] == metric.Value() {
+				frozen.counts[last] = total
+				continue
+			}
+
+			frozen.values = append(frozen.values, metric.Value())
+			frozen.counts = append(frozen.counts, total)
+		}
+	}
+
+	return frozen
+}
+
+func (f *FrozenDatabase) Count() int {
+	if len(f.counts) == 0 {
+		return 0
+	}
+
+	return f.counts[len(f.counts)-1]
+}
+
+// returns the value at the given 1-indexed rank
+func (f *FrozenDatabase) rank(rank int) int {
+	index := sort.SearchInts(f.counts, rank)
+	return f.values[index]
+}
+
+func (f *FrozenDatabase) GetMedian() int {
+	count := f.Count()
+	if count == 0 {
+		return 0
+	}
+
+	if count%2 == 1 {
+		return f.rank((count + 1) / 2)
+	}
+
+	return midpoint(f.rank(count/2), f.rank(count/2+1))
+}
+
+// returns the median of two values, truncated towards zero like
+// (a + b) / 2, so a median spanning -3 and 0 is -1 just as one spanning 0
+// and 3 is 1, but without overflowing for values of extreme magnitude
+func midpoint(a, b int) int {
+	// values of different signs can't overflow
+	if (a < 0) != (b < 0) {
+		return (a + b) / 2
+	}
+
+	return a/2 + b/2 + (a%2+b%2)/2
+}
+
+// returns the floor of (a + b) / 2 without overflowing, for binary
+// searches over values which can be negative
+func floorMidpoint(a, b int) int {
+	return (a & b) + (a^b)>>1
+}
+
+// GetMedianFloat returns the median, interpolating between the two middle
+// values when there is an even number of values.
+func (f *FrozenDatabase) GetMedianFloat() float64 {
+	count := f.Count()
+	if count == 0 {
+		return 0
+	}
+
+	if count%2 == 1 {
+		return float64(f.rank((count + 1) / 2))
+	}
+
+	return (float64(f.rank(count/2)) + float64(f.rank(count/2+1))) / 2
+}
+
+// GetPercentile returns the nearest-rank percentile for p, where p is a
+// fraction between 0 and 1 (eg: 0.99 for the p99).
+func (f *FrozenDatabase) GetPercentile(p float64) int {
+	count := f.Count()
+	if count == 0 {
+		return 0
+	}
+
+	return f.rank(nearestRank(p, count))
+}
+
+// GetPercentileRank returns the fraction of stored values less than or
+// equal to v, the inverse of GetPercentile, eg: to tell how a single slow
+// request compares with the rest. It is zero when nothing is stored.
+func (f *FrozenDatabase) GetPercentileRank(v int) float64 {
+	count := f.Count()
+	if count == 0 {
+		return 0
+	}
+
+	return float64(f.Rank(v)) / float64(count)
+}
+
+// returns the 1-indexed rank of the p percentile in a data set of count
+// values, where p is clamped to a fraction between 0 and 1
+func nearestRank(p float64, count int) int {
+	if p < 0 {
+		p = 0
+	} else if p > 1 {
+		p = 1
+	}
+
+	// nearest rank is ceil(p * count), but never less than the first rank
+	rank := int(p * float64(count))
+	if float64(rank) < p*float64(count) {
+		rank = rank + 1
+	}
+	if rank < 1 {
+		rank = 1
+	}
+
+	return rank
+}
+
+// returns the count of the value stored at index, undoing the prefix sum
+func (f *FrozenDatabase) countAt(index int) int {
+	if index == 0 {
+		return f.counts[0]
+	}
+
+	return f.counts[index] - f.counts[index-1]
+}
+
+// Rank returns the number of stored values less than or equal to value.
+func (f *FrozenDatabase) Rank(value int) int {
+	// index of the first value strictly greater than the one requested,
+	// which can't be searched for as value+1 as it may overflow
+	index := sort.Search(len(f.values), func(i int) bool { return f.values[i] > value })
+	if index == 0 {
+		return 0
+	}
+
+	return f.counts[index-1]
+}
+
+// Sum returns the sum of every stored value, as a float since it can
+// easily overflow an int.
+func (f *FrozenDatabase) Sum() float64 {
+	sum := 0.0
+	for i, value := range f.values {
+		sum += float64(value) * float64(f.countAt(i))
+	}
+
+	return sum
+}
+
+func (f *FrozenDatabase) Min() int {
+	if len(f.values) == 0 {
+		return 0
+	}
+
+	return f.values[0]
+}
+
+func (f *FrozenDatabase) Max() int {
+	if len(f.values) == 0 {
+		return 0
+	}
+
+	return f.values[len(f.values)-1]
+}
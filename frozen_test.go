@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFreeze(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// [0 1 2 3 4 5 5 6 6 7 7 8 8 ]
+	database.BulkWrite(buildBulkMetrics(0, 9))
+	database.BulkWrite(buildBulkMetrics(5, 9))
+
+	frozen, err := database.Freeze()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frozen.Count() != 13 {
+		t.Fatalf("expected 13 metrics, got %d", frozen.Count())
+	}
+	if frozen.GetMedian() != 5 {
+		t.Fatalf("expected median of 5, got %d", frozen.GetMedian())
+	}
+
+	// writes after the freeze are rejected
+	if err := database.BulkWrite(buildBulkMetrics(100, 110)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if frozen, _ = database.Freeze(); frozen.Count() != 13 {
+		t.Fatalf("expected write after freeze to be dropped")
+	}
+}
+
+func TestFrozenDatabasePercentiles(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// 1..100
+	database.BulkWrite(buildBulkMetrics(1, 101))
+	frozen, _ := database.Freeze()
+
+	cases := map[float64]int{
+		0:    1,
+		0.01: 1,
+		0.5:  50,
+		0.9:  90,
+		0.99: 99,
+		1:    100,
+	}
+	for p, expected := range cases {
+		if actual := frozen.GetPercentile(p); actual != expected {
+			t.Fatalf("expected p%v to be %d, got %d", p*100, expected, actual)
+		}
+	}
+
+	if frozen.GetMedian() != 50 {
+		t.Fatalf("expected median of 50, got %d", frozen.GetMedian())
+	}
+
+	ranks := map[int]float64{
+		0:   0,
+		1:   0.01,
+		50:  0.5,
+		99:  0.99,
+		100: 1,
+		500: 1,
+	}
+	for value, expected := range ranks {
+		if actual := frozen.GetPercentileRank(value); actual != expected {
+			t.Fatalf("expected %d to rank at %v, got %v", value, expected, actual)
+		}
+		if expected > 0 && frozen.GetPercentile(expected) != min(value, 100) {
+			t.Fatalf("expected the rank of %d to be the inverse of its percentile", value)
+		}
+	}
+}
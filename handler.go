@@ -0,0 +1,461 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a Snapshotter can return a point in time copy of its contents, which the
+// handler needs to serve anything but the median
+type Snapshotter interface {
+	Snapshot() (Snapshot, error)
+}
+
+// a database which tracks when it was last written, see WithStaleAfter
+type idleDatabase interface {
+	Idle() time.Duration
+	Stale() bool
+}
+
+type medianResponse struct {
+	Median int   `json:"median"`
+	Count  int64 `json:"count,omitempty"`
+
+	// only known for databases which track when they were last written
+	IdleSeconds float64 `json:"idle_seconds,omitempty"`
+	Stale       bool    `json:"stale,omitempty"`
+
+	// only known for databases which count their writes, see Generation
+	Generation uint64 `json:"generation,omitempty"`
+}
+
+type percentileResponse struct {
+	Percentile float64 `json:"percentile"`
+	Value      int     `json:"value"`
+	Count      int     `json:"count"`
+}
+
+// every quantile is read from the same snapshot as the count
+type quantilesResponse struct {
+	Quantiles []float64 `json:"quantiles"`
+	Values    []int     `json:"values"`
+	Count     int       `json:"count"`
+}
+
+// NewHandler returns an http.Handler serving queries against the database,
+// so it can be mounted on an existing server under its own mux and
+// middleware, eg: with http.StripPrefix. The paths are:
+//
+//	GET /median               the current median, and count if known
+//	GET /health               the Health, 503 once the database is closed
+//	GET /percentile?p=0.99    the value at a percentile, p between 0 and 1
+//	GET /quantiles?q=0.5&...  the values at each q, all from the same snapshot
+//	GET /report               a Report of the distribution
+//	GET /metrics              a Prometheus summary, named with ?name=
+//	GET /recovery             the RecoveryReport from when it was restored
+//	GET /threshold?window=1h  the ThresholdSeries of a WindowedDatabase
+//	GET /summaries?window=1h  the Summaries of a WindowedDatabase
+//	GET /range?since=&until=  the Range of a WindowedDatabase, in RFC 3339
+//	GET /samples              the RawSamples of a WindowedDatabase's latest window
+//	POST /write               writes wire format frames, eg: from a Client
+//	GET /provenance           the latest written batches, see WithProvenance
+//	GET /sketch?k=200         an Apache DataSketches KLL sketch, POST to merge one
+//
+// /percentile, /quantiles, /report, /metrics and /sketch need the database
+// to be a Snapshotter, or a HistogramDatabase for /sketch, and respond with
+// 501 otherwise. /recovery responds with 404 if the database wasn't
+// restored, and /threshold, /summaries and /range with 501
+// if it isn't windowed. /range is until now if until is left out.
+// /samples responds with 501 unless the database keeps raw samples.
+// Writes can be flow controlled with WithWriteCredits, and compressed with
+// any registered codec, named in their Content-Encoding. /metrics is served
+// in OpenMetrics, with exemplars, to scrapers which accept it if the
+// handler was created WithExemplarSource. /provenance responds with 501
+// unless the handler was created WithProvenance.
+func NewHandler(database Database, options ...HandlerOption) http.Handler {
+	config := &handlerConfig{}
+	for _, option := range options {
+		option(config)
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/median", func(w http.ResponseWriter, r *http.Request) {
+		response := medianResponse{Median: database.GetMedian()}
+		if counted, ok := database.(interface{ GetMedianAndCount() (int64, int64) }); ok {
+			median, count := counted.GetMedianAndCount()
+			response.Median, response.Count = int(median), count
+		}
+		if idle, ok := database.(idleDatabase); ok {
+			response.IdleSeconds, response.Stale = idle.Idle().Seconds(), idle.Stale()
+		}
+		if generational, ok := database.(interface{ Generation() uint64 }); ok {
+			response.Generation = generational.Generation()
+		}
+
+		writeJSON(w, response)
+	})
+
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		checked, ok := database.(interface{ Health() Health })
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T doesn't report its health", database), http.StatusNotImplemented)
+			return
+		}
+
+		health := checked.Health()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(health.statusCode())
+		json.NewEncoder(w).Encode(health)
+	})
+
+	mux.HandleFunc("/percentile", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := parseFraction(r.URL.Query().Get("p"))
+		if !ok {
+			http.Error(w, "p must be a fraction between 0 and 1", http.StatusBadRequest)
+			return
+		}
+
+		snapshot, ok := snapshotFor(w, database)
+		if !ok {
+			return
+		}
+
+		writeJSON(w, percentileResponse{
+			Percentile: p,
+			Value:      snapshot.GetPercentile(p),
+			Count:      snapshot.Count(),
+		})
+	})
+
+	mux.HandleFunc("/quantiles", func(w http.ResponseWriter, r *http.Request) {
+		quantiles := make([]float64, 0, len(r.URL.Query()["q"]))
+		for _, param := range r.URL.Query()["q"] {
+			quantile, ok := parseFraction(param)
+			if !ok {
+				http.Error(w, "each q must be a fraction between 0 and 1", http.StatusBadRequest)
+				return
+			}
+			quantiles = append(quantiles, quantile)
+		}
+		if len(quantiles) == 0 {
+			quantiles = defaultSummaryQuantiles
+		}
+
+		snapshot, ok := snapshotFor(w, database)
+		if !ok {
+			return
+		}
+
+		writeJSON(w, quantilesResponse{
+			Quantiles: quantiles,
+			Values:    snapshot.GetQuantiles(quantiles...),
+			Count:     snapshot.Count(),
+		})
+	})
+
+	mux.HandleFunc("/report", func(w http.ResponseWriter, r *http.Request) {
+		if snapshot, ok := snapshotFor(w, database); ok {
+			writeJSON(w, snapshot.Report())
+		}
+	})
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("name")
+		if name == "" {
+			name = "median_database"
+		}
+
+		snapshot, ok := snapshotFor(w, database)
+		if !ok {
+			return
+		}
+
+		if config.exemplars != nil && strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text") {
+			w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+			WriteOpenMetricsSummary(w, name, "", nil, snapshot, nil, config.exemplars.Exemplars())
+			fmt.Fprintln(w, "# EOF")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheusSummary(w, name, "", nil, snapshot, nil)
+	})
+
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "writes must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, ok := readableBody(w, r)
+		if !ok {
+			return
+		}
+		defer body.Close()
+
+		advertiseEncodings(w)
+		frames, count, err := readFrames(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if !config.acquire(w, count) {
+			return
+		}
+
+		// the credits are returned before they are advertised
+		applied := true
+		for _, frame := range frames {
+			if applied = config.apply(w, database, frame); !applied {
+				break
+			}
+			if config.provenance != nil {
+				provenance := newProvenance(frame.Metrics)
+				provenance.Source, provenance.ClientID, provenance.Sequence = r.RemoteAddr, r.Header.Get(clientIDHeader), frame.Sequence
+				config.provenance.record(provenance)
+			}
+		}
+		config.release(count)
+		if !applied {
+			return
+		}
+
+		config.advertise(w)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/sketch", func(w http.ResponseWriter, r *http.Request) {
+		serveSketch(w, r, database, config)
+	})
+
+	mux.HandleFunc("/provenance", func(w http.ResponseWriter, r *http.Request) {
+		serveProvenance(w, r, config.provenance)
+	})
+
+	mux.HandleFunc("/recovery", func(w http.ResponseWriter, r *http.Request) {
+		restored, ok := database.(interface{ RecoveryReport() (RecoveryReport, bool) })
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T can't be restored", database), http.StatusNotImplemented)
+			return
+		}
+
+		report, ok := restored.RecoveryReport()
+		if !ok {
+			http.Error(w, "database was not restored", http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, report)
+	})
+
+	mux.HandleFunc("/threshold", func(w http.ResponseWriter, r *http.Request) {
+		windowed, ok := database.(interface {
+			ThresholdSeries(time.Duration) []ThresholdPoint
+		})
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T isn't windowed", database), http.StatusNotImplemented)
+			return
+		}
+
+		window, err := time.ParseDuration(r.URL.Query().Get("window"))
+		if err != nil || window <= 0 {
+			http.Error(w, "window must be a positive duration, eg: 1h", http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, windowed.ThresholdSeries(window))
+	})
+
+	mux.HandleFunc("/summaries", func(w http.ResponseWriter, r *http.Request) {
+		windowed, ok := database.(interface {
+			Summaries(time.Duration) []WindowSummary
+		})
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T isn't windowed", database), http.StatusNotImplemented)
+			return
+		}
+
+		window, err := time.ParseDuration(r.URL.Query().Get("window"))
+		if err != nil || window <= 0 {
+			http.Error(w, "window must be a positive duration, eg: 1h", http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, windowed.Summaries(window))
+	})
+
+	mux.HandleFunc("/range", func(w http.ResponseWriter, r *http.Request) {
+		windowed, ok := database.(interface {
+			Range(time.Time, time.Time) RangeSummary
+		})
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T isn't windowed", database), http.StatusNotImplemented)
+			return
+		}
+
+		since, until, err := parseTimeRange(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, windowed.Range(since, until))
+	})
+
+	mux.HandleFunc("/samples", func(w http.ResponseWriter, r *http.Request) {
+		sampled, ok := database.(interface {
+			RawSamples() (RawSampleWindow, bool)
+		})
+		if !ok {
+			http.Error(w, fmt.Sprintf("%T isn't windowed", database), http.StatusNotImplemented)
+			return
+		}
+
+		samples, ok := sampled.RawSamples()
+		if !ok {
+			http.Error(w, "raw samples aren't kept, see WithRawSamples", http.StatusNotImplemented)
+			return
+		}
+
+		writeJSON(w, samples)
+	})
+
+	mux.HandleFunc("/export", exportHandler(database))
+
+	return mux
+}
+
+// writes an error response and returns false if a snapshot can't be taken
+func snapshotFor(w http.ResponseWriter, database Database) (Snapshot, bool) {
+	snapshotter, ok := database.(Snapshotter)
+	if !ok {
+		http.Error(w, fmt.Sprintf("%T does not support snapshots", database), http.StatusNotImplemented)
+		return Snapshot{}, false
+	}
+
+	snapshot, err := snapshotter.Snapshot()
+	if errors.Is(err, ErrClosed) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return Snapshot{}, false
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return Snapshot{}, false
+	}
+
+	return snapshot, true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// reads every frame of a write, so that a corrupt or invalid frame fails
+// the request before any of them are applied, rather than leaving the
+// frames ahead of it applied for a retry to count twice. It returns the
+// frames and the total count of their metrics.
+func readFrames(r io.Reader) ([]Frame, int, error) {
+	frames := make([]Frame, 0, 1)
+	count := 0
+	for {
+		frame, err := ReadFrame(r)
+		if err == io.EOF {
+			return frames, count, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+
+		for _, metric := range frame.Metrics {
+			if metric.Count() < 1 {
+				return nil, 0, fmt.Errorf("frame %d: bulk metric %v: %w", len(frames), metric, ErrInvalidMetric)
+			}
+			count += metric.Count()
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// writes the metrics, or writes an error response and returns false
+func (h *handlerConfig) write(w http.ResponseWriter, database Database, bulkMetrics []*BulkMetric) bool {
+	count := 0
+	for _, metric := range bulkMetrics {
+		count += metric.Count()
+	}
+
+	if !h.acquire(w, count) {
+		return false
+	}
+	defer h.release(count)
+
+	return h.apply(w, database, Frame{Metrics: bulkMetrics})
+}
+
+// takes credits for count metrics, if writes are flow controlled, or
+// writes an error response and returns false
+func (h *handlerConfig) acquire(w http.ResponseWriter, count int) bool {
+	if h.credits == nil || h.credits.acquire(count) {
+		return true
+	}
+
+	h.advertise(w)
+	w.Header().Set("Retry-After", h.credits.retryAfterHeader())
+	http.Error(w, fmt.Sprintf("%d metrics exceed the write credits", count), http.StatusTooManyRequests)
+	return false
+}
+
+// returns the credits taken by acquire
+func (h *handlerConfig) release(count int) {
+	if h.credits != nil {
+		h.credits.release(count)
+	}
+}
+
+// applies the frame, or writes an error response and returns false. A
+// sequenced frame is applied with ApplyFrame where the database supports
+// it, so a retried frame is skipped rather than counted twice.
+func (h *handlerConfig) apply(w http.ResponseWriter, database Database, frame Frame) bool {
+	var err error
+	if applier, ok := database.(interface{ ApplyFrame(Frame) error }); ok && frame.Sequence != 0 {
+		err = applier.ApplyFrame(frame)
+	} else {
+		err = database.BulkWrite(frame.Metrics)
+	}
+	if err == nil {
+		return true
+	}
+
+	h.advertise(w)
+	writeError(w, err)
+	return false
+}
+
+// writes the error response for a failed write
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrInvalidMetric):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, ErrSequenceGap):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, ErrBufferFull), errors.Is(err, ErrSeriesQuota):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	case errors.Is(err, ErrClosed):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// sets the credits header, if writes are flow controlled
+func (h *handlerConfig) advertise(w http.ResponseWriter) {
+	if h.credits != nil {
+		w.Header().Set(creditsHeader, strconv.Itoa(h.credits.remaining()))
+	}
+}
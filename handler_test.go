@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 101))
+
+	// mounted under a prefix, like an application would
+	mux := http.NewServeMux()
+	mux.Handle("/latency/", http.StripPrefix("/latency", NewHandler(database)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	get := func(path string, expectedStatus int) string {
+		response, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d for %s, got %d", expectedStatus, path, response.StatusCode)
+		}
+
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	var median medianResponse
+	json.Unmarshal([]byte(get("/latency/median", http.StatusOK)), &median)
+	if median.Median != 50 || median.Count != 100 {
+		t.Fatalf("expected a median of 50 over 100, got %+v", median)
+	}
+
+	var percentile percentileResponse
+	json.Unmarshal([]byte(get("/latency/percentile?p=0.9", http.StatusOK)), &percentile)
+	if percentile.Value != 90 {
+		t.Fatalf("expected a p90 of 90, got %+v", percentile)
+	}
+	get("/latency/percentile?p=90", http.StatusBadRequest)
+	get("/latency/percentile?p=NaN", http.StatusBadRequest)
+	get("/latency/quantiles?q=0.5&q=NaN", http.StatusBadRequest)
+
+	var report Report
+	json.Unmarshal([]byte(get("/latency/report", http.StatusOK)), &report)
+	if report.Count != 100 || report.Max != 100 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+
+	if body := get("/latency/metrics?name=latency", http.StatusOK); !strings.Contains(body, "latency_count 100\n") {
+		t.Fatalf("unexpected metrics:\n%s", body)
+	}
+	get("/latency/recovery", http.StatusNotFound)
+
+	// databases which can't snapshot still serve the median
+	histogram := httptest.NewServer(NewHandler(newTestHistogramDatabase(1)))
+	defer histogram.Close()
+	response, _ := http.Get(histogram.URL + "/report")
+	response.Body.Close()
+	if response.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected status 501, got %d", response.StatusCode)
+	}
+}
+
+func TestHandlerWritesWholeRequests(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+	handler := NewHandler(database)
+
+	post := func(frames ...Frame) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		for _, frame := range frames {
+			WriteFrame(body, frame)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/write", body))
+		return recorder
+	}
+
+	// a corrupt frame fails the request before the frame ahead of it is
+	// applied
+	body := &bytes.Buffer{}
+	WriteFrame(body, Frame{Sequence: 1, Metrics: buildBulkMetrics(0, 10)})
+	body.WriteString("corrupt")
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/write", body))
+	if recorder.Code != http.StatusBadRequest || database.Sequence() != 0 {
+		t.Fatalf("expected 400 with nothing applied, got %d at sequence %d", recorder.Code, database.Sequence())
+	}
+
+	// a retried request doesn't count its sequenced frames twice
+	for i := 0; i < 2; i++ {
+		if recorder := post(Frame{Sequence: 1, Metrics: buildBulkMetrics(0, 10)}, Frame{Sequence: 2, Metrics: buildBulkMetrics(10, 20)}); recorder.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d: %s", recorder.Code, recorder.Body)
+		}
+	}
+	if _, count := database.GetMedianAndCount(); count != 20 {
+		t.Fatalf("expected each frame counted once, got %d", count)
+	}
+
+	if recorder := post(Frame{Sequence: 5, Metrics: buildBulkMetrics(0, 1)}); recorder.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for a sequence gap, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// a histogram counts values into fixed width buckets, where bucket i holds
+// the values [i*width, (i+1)*width)
+type histogram struct {
+	width  int
+	counts map[int]int
+}
+
+func (h *histogram) bucket(value int) int {
+	bucket := value / h.width
+	// integer division truncates towards zero, but buckets are floored
+	if value%h.width != 0 && value < 0 {
+		bucket--
+	}
+
+	return bucket
+}
+
+// returns the bucket indexes in ascending order
+func (h *histogram) sortedBuckets() []int {
+	buckets := make([]int, 0, len(h.counts))
+	for bucket := range h.counts {
+		buckets = append(buckets, bucket)
+	}
+	sort.Ints(buckets)
+
+	return buckets
+}
+
+// a HistogramDatabase maintains several bucketed views of the same data at
+// once, eg: 1ms and 50ms buckets. Queries choose a resolution, trading
+// accuracy for speed since coarse histograms have far fewer buckets to scan
+// when values span several orders of magnitude. Writes are applied
+// synchronously, so Open and Close don't start or stop anything.
+type HistogramDatabase struct {
+	sync.RWMutex
+
+	histograms []*histogram
+	count      int
+	closed     bool
+}
+
+// NewHistogramDatabase creates a database with a histogram per resolution,
+// where each resolution is a bucket width, failing if any is below 1. A
+// resolution of 1 is exact.
+func NewHistogramDatabase(resolutions ...int) (*HistogramDatabase, error) {
+	resolutions = append([]int(nil), resolutions...)
+	sort.Ints(resolutions)
+
+	h := &HistogramDatabase{
+		histograms: make([]*histogram, 0, len(resolutions)),
+	}
+	for _, resolution := range resolutions {
+		if resolution < 1 {
+			return nil, fmt.Errorf("invalid histogram resolution %d", resolution)
+		}
+
+		h.histograms = append(h.histograms, &histogram{
+			width:  resolution,
+			counts: make(map[int]int),
+		})
+	}
+
+	return h, nil
+}
+
+func (h *HistogramDatabase) Open() {}
+
+func (h *HistogramDatabase) Close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+}
+
+func (h *HistogramDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	for _, metric := range bulkMetrics {
+		if metric == nil || metric.Count() < 1 {
+			return fmt.Errorf("bulk metric %v: %w", metric, ErrInvalidMetric)
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		return ErrClosed
+	}
+
+	for _, metric := range bulkMetrics {
+		h.count += metric.Count()
+		for _, histogram := range h.histograms {
+			histogram.counts[histogram.bucket(metric.Value())] += metric.Count()
+		}
+	}
+
+	return nil
+}
+
+// Resolutions returns the bucket widths of each histogram, finest first.
+func (h *HistogramDatabase) Resolutions() []int {
+	resolutions := make([]int, 0, len(h.histograms))
+	for _, histogram := range h.histograms {
+		resolutions = append(resolutions, histogram.width)
+	}
+
+	return resolutions
+}
+
+func (h *HistogramDatabase) histogram(resolution int) (*histogram, error) {
+	for _, histogram := range h.histograms {
+		if histogram.width == resolution {
+			return histogram, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no histogram with resolution %d", resolution)
+}
+
+// GetPercentile returns the nearest-rank percentile at the given
+// resolution, where p is a fraction between 0 and 1. The result is the
+// midpoint of the bucket holding the percentile, so it is accurate to
+// within half of the resolution.
+func (h *HistogramDatabase) GetPercentile(p float64, resolution int) (int, error) {
+	estimate, err := h.GetPercentileWithError(p, resolution)
+	return estimate.Value, err
+}
+
+// GetPercentileWithError returns the percentile like GetPercentile, along
+// with the bounds of the bucket it fell into, which the true percentile is
+// guaranteed to lie within.
+func (h *HistogramDatabase) GetPercentileWithError(p float64, resolution int) (Estimate, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	histogram, err := h.histogram(resolution)
+	if err != nil {
+		return Estimate{}, err
+	}
+
+	return h.estimate(histogram, p)
+}
+
+// estimates the percentile from the histogram, must be called with at
+// least the read lock held
+func (h *HistogramDatabase) estimate(histogram *histogram, p float64) (Estimate, error) {
+	if h.count == 0 {
+		return Estimate{}, ErrEmpty
+	}
+
+	rank := nearestRank(p, h.count)
+	seen := 0
+	for _, bucket := range histogram.sortedBuckets() {
+		seen += histogram.counts[bucket]
+		if seen >= rank {
+			start := bucket * histogram.width
+			return Estimate{
+				Value: start + histogram.width/2,
+				Low:   start,
+				High:  start + histogram.width - 1,
+			}, nil
+		}
+	}
+
+	// unreachable, the buckets always sum to the total count
+	return Estimate{}, ErrEmpty
+}
+
+// returns the interpolated value of the 1-indexed rank, assuming that the
+// values in the bucket holding it are spread evenly across the bucket
+func (h *histogram) interpolate(rank int) float64 {
+	seen := 0
+	for _, bucket := range h.sortedBuckets() {
+		count := h.counts[bucket]
+		if seen+count < rank {
+			seen += count
+			continue
+		}
+
+		start := float64(bucket * h.width)
+		// a lone value is assumed to sit in the middle of its bucket
+		if count == 1 {
+			return start + float64(h.width-1)/2
+		}
+
+		// otherwise the bucket's values run from its first to its last
+		// integer, so a bucket with a width of 1 is always exact
+		position := float64(rank-seen-1) / float64(count-1)
+		return start + position*float64(h.width-1)
+	}
+
+	return 0
+}
+
+// GetMedianFloat returns the median at the given resolution, interpolated
+// by the median's position within its bucket, and between the two middle
+// values when there is an even number of metrics.
+func (h *HistogramDatabase) GetMedianFloat(resolution int) (float64, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	histogram, err := h.histogram(resolution)
+	if err != nil {
+		return 0, err
+	}
+	if h.count == 0 {
+		return 0, ErrEmpty
+	}
+
+	if h.count%2 == 1 {
+		return histogram.interpolate((h.count + 1) / 2), nil
+	}
+
+	return (histogram.interpolate(h.count/2) + histogram.interpolate(h.count/2+1)) / 2, nil
+}
+
+// GetMedian returns the median at the finest resolution, or 0 when empty.
+func (h *HistogramDatabase) GetMedian() int {
+	if len(h.histograms) == 0 {
+		return 0
+	}
+
+	median, _ := h.GetPercentile(0.5, h.histograms[0].width)
+	return median
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHistogramDatabaseResolutions(t *testing.T) {
+	database := newTestHistogramDatabase(50, 1)
+	database.Open()
+	defer database.Close()
+
+	if _, err := database.GetPercentile(0.5, 1); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	// 1..1000
+	database.BulkWrite(buildBulkMetrics(1, 1001))
+
+	if resolutions := database.Resolutions(); resolutions[0] != 1 || resolutions[1] != 50 {
+		t.Fatalf("unexpected resolutions %v", resolutions)
+	}
+
+	cases := []struct {
+		p          float64
+		resolution int
+		expected   int
+	}{
+		{0.5, 1, 500},
+		{0.99, 1, 990},
+		// 500 falls into the [500, 550) bucket
+		{0.5, 50, 525},
+		{0.99, 50, 975},
+	}
+	for _, c := range cases {
+		actual, err := database.GetPercentile(c.p, c.resolution)
+		if err != nil || actual != c.expected {
+			t.Fatalf("expected p%v at resolution %d to be %d, got %d (%v)", c.p*100, c.resolution, c.expected, actual, err)
+		}
+	}
+
+	if _, err := database.GetPercentile(0.5, 10); err == nil {
+		t.Fatalf("expected an error for an unknown resolution")
+	}
+	if database.GetMedian() != 500 {
+		t.Fatalf("expected median of 500, got %d", database.GetMedian())
+	}
+
+	// the caller's resolutions are left as they were
+	resolutions := []int{50, 1}
+	if _, err := NewHistogramDatabase(resolutions...); err != nil || resolutions[0] != 50 {
+		t.Fatalf("expected the resolutions untouched, got %v (%v)", resolutions, err)
+	}
+	if _, err := NewHistogramDatabase(10, 0); err == nil {
+		t.Fatalf("expected a resolution of 0 to be rejected")
+	}
+}
+
+func TestHistogramBucketsNegativeValues(t *testing.T) {
+	h := &histogram{width: 10}
+	for value, expected := range map[int]int{-1: -1, -10: -1, -11: -2, 0: 0, 9: 0, 10: 1} {
+		if actual := h.bucket(value); actual != expected {
+			t.Fatalf("expected %d in bucket %d, got %d", value, expected, actual)
+		}
+	}
+}
+
+func TestHistogramDatabaseGetMedianFloat(t *testing.T) {
+	database := newTestHistogramDatabase(1, 10)
+
+	// 0..99, so the true median is 49.5
+	database.BulkWrite(buildBulkMetrics(0, 100))
+
+	for _, resolution := range []int{1, 10} {
+		median, err := database.GetMedianFloat(resolution)
+		if err != nil || median != 49.5 {
+			t.Fatalf("expected a median of 49.5 at resolution %d, got %v (%v)", resolution, median, err)
+		}
+	}
+
+	// a lone value sits in the middle of its bucket
+	sparse := newTestHistogramDatabase(10)
+	sparse.BulkWrite(buildBulkMetrics(3, 4))
+	if median, _ := sparse.GetMedianFloat(10); median != 4.5 {
+		t.Fatalf("expected a median of 4.5, got %v", median)
+	}
+}
+
+// creates a histogram database with resolutions known to be valid
+func newTestHistogramDatabase(resolutions ...int) *HistogramDatabase {
+	database, err := NewHistogramDatabase(resolutions...)
+	if err != nil {
+		panic(err)
+	}
+
+	return database
+}
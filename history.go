@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultHistorySize = 256
+
+const defaultTrendLookback = time.Minute
+
+type TimedMedian struct {
+	Median int
+	Time   time.Time
+}
+
+// a fixed size ring buffer of the most recently calculated medians. The
+// database worker is the only writer, but readers can call in from any
+// goroutine so access is guarded by a mutex.
+type medianHistory struct {
+	sync.Mutex
+
+	entries []TimedMedian
+	next    int
+	full    bool
+}
+
+func newMedianHistory(size int) *medianHistory {
+	return &medianHistory{
+		entries: make([]TimedMedian, size),
+	}
+}
+
+func (h *medianHistory) add(median int) {
+	if len(h.entries) == 0 {
+		return
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	h.entries[h.next] = TimedMedian{
+		Median: median,
+		Time:   time.Now(),
+	}
+
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+// returns up to the last n entries, oldest first
+func (h *medianHistory) last(n int) []TimedMedian {
+	h.Lock()
+	defer h.Unlock()
+
+	size := h.next
+	if h.full {
+		size = len(h.entries)
+	}
+	if n > size {
+		n = size
+	}
+	if n <= 0 {
+		return []TimedMedian{}
+	}
+
+	history := make([]TimedMedian, 0, n)
+	// start n entries behind the next write position, wrapping around
+	start := (h.next - n + len(h.entries)) % len(h.entries)
+	for i := 0; i < n; i++ {
+		history = append(history, h.entries[(start+i)%len(h.entries)])
+	}
+
+	return history
+}
+
+// returns the change in the median per minute, between the latest entry
+// and the oldest entry within lookback of it. Entries must be oldest first.
+func medianTrend(entries []TimedMedian, lookback time.Duration) float64 {
+	if len(entries) < 2 {
+		return 0
+	}
+
+	latest := entries[len(entries)-1]
+	oldest := latest
+	for i := len(entries) - 2; i >= 0; i-- {
+		if latest.Time.Sub(entries[i].Time) > lookback {
+			break
+		}
+		oldest = entries[i]
+	}
+
+	elapsed := latest.Time.Sub(oldest.Time)
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(latest.Median-oldest.Median) / elapsed.Minutes()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMedianHistoryWrapsAround(t *testing.T) {
+	history := newMedianHistory(3)
+	if len(history.last(10)) != 0 {
+		t.Fatalf("expected an empty history")
+	}
+
+	for i := 0; i < 5; i++ {
+		history.add(i)
+	}
+
+	entries := history.last(10)
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Median != i+2 {
+			t.Fatalf("expected median %d at %d, got %d", i+2, i, entry.Median)
+		}
+	}
+
+	if entries = history.last(1); entries[0].Median != 4 {
+		t.Fatalf("expected the latest median of 4, got %d", entries[0].Median)
+	}
+}
+
+func TestDatabaseHistory(t *testing.T) {
+	database := NewMedianDatabase(WithHistorySize(2))
+	database.Open()
+	defer database.Close()
+
+	database.BulkWrite(buildBulkMetrics(0, 3))
+	database.BulkWrite(buildBulkMetrics(10, 13))
+	database.BulkWrite(buildBulkMetrics(20, 23))
+	// the snapshot round trips through the worker, so all writes above
+	// have been applied by the time it returns
+	database.Snapshot()
+
+	history := database.History(5)
+	if len(history) != 2 || history[0].Median != 6 || history[1].Median != 11 {
+		t.Fatalf("unexpected history %+v", history)
+	}
+}
+
+func TestMedianTrend(t *testing.T) {
+	start := time.Now()
+	entries := []TimedMedian{
+		{Median: 0, Time: start},
+		{Median: 10, Time: start.Add(time.Minute)},
+		{Median: 20, Time: start.Add(2 * time.Minute)},
+		{Median: 50, Time: start.Add(3 * time.Minute)},
+	}
+
+	// only the last minute, rising 30 a minute
+	if trend := medianTrend(entries, time.Minute); trend != 30 {
+		t.Fatalf("expected a trend of 30 per minute, got %v", trend)
+	}
+
+	// the whole history, rising 50 over 3 minutes
+	if trend := medianTrend(entries, time.Hour); trend < 16.6 || trend > 16.7 {
+		t.Fatalf("expected a trend of 16.67 per minute, got %v", trend)
+	}
+
+	// nothing to compare the latest median against
+	if trend := medianTrend(entries, time.Second); trend != 0 {
+		t.Fatalf("expected no trend, got %v", trend)
+	}
+}
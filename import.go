@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the most observations in a single imported batch
+const importBatchSize = 1000
+
+// an ObservationReader reads historical observations, one per line, as
+// TimedBatches of the consecutive observations made at the same time, so
+// they can be backfilled into a WindowedDatabase or written to any other.
+// The formats are:
+//
+//	csv   a header naming a value column and optionally a time column,
+//	      eg: value,time
+//	json  a JSON object per line, eg: {"value": 12.5, "time": "..."}
+//
+// times are RFC 3339 or unix seconds, and observations without one are
+// read with a zero time. Values are rounded to the nearest integer.
+type ObservationReader struct {
+	next  func() (float64, time.Time, error)
+	lines int
+
+	// read ahead of the batch being returned, as it was made at a
+	// different time
+	pending *TimedBatch
+}
+
+// NewObservationReader reads observations in the format from r, skipping
+// the first skip observations, eg: ones imported before an interruption.
+func NewObservationReader(r io.Reader, format string, skip int) (*ObservationReader, error) {
+	o := &ObservationReader{}
+
+	switch format {
+	case "csv":
+		reader := csv.NewReader(r)
+		header, err := reader.Read()
+		if err != nil {
+			return nil, fmt.Errorf("csv header: %w", err)
+		}
+		valueColumn, timeColumn := -1, -1
+		for i, column := range header {
+			switch strings.TrimSpace(strings.ToLower(column)) {
+			case "value":
+				valueColumn = i
+			case "time", "timestamp":
+				timeColumn = i
+			}
+		}
+		if valueColumn < 0 {
+			return nil, fmt.Errorf("csv header %v has no value column", header)
+		}
+
+		o.next = func() (float64, time.Time, error) {
+			record, err := reader.Read()
+			if err != nil {
+				return 0, time.Time{}, err
+			}
+
+			observed := ""
+			if timeColumn >= 0 {
+				observed = record[timeColumn]
+			}
+			return parseObservation(record[valueColumn], observed)
+		}
+	case "json":
+		scanner := bufio.NewScanner(r)
+		o.next = func() (float64, time.Time, error) {
+			for scanner.Scan() {
+				line := strings.TrimSpace(scanner.Text())
+				if line == "" {
+					continue
+				}
+
+				observation := struct {
+					Value json.Number     `json:"value"`
+					Time  json.RawMessage `json:"time"`
+				}{}
+				if err := json.Unmarshal([]byte(line), &observation); err != nil {
+					return 0, time.Time{}, err
+				}
+
+				// times are either RFC 3339 strings or unix seconds
+				observed := strings.Trim(string(observation.Time), `"`)
+				if observed == "null" {
+					observed = ""
+				}
+				return parseObservation(observation.Value.String(), observed)
+			}
+
+			if err := scanner.Err(); err != nil {
+				return 0, time.Time{}, err
+			}
+			return 0, time.Time{}, io.EOF
+		}
+	case "parquet":
+		return nil, fmt.Errorf("parquet can't be read without a parquet decoder, convert it to csv first")
+	default:
+		return nil, fmt.Errorf("unknown format %q, expected csv or json", format)
+	}
+
+	for o.lines < skip {
+		if _, _, err := o.next(); err != nil {
+			return nil, fmt.Errorf("skipping %d observations: %w", skip, err)
+		}
+		o.lines++
+	}
+
+	return o, nil
+}
+
+func parseObservation(value, observed string) (float64, time.Time, error) {
+	parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(parsed) || math.IsInf(parsed, 0) {
+		return 0, time.Time{}, fmt.Errorf("value %q: %w", value, ErrInvalidMetric)
+	}
+
+	observed = strings.TrimSpace(observed)
+	if observed == "" {
+		return parsed, time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseFloat(observed, 64); err == nil {
+		return parsed, time.Unix(0, int64(seconds*float64(time.Second))), nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, observed)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("time %q: %w", observed, err)
+	}
+
+	return parsed, at, nil
+}
+
+// Next returns the next batch of observations made at the same time, or
+// io.EOF once there are none left. Malformed observations fail with the
+// line they were on.
+func (o *ObservationReader) Next() (TimedBatch, error) {
+	batch := TimedBatch{Metrics: make([]*BulkMetric, 0)}
+	if o.pending != nil {
+		batch, o.pending = *o.pending, nil
+	}
+
+	for len(batch.Metrics) < importBatchSize {
+		value, observed, err := o.next()
+		if err == io.EOF && len(batch.Metrics) > 0 {
+			return batch, nil
+		} else if err == io.EOF {
+			return TimedBatch{}, io.EOF
+		} else if err != nil {
+			return TimedBatch{}, fmt.Errorf("observation %d: %w", o.lines+1, err)
+		}
+		o.lines++
+
+		metric := &BulkMetric{value: int(math.Round(value)), count: 1}
+		if len(batch.Metrics) > 0 && !observed.Equal(batch.Time) {
+			o.pending = &TimedBatch{Time: observed, Metrics: []*BulkMetric{metric}}
+			return batch, nil
+		}
+
+		batch.Time = observed
+		batch.Metrics = append(batch.Metrics, metric)
+	}
+
+	return batch, nil
+}
+
+// Observations returns the number of observations read so far, including
+// any skipped, and any read ahead of the last batch returned.
+func (o *ObservationReader) Observations() int {
+	return o.lines
+}
+
+// imports a file, resuming from the observations state says were already
+// written, and saving the state after every write
+func importFile(client *Client, path, format string, state map[string]int, save func() error, progress time.Duration) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	done := state[path]
+	reader, err := NewObservationReader(bufio.NewReader(file), format, done)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	started, reported := time.Now(), time.Now()
+	for {
+		batch, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintf(os.Stderr, "%s: imported %d observations in %s\n", path, state[path]-done, time.Since(started).Round(time.Millisecond))
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if err := client.BulkWrite(batch.Metrics); err != nil {
+			return fmt.Errorf("%s: after %d observations: %w", path, state[path], err)
+		}
+
+		// the reader may have read one observation ahead of the batch
+		state[path] += len(batch.Metrics)
+		if err := save(); err != nil {
+			return err
+		}
+
+		if progress > 0 && time.Since(reported) >= progress {
+			reported = time.Now()
+			fmt.Fprintf(os.Stderr, "%s: %d observations\n", path, state[path])
+		}
+	}
+}
+
+func init() {
+	commands["import"] = command{
+		usage: "stream historical observations from csv or json files to a server",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("import", flag.ContinueOnError)
+			server := flags.String("url", "http://localhost:8080", "where the database's handler is served")
+			format := flags.String("format", "csv", "the format of the files, csv or json")
+			resume := flags.String("resume", "", "a file to record progress in, so an interrupted import can be resumed")
+			progress := flags.Duration("progress", 5*time.Second, "how often to report progress, or 0 to only report each file")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+			if flags.NArg() == 0 {
+				return fmt.Errorf("expected files to import")
+			}
+
+			state := make(map[string]int)
+			save := func() error { return nil }
+			if *resume != "" {
+				if data, err := os.ReadFile(*resume); err == nil {
+					if err := json.Unmarshal(data, &state); err != nil {
+						return fmt.Errorf("resume file %s: %w", *resume, err)
+					}
+				} else if !os.IsNotExist(err) {
+					return err
+				}
+
+				save = func() error {
+					data, _ := json.Marshal(state)
+					return os.WriteFile(*resume, data, 0644)
+				}
+			}
+
+			client := NewClient(*server, WithCompression("gzip"))
+			for _, path := range flags.Args() {
+				if err := importFile(client, path, *format, state, save, *progress); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	}
+}
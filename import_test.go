@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObservationReader(t *testing.T) {
+	csv := "time,value\n" +
+		"2024-01-01T00:00:00Z,10\n" +
+		"2024-01-01T00:00:00Z,20.4\n" +
+		"2024-01-01T00:01:00Z,30\n"
+	json := `{"value": 10, "time": "2024-01-01T00:00:00Z"}` + "\n" +
+		`{"value": 20.4, "time": 1704067200}` + "\n\n" +
+		`{"value": 30, "time": "2024-01-01T00:01:00Z"}` + "\n"
+
+	for format, input := range map[string]string{"csv": csv, "json": json} {
+		reader, err := NewObservationReader(strings.NewReader(input), format, 0)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", format, err)
+		}
+
+		// consecutive observations made at the same time are batched
+		first, err := reader.Next()
+		if err != nil || len(first.Metrics) != 2 || first.Metrics[1].Value() != 20 {
+			t.Fatalf("%s: unexpected batch %+v, %v", format, first, err)
+		}
+		second, err := reader.Next()
+		if err != nil || len(second.Metrics) != 1 || !second.Time.Equal(first.Time.Add(time.Minute)) {
+			t.Fatalf("%s: unexpected batch %+v, %v", format, second, err)
+		}
+		if _, err := reader.Next(); err != io.EOF {
+			t.Fatalf("%s: expected EOF, got %v", format, err)
+		}
+		if reader.Observations() != 3 {
+			t.Fatalf("%s: expected 3 observations, got %d", format, reader.Observations())
+		}
+	}
+}
+
+func TestObservationReaderResume(t *testing.T) {
+	input := "value\n1\n2\n3\n"
+	reader, err := NewObservationReader(strings.NewReader(input), "csv", 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	batch, err := reader.Next()
+	if err != nil || len(batch.Metrics) != 1 || batch.Metrics[0].Value() != 3 || !batch.Time.IsZero() {
+		t.Fatalf("unexpected batch %+v, %v", batch, err)
+	}
+}
+
+func TestObservationReaderErrors(t *testing.T) {
+	for _, format := range []string{"parquet", "xml"} {
+		if _, err := NewObservationReader(strings.NewReader(""), format, 0); err == nil {
+			t.Fatalf("expected %s to be rejected", format)
+		}
+	}
+	if _, err := NewObservationReader(strings.NewReader("time\n1\n"), "csv", 0); err == nil {
+		t.Fatalf("expected a header without a value column to be rejected")
+	}
+
+	reader, _ := NewObservationReader(strings.NewReader("value\n1\nslow\n"), "csv", 0)
+	if _, err := reader.Next(); !errors.Is(err, ErrInvalidMetric) || !strings.Contains(err.Error(), "observation 2") {
+		t.Fatalf("expected observation 2 to be invalid, got %v", err)
+	}
+}
+
+func TestObservationReaderBackfill(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute)
+	database.now = clock.now
+
+	lines := []string{"time,value"}
+	for i := 0; i < 5; i++ {
+		at := clock.now().Add(-time.Duration(i) * time.Minute).Format(time.RFC3339Nano)
+		lines = append(lines, at+",100", at+",200")
+	}
+	reader, _ := NewObservationReader(strings.NewReader(strings.Join(lines, "\n")), "csv", 0)
+
+	stats, err := database.Backfill(context.Background(), reader)
+	if err != nil || stats.Batches != 5 || stats.Applied != 10 {
+		t.Fatalf("unexpected stats %+v, %v", stats, err)
+	}
+	if count := database.GetWindow(time.Hour).Count(); count != 10 {
+		t.Fatalf("expected 10 metrics, got %d", count)
+	}
+}
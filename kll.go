@@ -0,0 +1,423 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// sketches are interchanged with Apache DataSketches as KLL sketches, in
+// their compact binary format, so they can be merged with sketches from
+// Java, C++ or Spark pipelines. Sketches are written as KllDoublesSketch
+// and either doubles or floats sketches are read. The layout, in little
+// endian, is an 8 byte preamble:
+//
+//	preamble ints (u8) | serial version (u8) | family (u8) | flags (u8) | k (u16) | m (u8) | unused (u8)
+//
+// followed by the single item of a sketch of one item, or for any larger
+// sketch by:
+//
+//	n (u64) | min k (u16) | levels (u8) | unused (u8) | level offsets (u32 each, but the last) | min | max | items
+//
+// where the items of level h each stand for 2^h values, and the level
+// offsets index a buffer whose size depends on k, m and the levels, with
+// the items packed at its end.
+const (
+	kllFamily    = 15
+	kllDefaultK  = 200
+	kllMaxK      = math.MaxUint16
+	kllMaxLevels = 61
+
+	// the smallest capacity of any level, m in DataSketches
+	kllMinWidth = 8
+
+	kllPreambleIntsShort = 2
+	kllPreambleIntsFull  = 5
+	kllFullPreambleBytes = 20
+
+	kllSerialVersionFull      = 1
+	kllSerialVersionSingle    = 2
+	kllSerialVersionUpdatable = 3
+
+	kllFlagEmpty           = 1
+	kllFlagLevelZeroSorted = 2
+	kllFlagSingleItem      = 4
+
+	// depths beyond which capacities are computed in two steps, so they
+	// don't overflow
+	kllCapacityDepthSplitLimit = 30
+)
+
+// a kllSketch holds the items of each level, sorted, where each item of
+// level h stands for 2^h values
+type kllSketch struct {
+	k      int
+	levels [][]float64
+	n      uint64
+
+	// the true extremes of the values, which compaction may drop from
+	// the levels
+	minimum, maximum float64
+
+	// alternates which item of each pair survives a compaction, so
+	// values aren't consistently rounded down or up
+	odd bool
+}
+
+// builds a sketch holding the values exactly, as long as there are few
+// enough distinct values for them to fit in the sketch, and otherwise
+// compacts them as a KLL sketch would
+func newKLLSketch(k int, values, counts []int) *kllSketch {
+	s := &kllSketch{k: k, levels: [][]float64{{}}, minimum: math.Inf(1), maximum: math.Inf(-1)}
+
+	// a count is split by its binary digits, eg: a count of 5 is an item
+	// at level 0 and an item at level 2, which keeps every level sorted
+	for i, value := range values {
+		s.n += uint64(counts[i])
+		s.minimum, s.maximum = math.Min(s.minimum, float64(value)), math.Max(s.maximum, float64(value))
+		for count, h := counts[i], 0; count > 0; count, h = count>>1, h+1 {
+			if count&1 == 0 {
+				continue
+			}
+			for len(s.levels) <= h {
+				s.levels = append(s.levels, []float64{})
+			}
+			s.levels[h] = append(s.levels[h], float64(value))
+		}
+	}
+
+	for s.retained() > kllTotalCapacity(s.k, len(s.levels)) {
+		s.compact(s.levelToCompact())
+	}
+
+	return s
+}
+
+func (s *kllSketch) retained() int {
+	retained := 0
+	for _, level := range s.levels {
+		retained += len(level)
+	}
+
+	return retained
+}
+
+// the lowest level which has reached its capacity, which there always is
+// while the sketch is over its total capacity
+func (s *kllSketch) levelToCompact() int {
+	for h, level := range s.levels {
+		if len(level) >= kllLevelCapacity(s.k, len(s.levels), h) {
+			return h
+		}
+	}
+
+	return len(s.levels) - 1
+}
+
+// halves the level by keeping one item of each pair at the level above,
+// where it stands for both. An odd item out is left where it is.
+func (s *kllSketch) compact(h int) {
+	if h == len(s.levels)-1 {
+		s.levels = append(s.levels, []float64{})
+	}
+
+	level := s.levels[h]
+	kept := []float64{}
+	if len(level)%2 == 1 {
+		kept, level = append(kept, level[0]), level[1:]
+	}
+
+	offset := 0
+	if s.odd {
+		offset = 1
+	}
+	s.odd = !s.odd
+
+	promoted := make([]float64, 0, len(level)/2+len(s.levels[h+1]))
+	for i := offset; i < len(level); i += 2 {
+		promoted = append(promoted, level[i])
+	}
+	promoted = append(promoted, s.levels[h+1]...)
+	sort.Float64s(promoted)
+
+	s.levels[h], s.levels[h+1] = kept, promoted
+}
+
+// the capacity of level h of a sketch with the given number of levels,
+// computed exactly as DataSketches does, as the layout depends on it
+func kllLevelCapacity(k, levels, h int) int {
+	return max(kllMinWidth, kllCapacityAux(k, levels-h-1))
+}
+
+func kllTotalCapacity(k, levels int) int {
+	total := 0
+	for h := 0; h < levels; h++ {
+		total += kllLevelCapacity(k, levels, h)
+	}
+
+	return total
+}
+
+// k * (2/3)^depth, rounded
+func kllCapacityAux(k, depth int) int {
+	if depth <= kllCapacityDepthSplitLimit {
+		return kllCapacityAuxAux(k, depth)
+	}
+
+	half := depth / 2
+	return kllCapacityAuxAux(kllCapacityAuxAux(k, half), depth-half)
+}
+
+func kllCapacityAuxAux(k, depth int) int {
+	powerOfThree := int64(1)
+	for i := 0; i < depth; i++ {
+		powerOfThree *= 3
+	}
+
+	scaled := (int64(k) << 1 << depth) / powerOfThree
+	return int((scaled + 1) >> 1)
+}
+
+// encodes the sketch as a compact KllDoublesSketch
+func (s *kllSketch) encode() []byte {
+	header := []byte{kllPreambleIntsShort, kllSerialVersionFull, kllFamily, kllFlagLevelZeroSorted, 0, 0, kllMinWidth, 0}
+	binary.LittleEndian.PutUint16(header[4:], uint16(s.k))
+
+	if s.n == 0 {
+		header[3] |= kllFlagEmpty
+		return header
+	}
+	if s.n == 1 {
+		header[1], header[3] = kllSerialVersionSingle, header[3]|kllFlagSingleItem
+		return binary.LittleEndian.AppendUint64(header, math.Float64bits(s.levels[0][0]))
+	}
+
+	header[0] = kllPreambleIntsFull
+	buf := binary.LittleEndian.AppendUint64(header, s.n)
+	buf = binary.LittleEndian.AppendUint16(buf, uint16(s.k))
+	buf = append(buf, byte(len(s.levels)), 0)
+
+	// the items are packed at the end of the buffer
+	offset := kllTotalCapacity(s.k, len(s.levels)) - s.retained()
+	for _, level := range s.levels {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(offset))
+		offset += len(level)
+	}
+
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(s.minimum))
+	buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(s.maximum))
+	for _, level := range s.levels {
+		for _, item := range level {
+			buf = binary.LittleEndian.AppendUint64(buf, math.Float64bits(item))
+		}
+	}
+
+	return buf
+}
+
+// MarshalKLL encodes the snapshot as an Apache DataSketches
+// KllDoublesSketch with the given k, eg: 200, the default of DataSketches.
+// Snapshots with few enough distinct values for the sketch to hold them
+// all are encoded exactly, and larger ones are compacted, with the rank
+// error of any KLL sketch of that k.
+func (s Snapshot) MarshalKLL(k int) ([]byte, error) {
+	if k < kllMinWidth || k > kllMaxK {
+		return nil, fmt.Errorf("kll k %d: must be between %d and %d", k, kllMinWidth, kllMaxK)
+	}
+
+	counts := make([]int, len(s.values))
+	for i := range counts {
+		counts[i] = s.countAt(i)
+	}
+
+	return newKLLSketch(k, s.values, counts).encode(), nil
+}
+
+// MarshalKLL encodes the histogram at the resolution as a KLL sketch, see
+// Snapshot.MarshalKLL, where each bucket's values are at its midpoint.
+func (h *HistogramDatabase) MarshalKLL(resolution, k int) ([]byte, error) {
+	if k < kllMinWidth || k > kllMaxK {
+		return nil, fmt.Errorf("kll k %d: must be between %d and %d", k, kllMinWidth, kllMaxK)
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+
+	histogram, err := h.histogram(resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := histogram.sortedBuckets()
+	values, counts := make([]int, 0, len(buckets)), make([]int, 0, len(buckets))
+	for _, bucket := range buckets {
+		values = append(values, bucket*histogram.width+histogram.width/2)
+		counts = append(counts, histogram.counts[bucket])
+	}
+
+	return newKLLSketch(k, values, counts).encode(), nil
+}
+
+// UnmarshalKLL decodes a compact Apache DataSketches KLL doubles or floats
+// sketch into the values it stands for, merged and rounded to the nearest
+// integer, so they can be written to any database. Items of higher levels
+// stand for many values, so a database written with the metrics of a
+// compacted sketch carries the sketch's error. Malformed sketches fail
+// with ErrSnapshotCorrupt.
+func UnmarshalKLL(data []byte) ([]*BulkMetric, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("kll sketch of %d bytes: %w", len(data), ErrSnapshotCorrupt)
+	}
+	if data[2] != kllFamily {
+		return nil, fmt.Errorf("kll sketch family %d, expected %d: %w", data[2], kllFamily, ErrSnapshotCorrupt)
+	}
+
+	serialVersion, flags := data[1], data[3]
+	k, m := int(binary.LittleEndian.Uint16(data[4:])), int(data[6])
+	switch {
+	case serialVersion == kllSerialVersionUpdatable:
+		return nil, fmt.Errorf("kll sketch is updatable, serialize it compact instead: %w", ErrSnapshotCorrupt)
+	case flags&kllFlagEmpty != 0:
+		return []*BulkMetric{}, nil
+	case flags&kllFlagSingleItem != 0 || serialVersion == kllSerialVersionSingle:
+		item, err := kllItem(data[8:], len(data)-8)
+		if err != nil {
+			return nil, err
+		}
+		return []*BulkMetric{{value: item, count: 1}}, nil
+	case serialVersion != kllSerialVersionFull || len(data) < kllFullPreambleBytes:
+		return nil, fmt.Errorf("kll sketch serial version %d: %w", serialVersion, ErrSnapshotCorrupt)
+	}
+
+	n := binary.LittleEndian.Uint64(data[8:])
+	levels := int(data[18])
+	if levels < 1 || levels > kllMaxLevels || m < 2 || len(data) < kllFullPreambleBytes+4*levels {
+		return nil, fmt.Errorf("kll sketch of %d levels: %w", levels, ErrSnapshotCorrupt)
+	}
+
+	offsets := make([]int, levels+1)
+	for h := 0; h < levels; h++ {
+		offsets[h] = int(binary.LittleEndian.Uint32(data[kllFullPreambleBytes+4*h:]))
+	}
+	offsets[levels] = 0
+	for h := 0; h < levels; h++ {
+		offsets[levels] += max(m, kllCapacityAux(k, levels-h-1))
+	}
+
+	retained := offsets[levels] - offsets[0]
+	items := data[kllFullPreambleBytes+4*levels:]
+	if retained < 1 || len(items)%(retained+2) != 0 {
+		return nil, fmt.Errorf("kll sketch of %d items in %d bytes: %w", retained, len(items), ErrSnapshotCorrupt)
+	}
+	size := len(items) / (retained + 2)
+
+	// the min and max come first, and aren't needed
+	items = items[2*size:]
+	counts := make(map[int]int)
+	weight, total := 1, uint64(0)
+	for h := 0; h < levels; h++ {
+		if offsets[h+1] < offsets[h] {
+			return nil, fmt.Errorf("kll sketch level %d: %w", h, ErrSnapshotCorrupt)
+		}
+		for i := offsets[h]; i < offsets[h+1]; i++ {
+			item, err := kllItem(items[(i-offsets[0])*size:], size)
+			if err != nil {
+				return nil, err
+			}
+			counts[item] += weight
+			total += uint64(weight)
+		}
+		weight <<= 1
+	}
+	if total != n {
+		return nil, fmt.Errorf("kll sketch items stand for %d values, expected %d: %w", total, n, ErrSnapshotCorrupt)
+	}
+
+	metrics := make([]*BulkMetric, 0, len(counts))
+	for value, count := range counts {
+		metrics = append(metrics, &BulkMetric{value: value, count: count})
+	}
+
+	return BulkMetrics(metrics).Merge(), nil
+}
+
+// decodes a double, or a float, rounded to the nearest integer
+func kllItem(data []byte, size int) (int, error) {
+	item := 0.0
+	switch size {
+	case 8:
+		item = math.Float64frombits(binary.LittleEndian.Uint64(data))
+	case 4:
+		item = float64(math.Float32frombits(binary.LittleEndian.Uint32(data)))
+	default:
+		return 0, fmt.Errorf("kll sketch items of %d bytes: %w", size, ErrSnapshotCorrupt)
+	}
+
+	if math.IsNaN(item) || math.IsInf(item, 0) || math.Abs(item) >= math.MaxInt64 {
+		return 0, fmt.Errorf("kll sketch item %v: %w", item, ErrSnapshotCorrupt)
+	}
+
+	return int(math.Round(item)), nil
+}
+
+// serves the database as a KLL sketch, or merges a POSTed sketch into it
+func serveSketch(w http.ResponseWriter, r *http.Request, database Database, config *handlerConfig) {
+	switch r.Method {
+	case http.MethodGet:
+		k := kllDefaultK
+		if param := r.URL.Query().Get("k"); param != "" {
+			parsed, err := strconv.Atoi(param)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("k %q: must be an integer", param), http.StatusBadRequest)
+				return
+			}
+			k = parsed
+		}
+
+		var sketch []byte
+		var err error
+		if histogram, ok := database.(*HistogramDatabase); ok && len(histogram.Resolutions()) > 0 {
+			sketch, err = histogram.MarshalKLL(histogram.Resolutions()[0], k)
+		} else if snapshotter, ok := database.(Snapshotter); ok {
+			snapshot, snapshotErr := snapshotter.Snapshot()
+			if snapshotErr != nil {
+				http.Error(w, snapshotErr.Error(), http.StatusInternalServerError)
+				return
+			}
+			sketch, err = snapshot.MarshalKLL(k)
+		} else {
+			http.Error(w, fmt.Sprintf("%T can't be sketched", database), http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(sketch)
+	case http.MethodPost:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metrics, err := UnmarshalKLL(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(metrics) > 0 && !config.write(w, database, metrics) {
+			return
+		}
+		config.advertise(w)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "sketches can only be read or POSTed", http.StatusMethodNotAllowed)
+	}
+}
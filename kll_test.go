@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKLLCapacity(t *testing.T) {
+	// as computed by DataSketches
+	cases := []struct{ k, levels, expected int }{
+		{200, 1, 200},
+		{200, 2, 333},
+		{200, 3, 422},
+		{8, 3, 24},
+	}
+	for _, c := range cases {
+		if actual := kllTotalCapacity(c.k, c.levels); actual != c.expected {
+			t.Fatalf("expected a capacity of %d for k %d and %d levels, got %d", c.expected, c.k, c.levels, actual)
+		}
+	}
+}
+
+func TestKLLRoundTrip(t *testing.T) {
+	database := NewSyncMedianDatabase()
+	database.BulkWrite(append(buildBulkMetrics(-50, 51), &BulkMetric{value: 7, count: 1000}))
+	snapshot, _ := database.Snapshot()
+
+	sketch, err := snapshot.MarshalKLL(kllDefaultK)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if sketch[0] != kllPreambleIntsFull || sketch[1] != kllSerialVersionFull || sketch[2] != kllFamily || binary.LittleEndian.Uint16(sketch[4:]) != 200 {
+		t.Fatalf("unexpected preamble % x", sketch[:8])
+	}
+	if n := binary.LittleEndian.Uint64(sketch[8:]); n != 1101 {
+		t.Fatalf("expected n of 1101, got %d", n)
+	}
+
+	// few enough values for the sketch to hold them exactly
+	metrics, err := UnmarshalKLL(sketch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoded := NewSyncMedianDatabase()
+	decoded.BulkWrite(metrics)
+	restored, _ := decoded.Snapshot()
+	for _, p := range []float64{0, 0.1, 0.5, 0.9, 1} {
+		if restored.GetPercentile(p) != snapshot.GetPercentile(p) {
+			t.Fatalf("expected p%v of %d, got %d", p*100, snapshot.GetPercentile(p), restored.GetPercentile(p))
+		}
+	}
+	if restored.Count() != 1101 || restored.Min() != -50 {
+		t.Fatalf("unexpected restored count %d and min %d", restored.Count(), restored.Min())
+	}
+
+	if _, err := snapshot.MarshalKLL(4); err == nil {
+		t.Fatalf("expected k below the minimum width to be rejected")
+	}
+}
+
+func TestKLLCompaction(t *testing.T) {
+	database := NewSyncMedianDatabase()
+	database.BulkWrite(buildBulkMetrics(0, 100000))
+	snapshot, _ := database.Snapshot()
+
+	sketch, _ := snapshot.MarshalKLL(kllDefaultK)
+	if len(sketch) > 8*1000 {
+		t.Fatalf("expected the sketch to be compacted, got %d bytes", len(sketch))
+	}
+
+	// the extremes are the true ones, even though compaction dropped them
+	// from the items
+	extremes := kllFullPreambleBytes + 4*int(sketch[18])
+	minimum := math.Float64frombits(binary.LittleEndian.Uint64(sketch[extremes:]))
+	maximum := math.Float64frombits(binary.LittleEndian.Uint64(sketch[extremes+8:]))
+	if minimum != 0 || maximum != 99999 {
+		t.Fatalf("expected a min of 0 and a max of 99999, got %v and %v", minimum, maximum)
+	}
+
+	metrics, err := UnmarshalKLL(sketch)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	decoded := NewSyncMedianDatabase()
+	decoded.BulkWrite(metrics)
+	restored, _ := decoded.Snapshot()
+	if restored.Count() != 100000 {
+		t.Fatalf("expected the sketch to stand for every value, got %d", restored.Count())
+	}
+
+	// the rank error of a KLL sketch with a k of 200 is about 1.65%
+	for _, p := range []float64{0.01, 0.25, 0.5, 0.75, 0.99} {
+		if actual, expected := restored.GetPercentile(p), snapshot.GetPercentile(p); math.Abs(float64(actual-expected)) > 2000 {
+			t.Fatalf("expected p%v near %d, got %d", p*100, expected, actual)
+		}
+	}
+}
+
+func TestUnmarshalKLLFixtures(t *testing.T) {
+	float32s := func(values ...float32) []byte {
+		buf := []byte{}
+		for _, value := range values {
+			buf = binary.LittleEndian.AppendUint32(buf, math.Float32bits(value))
+		}
+		return buf
+	}
+
+	// an empty and a single item doubles sketch, and a floats sketch of
+	// 1, 2 and 3 with a k of 200, laid out by hand from the DataSketches
+	// serialization format rather than written by the library itself
+	empty := []byte{0x02, 0x01, 0x0f, 0x01, 0xc8, 0x00, 0x08, 0x00}
+	single := append([]byte{0x02, 0x02, 0x0f, 0x04, 0xc8, 0x00, 0x08, 0x00}, binary.LittleEndian.AppendUint64(nil, math.Float64bits(41.6))...)
+	floats := []byte{0x05, 0x01, 0x0f, 0x02, 0xc8, 0x00, 0x08, 0x00, 3, 0, 0, 0, 0, 0, 0, 0, 0xc8, 0x00, 0x01, 0x00, 197, 0, 0, 0}
+	floats = append(floats, float32s(1, 3, 1, 2, 3)...)
+
+	if metrics, err := UnmarshalKLL(empty); err != nil || len(metrics) != 0 {
+		t.Fatalf("unexpected empty sketch %v: %v", metrics, err)
+	}
+	if metrics, err := UnmarshalKLL(single); err != nil || len(metrics) != 1 || metrics[0].Value() != 42 {
+		t.Fatalf("unexpected single item sketch %v: %v", metrics, err)
+	}
+	metrics, err := UnmarshalKLL(floats)
+	if err != nil || len(metrics) != 3 || metrics[0].Value() != 1 || metrics[2].Value() != 3 {
+		t.Fatalf("unexpected floats sketch %v: %v", metrics, err)
+	}
+
+	wrongFamily := append([]byte{}, empty...)
+	wrongFamily[2] = 7
+	wrongCount := append([]byte{}, floats...)
+	wrongCount[8] = 4
+	updatable := append([]byte{}, floats...)
+	updatable[1] = kllSerialVersionUpdatable
+	for name, corrupt := range map[string][]byte{
+		"truncated":    floats[:len(floats)-3],
+		"short":        empty[:4],
+		"wrong family": wrongFamily,
+		"wrong count":  wrongCount,
+		"updatable":    updatable,
+	} {
+		if _, err := UnmarshalKLL(corrupt); !errors.Is(err, ErrSnapshotCorrupt) {
+			t.Fatalf("%s: expected ErrSnapshotCorrupt, got %v", name, err)
+		}
+	}
+}
+
+func TestHandlerSketch(t *testing.T) {
+	source := NewSyncMedianDatabase()
+	source.BulkWrite(buildBulkMetrics(1, 1001))
+	sourceServer := httptest.NewServer(NewHandler(source))
+	defer sourceServer.Close()
+
+	destination := NewSyncMedianDatabase()
+	destination.BulkWrite(buildBulkMetrics(1001, 2001))
+	destinationServer := httptest.NewServer(NewHandler(destination))
+	defer destinationServer.Close()
+
+	response, err := http.Get(sourceServer.URL + "/sketch?k=100")
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %v: %v", response, err)
+	}
+	sketch, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	response, err = http.Post(destinationServer.URL+"/sketch", "application/octet-stream", bytes.NewReader(sketch))
+	if err != nil || response.StatusCode != http.StatusNoContent {
+		t.Fatalf("unexpected response %v: %v", response, err)
+	}
+	response.Body.Close()
+
+	if median, count := destination.GetMedianAndCount(); count != 2000 || median < 950 || median > 1050 {
+		t.Fatalf("expected the sketches to be merged, got a median of %d of %d", median, count)
+	}
+
+	histogram := newTestHistogramDatabase(10)
+	histogram.BulkWrite(buildBulkMetrics(0, 100))
+	histogramServer := httptest.NewServer(NewHandler(histogram))
+	defer histogramServer.Close()
+
+	response, err = http.Get(histogramServer.URL + "/sketch")
+	if err != nil || response.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected response %v: %v", response, err)
+	}
+	sketch, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	if metrics, err := UnmarshalKLL(sketch); err != nil || len(metrics) != 10 || metrics[0].Value() != 5 || metrics[0].Count() != 10 {
+		t.Fatalf("expected a value per bucket at its midpoint, got %v: %v", metrics, err)
+	}
+
+	for path, status := range map[string]int{"/sketch?k=x": http.StatusBadRequest, "/sketch?k=1": http.StatusBadRequest} {
+		response, err := http.Get(sourceServer.URL + path)
+		if err != nil || response.StatusCode != status {
+			t.Fatalf("expected %d for %s, got %v: %v", status, path, response, err)
+		}
+		response.Body.Close()
+	}
+	response, _ = http.Post(sourceServer.URL+"/sketch", "application/octet-stream", bytes.NewReader([]byte{1, 2, 3}))
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a malformed sketch to be rejected, got %d", response.StatusCode)
+	}
+	response.Body.Close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+// a LimitWarning is raised when the usage of a limit crosses its soft
+// threshold, before the hard limit starts rejecting or degrading
+type LimitWarning struct {
+	// which limit, eg: series, distinct values, bytes or flush queue
+	Limit string
+	// what the limit applies to, eg: a tenant or a worker's name, which
+	// is empty for limits on a single database
+	Scope string
+
+	Usage int
+	Soft  int
+	Hard  int
+}
+
+// a SoftLimit warns once usage of a hard limit reaches a fraction of it,
+// giving operators time to react before anything is rejected
+type SoftLimit struct {
+	// the fraction of the hard limit warnings start at, eg: 0.8
+	Fraction float64
+
+	// called once usage reaches the soft threshold, and again only once
+	// usage has dropped back under it and reached it again. It is called
+	// synchronously from the write which crossed the threshold, so it
+	// must not block.
+	Warn func(LimitWarning)
+}
+
+// the usage at which the soft limit warns
+func (s SoftLimit) threshold(hard int) int {
+	return int(math.Ceil(float64(hard) * s.Fraction))
+}
+
+// tracks which limits and scopes have been warned about, so each crossing
+// is only warned about once. A nil softLimiter never warns.
+type softLimiter struct {
+	sync.Mutex
+
+	limit  SoftLimit
+	warned map[[2]string]bool
+}
+
+func newSoftLimiter(limit SoftLimit) *softLimiter {
+	if limit.Warn == nil || limit.Fraction <= 0 {
+		return nil
+	}
+
+	return &softLimiter{limit: limit, warned: make(map[[2]string]bool)}
+}
+
+// warns if usage has crossed the soft threshold of the hard limit since
+// the last check, re-arming the warning once usage drops back under it
+func (s *softLimiter) check(limit, scope string, usage, hard int) {
+	if s == nil || hard <= 0 {
+		return
+	}
+
+	soft := s.limit.threshold(hard)
+	key := [2]string{limit, scope}
+
+	s.Lock()
+	crossed := usage >= soft && !s.warned[key]
+	if usage >= soft {
+		s.warned[key] = true
+	} else {
+		delete(s.warned, key)
+	}
+	s.Unlock()
+
+	if crossed {
+		s.limit.Warn(LimitWarning{Limit: limit, Scope: scope, Usage: usage, Soft: soft, Hard: hard})
+	}
+}
+
+// WithSeriesSoftLimit warns once a tenant's series reach a fraction of the
+// series database's maximum, before new series start being routed into
+// the overflow series.
+func WithSeriesSoftLimit(limit SoftLimit) SeriesOption {
+	return func(s *SeriesDatabase) {
+		s.softLimit = newSoftLimiter(limit)
+	}
+}
+
+// WithFlushQueueSoftLimit warns once the flushes waiting on the database
+// reach a fraction of the flush queue's depth, see WithFlushQueue, before
+// flushes start blocking or being dropped.
+func WithFlushQueueSoftLimit(limit SoftLimit) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.softLimit = newSoftLimiter(limit)
+	}
+}
+
+// SetSoftLimit warns once a tenant's series reach a fraction of its
+// quota's MaxSeries, before writes to new series start being refused.
+func (t *Tenants) SetSoftLimit(limit SoftLimit) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.softLimit = newSoftLimiter(limit)
+}
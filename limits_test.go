@@ -0,0 +1,80 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// collects the warnings raised by a soft limit
+type warnings struct {
+	sync.Mutex
+	raised []LimitWarning
+}
+
+func (w *warnings) limit(fraction float64) SoftLimit {
+	return SoftLimit{Fraction: fraction, Warn: func(warning LimitWarning) {
+		w.Lock()
+		defer w.Unlock()
+		w.raised = append(w.raised, warning)
+	}}
+}
+
+func (w *warnings) get() []LimitWarning {
+	w.Lock()
+	defer w.Unlock()
+	return append([]LimitWarning{}, w.raised...)
+}
+
+func TestSeriesSoftLimit(t *testing.T) {
+	raised := &warnings{}
+	series := NewSeriesDatabase(10, func() Database { return NewSyncMedianDatabase() }, WithSeriesSoftLimit(raised.limit(0.8)))
+
+	for i := 0; i < 12; i++ {
+		series.Write(SeriesKey{Tenant: "a", Name: string(rune('a' + i))}, buildBulkMetrics(0, 1))
+	}
+
+	// warned once, at 8 of 10 series, however far beyond it usage went
+	expected := LimitWarning{Limit: "series", Scope: "a", Usage: 8, Soft: 8, Hard: 10}
+	if got := raised.get(); len(got) != 1 || got[0] != expected {
+		t.Fatalf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestDegradationSoftLimit(t *testing.T) {
+	raised := &warnings{}
+	database := NewDegradingDatabase(DegradationPolicy{MaxDistinctValues: 100, Resolution: 10, Soft: raised.limit(0.5)})
+	database.Open()
+	defer database.Close()
+
+	for i := 0; i < 6; i++ {
+		database.BulkWrite(buildBulkMetrics(i*10, i*10+10))
+		time.Sleep(time.Millisecond)
+	}
+	for deadline := time.Now().Add(time.Second); len(raised.get()) == 0 && time.Now().Before(deadline); {
+		database.BulkWrite(buildBulkMetrics(0, 1))
+		time.Sleep(time.Millisecond)
+	}
+
+	if got := raised.get(); len(got) != 1 || got[0].Limit != "distinct values" || got[0].Soft != 50 || database.Degraded() {
+		t.Fatalf("expected a warning before degrading, got %+v", got)
+	}
+}
+
+func TestFlushQueueSoftLimit(t *testing.T) {
+	raised := &warnings{}
+	database := newStalledDatabase()
+	worker := NewBufferedWorker(1, time.Hour, database, WithWorkerName("ingest"),
+		WithFlushQueue(4, DropFlushes), WithFlushQueueSoftLimit(raised.limit(0.5)))
+	worker.Start()
+
+	for i := 0; i < 10; i++ {
+		worker.Write(NewIntMetric(i))
+	}
+	close(database.release)
+	worker.Stop()
+
+	if got := raised.get(); len(got) != 1 || got[0].Limit != "flush queue" || got[0].Scope != "ingest" || got[0].Hard != 4 {
+		t.Fatalf("expected a warning as the queue filled, got %+v", got)
+	}
+}
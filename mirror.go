@@ -0,0 +1,173 @@
+package main
+
+import (
+	"math"
+	"sync"
+)
+
+type MirrorStats struct {
+	// batches written to the primary, and how many of those the
+	// secondary failed to write
+	Batches         uint64
+	SecondaryErrors uint64
+	LastError       error
+
+	// how far the secondary's median was from the primary's, as of the
+	// last Compare, along with the largest difference seen so far
+	Comparisons   uint64
+	Divergence    int
+	MaxDivergence int
+
+	// queries duplicated to the secondary, and how many of those were
+	// further from the primary than the tolerance
+	ShadowReads      uint64
+	ShadowMismatches uint64
+}
+
+// a ShadowReadPolicy duplicates queries to the secondary and compares the
+// answers. An answer mismatches when it differs from the primary's by more
+// than both tolerances, so zero tolerances count any difference.
+type ShadowReadPolicy struct {
+	// the absolute difference allowed
+	Tolerance int
+	// the difference allowed as a fraction of the primary's answer, eg:
+	// 0.05 for an approximate backend with a 5% error bound
+	RelativeTolerance float64
+
+	// called with every mismatch, eg: to log it. It is called before the
+	// query returns, so must be quick
+	OnMismatch func(ShadowMismatch)
+}
+
+type ShadowMismatch struct {
+	Query     string
+	Primary   int
+	Secondary int
+}
+
+func (s ShadowReadPolicy) mismatched(primary, secondary int) bool {
+	difference := math.Abs(float64(secondary - primary))
+	return difference > float64(s.Tolerance) && difference > s.RelativeTolerance*math.Abs(float64(primary))
+}
+
+type MirrorOption func(*MirrorDatabase)
+
+// WithShadowReads duplicates every query to the secondary, counting the
+// answers which mismatch the primary's. The primary's answer is always
+// the one returned.
+func WithShadowReads(policy ShadowReadPolicy) MirrorOption {
+	return func(m *MirrorDatabase) {
+		m.shadow = &policy
+	}
+}
+
+// a MirrorDatabase writes every batch to a primary and a secondary
+// database, so that a new backend can be run against production traffic
+// and compared with the one it replaces before cutting over. Queries are
+// only answered by the primary, and errors from the secondary are counted
+// rather than returned.
+type MirrorDatabase struct {
+	sync.Mutex
+
+	primary   Database
+	secondary Database
+	shadow    *ShadowReadPolicy
+	stats     MirrorStats
+}
+
+func NewMirrorDatabase(primary, secondary Database, options ...MirrorOption) *MirrorDatabase {
+	m := &MirrorDatabase{
+		primary:   primary,
+		secondary: secondary,
+	}
+
+	for _, option := range options {
+		option(m)
+	}
+
+	return m
+}
+
+func (m *MirrorDatabase) Open() {
+	m.primary.Open()
+	m.secondary.Open()
+}
+
+func (m *MirrorDatabase) Close() {
+	m.primary.Close()
+	m.secondary.Close()
+}
+
+func (m *MirrorDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	// each database may hold on to, or modify, the metrics it is given
+	err := m.primary.BulkWrite(copyMetrics(bulkMetrics))
+	if err != nil {
+		return err
+	}
+	secondaryErr := m.secondary.BulkWrite(copyMetrics(bulkMetrics))
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Batches++
+	if secondaryErr != nil {
+		m.stats.SecondaryErrors++
+		m.stats.LastError = secondaryErr
+	}
+
+	return nil
+}
+
+func (m *MirrorDatabase) GetMedian() int {
+	median := m.primary.GetMedian()
+	if m.shadow != nil {
+		m.shadowRead("median", median, m.secondary.GetMedian())
+	}
+
+	return median
+}
+
+// records the secondary's answer to a shadowed query
+func (m *MirrorDatabase) shadowRead(query string, primary, secondary int) {
+	mismatched := m.shadow.mismatched(primary, secondary)
+
+	m.Lock()
+	m.stats.ShadowReads++
+	if mismatched {
+		m.stats.ShadowMismatches++
+	}
+	m.Unlock()
+
+	if mismatched && m.shadow.OnMismatch != nil {
+		m.shadow.OnMismatch(ShadowMismatch{Query: query, Primary: primary, Secondary: secondary})
+	}
+}
+
+// Compare records how far the secondary's median is from the primary's,
+// and returns the difference. Databases which apply writes asynchronously
+// can briefly diverge while a batch is in flight, so compare periodically
+// and watch the maximum rather than alerting on a single comparison.
+func (m *MirrorDatabase) Compare() int {
+	divergence := m.secondary.GetMedian() - m.primary.GetMedian()
+	if divergence < 0 {
+		divergence = -divergence
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	m.stats.Comparisons++
+	m.stats.Divergence = divergence
+	if divergence > m.stats.MaxDivergence {
+		m.stats.MaxDivergence = divergence
+	}
+
+	return divergence
+}
+
+func (m *MirrorDatabase) Stats() MirrorStats {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.stats
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMirrorDatabase(t *testing.T) {
+	// an exact database mirrored into a coarse histogram
+	database := NewMirrorDatabase(NewRollingDatabase(1000, RejectNew), newTestHistogramDatabase(10))
+	database.Open()
+	defer database.Close()
+
+	if err := database.BulkWrite(buildBulkMetrics(0, 101)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if median := database.GetMedian(); median != 50 {
+		t.Fatalf("expected the primary's median of 50, got %d", median)
+	}
+
+	// the histogram answers with its bucket midpoint
+	if divergence := database.Compare(); divergence != 5 {
+		t.Fatalf("expected a divergence of 5, got %d", divergence)
+	}
+
+	// the secondary rejecting a write doesn't fail it
+	mirror := NewMirrorDatabase(NewRollingDatabase(1000, RejectNew), NewRollingDatabase(100, RejectNew))
+	mirror.BulkWrite(buildBulkMetrics(0, 100))
+	if err := mirror.BulkWrite(buildBulkMetrics(0, 10)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	stats := mirror.Stats()
+	if stats.Batches != 2 || stats.SecondaryErrors != 1 || stats.LastError == nil {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestMirrorDatabaseShadowReads(t *testing.T) {
+	var mismatches []ShadowMismatch
+	database := NewMirrorDatabase(NewRollingDatabase(1000, RejectNew), newTestHistogramDatabase(10), WithShadowReads(ShadowReadPolicy{
+		RelativeTolerance: 0.1,
+		OnMismatch: func(mismatch ShadowMismatch) {
+			mismatches = append(mismatches, mismatch)
+		},
+	}))
+
+	// 50 against the histogram's 55 is within 10%
+	database.BulkWrite(buildBulkMetrics(0, 101))
+	if median := database.GetMedian(); median != 50 {
+		t.Fatalf("expected the primary's median of 50, got %d", median)
+	}
+
+	// 1 against the histogram's 5 isn't
+	database = NewMirrorDatabase(NewRollingDatabase(1000, RejectNew), newTestHistogramDatabase(10), WithShadowReads(ShadowReadPolicy{
+		RelativeTolerance: 0.1,
+		OnMismatch: func(mismatch ShadowMismatch) {
+			mismatches = append(mismatches, mismatch)
+		},
+	}))
+	database.BulkWrite(buildBulkMetrics(0, 3))
+	if median := database.GetMedian(); median != 1 {
+		t.Fatalf("expected the primary's median of 1, got %d", median)
+	}
+
+	if stats := database.Stats(); stats.ShadowReads != 1 || stats.ShadowMismatches != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if len(mismatches) != 1 || mismatches[0] != (ShadowMismatch{Query: "median", Primary: 1, Secondary: 5}) {
+		t.Fatalf("unexpected mismatches %+v", mismatches)
+	}
+}
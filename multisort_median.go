@@ -1,5 +1,10 @@
 package main
 
+import (
+	"math"
+	"sort"
+)
+
 type Metric interface {
 	Value() int
 }
@@ -18,9 +23,112 @@ func (i IntMetric) Value() int {
 	return i.value
 }
 
+// a FloatMetric is a raw observation which is stored rounded to the
+// nearest int, eg: a latency in fractional milliseconds. The worker keeps
+// the raw values in aggregate so that the exact mean and extremes survive
+// the rounding.
+type FloatMetric struct {
+	raw float64
+}
+
+func NewFloatMetric(raw float64) *FloatMetric {
+	return &FloatMetric{
+		raw: raw,
+	}
+}
+
+func (f FloatMetric) Value() int {
+	return int(math.Round(f.raw))
+}
+
+func (f FloatMetric) Raw() float64 {
+	return f.raw
+}
+
+// a RawMetric is a metric whose value was bucketed from a raw observation
+type RawMetric interface {
+	Metric
+	Raw() float64
+}
+
+// a MultiMetric expands into many values at ingest, eg: a histogram which
+// was bucketed by a client, so that it can be written in a single call.
+// Expand is called more than once, so must return the same metrics each
+// time, and Value is only used by code which isn't aware of MultiMetric.
+type MultiMetric interface {
+	Metric
+	Expand() []*BulkMetric
+}
+
+// a HistogramMetric is a MultiMetric of pre-bucketed counts
+type HistogramMetric struct {
+	buckets []*BulkMetric
+}
+
+// NewHistogramMetric creates a metric holding count observations of each
+// value.
+func NewHistogramMetric(counts map[int]int) *HistogramMetric {
+	buckets := make(BulkMetrics, 0, len(counts))
+	for value, count := range counts {
+		buckets = append(buckets, &BulkMetric{value: value, count: count})
+	}
+	sort.Sort(buckets)
+
+	return &HistogramMetric{
+		buckets: buckets,
+	}
+}
+
+// Value returns the lowest value in the histogram.
+func (h HistogramMetric) Value() int {
+	if len(h.buckets) == 0 {
+		return 0
+	}
+
+	return h.buckets[0].Value()
+}
+
+func (h HistogramMetric) Expand() []*BulkMetric {
+	return h.buckets
+}
+
 type BulkMetric struct {
 	value int
 	count int
+
+	// the raw observations behind the value, only set for metrics which
+	// were built from them
+	aggregate *Aggregate
+}
+
+// an Aggregate summarizes raw observations
+type Aggregate struct {
+	Count int
+	Sum   float64
+	Min   float64
+	Max   float64
+}
+
+func (a Aggregate) Mean() float64 {
+	if a.Count == 0 {
+		return 0
+	}
+
+	return a.Sum / float64(a.Count)
+}
+
+func (a *Aggregate) merge(other Aggregate) {
+	if other.Count == 0 {
+		return
+	}
+	if a.Count == 0 || other.Min < a.Min {
+		a.Min = other.Min
+	}
+	if a.Count == 0 || other.Max > a.Max {
+		a.Max = other.Max
+	}
+	a.Count += other.Count
+	a.Sum += other.Sum
 }
 
 func (b BulkMetric) Value() int {
@@ -50,6 +158,128 @@ func NewBulkMetric(value int) *BulkMetric {
 	}
 }
 
-func main() {
-	panic("not implemented; use `go test -v` or `go test -benchmark=.` instead")
+// NewAggregateMetric returns a metric for a single raw observation which
+// was bucketed into value.
+func NewAggregateMetric(value int, raw float64) *BulkMetric {
+	return &BulkMetric{
+		value:     value,
+		count:     1,
+		aggregate: &Aggregate{Count: 1, Sum: raw, Min: raw, Max: raw},
+	}
+}
+
+// Observe counts another raw observation which was bucketed into the
+// metric's value.
+func (b *BulkMetric) Observe(raw float64) {
+	b.observe(raw, 1)
+}
+
+// counts the raw observation count times
+func (b *BulkMetric) observe(raw float64, count int) {
+	aggregate := b.Aggregate()
+	aggregate.merge(Aggregate{Count: count, Sum: raw * float64(count), Min: raw, Max: raw})
+	b.aggregate = &aggregate
+	b.count = b.count + count
+}
+
+// Aggregate returns the sum, min and max of the raw observations behind
+// the metric. Metrics which weren't built from raw observations are
+// treated as if every observation was exactly the value.
+func (b BulkMetric) Aggregate() Aggregate {
+	if b.aggregate != nil {
+		return *b.aggregate
+	}
+
+	return Aggregate{
+		Count: b.count,
+		Sum:   float64(b.value) * float64(b.count),
+		Min:   float64(b.value),
+		Max:   float64(b.value),
+	}
+}
+
+// adds the other metric's count and raw observations to the metric
+func (b *BulkMetric) absorb(other *BulkMetric) {
+	if b.aggregate != nil || other.aggregate != nil {
+		aggregate := b.Aggregate()
+		aggregate.merge(other.Aggregate())
+		b.aggregate = &aggregate
+	}
+	b.count = b.count + other.count
+}
+
+// multiplies the metric's count, and its raw observations, by weight
+func (b *BulkMetric) scale(weight int) {
+	if weight == 1 {
+		return
+	}
+
+	b.count = b.count * weight
+	if b.aggregate != nil {
+		b.aggregate.Count = b.aggregate.Count * weight
+		b.aggregate.Sum = b.aggregate.Sum * float64(weight)
+	}
+}
+
+func copyMetrics(metrics []*BulkMetric) []*BulkMetric {
+	copied := make([]*BulkMetric, 0, len(metrics))
+	for _, metric := range metrics {
+		copied = append(copied, copyMetric(metric))
+	}
+
+	return copied
+}
+
+func copyMetric(metric *BulkMetric) *BulkMetric {
+	copied := &BulkMetric{
+		value: metric.Value(),
+		count: metric.Count(),
+	}
+	if metric.aggregate != nil {
+		aggregate := *metric.aggregate
+		copied.aggregate = &aggregate
+	}
+
+	return copied
+}
+
+// BulkMetrics is a batch of BulkMetric which sorts by value
+type BulkMetrics []*BulkMetric
+
+func (b BulkMetrics) Len() int {
+	return len(b)
+}
+
+func (b BulkMetrics) Less(i, j int) bool {
+	return b[i].Value() < b[j].Value()
+}
+
+func (b BulkMetrics) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// Merge returns a new, sorted batch where metrics sharing a value have been
+// combined into a single metric by summing their counts. The returned
+// metrics are copies, so the receiver is left untouched.
+func (b BulkMetrics) Merge() BulkMetrics {
+	sorted := make(BulkMetrics, 0, len(b))
+	for _, metric := range b {
+		if metric != nil {
+			sorted = append(sorted, metric)
+		}
+	}
+	sort.Stable(sorted)
+
+	merged := make(BulkMetrics, 0, len(sorted))
+	for _, metric := range sorted {
+		last := len(merged) - 1
+		if last >= 0 && merged[last].Value() == metric.Value() {
+			merged[last].absorb(metric)
+			continue
+		}
+
+		merged = append(merged, copyMetric(metric))
+	}
+
+	return merged
 }
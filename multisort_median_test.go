@@ -7,3 +7,43 @@ import (
 func TestTemp(t *testing.T) {
 
 }
+
+func TestBulkMetricsMerge(t *testing.T) {
+	two := NewBulkMetric(2)
+	two.IncrBy(2)
+
+	batch := BulkMetrics{NewBulkMetric(3), two, nil, NewBulkMetric(1), NewBulkMetric(2), NewBulkMetric(3)}
+	merged := batch.Merge()
+
+	expected := []BulkMetric{{value: 1, count: 1}, {value: 2, count: 4}, {value: 3, count: 2}}
+	if len(merged) != len(expected) {
+		t.Fatalf("expected %v, got %d metrics", expected, len(merged))
+	}
+	for i, metric := range expected {
+		if *merged[i] != metric {
+			t.Fatalf("expected %v at %d, got %v", metric, i, *merged[i])
+		}
+	}
+
+	// the original batch must not be modified
+	if two.Count() != 3 || batch[0].Value() != 3 {
+		t.Fatalf("expected the original batch to be untouched")
+	}
+}
+
+func TestBulkMetricsMergeAggregates(t *testing.T) {
+	bucket := NewAggregateMetric(2, 1.6)
+	bucket.Observe(2.4)
+
+	merged := BulkMetrics{bucket, NewBulkMetric(2), NewAggregateMetric(3, 3.1)}.Merge()
+
+	aggregate := merged[0].Aggregate()
+	if merged[0].Count() != 3 || aggregate.Count != 3 || aggregate.Sum != 6 || aggregate.Min != 1.6 || aggregate.Max != 2.4 {
+		t.Fatalf("expected 3 observations summing to 6 between 1.6 and 2.4, got %+v", aggregate)
+	}
+
+	// plain metrics are their own aggregate
+	if aggregate := NewBulkMetric(4).Aggregate(); aggregate.Mean() != 4 || aggregate.Min != 4 {
+		t.Fatalf("expected a plain metric to aggregate to its value, got %+v", aggregate)
+	}
+}
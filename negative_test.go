@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"math"
+	"testing"
+	"time"
+)
+
+// negative, zero crossing and extreme values are stored and answered
+// exactly like any other, and the median of two middle values is
+// truncated towards zero, so it mirrors the median of the negated values
+
+func TestMidpoint(t *testing.T) {
+	cases := []struct{ a, b, expected int }{
+		{0, 3, 1},
+		{-3, 0, -1},
+		{-1, 2, 0},
+		{-2, -1, -1},
+		{-5, -3, -4},
+		{math.MaxInt, math.MaxInt, math.MaxInt},
+		{math.MaxInt - 1, math.MaxInt, math.MaxInt - 1},
+		{math.MinInt, math.MinInt + 1, math.MinInt + 1},
+		{math.MinInt, math.MaxInt, 0},
+	}
+
+	for _, c := range cases {
+		if actual := midpoint(c.a, c.b); actual != c.expected {
+			t.Fatalf("expected the midpoint of %d and %d to be %d, got %d", c.a, c.b, c.expected, actual)
+		}
+	}
+
+	floored := []struct{ a, b, expected int }{
+		{-5, -4, -5},
+		{-1, 0, -1},
+		{math.MinInt, math.MaxInt, -1},
+		{math.MaxInt - 1, math.MaxInt, math.MaxInt - 1},
+	}
+	for _, c := range floored {
+		if actual := floorMidpoint(c.a, c.b); actual != c.expected {
+			t.Fatalf("expected the floored midpoint of %d and %d to be %d, got %d", c.a, c.b, c.expected, actual)
+		}
+	}
+}
+
+func TestMedianDatabaseNegativeValues(t *testing.T) {
+	cases := []struct {
+		name        string
+		metrics     []*BulkMetric
+		median      int
+		medianFloat float64
+	}{
+		{"negative", buildBulkMetrics(-100, -50), -75, -75.5},
+		{"single negative", []*BulkMetric{{value: -3, count: 1}}, -3, -3},
+		{"spanning zero", []*BulkMetric{{value: -3, count: 1}, {value: 0, count: 1}}, -1, -1.5},
+		{"symmetric", buildBulkMetrics(-50, 51), 0, 0},
+		{"maximum", []*BulkMetric{{value: math.MaxInt, count: 2}, {value: math.MaxInt - 1, count: 2}}, math.MaxInt - 1, float64(math.MaxInt)},
+		{"minimum", []*BulkMetric{{value: math.MinInt, count: 3}, {value: math.MinInt + 1, count: 3}}, math.MinInt + 1, float64(math.MinInt)},
+		{"both extremes", []*BulkMetric{{value: math.MinInt, count: 1}, {value: math.MaxInt, count: 1}}, 0, 0},
+	}
+
+	for _, c := range cases {
+		database := NewMedianDatabase()
+		database.Open()
+		if err := <-database.BulkWriteAcked(c.metrics); err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+
+		if median := database.GetMedian(); median != c.median {
+			t.Fatalf("%s: expected a median of %d, got %d", c.name, c.median, median)
+		}
+		if median := database.GetMedianFloat(); median != c.medianFloat {
+			t.Fatalf("%s: expected a float median of %v, got %v", c.name, c.medianFloat, median)
+		}
+
+		// every other way of storing the values agrees
+		frozen, _ := database.Freeze()
+		sync := NewSyncMedianDatabase()
+		sync.BulkWrite(c.metrics)
+		distributed, _ := DistributedMedian(context.Background(), []Shard{NewLocalShard(frozen)})
+		if frozen.GetMedian() != c.median || sync.GetMedian() != c.median || distributed != c.median {
+			t.Fatalf("%s: expected every database to agree on %d", c.name, c.median)
+		}
+		database.Close()
+	}
+}
+
+func TestExtremeValueRanks(t *testing.T) {
+	frozen := freezeMetrics([]*BulkMetric{{value: math.MinInt, count: 1}, {value: -1, count: 2}, {value: math.MaxInt, count: 3}})
+	if frozen.Rank(math.MaxInt) != 6 || frozen.Rank(math.MinInt) != 1 || frozen.Rank(-2) != 1 {
+		t.Fatalf("unexpected ranks %d %d %d", frozen.Rank(math.MaxInt), frozen.Rank(math.MinInt), frozen.Rank(-2))
+	}
+	if frozen.GetPercentile(0) != math.MinInt || frozen.GetPercentile(0.5) != -1 || frozen.GetPercentile(1) != math.MaxInt {
+		t.Fatalf("unexpected percentiles")
+	}
+
+	clock := newTestClock()
+	windowed := newTestWindowedDatabase(time.Minute, time.Hour)
+	windowed.now = clock.now
+	windowed.BulkWrite([]*BulkMetric{{value: math.MinInt, count: 1}, {value: -1, count: 2}})
+	clock.advance(time.Minute)
+	windowed.BulkWrite([]*BulkMetric{{value: math.MaxInt, count: 3}})
+	for _, p := range []float64{0, 0.5, 1} {
+		if value, _ := windowed.GetWindowedPercentile(p, time.Hour); value != frozen.GetPercentile(p) {
+			t.Fatalf("expected the windowed p%v to be %d, got %d", p*100, frozen.GetPercentile(p), value)
+		}
+	}
+
+	histogram := newTestHistogramDatabase(10)
+	histogram.BulkWrite(buildBulkMetrics(-25, -5))
+	if median := histogram.GetMedian(); median > -10 || median < -20 {
+		t.Fatalf("expected a negative median near -15, got %d", median)
+	}
+}
+
+func BenchmarkMedianDatabaseZeroCrossing(b *testing.B) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// batches alternate either side of zero, so the median keeps
+		// crossing it
+		start := (i%200 - 100) * 10
+		<-database.BulkWriteAcked(buildBulkMetrics(start, start+10))
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sends a state such as "READY=1" to the service manager, eg: systemd
+// running the serve command as a Type=notify service. The notification is
+// a single datagram written to the unix socket named by NOTIFY_SOCKET, so
+// it does nothing when the process wasn't started by a service manager.
+func notifyServiceManager(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+
+	// a socket starting with @ is in the abstract namespace, which the
+	// net package handles for us
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("notify %s: %w", socket, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("notify %s: %w", socket, err)
+	}
+
+	return nil
+}
+
+// returns how often the service manager expects a "WATCHDOG=1", or zero if
+// the watchdog isn't enabled for this process
+func watchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	return time.Duration(usec) * time.Microsecond
+}
+
+// pings the service manager's watchdog at half the interval it expects,
+// until stop is closed. Failed pings are logged and retried on the next
+// tick, leaving it to the service manager to restart the process if they
+// keep failing.
+func runWatchdog(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := notifyServiceManager("WATCHDOG=1"); err != nil {
+				fmt.Fprintf(os.Stderr, "watchdog: %v\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
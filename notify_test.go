@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// listens where a service manager would, returning each state it is sent
+func listenForNotifications(t *testing.T) <-chan string {
+	socket := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socket)
+
+	states := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			states <- string(buf[:n])
+		}
+	}()
+
+	return states
+}
+
+func TestNotifyServiceManager(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := notifyServiceManager("READY=1"); err != nil {
+		t.Fatalf("expected nothing to be sent without a service manager, got %v", err)
+	}
+
+	states := listenForNotifications(t)
+	if err := notifyServiceManager("READY=1"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state := <-states; state != "READY=1" {
+		t.Fatalf("expected READY=1, got %q", state)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", filepath.Join(t.TempDir(), "missing"))
+	if err := notifyServiceManager("READY=1"); err == nil {
+		t.Fatalf("expected an error for a missing socket")
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	for _, c := range []struct {
+		usec, pid string
+		expected  time.Duration
+	}{
+		{"", "", 0},
+		{"invalid", "", 0},
+		{"-1", "", 0},
+		{"20000", "", 20 * time.Millisecond},
+		{"20000", strconv.Itoa(1 << 30), 0},
+	} {
+		t.Setenv("WATCHDOG_USEC", c.usec)
+		t.Setenv("WATCHDOG_PID", c.pid)
+		if interval := watchdogInterval(); interval != c.expected {
+			t.Fatalf("expected an interval of %v for %q, got %v", c.expected, c.usec, interval)
+		}
+	}
+
+	states := listenForNotifications(t)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		runWatchdog(20*time.Millisecond, stop)
+		close(done)
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case state := <-states:
+			if state != "WATCHDOG=1" {
+				t.Fatalf("expected WATCHDOG=1, got %q", state)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the watchdog to be pinged")
+		}
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// updates queued for an isolated observer per pool worker, beyond which
+// they are dropped
+const observerQueueSize = 64
+
+// a StatsUpdate is passed to observers each time the median is
+// recalculated
+type StatsUpdate struct {
+	Median      int64
+	MedianFloat float64
+	Count       int64
+	Generation  uint64
+	Updated     time.Time
+}
+
+func (s *medianStats) update() StatsUpdate {
+	return StatsUpdate{
+		Median:      s.median,
+		MedianFloat: s.medianFloat,
+		Count:       s.count,
+		Generation:  s.generation,
+		Updated:     s.updated,
+	}
+}
+
+// an observer is either called by the worker after every recalculation,
+// or, if it has an interval, at most once per interval with the latest
+// stats
+type observer struct {
+	callback func(StatsUpdate)
+	interval time.Duration
+}
+
+// WithObserver registers a callback which is called from the worker each
+// time the median is recalculated. The callback holds up every write, so
+// it must be quick; busy databases should use WithCoalescedObserver.
+func WithObserver(callback func(StatsUpdate)) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.observers = append(m.observers, observer{callback: callback})
+	}
+}
+
+// WithCoalescedObserver registers a callback which is called at most once
+// per interval with the latest stats, and only if the median was
+// recalculated since it was last called. It runs on its own goroutine,
+// so it never slows down the worker however many writes there are.
+func WithCoalescedObserver(interval time.Duration, callback func(StatsUpdate)) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.observers = append(m.observers, observer{callback: callback, interval: interval})
+	}
+}
+
+// WithObserverIsolation runs every observer on a pool of workers rather
+// than on the worker, so a misbehaving observer can neither block nor
+// crash the database. Panics are recovered, and callbacks which run for
+// longer than the timeout are abandoned, both being reported on Errors. A
+// zero timeout lets callbacks run for as long as they like. Updates for
+// per recalculation observers are queued for the pool, and dropped when
+// the pool falls behind; with more than one worker they may also be
+// delivered out of order.
+func WithObserverIsolation(workers int, timeout time.Duration) DatabaseOption {
+	return func(m *MedianDatabase) {
+		if workers < 1 {
+			workers = 1
+		}
+
+		m.observerPool = &observerPool{
+			workers: workers,
+			timeout: timeout,
+			tasks:   make(chan func(), workers*observerQueueSize),
+		}
+	}
+}
+
+type observerPool struct {
+	workers int
+	timeout time.Duration
+	tasks   chan func()
+
+	// reports errors on the database's Errors channel
+	report func(error)
+}
+
+// runs the queued callbacks until doneCh is closed
+func (p *observerPool) start(doneCh <-chan struct{}) {
+	for i := 0; i < p.workers; i++ {
+		go func() {
+			for {
+				select {
+				case task := <-p.tasks:
+					p.run(task)
+				case <-doneCh:
+					return
+				}
+			}
+		}()
+	}
+}
+
+// queues the callback without blocking, returning false if it was dropped
+func (p *observerPool) submit(task func()) bool {
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// runs the callback, recovering any panic and giving up on it after the
+// timeout. An abandoned callback keeps running in the background, but
+// the pool worker moves on.
+func (p *observerPool) run(task func()) {
+	if p.timeout <= 0 {
+		if err := recoverPanic(task); err != nil {
+			p.report(fmt.Errorf("observer: %w", err))
+		}
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- recoverPanic(task)
+	}()
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			p.report(fmt.Errorf("observer: %w", err))
+		}
+	case <-timer.C:
+		p.report(fmt.Errorf("observer still running after %v: %w", p.timeout, ErrTimeout))
+	}
+}
+
+// notifies the per recalculation observers, from the worker
+func (m *MedianDatabase) notify(stats *medianStats) {
+	for _, observer := range m.observers {
+		if observer.interval > 0 {
+			continue
+		}
+
+		if m.observerPool == nil {
+			observer.callback(stats.update())
+			continue
+		}
+
+		callback, update := observer.callback, stats.update()
+		if !m.observerPool.submit(func() { callback(update) }) {
+			reportError(m.errCh, m.named(fmt.Errorf("observer update dropped: %w", ErrBufferFull)))
+		}
+	}
+}
+
+// starts a goroutine for each coalesced observer, which stop once the
+// database is closed
+func (m *MedianDatabase) startObservers() {
+	// every recalculation publishes a new stats block, so an observer
+	// is due whenever the published block has changed
+	notified := m.stats.Load().(*medianStats)
+	if m.observerPool != nil {
+		m.observerPool.report = func(err error) {
+			reportError(m.errCh, m.named(err))
+		}
+		m.observerPool.start(m.doneCh)
+	}
+
+	for _, observer := range m.observers {
+		if observer.interval > 0 {
+			go m.coalesce(observer, notified)
+		}
+	}
+}
+
+func (m *MedianDatabase) coalesce(observer observer, notified *medianStats) {
+	ticker := time.NewTicker(observer.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.doneCh:
+			return
+		}
+
+		stats := m.stats.Load().(*medianStats)
+		if stats == notified {
+			continue
+		}
+
+		notified = stats
+		if m.observerPool == nil {
+			observer.callback(stats.update())
+		} else {
+			m.observerPool.run(func() { observer.callback(stats.update()) })
+		}
+	}
+}
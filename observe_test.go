@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestObservers(t *testing.T) {
+	var lock sync.Mutex
+	every := []StatsUpdate{}
+	coalesced := []StatsUpdate{}
+
+	database := NewMedianDatabase(
+		WithObserver(func(update StatsUpdate) {
+			every = append(every, update)
+		}),
+		WithCoalescedObserver(20*time.Millisecond, func(update StatsUpdate) {
+			lock.Lock()
+			defer lock.Unlock()
+			coalesced = append(coalesced, update)
+		}),
+	)
+	database.Open()
+	defer database.Close()
+
+	for i := 0; i < 100; i++ {
+		<-database.BulkWriteAcked(buildBulkMetrics(i, i+1))
+	}
+
+	if len(every) != 100 || every[99].Count != 100 || every[99].Median != 49 {
+		t.Fatalf("expected an update per write, got %d ending with %+v", len(every), every[len(every)-1])
+	}
+
+	// the coalesced observer catches up with the latest stats
+	deadline := time.Now().Add(time.Second)
+	for {
+		lock.Lock()
+		calls := len(coalesced)
+		caughtUp := calls > 0 && coalesced[calls-1].Count == 100
+		lock.Unlock()
+
+		if caughtUp {
+			if calls >= 100 {
+				t.Fatalf("expected coalesced updates, got %d", calls)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the coalesced observer to see every write, got %+v", coalesced)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// and isn't called again without a recalculation
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	defer lock.Unlock()
+	if coalesced[len(coalesced)-1].Count != 100 || len(coalesced) > 1 && coalesced[len(coalesced)-2].Count == 100 {
+		t.Fatalf("expected no repeated updates, got %+v", coalesced)
+	}
+}
+
+func TestObserverIsolation(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	delivered := make(chan StatsUpdate, 10)
+	database := NewMedianDatabase(
+		WithObserverIsolation(2, 20*time.Millisecond),
+		WithObserver(func(update StatsUpdate) {
+			panic("misbehaving observer")
+		}),
+		WithObserver(func(update StatsUpdate) {
+			<-block
+		}),
+		WithObserver(func(update StatsUpdate) {
+			delivered <- update
+		}),
+	)
+	database.Open()
+	defer database.Close()
+
+	// neither observer holds up or crashes the worker
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-database.BulkWriteAcked(buildBulkMetrics(1, 11)):
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected writes not to wait on observers")
+		}
+	}
+
+	var panicked *PanicError
+	timedOut := false
+	deadline := time.After(2 * time.Second)
+	for panicked == nil || !timedOut {
+		select {
+		case err := <-database.Errors():
+			if errors.As(err, &panicked) && panicked.Value != "misbehaving observer" {
+				t.Fatalf("unexpected panic %v", panicked.Value)
+			}
+			timedOut = timedOut || errors.Is(err, ErrTimeout)
+		case <-deadline:
+			t.Fatalf("expected a panic and a timeout to be reported")
+		}
+	}
+
+	select {
+	case update := <-delivered:
+		if update.Count < 10 || update.Median != 5 {
+			t.Fatalf("unexpected update %+v", update)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the well behaved observer to be notified")
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// a run of equal keys in an OrderedDatabase
+type orderedRun[K any] struct {
+	key   K
+	count int
+}
+
+// an OrderedDatabase stores keys of any type ordered by a comparator, eg:
+// version strings or ULIDs, to find the middle release or ID in a stream.
+// Keys can't be averaged, so the median of an even number of keys is the
+// lower of the two middle keys. Writes are applied synchronously.
+type OrderedDatabase[K any] struct {
+	sync.RWMutex
+
+	compare func(a, b K) int
+	runs    []orderedRun[K]
+	count   int
+}
+
+// NewOrderedDatabase creates a database ordered by compare, which returns a
+// negative number when a sorts before b, zero when they are equal and a
+// positive number otherwise.
+func NewOrderedDatabase[K any](compare func(a, b K) int) *OrderedDatabase[K] {
+	return &OrderedDatabase[K]{
+		compare: compare,
+	}
+}
+
+// NewStringDatabase creates a database of lexicographically ordered strings.
+func NewStringDatabase() *OrderedDatabase[string] {
+	return NewOrderedDatabase(strings.Compare)
+}
+
+func (o *OrderedDatabase[K]) Write(keys ...K) {
+	for _, key := range keys {
+		o.WriteCount(key, 1)
+	}
+}
+
+// WriteCount writes the key count times.
+func (o *OrderedDatabase[K]) WriteCount(key K, count int) error {
+	if count < 1 {
+		return ErrInvalidMetric
+	}
+
+	o.Lock()
+	defer o.Unlock()
+
+	index := sort.Search(len(o.runs), func(i int) bool {
+		return o.compare(o.runs[i].key, key) >= 0
+	})
+	if index < len(o.runs) && o.compare(o.runs[index].key, key) == 0 {
+		o.runs[index].count += count
+	} else {
+		o.runs = append(o.runs, orderedRun[K]{})
+		copy(o.runs[index+1:], o.runs[index:])
+		o.runs[index] = orderedRun[K]{key: key, count: count}
+	}
+	o.count += count
+
+	return nil
+}
+
+func (o *OrderedDatabase[K]) Count() int {
+	o.RLock()
+	defer o.RUnlock()
+
+	return o.count
+}
+
+// GetMedian returns the middle key, or ErrEmpty before anything is written.
+func (o *OrderedDatabase[K]) GetMedian() (K, error) {
+	return o.GetPercentile(0.5)
+}
+
+// GetPercentile returns the key at the p percentile, where p is a fraction
+// between 0 and 1, using the nearest rank.
+func (o *OrderedDatabase[K]) GetPercentile(p float64) (K, error) {
+	o.RLock()
+	defer o.RUnlock()
+
+	var key K
+	if o.count == 0 {
+		return key, ErrEmpty
+	}
+
+	return o.rank(nearestRank(p, o.count)), nil
+}
+
+// returns the key at the given 1-indexed rank, which must be held
+func (o *OrderedDatabase[K]) rank(rank int) K {
+	seen := 0
+	for _, run := range o.runs {
+		seen += run.count
+		if seen >= rank {
+			return run.key
+		}
+	}
+
+	var key K
+	return key
+}
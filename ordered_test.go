@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOrderedDatabaseStrings(t *testing.T) {
+	database := NewStringDatabase()
+
+	if _, err := database.GetMedian(); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	database.Write("01HZ3", "01HZ1", "01HZ5", "01HZ2")
+	database.WriteCount("01HZ4", 1)
+
+	if median, _ := database.GetMedian(); median != "01HZ3" {
+		t.Fatalf("expected a median of 01HZ3, got %s", median)
+	}
+
+	// the lower middle key of an even count
+	database.Write("01HZ6")
+	if median, _ := database.GetMedian(); median != "01HZ3" {
+		t.Fatalf("expected a median of 01HZ3, got %s", median)
+	}
+	if max, _ := database.GetPercentile(1); max != "01HZ6" || database.Count() != 6 {
+		t.Fatalf("expected a max of 01HZ6 over 6 keys, got %s over %d", max, database.Count())
+	}
+}
+
+func TestOrderedDatabaseComparator(t *testing.T) {
+	// compare versions numerically rather than lexicographically, so that
+	// 1.10 sorts after 1.9
+	database := NewOrderedDatabase(func(a, b string) int {
+		as, bs := strings.Split(a, "."), strings.Split(b, ".")
+		for i := 0; i < len(as) && i < len(bs); i++ {
+			an, _ := strconv.Atoi(as[i])
+			bn, _ := strconv.Atoi(bs[i])
+			if an != bn {
+				return an - bn
+			}
+		}
+		return len(as) - len(bs)
+	})
+
+	database.Write("1.10", "1.2", "1.9", "1.11", "1.1")
+	if median, _ := database.GetMedian(); median != "1.9" {
+		t.Fatalf("expected a median of 1.9, got %s", median)
+	}
+}
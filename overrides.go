@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+)
+
+// a SeriesOverride configures the series whose names match its pattern
+// differently from the rest, eg: payment latency kept in full in a
+// windowed database with an SLO threshold, while health checks are
+// sampled. Overrides are usually read from a config file with
+// ParseSeriesOverrides, as a JSON array of:
+//
+//	{"pattern": "payments.*", "backend": "windowed", "config": {"retention": "24h", "threshold": "500"}}
+//	{"pattern": "healthcheck.*", "sample_rate": 0.01}
+type SeriesOverride struct {
+	// matched against the series name, without its tenant, with
+	// path.Match, eg: "payments.*"
+	Pattern string `json:"pattern"`
+
+	// the backend the series is created with, see NewBackend, instead of
+	// the series database's factory. The window length and thresholds of
+	// a series are set in the backend's config.
+	Backend string        `json:"backend,omitempty"`
+	Config  BackendConfig `json:"config,omitempty"`
+
+	// the fraction of the series' metrics a SeriesWorker keeps, unless
+	// the worker was given a rate for the series itself
+	SampleRate *float64 `json:"sample_rate,omitempty"`
+}
+
+func (o SeriesOverride) validate() error {
+	if _, err := path.Match(o.Pattern, ""); err != nil {
+		return fmt.Errorf("override %q: %w", o.Pattern, err)
+	}
+
+	// the database is never opened, so there is nothing to clean up
+	if o.Backend != "" {
+		if _, err := NewBackend(o.Backend, o.Config); err != nil {
+			return fmt.Errorf("override %q: %w", o.Pattern, err)
+		}
+	}
+
+	return nil
+}
+
+func (o SeriesOverride) matches(name string) bool {
+	matched, _ := path.Match(o.Pattern, name)
+	return matched
+}
+
+// ParseSeriesOverrides reads a JSON array of overrides, failing if any
+// pattern is malformed or any backend can't be created from its config.
+func ParseSeriesOverrides(r io.Reader) ([]SeriesOverride, error) {
+	overrides := []SeriesOverride{}
+	if err := json.NewDecoder(r).Decode(&overrides); err != nil {
+		return nil, fmt.Errorf("invalid overrides: %w", err)
+	}
+
+	for _, override := range overrides {
+		if err := override.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return overrides, nil
+}
+
+// WithSeriesOverrides configures the series matching each override's
+// pattern, where the first matching override applies. Series which match
+// none, and the overflow series, are created by the factory as usual.
+// Overrides which haven't been through ParseSeriesOverrides should be
+// valid, as a series whose backend fails is created by the factory.
+func WithSeriesOverrides(overrides ...SeriesOverride) SeriesOption {
+	return func(s *SeriesDatabase) {
+		s.overrides = append(s.overrides, overrides...)
+	}
+}
+
+// returns the first override matching the series name
+func (s *SeriesDatabase) override(name string) (SeriesOverride, bool) {
+	if name == OverflowSeries {
+		return SeriesOverride{}, false
+	}
+
+	for _, override := range s.overrides {
+		if override.matches(name) {
+			return override, true
+		}
+	}
+
+	return SeriesOverride{}, false
+}
+
+// creates the database for a new series
+func (s *SeriesDatabase) create(name string) Database {
+	if override, ok := s.override(name); ok && override.Backend != "" {
+		if database, err := NewBackend(override.Backend, override.Config); err == nil {
+			return database
+		}
+	}
+
+	return s.factory()
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSeriesOverrides(t *testing.T) {
+	overrides, err := ParseSeriesOverrides(strings.NewReader(`[
+		{"pattern": "payments.*", "backend": "windowed", "config": {"retention": "24h", "threshold": "500"}},
+		{"pattern": "healthcheck.*", "sample_rate": 0},
+		{"pattern": "*", "backend": "median", "config": {"thresholds": "100"}}
+	]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	database := NewSeriesDatabase(0, func() Database {
+		return newTestHistogramDatabase(1)
+	}, WithSeriesOverrides(overrides...))
+	defer database.Close()
+
+	worker := NewSeriesWorker(database, 10, time.Hour, nil)
+	for _, name := range []string{"payments.eu", "healthcheck.eu", "search"} {
+		if err := worker.Write(SeriesKey{Tenant: "shop", Name: name}, NewBulkMetric(600)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	worker.Stop()
+
+	// the first matching override applies
+	payments, ok := database.Get(SeriesKey{Tenant: "shop", Name: "payments.eu"})
+	if windowed, isWindowed := payments.(*WindowedDatabase); !ok || !isWindowed || windowed.retention != 24*time.Hour || windowed.threshold != 500 {
+		t.Fatalf("expected a windowed database for payments, got %T", payments)
+	}
+	if points := payments.(*WindowedDatabase).ThresholdSeries(time.Hour); len(points) != 1 || points[0].Above != 1 {
+		t.Fatalf("expected the payment to be over the threshold, got %+v", points)
+	}
+
+	search, ok := database.Get(SeriesKey{Tenant: "shop", Name: "search"})
+	if median, isMedian := search.(*MedianDatabase); !ok || !isMedian || len(median.thresholds) != 1 {
+		t.Fatalf("expected a median database with a threshold for search, got %T", search)
+	}
+
+	// sampled out entirely, so never created
+	if _, ok := database.Get(SeriesKey{Tenant: "shop", Name: "healthcheck.eu"}); ok {
+		t.Fatalf("expected health checks to be dropped")
+	}
+
+	for _, config := range []string{
+		`[{"pattern": "[payments"}]`,
+		`[{"pattern": "payments.*", "backend": "skiplist"}]`,
+		`[{"pattern": "payments.*", "backend": "windowed", "config": {"retention": "forever"}}]`,
+	} {
+		if _, err := ParseSeriesOverrides(strings.NewReader(config)); err == nil {
+			t.Fatalf("expected %s to be rejected", config)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the quantiles rendered when none are given
+var defaultSummaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// WritePrometheusSummary renders the snapshot as a Prometheus summary metric
+// family in the text exposition format, so it can be scraped or federated
+// by existing Prometheus tooling:
+//
+//	# HELP api_latency request latency
+//	# TYPE api_latency summary
+//	api_latency{region="eu",quantile="0.5"} 42
+//	api_latency_sum{region="eu"} 8400
+//	api_latency_count{region="eu"} 200
+func WritePrometheusSummary(w io.Writer, name, help string, labels map[string]string, snapshot Snapshot, quantiles []float64) error {
+	if len(quantiles) == 0 {
+		quantiles = defaultSummaryQuantiles
+	}
+
+	values := make([]float64, 0, len(quantiles))
+	for _, quantile := range quantiles {
+		value := 0.0
+		if snapshot.Count() > 0 {
+			value = float64(snapshot.GetPercentile(quantile))
+		}
+		values = append(values, value)
+	}
+
+	return writeSummary(w, name, help, labels, quantiles, values, snapshot.Sum(), snapshot.Count())
+}
+
+// writes a summary metric family with a value per quantile
+func writeSummary(w io.Writer, name, help string, labels map[string]string, quantiles, values []float64, sum float64, count int) error {
+	return writeSummaryAnnotated(w, name, help, labels, quantiles, values, nil, sum, count)
+}
+
+// writes a summary metric family, with each quantile's line followed by
+// its annotation, if any, eg: an exemplar
+func writeSummaryAnnotated(w io.Writer, name, help string, labels map[string]string, quantiles, values []float64, annotations []string, sum float64, count int) error {
+	buf := bufio.NewWriter(w)
+	if help != "" {
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, escapeHelp(help))
+	}
+	fmt.Fprintf(buf, "# TYPE %s summary\n", name)
+
+	base := formatLabels(labels)
+	for i, quantile := range quantiles {
+		quantileLabel := `quantile="` + formatPrometheusFloat(quantile) + `"`
+		annotation := ""
+		if i < len(annotations) {
+			annotation = annotations[i]
+		}
+		fmt.Fprintf(buf, "%s{%s} %s%s\n", name, joinLabels(base, quantileLabel), formatPrometheusFloat(values[i]), annotation)
+	}
+
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, wrapLabels(base), formatPrometheusFloat(sum))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, wrapLabels(base), count)
+
+	return buf.Flush()
+}
+
+// renders labels sorted by name, without the surrounding braces
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, 0, len(names))
+	for _, name := range names {
+		pairs = append(pairs, name+`="`+escapeLabelValue(labels[name])+`"`)
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, label string) string {
+	if labels == "" {
+		return label
+	}
+
+	return labels + "," + label
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func formatPrometheusFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWritePrometheusSummary(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// 1..100
+	database.BulkWrite(buildBulkMetrics(1, 101))
+	snapshot, _ := database.Snapshot()
+
+	buf := new(bytes.Buffer)
+	labels := map[string]string{"region": "eu", "path": `/a"b`}
+	if err := WritePrometheusSummary(buf, "api_latency", "request latency", labels, snapshot, []float64{0.5, 0.99}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := `# HELP api_latency request latency
+# TYPE api_latency summary
+api_latency{path="/a\"b",region="eu",quantile="0.5"} 50
+api_latency{path="/a\"b",region="eu",quantile="0.99"} 99
+api_latency_sum{path="/a\"b",region="eu"} 5050
+api_latency_count{path="/a\"b",region="eu"} 100
+`
+	if buf.String() != expected {
+		t.Fatalf("expected:\n%s\ngot:\n%s", expected, buf.String())
+	}
+}
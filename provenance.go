@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// the header a Client created WithClientID names itself in
+const clientIDHeader = "X-Client-ID"
+
+// a Provenance records where a single written batch came from, and enough
+// of what was in it to attribute a shift in the median to its producer
+type Provenance struct {
+	Time time.Time `json:"time"`
+	// the address the batch was sent from, and the ID its client named
+	// itself with, if any
+	Source   string `json:"source"`
+	ClientID string `json:"client_id,omitempty"`
+	// zero unless the batch was sequenced
+	Sequence uint64 `json:"sequence,omitempty"`
+	Count    int    `json:"count"`
+	// the batch's smallest, middle and largest values, where the median
+	// is the nearest rank, so a value which was actually written
+	Min    int `json:"min"`
+	Median int `json:"median"`
+	Max    int `json:"max"`
+}
+
+func newProvenance(metrics []*BulkMetric) Provenance {
+	merged := BulkMetrics(metrics).Merge()
+
+	provenance := Provenance{}
+	for _, metric := range merged {
+		provenance.Count += metric.Count()
+	}
+	if len(merged) == 0 {
+		return provenance
+	}
+
+	provenance.Min, provenance.Max = merged[0].Value(), merged[len(merged)-1].Value()
+	seen, rank := 0, (provenance.Count+1)/2
+	for _, metric := range merged {
+		if seen += metric.Count(); seen >= rank {
+			provenance.Median = metric.Value()
+			break
+		}
+	}
+
+	return provenance
+}
+
+// a ProvenanceLog keeps the provenance of the latest batches written
+// through a handler created WithProvenance, dropping the oldest once it
+// holds its size, so the log is bounded however long it runs.
+type ProvenanceLog struct {
+	sync.Mutex
+
+	// a ring, where next is the oldest entry once it is full
+	entries []Provenance
+	next    int
+	full    bool
+
+	// overridden in tests to control the passing of time
+	now func() time.Time
+}
+
+// NewProvenanceLog creates a log of the latest size batches.
+func NewProvenanceLog(size int) *ProvenanceLog {
+	return &ProvenanceLog{
+		entries: make([]Provenance, max(size, 1)),
+		now:     time.Now,
+	}
+}
+
+func (p *ProvenanceLog) record(provenance Provenance) {
+	p.Lock()
+	defer p.Unlock()
+
+	provenance.Time = p.now()
+	p.entries[p.next] = provenance
+	p.next = (p.next + 1) % len(p.entries)
+	if p.next == 0 {
+		p.full = true
+	}
+}
+
+// a ProvenanceFilter selects entries from a ProvenanceLog, where zero
+// fields select everything
+type ProvenanceFilter struct {
+	Source   string
+	ClientID string
+	Since    time.Time
+	// the most entries, keeping the latest
+	Limit int
+}
+
+func (f ProvenanceFilter) matches(provenance Provenance) bool {
+	return (f.Source == "" || provenance.Source == f.Source) &&
+		(f.ClientID == "" || provenance.ClientID == f.ClientID) &&
+		!provenance.Time.Before(f.Since)
+}
+
+// Entries returns the logged entries the filter selects, oldest first.
+func (p *ProvenanceLog) Entries(filter ProvenanceFilter) []Provenance {
+	p.Lock()
+	defer p.Unlock()
+
+	ordered := p.entries[:p.next]
+	if p.full {
+		ordered = append(append([]Provenance{}, p.entries[p.next:]...), p.entries[:p.next]...)
+	}
+
+	entries := make([]Provenance, 0)
+	for _, provenance := range ordered {
+		if filter.matches(provenance) {
+			entries = append(entries, provenance)
+		}
+	}
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[len(entries)-filter.Limit:]
+	}
+
+	return entries
+}
+
+// WithProvenance records the provenance of every batch written to /write
+// in the log, and serves it on /provenance, so an unexpected shift in the
+// median can be attributed to the producer which caused it.
+func WithProvenance(log *ProvenanceLog) HandlerOption {
+	return func(h *handlerConfig) {
+		h.provenance = log
+	}
+}
+
+// WithClientID names the client in every write, so the batches it sends
+// can be told apart in a server's provenance log, see WithProvenance.
+func WithClientID(id string) ClientOption {
+	return func(c *Client) {
+		c.clientID = id
+	}
+}
+
+// serves the log's entries, filtered by the source, client, since and
+// limit query parameters
+func serveProvenance(w http.ResponseWriter, r *http.Request, log *ProvenanceLog) {
+	if log == nil {
+		http.Error(w, "provenance isn't recorded", http.StatusNotImplemented)
+		return
+	}
+
+	values := r.URL.Query()
+	filter := ProvenanceFilter{Source: values.Get("source"), ClientID: values.Get("client")}
+	if since := values.Get("since"); since != "" {
+		parsed, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+			return
+		}
+		filter.Since = parsed
+	}
+	if limit := values.Get("limit"); limit != "" {
+		parsed, err := strconv.Atoi(limit)
+		if err != nil || parsed < 0 {
+			http.Error(w, fmt.Sprintf("limit %q: must be a count", limit), http.StatusBadRequest)
+			return
+		}
+		filter.Limit = parsed
+	}
+
+	writeJSON(w, log.Entries(filter))
+}
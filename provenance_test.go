@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProvenanceLog(t *testing.T) {
+	clock := newTestClock()
+	log := NewProvenanceLog(3)
+	log.now = clock.now
+
+	for i := 0; i < 5; i++ {
+		clock.advance(time.Second)
+		provenance := newProvenance(buildBulkMetrics(i*10, i*10+5))
+		provenance.ClientID = []string{"a", "b"}[i%2]
+		log.record(provenance)
+	}
+
+	// only the latest three are kept, oldest first
+	entries := log.Entries(ProvenanceFilter{})
+	if len(entries) != 3 || entries[0].Min != 20 || entries[2].Max != 44 {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	if entries[0].Count != 5 || entries[0].Median != 22 {
+		t.Fatalf("expected the batch to be summarized, got %+v", entries[0])
+	}
+
+	if entries := log.Entries(ProvenanceFilter{ClientID: "a"}); len(entries) != 2 || entries[1].Min != 40 {
+		t.Fatalf("unexpected entries for client a %+v", entries)
+	}
+	if entries := log.Entries(ProvenanceFilter{Since: clock.now()}); len(entries) != 1 {
+		t.Fatalf("expected only the latest entry, got %+v", entries)
+	}
+	if entries := log.Entries(ProvenanceFilter{Limit: 2}); len(entries) != 2 || entries[1].Min != 40 {
+		t.Fatalf("expected the latest two entries, got %+v", entries)
+	}
+}
+
+func TestHandlerProvenance(t *testing.T) {
+	database := NewSyncMedianDatabase()
+	log := NewProvenanceLog(10)
+	server := httptest.NewServer(NewHandler(database, WithProvenance(log)))
+	defer server.Close()
+
+	NewClient(server.URL, WithClientID("ingest-1")).BulkWrite(buildBulkMetrics(1, 4))
+	NewClient(server.URL).BulkWrite([]*BulkMetric{{value: 1000, count: 7}})
+
+	response, err := http.Get(server.URL + "/provenance?client=ingest-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var entries []Provenance
+	json.NewDecoder(response.Body).Decode(&entries)
+	response.Body.Close()
+	if len(entries) != 1 || entries[0].Count != 3 || entries[0].Median != 2 || entries[0].Source == "" {
+		t.Fatalf("unexpected provenance %+v", entries)
+	}
+
+	// the shift is attributable to the client which didn't name itself
+	entries = log.Entries(ProvenanceFilter{})
+	if len(entries) != 2 || entries[1].ClientID != "" || entries[1].Median != 1000 {
+		t.Fatalf("unexpected provenance %+v", entries)
+	}
+
+	for path, status := range map[string]int{
+		"/provenance?limit=x":     http.StatusBadRequest,
+		"/provenance?since=today": http.StatusBadRequest,
+	} {
+		response, err := http.Get(server.URL + path)
+		if err != nil || response.StatusCode != status {
+			t.Fatalf("expected %d for %s, got %v: %v", status, path, response, err)
+		}
+		response.Body.Close()
+	}
+
+	unrecorded := httptest.NewServer(NewHandler(database))
+	defer unrecorded.Close()
+	response, err = http.Get(unrecorded.URL + "/provenance")
+	if err != nil || response.StatusCode != http.StatusNotImplemented {
+		t.Fatalf("expected 501 without a provenance log, got %v: %v", response, err)
+	}
+	response.Body.Close()
+}
@@ -0,0 +1,51 @@
+package main
+
+// GetQuantiles returns the nearest-rank value of each quantile, in the
+// order they were asked for. They are read from the same values, so a
+// higher quantile is never below a lower one.
+func (f *FrozenDatabase) GetQuantiles(quantiles ...float64) []int {
+	values := make([]int, len(quantiles))
+	for i, quantile := range quantiles {
+		values[i] = f.GetPercentile(quantile)
+	}
+
+	return values
+}
+
+// GetQuantiles returns the value of each quantile, eg: 0.5 and 0.99, from
+// a single snapshot, so the quantiles are consistent with each other
+// however many writes are applied in the meantime. Asking for each with
+// its own query instead could see p50 above p99 after a burst of low
+// values.
+func (m *MedianDatabase) GetQuantiles(quantiles ...float64) ([]int, error) {
+	snapshot, err := m.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	return snapshot.GetQuantiles(quantiles...), nil
+}
+
+// GetQuantiles returns the value of each quantile at the given resolution,
+// like GetPercentile, all read under the same lock so they are consistent
+// with each other.
+func (h *HistogramDatabase) GetQuantiles(resolution int, quantiles ...float64) ([]int, error) {
+	h.RLock()
+	defer h.RUnlock()
+
+	histogram, err := h.histogram(resolution)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]int, len(quantiles))
+	for i, quantile := range quantiles {
+		estimate, err := h.estimate(histogram, quantile)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = estimate.Value
+	}
+
+	return values, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// bursts of low and high values move every quantile at once, so quantiles
+// read from different states could cross
+func TestQuantilesConsistentUnderConcurrentWrites(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+	histogram := newTestHistogramDatabase(10)
+	handler := NewHandler(database)
+
+	stop := make(chan struct{})
+	writers := sync.WaitGroup{}
+	for _, start := range []int{0, 100000} {
+		writers.Add(1)
+		go func(start int) {
+			defer writers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				metrics := buildBulkMetrics(start+i%1000, start+i%1000+50)
+				database.BulkWrite(metrics)
+				histogram.BulkWrite(metrics)
+			}
+		}(start)
+	}
+
+	quantiles := []float64{0.01, 0.5, 0.9, 0.99}
+	ordered := func(values []int) bool {
+		for i := 1; i < len(values); i++ {
+			if values[i] < values[i-1] {
+				return false
+			}
+		}
+		return true
+	}
+	for i := 0; i < 200; i++ {
+		values, err := database.GetQuantiles(quantiles...)
+		if err != nil || len(values) != len(quantiles) || !ordered(values) {
+			t.Fatalf("expected ordered quantiles, got %v, %v", values, err)
+		}
+
+		if values, err := histogram.GetQuantiles(10, quantiles...); err == nil && !ordered(values) {
+			t.Fatalf("expected ordered histogram quantiles, got %v", values)
+		}
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/quantiles?q=0.99&q=0.5", nil))
+		response := quantilesResponse{}
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil || len(response.Values) != 2 || response.Values[0] < response.Values[1] {
+			t.Fatalf("expected p99 at least p50, got %+v, %v", response, err)
+		}
+	}
+	close(stop)
+	writers.Wait()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/quantiles?q=2", nil))
+	if recorder.Code != 400 {
+		t.Fatalf("expected 400 for a quantile above 1, got %d", recorder.Code)
+	}
+}
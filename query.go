@@ -0,0 +1,502 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// series in a Registry can carry tags in their name, eg:
+// api.latency{region=eu,host=a}, which queries select on with a selector
+// of the same form where each tag is matched with = or !=, eg:
+// api.latency{region=eu,host!=a}. A selector without a name matches every
+// series with matching tags.
+
+type TagMatcher struct {
+	Key    string
+	Value  string
+	Negate bool
+}
+
+func (t TagMatcher) matches(tags map[string]string) bool {
+	value, ok := tags[t.Key]
+	if t.Negate {
+		return !ok || value != t.Value
+	}
+
+	return ok && value == t.Value
+}
+
+type Selector struct {
+	Name     string
+	Matchers []TagMatcher
+}
+
+// ParseSelector parses a selector such as api.latency{region=eu}.
+func ParseSelector(selector string) (Selector, error) {
+	name, tags, err := splitSeriesName(selector)
+	if err != nil {
+		return Selector{}, err
+	}
+
+	parsed := Selector{Name: name, Matchers: make([]TagMatcher, 0, len(tags))}
+	for _, tag := range tags {
+		matcher := TagMatcher{}
+		if i := strings.Index(tag, "!="); i >= 0 {
+			matcher = TagMatcher{Key: tag[:i], Value: tag[i+2:], Negate: true}
+		} else if i := strings.Index(tag, "="); i >= 0 {
+			matcher = TagMatcher{Key: tag[:i], Value: tag[i+1:]}
+		}
+		if matcher.Key == "" {
+			return Selector{}, fmt.Errorf("selector %q: invalid tag matcher %q", selector, tag)
+		}
+		parsed.Matchers = append(parsed.Matchers, matcher)
+	}
+
+	if parsed.Name == "" && len(parsed.Matchers) == 0 {
+		return Selector{}, fmt.Errorf("selector %q: needs a name or a tag matcher", selector)
+	}
+
+	return parsed, nil
+}
+
+// Matches reports whether the series, named with its tags, is selected.
+func (s Selector) Matches(series string) bool {
+	name, tags := parseSeriesName(series)
+	if s.Name != "" && name != s.Name {
+		return false
+	}
+
+	for _, matcher := range s.Matchers {
+		if !matcher.matches(tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// splits name{a=b,c=d} into the name and each of its tags
+func splitSeriesName(series string) (string, []string, error) {
+	open := strings.Index(series, "{")
+	if open < 0 {
+		return series, nil, nil
+	}
+	if !strings.HasSuffix(series, "}") {
+		return "", nil, fmt.Errorf("series %q: unterminated tags", series)
+	}
+
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(series[open+1:len(series)-1], ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return series[:open], tags, nil
+}
+
+// returns the series' name and tags, where anything which can't be parsed
+// as tags is treated as part of the name
+func parseSeriesName(series string) (string, map[string]string) {
+	name, tags, err := splitSeriesName(series)
+	if err != nil {
+		return series, nil
+	}
+
+	parsed := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if i := strings.Index(tag, "="); i > 0 {
+			parsed[tag[:i]] = tag[i+1:]
+		}
+	}
+
+	return name, parsed
+}
+
+// a Query selects series from a Registry and the quantiles to compute over
+// them, merged into a single distribution. Its query parameters are:
+//
+//	series     the selector, required
+//	window     a duration to limit the query to, eg: 15m, which needs
+//	           every selected database to be a WindowedDatabase
+//	quantiles  a comma separated list, eg: p50,p99,p99.9 or 0.5,0.99,
+//	           the p50, p90 and p99 by default
+//	format     json (the default), text or prometheus
+type Query struct {
+	Selector  Selector
+	Window    time.Duration
+	Quantiles []float64
+	Format    string
+}
+
+var queryFormats = map[string]bool{"json": true, "text": true, "prometheus": true}
+
+// ParseQuery parses a query from its query parameters.
+func ParseQuery(values url.Values) (Query, error) {
+	selector, err := ParseSelector(values.Get("series"))
+	if err != nil {
+		return Query{}, err
+	}
+
+	query := Query{
+		Selector:  selector,
+		Quantiles: defaultSummaryQuantiles,
+		Format:    "json",
+	}
+
+	if window := values.Get("window"); window != "" {
+		query.Window, err = time.ParseDuration(window)
+		if err != nil || query.Window <= 0 {
+			return Query{}, fmt.Errorf("window %q: must be a positive duration", window)
+		}
+	}
+
+	if quantiles := values.Get("quantiles"); quantiles != "" {
+		query.Quantiles = make([]float64, 0)
+		for _, quantile := range strings.Split(quantiles, ",") {
+			parsed, err := parseQuantile(strings.TrimSpace(quantile))
+			if err != nil {
+				return Query{}, err
+			}
+			query.Quantiles = append(query.Quantiles, parsed)
+		}
+	}
+
+	if format := values.Get("format"); format != "" {
+		if !queryFormats[format] {
+			return Query{}, fmt.Errorf("format %q: must be json, text or prometheus", format)
+		}
+		query.Format = format
+	}
+
+	return query, nil
+}
+
+// parses a quantile as either a fraction or a percentile, eg: 0.99 or p99
+func parseQuantile(quantile string) (float64, error) {
+	percentile := strings.HasPrefix(quantile, "p")
+
+	parsed, err := strconv.ParseFloat(strings.TrimPrefix(quantile, "p"), 64)
+	if percentile {
+		parsed = parsed / 100
+	}
+	if err != nil || !isFraction(parsed) {
+		return 0, fmt.Errorf("quantile %q: must be a fraction between 0 and 1, or a percentile such as p99", quantile)
+	}
+
+	return parsed, nil
+}
+
+// parses a fraction between 0 and 1, eg: a quantile of 0.99
+func parseFraction(fraction string) (float64, bool) {
+	parsed, err := strconv.ParseFloat(fraction, 64)
+	return parsed, err == nil && isFraction(parsed)
+}
+
+// NaN compares false against every bound, so it is rejected explicitly
+func isFraction(value float64) bool {
+	return !math.IsNaN(value) && value >= 0 && value <= 1
+}
+
+type QuantileValue struct {
+	Quantile float64 `json:"quantile"`
+	Value    int     `json:"value"`
+}
+
+type QueryResult struct {
+	// the names of the selected series, sorted
+	Series    []string        `json:"series"`
+	Window    string          `json:"window,omitempty"`
+	Count     int             `json:"count"`
+	Quantiles []QuantileValue `json:"quantiles"`
+	// the metadata of each selected series which has any
+	Metadata map[string]SeriesMetadata `json:"metadata,omitempty"`
+
+	snapshot Snapshot
+}
+
+// Unit returns the unit shared by every selected series, or nothing if
+// they don't all have the same unit.
+func (q QueryResult) Unit() string {
+	unit := ""
+	for i, name := range q.Series {
+		if i == 0 {
+			unit = q.Metadata[name].Unit
+		} else if q.Metadata[name].Unit != unit {
+			return ""
+		}
+	}
+
+	return unit
+}
+
+// String renders the result for people, in the unit of the series, eg:
+//
+//	count = 200
+//	p50 = 38ms
+//	p99 = 412ms
+func (q QueryResult) String() string {
+	unit := q.Unit()
+
+	lines := []string{fmt.Sprintf("count = %d", q.Count)}
+	for _, quantile := range q.Quantiles {
+		lines = append(lines, fmt.Sprintf("p%s = %s", formatPrometheusFloat(quantile.Quantile*100), FormatValue(float64(quantile.Value), unit)))
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// Query answers the query over every matching database, see
+// WithConcurrency. ErrEmpty is returned if no series matches.
+func (r *Registry) Query(query Query) (QueryResult, error) {
+	result := QueryResult{
+		Series:    make([]string, 0),
+		Quantiles: make([]QuantileValue, 0, len(query.Quantiles)),
+	}
+	if query.Window > 0 {
+		result.Window = query.Window.String()
+	}
+
+	names := make([]string, 0)
+	for _, name := range r.Names() {
+		if query.Selector.Matches(name) {
+			names = append(names, name)
+		}
+	}
+
+	// the matching series are snapshotted concurrently, then merged in
+	// name order so the first error is always the same one
+	taken := make([]SeriesSnapshot, len(names))
+	r.each(names, func(i int, name string, database Database) {
+		snapshot, err := querySnapshot(name, database, query.Window)
+		taken[i] = SeriesSnapshot{Name: name, Snapshot: snapshot, Err: err}
+	})
+
+	snapshots := make([]Snapshot, 0, len(taken))
+	for _, snapshot := range taken {
+		name := snapshot.Name
+		if name == "" {
+			continue
+		}
+		if snapshot.Err != nil {
+			return QueryResult{}, snapshot.Err
+		}
+
+		result.Series = append(result.Series, name)
+		snapshots = append(snapshots, snapshot.Snapshot)
+		if metadata := r.Metadata(name); metadata != (SeriesMetadata{}) {
+			if result.Metadata == nil {
+				result.Metadata = make(map[string]SeriesMetadata)
+			}
+			result.Metadata[name] = metadata
+		}
+	}
+	if len(snapshots) == 0 {
+		return QueryResult{}, fmt.Errorf("no series matches the selector: %w", ErrEmpty)
+	}
+
+	result.snapshot = mergeSnapshots(snapshots...)
+	result.Count = result.snapshot.Count()
+	for _, quantile := range query.Quantiles {
+		value := 0
+		if result.Count > 0 {
+			value = result.snapshot.GetPercentile(quantile)
+		}
+		result.Quantiles = append(result.Quantiles, QuantileValue{quantile, value})
+	}
+
+	return result, nil
+}
+
+// a query was made which the selected database can't answer
+var errUnsupportedQuery = errors.New("unsupported query")
+
+func querySnapshot(name string, database Database, window time.Duration) (Snapshot, error) {
+	if window > 0 {
+		windowed, ok := database.(interface{ GetWindow(time.Duration) Snapshot })
+		if !ok {
+			return Snapshot{}, fmt.Errorf("series %s isn't windowed: %w", name, errUnsupportedQuery)
+		}
+
+		return windowed.GetWindow(window), nil
+	}
+
+	snapshotter, ok := database.(Snapshotter)
+	if !ok {
+		return Snapshot{}, fmt.Errorf("series %s doesn't support snapshots: %w", name, errUnsupportedQuery)
+	}
+
+	return snapshotter.Snapshot()
+}
+
+// serves a query parsed from the request's query parameters
+func serveQuery(w http.ResponseWriter, r *http.Request, registry *Registry) {
+	query, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result, err := registry.Query(query)
+	switch {
+	case errors.Is(err, ErrEmpty):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errUnsupportedQuery):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrClosed):
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch query.Format {
+	case "text":
+		w.Header().Set("Content-Type", "text/plain")
+		fmt.Fprint(w, result)
+	case "prometheus":
+		labels := make(map[string]string)
+		for _, matcher := range query.Selector.Matchers {
+			if !matcher.Negate {
+				labels[matcher.Key] = matcher.Value
+			}
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheusSummary(w, prometheusName(query.Selector.Name), "", labels, result.snapshot, query.Quantiles)
+	default:
+		writeJSON(w, result)
+	}
+}
+
+// a batchQuery is a single query of a batch, with the same fields as the
+// query parameters of /query
+type batchQuery struct {
+	Series    string `json:"series"`
+	Window    string `json:"window,omitempty"`
+	Quantiles string `json:"quantiles,omitempty"`
+}
+
+type BatchResult struct {
+	Query string `json:"query"`
+	QueryResult
+	Error string `json:"error,omitempty"`
+}
+
+// QueryBatch answers every query independently, so a query which fails
+// doesn't fail the rest of the batch.
+func (r *Registry) QueryBatch(queries []Query) []BatchResult {
+	results := make([]BatchResult, 0, len(queries))
+	for _, query := range queries {
+		result, err := r.Query(query)
+		batchResult := BatchResult{QueryResult: result}
+		if err != nil {
+			batchResult.Error = err.Error()
+		}
+		results = append(results, batchResult)
+	}
+
+	return results
+}
+
+// serves a batch of queries POSTed as a JSON array, eg: to render every
+// panel of a dashboard in a single round trip:
+//
+//	[{"series": "api.latency{region=eu}", "window": "15m", "quantiles": "p50,p99"}, ...]
+//
+// results are returned as JSON, in the same order as the queries
+func serveQueryBatch(w http.ResponseWriter, r *http.Request, registry *Registry) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "batches must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	batch := make([]batchQuery, 0)
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		http.Error(w, fmt.Sprintf("invalid batch: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	queries := make([]Query, 0, len(batch))
+	for i, query := range batch {
+		parsed, err := ParseQuery(url.Values{
+			"series":    {query.Series},
+			"window":    {query.Window},
+			"quantiles": {query.Quantiles},
+		})
+		if err != nil {
+			http.Error(w, fmt.Sprintf("query %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+		queries = append(queries, parsed)
+	}
+
+	results := registry.QueryBatch(queries)
+	for i := range results {
+		results[i].Query = batch[i].Series
+	}
+
+	writeJSON(w, results)
+}
+
+// replaces every character which isn't valid in a Prometheus metric name
+func prometheusName(name string) string {
+	if name == "" {
+		return "query"
+	}
+
+	return strings.Map(func(r rune) rune {
+		if r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func init() {
+	commands["query"] = command{
+		usage: "query a server's registry, eg: -series 'api.latency{region=eu}' -window 15m",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("query", flag.ContinueOnError)
+			server := flags.String("url", "http://localhost:8080", "where the registry handler is served")
+			series := flags.String("series", "", "the series selector")
+			window := flags.String("window", "", "only query this far back, eg: 15m")
+			quantiles := flags.String("quantiles", "p50,p90,p99", "the quantiles to query")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+
+			values := url.Values{"series": {*series}, "quantiles": {*quantiles}, "format": {"text"}}
+			if *window != "" {
+				values.Set("window", *window)
+			}
+
+			resp, err := http.Get(strings.TrimSuffix(*server, "/") + "/query?" + values.Encode())
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				body, _ := io.ReadAll(resp.Body)
+				return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+			}
+
+			_, err = io.Copy(os.Stdout, resp.Body)
+			return err
+		},
+	}
+}
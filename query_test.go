@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelector(t *testing.T) {
+	selector, err := ParseSelector("api.latency{region=eu, host!=a}")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for series, expected := range map[string]bool{
+		"api.latency{region=eu,host=b}": true,
+		"api.latency{region=eu}":        true,
+		"api.latency{region=eu,host=a}": false,
+		"api.latency{region=us}":        false,
+		"api.latency":                   false,
+		"db.latency{region=eu}":         false,
+	} {
+		if selector.Matches(series) != expected {
+			t.Fatalf("expected %s to match %v", series, expected)
+		}
+	}
+
+	tagsOnly, _ := ParseSelector("{region=eu}")
+	if !tagsOnly.Matches("db.latency{region=eu}") {
+		t.Fatalf("expected a selector without a name to match any name")
+	}
+
+	for _, invalid := range []string{"", "api{", "api{=eu}", "api{region}"} {
+		if _, err := ParseSelector(invalid); err == nil {
+			t.Fatalf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	query, err := ParseQuery(url.Values{
+		"series":    {"api.latency"},
+		"window":    {"15m"},
+		"quantiles": {"p50,p99.9,0.25"},
+		"format":    {"text"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if query.Window != 15*time.Minute || query.Format != "text" || len(query.Quantiles) != 3 ||
+		query.Quantiles[0] != 0.5 || query.Quantiles[1] < 0.9989 || query.Quantiles[1] > 0.9991 || query.Quantiles[2] != 0.25 {
+		t.Fatalf("unexpected query %+v", query)
+	}
+
+	for _, invalid := range []url.Values{
+		{"series": {"api"}, "window": {"soon"}},
+		{"series": {"api"}, "quantiles": {"p101"}},
+		{"series": {"api"}, "quantiles": {"NaN"}},
+		{"series": {"api"}, "quantiles": {"pNaN"}},
+		{"series": {"api"}, "format": {"xml"}},
+	} {
+		if _, err := ParseQuery(invalid); err == nil {
+			t.Fatalf("expected %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestRegistryQuery(t *testing.T) {
+	registry := NewRegistry()
+
+	now := time.Now()
+	for i, region := range []string{"eu", "us"} {
+		windowed := newTestWindowedDatabase(time.Minute, time.Hour, WithLateness(time.Hour, DropLate))
+		windowed.now = func() time.Time { return now }
+		windowed.WriteAt(now.Add(-30*time.Minute), buildBulkMetrics(1000, 1100))
+		windowed.WriteAt(now, buildBulkMetrics(i*100, i*100+100))
+		registry.Register("api.latency{region="+region+"}", windowed)
+	}
+	median := NewMedianDatabase()
+	median.Open()
+	defer median.Close()
+	registry.Register("api.errors{region=eu}", median)
+
+	result, err := registry.Query(Query{Selector: Selector{Name: "api.latency"}, Window: 15 * time.Minute, Quantiles: []float64{0.5}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(result.Series) != 2 || result.Count != 200 || result.Quantiles[0].Value != 99 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	if _, err := registry.Query(Query{Selector: Selector{Name: "missing"}}); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	server := httptest.NewServer(NewRegistryHandler(registry))
+	defer server.Close()
+
+	get := func(query string, expectedStatus int) string {
+		response, err := http.Get(server.URL + "/query?" + query)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d for %s, got %d", expectedStatus, query, response.StatusCode)
+		}
+
+		body, _ := io.ReadAll(response.Body)
+		return string(body)
+	}
+
+	// p50,p99 of api.latency{region=eu} over 15m as JSON
+	selector := url.QueryEscape("api.latency{region=eu}")
+	json.Unmarshal([]byte(get("series="+selector+"&window=15m&quantiles=p50,p99", http.StatusOK)), &result)
+	if result.Count != 100 || result.Quantiles[0].Value != 49 || result.Quantiles[1].Value != 98 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	if body := get("series="+selector+"&quantiles=p50&format=prometheus&window=1h", http.StatusOK); !strings.Contains(body, `api_latency{region="eu",quantile="0.5"} 99`) {
+		t.Fatalf("unexpected prometheus output:\n%s", body)
+	}
+	if body := get("series="+selector+"&quantiles=p50&format=text&window=1h", http.StatusOK); body != "count = 200\np50 = 99\n" {
+		t.Fatalf("unexpected text output:\n%s", body)
+	}
+
+	// the errors series isn't windowed
+	get("series="+url.QueryEscape("{region=eu}")+"&window=15m", http.StatusBadRequest)
+	get("series=missing", http.StatusNotFound)
+	get("series=", http.StatusBadRequest)
+}
+
+func TestRegistryQueryBatch(t *testing.T) {
+	registry := NewRegistry()
+	for i, name := range []string{"api.latency{region=eu}", "api.latency{region=us}"} {
+		database := NewMedianDatabase()
+		database.Open()
+		defer database.Close()
+		<-database.BulkWriteAcked(buildBulkMetrics(i*100, i*100+100))
+		registry.Register(name, database)
+	}
+
+	server := httptest.NewServer(NewRegistryHandler(registry))
+	defer server.Close()
+
+	post := func(body string, expectedStatus int) []BatchResult {
+		response, err := http.Post(server.URL+"/query/batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		defer response.Body.Close()
+
+		if response.StatusCode != expectedStatus {
+			t.Fatalf("expected status %d, got %d", expectedStatus, response.StatusCode)
+		}
+
+		results := make([]BatchResult, 0)
+		json.NewDecoder(response.Body).Decode(&results)
+		return results
+	}
+
+	results := post(`[
+		{"series": "api.latency{region=eu}", "quantiles": "p50"},
+		{"series": "api.latency", "quantiles": "p50,p99"},
+		{"series": "missing"}
+	]`, http.StatusOK)
+	if len(results) != 3 {
+		t.Fatalf("expected 3 results, got %d", len(results))
+	}
+	if results[0].Query != "api.latency{region=eu}" || results[0].Count != 100 || results[0].Quantiles[0].Value != 49 {
+		t.Fatalf("unexpected result %+v", results[0])
+	}
+	if len(results[1].Series) != 2 || results[1].Count != 200 || results[1].Quantiles[1].Value != 197 {
+		t.Fatalf("unexpected result %+v", results[1])
+	}
+	if results[2].Error == "" {
+		t.Fatalf("expected the missing series to fail on its own, got %+v", results[2])
+	}
+
+	post(`[{"series": "api", "window": "soon"}]`, http.StatusBadRequest)
+	post(`{"series": "api"}`, http.StatusBadRequest)
+}
@@ -0,0 +1,79 @@
+package main
+
+// the side of the boundary between the left and right sides of a
+// MedianDatabase that values are moved towards
+type rebalanceDirection int
+
+const (
+	// from the tail of the left side onto the head of the right side
+	towardsRight rebalanceDirection = iota
+	// from the head of the right side onto the tail of the left side
+	towardsLeft
+)
+
+// rebalance moves count values across the boundary between two sorted
+// lists of runs, whose concatenation is sorted, in the direction, and
+// returns the new lists. Runs at the boundary are moved whole while they
+// fit in what's left to move, and the last is split, leaving the left
+// tail and the right head with the same value. A moved run merges into a
+// run of the same value on the other side rather than being added next to
+// it, so the runs don't fragment under repeated rebalancing. It moves
+// fewer than count values if the side they're moved from runs out.
+//
+// Both directions share the one loop, so they can't drift apart: only
+// which end of which side is the donor differs.
+func rebalance(left, right []*BulkMetric, count int, direction rebalanceDirection) ([]*BulkMetric, []*BulkMetric) {
+	for count > 0 {
+		// the run next to the boundary, on the side being moved from
+		var edge *BulkMetric
+		if direction == towardsRight && len(left) > 0 {
+			edge = left[len(left)-1]
+		} else if direction == towardsLeft && len(right) > 0 {
+			edge = right[0]
+		} else {
+			break
+		}
+
+		moved := edge
+		if edge.Count() > count {
+			// only part of the run fits, the rest stays where it is
+			edge.DecrBy(count)
+			moved = &BulkMetric{value: edge.Value(), count: count}
+		} else if direction == towardsRight {
+			left = left[:len(left)-1]
+		} else {
+			right = right[1:]
+		}
+		count -= moved.Count()
+
+		if direction == towardsRight {
+			right = pushHead(right, moved)
+		} else {
+			left = pushTail(left, moved)
+		}
+	}
+
+	return left, right
+}
+
+// adds the run to the head of the runs, merging it into the head if they
+// have the same value
+func pushHead(runs []*BulkMetric, run *BulkMetric) []*BulkMetric {
+	if len(runs) > 0 && runs[0].Value() == run.Value() {
+		runs[0].IncrBy(run.Count())
+		return runs
+	}
+
+	return append([]*BulkMetric{run}, runs...)
+}
+
+// adds the run to the tail of the runs, merging it into the tail if they
+// have the same value
+func pushTail(runs []*BulkMetric, run *BulkMetric) []*BulkMetric {
+	if last := len(runs) - 1; last >= 0 && runs[last].Value() == run.Value() {
+		runs[last].IncrBy(run.Count())
+		return runs
+	}
+
+	return append(runs, run)
+}
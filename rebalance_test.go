@@ -0,0 +1,116 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// every list of runs over the values, in order, with each run holding one
+// or two values
+func enumerateRuns(values []int) [][][2]int {
+	if len(values) == 0 {
+		return [][][2]int{{}}
+	}
+
+	enumerated := make([][][2]int, 0)
+	for _, rest := range enumerateRuns(values[1:]) {
+		enumerated = append(enumerated, rest)
+		for count := 1; count <= 2; count++ {
+			enumerated = append(enumerated, append([][2]int{{values[0], count}}, rest...))
+		}
+	}
+
+	return enumerated
+}
+
+func buildRuns(runs [][2]int) []*BulkMetric {
+	metrics := make([]*BulkMetric, 0, len(runs))
+	for _, run := range runs {
+		metrics = append(metrics, &BulkMetric{value: run[0], count: run[1]})
+	}
+	return metrics
+}
+
+func flattenRuns(runs []*BulkMetric) []int {
+	values := make([]int, 0)
+	for _, run := range runs {
+		for i := 0; i < run.Count(); i++ {
+			values = append(values, run.Value())
+		}
+	}
+	return values
+}
+
+// checks the runs hold at least one value each, in strictly increasing
+// order, so nothing was fragmented
+func checkRuns(t *testing.T, name string, runs []*BulkMetric) {
+	for i, run := range runs {
+		if run.Count() < 1 {
+			t.Fatalf("%s: run %d holds %d values", name, i, run.Count())
+		}
+		if i > 0 && runs[i-1].Value() >= run.Value() {
+			t.Fatalf("%s: runs %d and %d are out of order, or fragmented", name, i-1, i)
+		}
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	cases := 0
+	for _, leftRuns := range enumerateRuns([]int{1, 2, 3}) {
+		for _, rightRuns := range enumerateRuns([]int{1, 2, 3, 4}) {
+			// the concatenation must be sorted, sharing at most the
+			// boundary value
+			if len(leftRuns) > 0 && len(rightRuns) > 0 && leftRuns[len(leftRuns)-1][0] > rightRuns[0][0] {
+				continue
+			}
+
+			leftValues, rightValues := flattenRuns(buildRuns(leftRuns)), flattenRuns(buildRuns(rightRuns))
+			for count := 0; count <= len(leftValues)+len(rightValues)+1; count++ {
+				for _, direction := range []rebalanceDirection{towardsRight, towardsLeft} {
+					cases++
+
+					// moving one value at a time
+					expectedLeft, expectedRight := append([]int{}, leftValues...), append([]int{}, rightValues...)
+					if direction == towardsRight {
+						moved := min(count, len(expectedLeft))
+						expectedRight = append(append([]int{}, expectedLeft[len(expectedLeft)-moved:]...), expectedRight...)
+						expectedLeft = expectedLeft[:len(expectedLeft)-moved]
+					} else {
+						moved := min(count, len(expectedRight))
+						expectedLeft = append(expectedLeft, expectedRight[:moved]...)
+						expectedRight = expectedRight[moved:]
+					}
+
+					left, right := rebalance(buildRuns(leftRuns), buildRuns(rightRuns), count, direction)
+					name := map[rebalanceDirection]string{towardsRight: "rebalancing right", towardsLeft: "rebalancing left"}[direction]
+					if actual := flattenRuns(left); !reflect.DeepEqual(actual, expectedLeft) {
+						t.Fatalf("%s %d of %v | %v: expected left %v, got %v", name, count, leftRuns, rightRuns, expectedLeft, actual)
+					}
+					if actual := flattenRuns(right); !reflect.DeepEqual(actual, expectedRight) {
+						t.Fatalf("%s %d of %v | %v: expected right %v, got %v", name, count, leftRuns, rightRuns, expectedRight, actual)
+					}
+					checkRuns(t, name, left)
+					checkRuns(t, name, right)
+				}
+			}
+		}
+	}
+
+	if cases < 1000 {
+		t.Fatalf("expected the cases to be exhaustive, only ran %d", cases)
+	}
+}
+
+func TestRebalanceRoundTrip(t *testing.T) {
+	// moving values across and back leaves a single run either side of
+	// the boundary, however often it is repeated
+	left, right := buildRuns([][2]int{{1, 2}, {5, 3}}), buildRuns([][2]int{{5, 2}, {9, 1}})
+	for i := 0; i < 100; i++ {
+		left, right = rebalance(left, right, i%4+1, towardsRight)
+		left, right = rebalance(left, right, i%4+1, towardsLeft)
+	}
+
+	if len(left) != 2 || left[1].Count() != 3 || len(right) != 2 || right[0].Count() != 2 {
+		t.Fatalf("expected the runs to be unchanged, got %v | %v", flattenRuns(left), flattenRuns(right))
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// a recording is every batch a database applied, with when it was applied,
+// so that a bug which depends on the data can be reproduced exactly by
+// replaying it. It is laid out as:
+//
+//	[4]byte "MSR1"
+//	records, each of:
+//	  int64  unix nanoseconds the batch was applied at (big endian)
+//	  frame  the batch and its sequence, in the wire format
+//
+// unlike a frame log there is no footer, as a recording is most useful
+// from a process which crashed. A torn final record is ignored.
+
+var recordingMagic = []byte("MSR1")
+
+// a RecordedBatch is a single batch read back from a recording
+type RecordedBatch struct {
+	Time time.Time
+	Frame
+}
+
+type Recorder struct {
+	sync.Mutex
+
+	w   io.Writer
+	err error
+}
+
+// NewRecorder writes the recording's header to w. Recording is on the
+// write path, so w should be buffered.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	if _, err := w.Write(recordingMagic); err != nil {
+		return nil, err
+	}
+
+	return &Recorder{w: w}, nil
+}
+
+// Record appends a batch to the recording. Once a write has failed the
+// recording can't be replayed exactly, so every later call returns the
+// same error.
+func (r *Recorder) Record(applied time.Time, frame Frame) error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	encoded := EncodeFrame(frame)
+	record := make([]byte, 8, 8+len(encoded))
+	binary.BigEndian.PutUint64(record, uint64(applied.UnixNano()))
+	if _, err := r.w.Write(append(record, encoded...)); err != nil {
+		r.err = fmt.Errorf("recording: %w", err)
+	}
+
+	return r.err
+}
+
+// WithRecorder records every batch the database applies, along with its
+// sequence and when it was applied, see Replay. Batches are recorded from
+// the worker, so a slow recording holds up all other writes, and failures
+// to record are reported on Errors.
+func WithRecorder(recorder *Recorder) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.recorder = recorder
+	}
+}
+
+// ReadRecording reads every batch from a recording, oldest first.
+func ReadRecording(r io.Reader) ([]RecordedBatch, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, recordingMagic) {
+		return nil, fmt.Errorf("missing recording header: %w", ErrSnapshotCorrupt)
+	}
+
+	batches := make([]RecordedBatch, 0)
+	pos := len(recordingMagic)
+	for pos < len(data) {
+		if len(data)-pos < 8 {
+			break
+		}
+
+		frame, n, ok := parseFrame(data[pos+8:])
+		if !ok {
+			// only the last record can have been torn
+			if !tornFrame(data[pos+8:]) {
+				return nil, fmt.Errorf("record at offset %d: %w", pos, ErrSnapshotCorrupt)
+			}
+			break
+		}
+
+		batches = append(batches, RecordedBatch{
+			Time:  time.Unix(0, int64(binary.BigEndian.Uint64(data[pos:]))),
+			Frame: frame,
+		})
+		pos += 8 + n
+	}
+
+	return batches, nil
+}
+
+// reports whether data is a frame cut short, rather than a corrupt one
+func tornFrame(data []byte) bool {
+	if len(data) < 4 {
+		return true
+	}
+
+	length := binary.BigEndian.Uint32(data)
+	return length <= maxFrameSize && uint64(len(data)) < uint64(length)+8
+}
+
+// Replay applies the recorded batches to database in order, waiting
+// between them as long as they were originally apart divided by speed, so
+// a speed of 10 replays an hour in six minutes. A speed of zero replays
+// as fast as the database applies them. Databases which can apply frames,
+// eg: a MedianDatabase, apply each batch before the next is sent, so they
+// see exactly the same batches in exactly the same order as the original.
+// Replay fails if the recording skipped a sequence, as the result could
+// then differ from the original.
+func Replay(batches []RecordedBatch, database Database, speed float64) error {
+	for i, batch := range batches {
+		if i > 0 {
+			previous := batches[i-1]
+			if previous.Sequence != 0 && batch.Sequence > previous.Sequence+1 {
+				return fmt.Errorf("recording skipped from %d to %d: %w", previous.Sequence, batch.Sequence, ErrSequenceGap)
+			}
+			if speed > 0 {
+				time.Sleep(time.Duration(float64(batch.Time.Sub(previous.Time)) / speed))
+			}
+		}
+
+		var err error
+		if applier, ok := database.(interface{ ApplyFrame(Frame) error }); ok {
+			// the fresh database has its own sequence, so only the order
+			// is kept
+			err = applier.ApplyFrame(Frame{Metrics: copyMetrics(batch.Metrics)})
+		} else {
+			err = database.BulkWrite(copyMetrics(batch.Metrics))
+		}
+		if err != nil {
+			return fmt.Errorf("batch %d: %w", batch.Sequence, err)
+		}
+	}
+
+	return nil
+}
+
+func init() {
+	commands["replay"] = command{
+		usage: "replay a recording through a fresh database and print its stats",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+			speed := flags.Float64("speed", 0, "how much faster than the original to replay, or 0 for as fast as possible")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+			if flags.NArg() != 1 {
+				return fmt.Errorf("expected the recording to replay")
+			}
+
+			file, err := os.Open(flags.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			batches, err := ReadRecording(bufio.NewReader(file))
+			if err != nil {
+				return err
+			}
+
+			database := NewMedianDatabase()
+			database.Open()
+			defer database.Close()
+			if err := Replay(batches, database, *speed); err != nil {
+				return err
+			}
+
+			median, count := database.GetMedianAndCount()
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(struct {
+				Batches     int     `json:"batches"`
+				Median      int64   `json:"median"`
+				MedianFloat float64 `json:"median_float"`
+				Count       int64   `json:"count"`
+			}{len(batches), median, database.GetMedianFloat(), count})
+		},
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRecordAndReplay(t *testing.T) {
+	buf := &bytes.Buffer{}
+	recorder, err := NewRecorder(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	original := NewMedianDatabase(WithRecorder(recorder))
+	original.Open()
+	for i := 0; i < 10; i++ {
+		<-original.BulkWriteAcked(buildBulkMetrics(i*7, i*7+13))
+	}
+	original.Close()
+
+	// a torn final record is ignored
+	data := buf.Bytes()
+	batches, err := ReadRecording(bytes.NewReader(data[:len(data)-3]))
+	if err != nil || len(batches) != 9 {
+		t.Fatalf("expected 9 batches from a torn recording, got %d: %v", len(batches), err)
+	}
+
+	batches, err = ReadRecording(bytes.NewReader(data))
+	if err != nil || len(batches) != 10 {
+		t.Fatalf("expected 10 batches, got %d: %v", len(batches), err)
+	}
+	for i, batch := range batches {
+		if batch.Sequence != uint64(i+1) || batch.Time.IsZero() || (i > 0 && batch.Time.Before(batches[i-1].Time)) {
+			t.Fatalf("unexpected batch %d: %+v", i, batch)
+		}
+	}
+
+	replayed := NewMedianDatabase()
+	replayed.Open()
+	defer replayed.Close()
+	if err := Replay(batches, replayed, 0); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	median, count := original.GetMedianAndCount()
+	if replayedMedian, replayedCount := replayed.GetMedianAndCount(); replayedMedian != median || replayedCount != count || replayed.GetMedianFloat() != original.GetMedianFloat() {
+		t.Fatalf("expected %d of %d, got %d of %d", median, count, replayedMedian, replayedCount)
+	}
+
+	// a recording which skipped a batch can't be replayed exactly
+	if err := Replay(append(batches[:1:1], batches[2:]...), newTestHistogramDatabase(1), 0); !errors.Is(err, ErrSequenceGap) {
+		t.Fatalf("expected ErrSequenceGap, got %v", err)
+	}
+
+	if _, err := ReadRecording(bytes.NewReader([]byte("MSL1"))); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+}
+
+func TestReplaySpeed(t *testing.T) {
+	start := time.Now()
+	batches := []RecordedBatch{
+		{Time: start, Frame: Frame{Sequence: 1, Metrics: buildBulkMetrics(0, 10)}},
+		{Time: start.Add(200 * time.Millisecond), Frame: Frame{Sequence: 2, Metrics: buildBulkMetrics(0, 10)}},
+	}
+
+	database := newTestHistogramDatabase(1)
+	began := time.Now()
+	if err := Replay(batches, database, 4); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if took := time.Since(began); took < 50*time.Millisecond || took > time.Second {
+		t.Fatalf("expected a 4x replay to take about 50ms, took %s", took)
+	}
+	if database.GetMedian() != 4 {
+		t.Fatalf("expected median 4, got %d", database.GetMedian())
+	}
+}
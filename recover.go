@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+const errorChannelSize = 16
+
+// a PanicError is reported on a database or worker error channel when one
+// of their background goroutines panics
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("panic: %v\n%s", p.Value, p.Stack)
+}
+
+// a RestartPolicy decides whether a background goroutine is restarted after
+// a panic. A restarted goroutine keeps all of its buffered state.
+type RestartPolicy struct {
+	// the maximum number of restarts over the lifetime of the goroutine,
+	// where zero never restarts and a negative value always restarts
+	MaxRestarts int
+}
+
+func (r RestartPolicy) allows(restarts int) bool {
+	return r.MaxRestarts < 0 || restarts < r.MaxRestarts
+}
+
+// calls fn, converting any panic into a PanicError which is returned
+func recoverPanic(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{
+				Value: r,
+				Stack: debug.Stack(),
+			}
+		}
+	}()
+
+	fn()
+	return nil
+}
+
+// sends err on errCh without blocking, dropping it if nobody is listening
+// and the channel is full
+func reportError(errCh chan error, err error) {
+	select {
+	case errCh <- err:
+	default:
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a metric which panics when the worker reads its value
+type panicMetric struct{}
+
+func (p panicMetric) Value() int {
+	panic("bad metric")
+}
+
+func expectPanicError(t *testing.T, errCh <-chan error) {
+	select {
+	case err := <-errCh:
+		var panicErr *PanicError
+		if !errors.As(err, &panicErr) {
+			t.Fatalf("expected a PanicError, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for panic to be reported")
+	}
+}
+
+func TestMedianDatabaseRestartsAfterPanic(t *testing.T) {
+	database := NewMedianDatabase(WithRestartPolicy(RestartPolicy{MaxRestarts: 1}))
+	database.Open()
+	defer database.Close()
+
+	database.BulkWrite(buildBulkMetrics(0, 9))
+	database.query(func(left, right []*BulkMetric) {
+		panic("bad query")
+	})
+	expectPanicError(t, database.Errors())
+
+	// the restarted worker still has everything written before the panic
+	snapshot, err := database.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if snapshot.Count() != 9 || snapshot.GetMedian() != 4 {
+		t.Fatalf("expected state to be preserved, got count %d", snapshot.Count())
+	}
+
+	// the second panic exhausts the restart policy
+	database.query(func(left, right []*BulkMetric) {
+		panic("bad query")
+	})
+	expectPanicError(t, database.Errors())
+
+	// wait for the worker to mark itself as failed
+	for i := 0; ; i++ {
+		if err := database.BulkWrite(buildBulkMetrics(0, 1)); errors.Is(err, ErrClosed) {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("expected writes to fail after the worker failed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBufferedWorkerRestartsAfterPanic(t *testing.T) {
+	flushed := make(chan int, 1)
+	db := newMockDatabase(t, func(bulkMetrics []*BulkMetric) {
+		count := 0
+		for _, metric := range bulkMetrics {
+			count += metric.Count()
+		}
+		flushed <- count
+	})
+
+	worker := NewBufferedWorker(3, time.Minute, db, WithWorkerRestartPolicy(RestartPolicy{MaxRestarts: -1}))
+	worker.Start()
+
+	worker.Write(NewIntMetric(1))
+	worker.Write(panicMetric{})
+	expectPanicError(t, worker.Errors())
+
+	// the metric buffered before the panic is flushed with the rest
+	worker.Write(NewIntMetric(2))
+	worker.Write(NewIntMetric(3))
+
+	select {
+	case count := <-flushed:
+		if count != 3 {
+			t.Fatalf("expected 3 metrics to be flushed, got %d", count)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	worker.Stop()
+}
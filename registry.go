@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BackendConfig holds the settings for a backend, eg: as read from a
+// config file. Each backend documents the keys it understands.
+type BackendConfig map[string]string
+
+// a BackendFactory creates a Database from its config
+type BackendFactory func(config BackendConfig) (Database, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available by name to NewBackend, so that
+// other packages can contribute storage engines without this package
+// importing them. It is meant to be called from init, and panics if the
+// name is already registered or the factory is nil.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if factory == nil {
+		panic("backend factory for " + name + " is nil")
+	}
+	if _, ok := backends[name]; ok {
+		panic("backend " + name + " registered twice")
+	}
+	backends[name] = factory
+}
+
+// removes the backend registered under name, eg: one registered by a test
+func unregisterBackend(name string) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	delete(backends, name)
+}
+
+// NewBackend creates a database with the backend registered under name.
+// The database still needs to be opened.
+func NewBackend(name string, config BackendConfig) (Database, error) {
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("backend %q: %w", name, ErrUnknownBackend)
+	}
+
+	return factory(config)
+}
+
+// Backends returns the names of every registered backend, sorted.
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// returns the config value as an int, or fallback if it isn't set
+func (c BackendConfig) int(key string, fallback int) (int, error) {
+	value, ok := c[key]
+	if !ok {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("backend config %s: %w", key, err)
+	}
+
+	return parsed, nil
+}
+
+// returns the config value as a duration, or fallback if it isn't set
+func (c BackendConfig) duration(key string, fallback time.Duration) (time.Duration, error) {
+	value, ok := c[key]
+	if !ok {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("backend config %s: invalid duration %q", key, value)
+	}
+
+	return parsed, nil
+}
+
+// returns the config value as a comma separated list of ints
+func (c BackendConfig) ints(key string) ([]int, error) {
+	values := []int{}
+	for _, value := range strings.Split(c[key], ",") {
+		if value = strings.TrimSpace(value); value == "" {
+			continue
+		}
+
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, fmt.Errorf("backend config %s: invalid value %q", key, value)
+		}
+		values = append(values, parsed)
+	}
+
+	return values, nil
+}
+
+func init() {
+	// median: exact, and thresholds, a comma separated list counted with
+	// WithThresholds
+	RegisterBackend("median", func(config BackendConfig) (Database, error) {
+		thresholds, err := config.ints("thresholds")
+		if err != nil {
+			return nil, err
+		}
+		if len(thresholds) > 0 {
+			return NewMedianDatabase(WithThresholds(thresholds...)), nil
+		}
+
+		return NewMedianDatabase(), nil
+	})
+
+	// histogram: resolutions, a comma separated list of bucket widths
+	// which defaults to 1
+	RegisterBackend("histogram", func(config BackendConfig) (Database, error) {
+		resolutions := []int{}
+		for _, resolution := range strings.Split(config["resolutions"], ",") {
+			if resolution = strings.TrimSpace(resolution); resolution == "" {
+				continue
+			}
+
+			parsed, err := strconv.Atoi(resolution)
+			if err != nil || parsed < 1 {
+				return nil, fmt.Errorf("backend config resolutions: invalid resolution %q", resolution)
+			}
+			resolutions = append(resolutions, parsed)
+		}
+		if len(resolutions) == 0 {
+			resolutions = append(resolutions, 1)
+		}
+
+		histogram, err := NewHistogramDatabase(resolutions...)
+		if err != nil {
+			return nil, err
+		}
+
+		return histogram, nil
+	})
+
+	// rolling: capacity, required, and policy, either drop-oldest (the
+	// default) or reject-new
+	RegisterBackend("rolling", func(config BackendConfig) (Database, error) {
+		capacity, err := config.int("capacity", 0)
+		if err != nil {
+			return nil, err
+		}
+		if capacity < 1 {
+			return nil, fmt.Errorf("backend config capacity: must be at least 1")
+		}
+
+		policy := DropOldest
+		switch config["policy"] {
+		case "", "drop-oldest":
+		case "reject-new":
+			policy = RejectNew
+		default:
+			return nil, fmt.Errorf("backend config policy: unknown policy %q", config["policy"])
+		}
+
+		return NewRollingDatabase(capacity, policy), nil
+	})
+
+	// windowed: resolution, which defaults to 1m, retention, which
+	// defaults to 1h, threshold, counted with WithThreshold if set, and
+	// raw_samples, the most samples kept WithRawSamples if set
+	RegisterBackend("windowed", func(config BackendConfig) (Database, error) {
+		resolution, err := config.duration("resolution", time.Minute)
+		if err != nil {
+			return nil, err
+		}
+		retention, err := config.duration("retention", time.Hour)
+		if err != nil {
+			return nil, err
+		}
+		if retention < resolution {
+			return nil, fmt.Errorf("backend config retention: must be at least the resolution")
+		}
+
+		options := []WindowOption{}
+		if _, ok := config["threshold"]; ok {
+			threshold, err := config.int("threshold", 0)
+			if err != nil {
+				return nil, err
+			}
+			options = append(options, WithThreshold(threshold))
+		}
+		if _, ok := config["raw_samples"]; ok {
+			limit, err := config.int("raw_samples", 0)
+			if err != nil {
+				return nil, err
+			} else if limit < 1 {
+				return nil, fmt.Errorf("backend config raw_samples: must be positive")
+			}
+			options = append(options, WithRawSamples(limit))
+		}
+
+		windowed, err := NewWindowedDatabase(resolution, retention, options...)
+		if err != nil {
+			return nil, err
+		}
+
+		return windowed, nil
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestBackendRegistry(t *testing.T) {
+	RegisterBackend("test-fixed", func(config BackendConfig) (Database, error) {
+		return NewRollingDatabase(1, RejectNew), nil
+	})
+	t.Cleanup(func() { unregisterBackend("test-fixed") })
+
+	// other tests and files may register backends of their own
+	registered := make(map[string]bool)
+	for _, name := range Backends() {
+		registered[name] = true
+	}
+	for _, name := range []string{"histogram", "median", "rolling", "test-fixed", "windowed"} {
+		if !registered[name] {
+			t.Fatalf("expected backend %s in %v", name, Backends())
+		}
+	}
+
+	database, err := NewBackend("histogram", BackendConfig{"resolutions": "1, 50"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if resolutions := database.(*HistogramDatabase).Resolutions(); !reflect.DeepEqual(resolutions, []int{1, 50}) {
+		t.Fatalf("unexpected resolutions %v", resolutions)
+	}
+
+	if _, err := NewBackend("rolling", BackendConfig{"capacity": "ten"}); err == nil {
+		t.Fatalf("expected an invalid capacity to fail")
+	}
+	database, err = NewBackend("windowed", BackendConfig{"resolution": "10s", "threshold": "250"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if windowed := database.(*WindowedDatabase); windowed.resolution != 10*time.Second || windowed.retention != time.Hour || !windowed.thresholded || windowed.threshold != 250 {
+		t.Fatalf("unexpected windowed database %+v", windowed)
+	}
+	if _, err := NewBackend("windowed", BackendConfig{"resolution": "1h", "retention": "1m"}); err == nil {
+		t.Fatalf("expected a retention shorter than the resolution to fail")
+	}
+
+	database, err = NewBackend("median", BackendConfig{"thresholds": "500,100"})
+	if err != nil || !reflect.DeepEqual(database.(*MedianDatabase).thresholds, []int{100, 500}) {
+		t.Fatalf("expected thresholds, got %v", err)
+	}
+
+	if _, err := NewBackend("skiplist", nil); !errors.Is(err, ErrUnknownBackend) {
+		t.Fatalf("expected ErrUnknownBackend, got %v", err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("expected registering a name twice to panic")
+		}
+	}()
+	RegisterBackend("median", func(config BackendConfig) (Database, error) {
+		return nil, nil
+	})
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// a RemoteWriteForwarder periodically remote writes every registered
+// series' percentiles to a Prometheus compatible backend, eg: Mimir or
+// Thanos, as a summary per series and window:
+//
+//	api_latency{quantile="0.99",window="5m",region="eu"} 412
+//	api_latency_count{window="5m",region="eu"} 2000
+//	api_latency_sum{window="5m",region="eu"} 76000
+//
+// so long term storage and alerting can reuse existing infrastructure.
+// Series tags become labels, and the window label is left out for series
+// forwarded in whole.
+type RemoteWriteForwarder struct {
+	registry  *Registry
+	url       string
+	client    *http.Client
+	interval  time.Duration
+	windows   []time.Duration
+	quantiles []float64
+
+	quitCh  chan struct{}
+	doneCh  chan struct{}
+	errCh   chan error
+	started int32
+}
+
+// NewRemoteWriteForwarder creates a forwarder writing to the remote write
+// endpoint at url every interval. Without any windows, each series is
+// forwarded in whole; otherwise it is forwarded over each window, and
+// series which aren't windowed are skipped.
+func NewRemoteWriteForwarder(registry *Registry, url string, interval time.Duration, windows ...time.Duration) *RemoteWriteForwarder {
+	if len(windows) == 0 {
+		windows = []time.Duration{0}
+	}
+
+	return &RemoteWriteForwarder{
+		registry:  registry,
+		url:       url,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		interval:  interval,
+		windows:   windows,
+		quantiles: defaultSummaryQuantiles,
+		quitCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+		errCh:     make(chan error, errorChannelSize),
+	}
+}
+
+// a single sample of a remote write request, with its labels sorted by
+// name as remote write requires
+type remoteSample struct {
+	labels [][2]string
+	value  float64
+}
+
+func newRemoteSample(name string, labels map[string]string, value float64) remoteSample {
+	sample := remoteSample{labels: [][2]string{{"__name__", name}}, value: value}
+	for key, label := range labels {
+		sample.labels = append(sample.labels, [2]string{key, label})
+	}
+	sort.Slice(sample.labels, func(i, j int) bool { return sample.labels[i][0] < sample.labels[j][0] })
+
+	return sample
+}
+
+func (f *RemoteWriteForwarder) samples(name string, window time.Duration, snapshot Snapshot) []remoteSample {
+	base, tags := parseSeriesName(name)
+	base = prometheusName(base)
+	labels := make(map[string]string, len(tags)+2)
+	for key, value := range tags {
+		labels[prometheusName(key)] = value
+	}
+	if window > 0 {
+		labels["window"] = window.String()
+	}
+
+	samples := make([]remoteSample, 0, len(f.quantiles)+2)
+	samples = append(samples,
+		newRemoteSample(base+"_count", labels, float64(snapshot.Count())),
+		newRemoteSample(base+"_sum", labels, float64(snapshot.Sum())))
+	if snapshot.Count() == 0 {
+		return samples
+	}
+
+	for _, quantile := range f.quantiles {
+		labels["quantile"] = formatPrometheusFloat(quantile)
+		samples = append(samples, newRemoteSample(base, labels, float64(snapshot.GetPercentile(quantile))))
+	}
+
+	return samples
+}
+
+// Push remote writes every series and window now, in a single request.
+// Series which can't be snapshotted are left out, and the last of their
+// errors is returned once the rest have been written.
+func (f *RemoteWriteForwarder) Push() error {
+	now := time.Now()
+
+	var lastErr error
+	samples := make([]remoteSample, 0)
+	for _, snapshots := range f.registry.snapshotWindows(f.windows) {
+		for i, snapshot := range snapshots {
+			if errors.Is(snapshot.Err, errUnsupportedQuery) {
+				continue
+			} else if snapshot.Err != nil {
+				lastErr = snapshot.Err
+				continue
+			}
+
+			samples = append(samples, f.samples(snapshot.Name, f.windows[i], snapshot.Snapshot)...)
+		}
+	}
+	if len(samples) == 0 {
+		return lastErr
+	}
+
+	request, _ := http.NewRequest(http.MethodPost, f.url, bytes.NewReader(snappyEncode(encodeRemoteWrite(samples, now))))
+	request.Header.Set("Content-Type", "application/x-protobuf")
+	request.Header.Set("Content-Encoding", "snappy")
+	request.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := f.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return lastErr
+}
+
+// Start forwards every interval until stopped.
+func (f *RemoteWriteForwarder) Start() {
+	atomic.StoreInt32(&f.started, 1)
+	go func() {
+		defer close(f.doneCh)
+
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := f.Push(); err != nil {
+					reportError(f.errCh, err)
+				}
+			case <-f.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops forwarding, without forwarding the partial interval.
+func (f *RemoteWriteForwarder) Stop() {
+	close(f.quitCh)
+	if atomic.LoadInt32(&f.started) == 1 {
+		<-f.doneCh
+	}
+}
+
+// Errors returns a channel of errors from querying series or writing to
+// the backend. Errors are dropped if the channel isn't drained.
+func (f *RemoteWriteForwarder) Errors() <-chan error {
+	return f.errCh
+}
+
+// encodes a WriteRequest with a time series per sample, see
+// decodeRemoteWrite
+func encodeRemoteWrite(samples []remoteSample, now time.Time) []byte {
+	appendBytes := func(buf []byte, field int, value []byte) []byte {
+		buf = binary.AppendUvarint(buf, uint64(field<<3|2))
+		buf = binary.AppendUvarint(buf, uint64(len(value)))
+		return append(buf, value...)
+	}
+
+	request := make([]byte, 0, 64*len(samples))
+	for _, sample := range samples {
+		series := make([]byte, 0, 64)
+		for _, label := range sample.labels {
+			encoded := appendBytes(nil, 1, []byte(label[0]))
+			series = appendBytes(series, 1, appendBytes(encoded, 2, []byte(label[1])))
+		}
+
+		encoded := binary.AppendUvarint(nil, 1<<3|1)
+		encoded = binary.LittleEndian.AppendUint64(encoded, math.Float64bits(sample.value))
+		encoded = binary.AppendUvarint(encoded, 2<<3)
+		encoded = binary.AppendUvarint(encoded, uint64(now.UnixMilli()))
+		series = appendBytes(series, 2, encoded)
+
+		request = appendBytes(request, 1, series)
+	}
+
+	return request
+}
+
+// encodes a snappy block, replacing repeats of the last 64KB with copies,
+// which is most of a remote write request's labels
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(make([]byte, 0, len(src)/2+16), uint64(len(src)))
+
+	seen := make(map[uint32]int)
+	literal := 0
+	for i := 0; i+4 <= len(src); {
+		key := binary.LittleEndian.Uint32(src[i:])
+		candidate, ok := seen[key]
+		seen[key] = i
+		if !ok || i-candidate > math.MaxUint16 {
+			i++
+			continue
+		}
+
+		length := 4
+		for i+length < len(src) && length < 64 && src[candidate+length] == src[i+length] {
+			length++
+		}
+
+		dst = appendSnappyLiteral(dst, src[literal:i])
+		offset := i - candidate
+		dst = append(dst, byte(2|(length-1)<<2), byte(offset), byte(offset>>8))
+		i += length
+		literal = i
+	}
+
+	return appendSnappyLiteral(dst, src[literal:])
+}
+
+func appendSnappyLiteral(dst, literal []byte) []byte {
+	switch n := len(literal) - 1; {
+	case n < 0:
+		return dst
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+
+	return append(dst, literal...)
+}
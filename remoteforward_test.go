@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRemoteWriteForwarder(t *testing.T) {
+	registry := NewRegistry()
+	database := NewSyncMedianDatabase()
+	database.BulkWrite(buildBulkMetrics(1, 101))
+	registry.Register("api.latency{region=eu}", database)
+
+	received := make(map[string]float64)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		request, err := snappyDecode(body)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		decodeRemoteWrite(request, func(labels map[string]string, samples []float64) {
+			received[labels["__name__"]+"/"+labels["region"]+"/"+labels["quantile"]] = samples[0]
+		})
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	forwarder := NewRemoteWriteForwarder(registry, server.URL, time.Minute)
+	if err := forwarder.Push(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if received["api_latency_count/eu/"] != 100 || received["api_latency_sum/eu/"] != 5050 || received["api_latency/eu/0.99"] != 99 {
+		t.Fatalf("unexpected samples %v", received)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "out of order sample", http.StatusBadRequest)
+	}))
+	defer failing.Close()
+	if err := NewRemoteWriteForwarder(registry, failing.URL, time.Minute).Push(); err == nil {
+		t.Fatalf("expected a rejected write to fail")
+	}
+}
+
+func TestSnappyEncode(t *testing.T) {
+	random := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, src := range [][]byte{{}, []byte("abc"), bytes.Repeat([]byte("api_latency{region=eu}"), 1000), random} {
+		encoded := snappyEncode(src)
+		decoded, err := snappyDecode(encoded)
+		if err != nil || !bytes.Equal(decoded, src) {
+			t.Fatalf("expected %d bytes to round trip, got %d, %v", len(src), len(decoded), err)
+		}
+	}
+
+	if repeated := bytes.Repeat([]byte("abcd"), 1000); len(snappyEncode(repeated)) > len(repeated)/10 {
+		t.Fatalf("expected repeats to be compressed")
+	}
+}
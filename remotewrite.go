@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var errMalformedRemoteWrite = errors.New("malformed remote write request")
+
+const (
+	// the largest compressed request accepted, well above the few
+	// megabytes Prometheus sends at most
+	maxRemoteWriteBytes = 32 << 20
+
+	// the largest decompressed request accepted
+	maxRemoteWriteDecodedBytes = 1 << 28
+)
+
+// a RemoteWriteRule selects series from Prometheus remote write requests
+// to be written into a SeriesDatabase. Rules are usually read from a
+// config file with ParseRemoteWriteRules, as a JSON array of:
+//
+//	{"match": "http_request_duration_seconds{job=api}", "series": "api.latency", "scale": 1000}
+type RemoteWriteRule struct {
+	// a selector on the metric name and labels, see ParseSelector
+	Match string `json:"match"`
+
+	// the series the samples are written to, by default the metric name
+	// with its labels, eg: http_request_duration_seconds{job=api,le=0.5}
+	Series string `json:"series,omitempty"`
+
+	// multiplies every sample before it is rounded, eg: 1000 to store
+	// latencies reported in seconds as milliseconds. 1 if unset.
+	Scale float64 `json:"scale,omitempty"`
+
+	selector Selector
+}
+
+// ParseRemoteWriteRules reads a JSON array of rules, failing if any
+// selector is malformed.
+func ParseRemoteWriteRules(r io.Reader) ([]RemoteWriteRule, error) {
+	rules := []RemoteWriteRule{}
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("invalid remote write rules: %w", err)
+	}
+
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+
+	return rules, nil
+}
+
+// parses the rule's selector, which it must be before it routes anything
+func (r *RemoteWriteRule) compile() error {
+	selector, err := ParseSelector(r.Match)
+	if err != nil {
+		return err
+	}
+	r.selector = selector
+
+	return nil
+}
+
+// returns the series the labels are written to, if the rule selects them
+func (r RemoteWriteRule) route(labels map[string]string) (string, bool) {
+	if r.selector.Name != "" && labels["__name__"] != r.selector.Name {
+		return "", false
+	}
+	for _, matcher := range r.selector.Matchers {
+		if !matcher.matches(labels) {
+			return "", false
+		}
+	}
+
+	if r.Series != "" {
+		return r.Series, true
+	}
+
+	tags := make([]string, 0, len(labels))
+	for key, value := range labels {
+		if key != "__name__" {
+			tags = append(tags, key+"="+value)
+		}
+	}
+	if len(tags) == 0 {
+		return labels["__name__"], true
+	}
+	sort.Strings(tags)
+
+	return labels["__name__"] + "{" + strings.Join(tags, ",") + "}", true
+}
+
+func (r RemoteWriteRule) metric(sample float64) *BulkMetric {
+	scale := r.Scale
+	if scale == 0 {
+		scale = 1
+	}
+
+	return &BulkMetric{value: int(math.Round(sample * scale)), count: 1}
+}
+
+// NewRemoteWriteHandler accepts Prometheus remote write requests, so a
+// Prometheus server can tee its samples into the series database with
+// only a remote_write entry in its config:
+//
+//	remote_write:
+//	  - url: http://localhost:8080/api/v1/write
+//
+// Each series in a request is written by the first rule selecting it, and
+// series no rule selects are dropped, as are stale markers. Samples are
+// written as they arrive, ignoring their timestamps. Requests over 32MB
+// compressed are refused with 413.
+//
+// Series are written one at a time, in order of name. If the first fails
+// nothing was written, and the response is one Prometheus retries where
+// the error is transient, eg: 503 for a closed database. If a later one
+// fails, the request is refused with 400 so that Prometheus drops it
+// rather than retrying and counting the series already written twice.
+func NewRemoteWriteHandler(series *SeriesDatabase, rules ...RemoteWriteRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "writes must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		request, err := snappyDecode(compressed)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		written := make(map[string][]*BulkMetric)
+		err = decodeRemoteWrite(request, func(labels map[string]string, samples []float64) {
+			for _, rule := range rules {
+				name, ok := rule.route(labels)
+				if !ok {
+					continue
+				}
+
+				for _, sample := range samples {
+					if !math.IsNaN(sample) && !math.IsInf(sample, 0) {
+						written[name] = append(written[name], rule.metric(sample))
+					}
+				}
+				return
+			}
+		})
+		// Prometheus retries 5xx responses, but not malformed requests
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// series are created in order, so the same requests always
+		// overflow the same series
+		names := make([]string, 0, len(written))
+		for name := range written {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for i, name := range names {
+			err := series.Write(SeriesKey{Name: name}, written[name])
+			if err == nil {
+				continue
+			}
+
+			// once any series is written a retry would count it twice,
+			// so the request is refused for good with a 4xx, which
+			// Prometheus drops rather than retries
+			err = fmt.Errorf("series %s: %w", name, err)
+			if i > 0 {
+				http.Error(w, fmt.Sprintf("%d of %d series written: %v", i, len(names), err), http.StatusBadRequest)
+				return
+			}
+			writeError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// calls fn with each series of a WriteRequest, which is:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; ... }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; ... }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func decodeRemoteWrite(request []byte, fn func(labels map[string]string, samples []float64)) error {
+	return protoFields(request, func(field int, value []byte) error {
+		if field != 1 {
+			return nil
+		}
+
+		labels := make(map[string]string)
+		samples := make([]float64, 0, 1)
+		err := protoFields(value, func(field int, value []byte) error {
+			switch field {
+			case 1:
+				name, label := "", ""
+				err := protoFields(value, func(field int, value []byte) error {
+					switch field {
+					case 1:
+						name = string(value)
+					case 2:
+						label = string(value)
+					}
+					return nil
+				})
+				labels[name] = label
+				return err
+			case 2:
+				sample := 0.0
+				err := protoFields(value, func(field int, value []byte) error {
+					if field == 1 && len(value) == 8 {
+						sample = math.Float64frombits(binary.LittleEndian.Uint64(value))
+					}
+					return nil
+				})
+				samples = append(samples, sample)
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fn(labels, samples)
+		return nil
+	})
+}
+
+// calls fn with the number and raw value of each field of a protobuf
+// message. Varints are passed undecoded, which is all remote write needs.
+func protoFields(message []byte, fn func(field int, value []byte) error) error {
+	for len(message) > 0 {
+		key, n := binary.Uvarint(message)
+		if n <= 0 {
+			return errMalformedRemoteWrite
+		}
+		message = message[n:]
+
+		length := 0
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(message); n <= 0 {
+				return errMalformedRemoteWrite
+			}
+			length = n
+		case 1:
+			length = 8
+		case 2:
+			size, n := binary.Uvarint(message)
+			if n <= 0 || size > uint64(len(message)-n) {
+				return errMalformedRemoteWrite
+			}
+			message = message[n:]
+			length = int(size)
+		case 5:
+			length = 4
+		default:
+			return fmt.Errorf("wire type %d: %w", key&7, errMalformedRemoteWrite)
+		}
+		if length > len(message) {
+			return errMalformedRemoteWrite
+		}
+
+		if err := fn(int(key>>3), message[:length]); err != nil {
+			return err
+		}
+		message = message[length:]
+	}
+
+	return nil
+}
+
+// decodes a snappy block, the compression remote write requests are
+// always sent with
+func snappyDecode(src []byte) ([]byte, error) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || length > maxRemoteWriteDecodedBytes {
+		return nil, fmt.Errorf("snappy: invalid length")
+	}
+	src = src[n:]
+
+	// the declared length isn't trusted up front, the buffer grows as the
+	// input actually decodes
+	dst := make([]byte, 0, min(length, uint64(len(src))*2))
+	for len(src) > 0 {
+		tag := src[0]
+		size, offset := 0, 0
+		switch tag & 3 {
+		case 0:
+			size = int(tag>>2) + 1
+			src = src[1:]
+			if size > 60 {
+				bytes := size - 60
+				if len(src) < bytes {
+					return nil, fmt.Errorf("snappy: truncated literal")
+				}
+				size = 1
+				for i := 0; i < bytes; i++ {
+					size += int(src[i]) << (8 * i)
+				}
+				src = src[bytes:]
+			}
+			if size > len(src) {
+				return nil, fmt.Errorf("snappy: truncated literal")
+			}
+			if uint64(len(dst)+size) > length {
+				return nil, fmt.Errorf("snappy: literal beyond the declared length")
+			}
+			dst = append(dst, src[:size]...)
+			src = src[size:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, fmt.Errorf("snappy: truncated copy")
+			}
+			size = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, fmt.Errorf("snappy: truncated copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, fmt.Errorf("snappy: truncated copy")
+			}
+			size = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:]))
+			src = src[5:]
+		}
+
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+size) > length {
+			return nil, fmt.Errorf("snappy: invalid copy")
+		}
+		// copies can overlap what they copy, so go a byte at a time
+		start := len(dst) - offset
+		for i := 0; i < size; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+
+	if uint64(len(dst)) != length {
+		return nil, fmt.Errorf("snappy: decoded %d bytes, expected %d", len(dst), length)
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func protoBytes(field int, value []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(field<<3|2))
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+func protoDouble(field int, value float64) []byte {
+	buf := binary.AppendUvarint(nil, uint64(field<<3|1))
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(value))
+}
+
+func protoVarint(field int, value uint64) []byte {
+	buf := binary.AppendUvarint(nil, uint64(field<<3))
+	return binary.AppendUvarint(buf, value)
+}
+
+// builds a snappy block of a single literal, which every decoder accepts
+func snappyLiteral(src []byte) []byte {
+	buf := binary.AppendUvarint(nil, uint64(len(src)))
+	buf = append(buf, 62<<2, byte(len(src)-1), byte((len(src)-1)>>8), byte((len(src)-1)>>16))
+	return append(buf, src...)
+}
+
+func remoteWriteSeries(labels map[string]string, samples ...float64) []byte {
+	series := []byte{}
+	for name, value := range labels {
+		series = append(series, protoBytes(1, append(protoBytes(1, []byte(name)), protoBytes(2, []byte(value))...))...)
+	}
+	for i, sample := range samples {
+		series = append(series, protoBytes(2, append(protoDouble(1, sample), protoVarint(2, uint64(1700000000000+i))...))...)
+	}
+
+	return protoBytes(1, series)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	rules, err := ParseRemoteWriteRules(strings.NewReader(`[
+		{"match": "http_request_duration_seconds{job=api}", "series": "api.latency", "scale": 1000},
+		{"match": "queue_depth"}
+	]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	series := NewSeriesDatabase(10, func() Database { return NewSyncMedianDatabase() })
+	handler := NewRemoteWriteHandler(series, rules...)
+
+	request := bytes.Join([][]byte{
+		remoteWriteSeries(map[string]string{"__name__": "http_request_duration_seconds", "job": "api"}, 0.1, 0.2, 0.3),
+		remoteWriteSeries(map[string]string{"__name__": "http_request_duration_seconds", "job": "batch"}, 5),
+		remoteWriteSeries(map[string]string{"__name__": "queue_depth", "queue": "emails"}, 7, math.NaN()),
+	}, nil)
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappyLiteral(request))))
+	if recorder.Code != 204 {
+		t.Fatalf("expected 204, got %d %s", recorder.Code, recorder.Body)
+	}
+
+	api, ok := series.Get(SeriesKey{Name: "api.latency"})
+	if !ok || api.GetMedian() != 200 {
+		t.Fatalf("expected api.latency to have a median of 200ms")
+	}
+	queue, ok := series.Get(SeriesKey{Name: "queue_depth{queue=emails}"})
+	if _, count := queue.(*SyncMedianDatabase).GetMedianAndCount(); !ok || count != 1 {
+		t.Fatalf("expected queue_depth to have the one sample which isn't stale")
+	}
+	if _, ok := series.Get(SeriesKey{Name: "http_request_duration_seconds{job=batch}"}); ok {
+		t.Fatalf("expected series no rule selects to be dropped")
+	}
+
+	for _, body := range [][]byte{request, snappyLiteral([]byte{0x0a, 0xff})} {
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(body)))
+		if recorder.Code != 400 {
+			t.Fatalf("expected a malformed request to be rejected, got %d", recorder.Code)
+		}
+	}
+}
+
+func TestRemoteWritePartialFailure(t *testing.T) {
+	rules, err := ParseRemoteWriteRules(strings.NewReader(`[{"match": "a"}, {"match": "b"}]`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// each series holds a single sample
+	series := NewSeriesDatabase(10, func() Database { return NewRollingDatabase(1, RejectNew) })
+	handler := NewRemoteWriteHandler(series, rules...)
+	write := func(request []byte) int {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/v1/write", bytes.NewReader(snappyLiteral(request))))
+		return recorder.Code
+	}
+
+	// nothing is written when the first series fails, so it can be retried
+	if code := write(remoteWriteSeries(map[string]string{"__name__": "b"}, 1, 2)); code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 when nothing was written, got %d", code)
+	}
+
+	// a later series failing refuses the request for good
+	request := bytes.Join([][]byte{
+		remoteWriteSeries(map[string]string{"__name__": "a"}, 1),
+		remoteWriteSeries(map[string]string{"__name__": "b"}, 1, 2),
+	}, nil)
+	if code := write(request); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 after a partial write, got %d", code)
+	}
+	if a, ok := series.Get(SeriesKey{Name: "a"}); !ok || a.(*RollingDatabase).count != 1 {
+		t.Fatalf("expected the series written before the failure to be kept")
+	}
+}
+
+func TestSnappyDecode(t *testing.T) {
+	// a literal abc, then an overlapping copy of 6 bytes from 3 back
+	decoded, err := snappyDecode([]byte{9, 2 << 2, 'a', 'b', 'c', 1 | 2<<2, 3})
+	if err != nil || string(decoded) != "abcabcabc" {
+		t.Fatalf("unexpected decoding %q, %v", decoded, err)
+	}
+
+	if _, err := snappyDecode([]byte{9, 2 << 2, 'a', 'b', 'c', 1 | 2<<2, 4}); err == nil {
+		t.Fatalf("expected a copy from before the start to be rejected")
+	}
+
+	// a huge declared length isn't allocated up front, and literals can't
+	// run past it
+	huge := binary.AppendUvarint(nil, maxRemoteWriteDecodedBytes)
+	if _, err := snappyDecode(append(huge, 0, 'a')); err == nil {
+		t.Fatalf("expected a short decoding to be rejected")
+	}
+	if _, err := snappyDecode([]byte{2, 2 << 2, 'a', 'b', 'c'}); err == nil {
+		t.Fatalf("expected a literal beyond the declared length to be rejected")
+	}
+}
+
+func TestRemoteWriteBodyLimit(t *testing.T) {
+	handler := NewRemoteWriteHandler(NewSeriesDatabase(10, func() Database { return NewSyncMedianDatabase() }))
+
+	recorder := httptest.NewRecorder()
+	body := bytes.NewReader(make([]byte, maxRemoteWriteBytes+1))
+	handler.ServeHTTP(recorder, httptest.NewRequest("POST", "/api/v1/write", body))
+	if recorder.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for an oversized body, got %d", recorder.Code)
+	}
+}
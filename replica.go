@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+)
+
+// a Replica is a read-only copy of a primary database. It is bootstrapped
+// from a streamed snapshot of the primary and then kept up to date by
+// applying the batches the primary emits through its replication sink.
+// Batches are deduplicated by sequence number, so resending batches the
+// snapshot already included, or any other batch, is harmless.
+type Replica struct {
+	database *MedianDatabase
+}
+
+// NewReplica reads a snapshot written with WriteSnapshot from r and opens
+// a replica seeded with its contents.
+func NewReplica(r io.Reader) (*Replica, error) {
+	snapshot, err := ReadSnapshot(r)
+	if err != nil {
+		return nil, err
+	}
+
+	replica := &Replica{
+		database: NewMedianDatabase(),
+	}
+	replica.database.Open()
+
+	if err := replica.database.seed(snapshot); err != nil {
+		replica.database.Close()
+		return nil, err
+	}
+
+	return replica, nil
+}
+
+// Apply applies a single replicated batch, see MedianDatabase.ApplyFrame.
+func (r *Replica) Apply(frame Frame) error {
+	return r.database.ApplyFrame(frame)
+}
+
+// Follow applies every frame read from stream until it is exhausted.
+func (r *Replica) Follow(stream io.Reader) error {
+	for {
+		frame, err := ReadFrame(stream)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := r.Apply(frame); err != nil {
+			return err
+		}
+	}
+}
+
+func (r *Replica) GetMedian() int {
+	return r.database.GetMedian()
+}
+
+func (r *Replica) GetMedianAndCount() (int64, int64) {
+	return r.database.GetMedianAndCount()
+}
+
+func (r *Replica) Snapshot() (Snapshot, error) {
+	return r.database.Snapshot()
+}
+
+func (r *Replica) Close() {
+	r.database.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestReplicaFollowsPrimary(t *testing.T) {
+	stream := new(bytes.Buffer)
+	primary := NewMedianDatabase(WithReplicationSink(func(frame Frame) {
+		WriteFrame(stream, frame)
+	}))
+	primary.Open()
+	defer primary.Close()
+
+	primary.BulkWrite(buildBulkMetrics(0, 10))
+	snapshot, _ := primary.Snapshot()
+
+	// only batches after the snapshot need to be replicated
+	stream.Reset()
+	primary.BulkWrite(buildBulkMetrics(5, 20))
+	primary.BulkWrite(buildBulkMetrics(5, 6))
+	expected, _ := primary.Snapshot()
+
+	encoded := new(bytes.Buffer)
+	if err := WriteSnapshot(encoded, snapshot); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	replica, err := NewReplica(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer replica.Close()
+
+	if err := replica.Follow(stream); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	actual, _ := replica.Snapshot()
+	if diff := Diff(expected, actual); len(diff.Deltas) != 0 {
+		t.Fatalf("expected replica to match primary, got deltas %v", diff.Deltas)
+	}
+	if replica.GetMedian() != primary.GetMedian() {
+		t.Fatalf("expected median %d, got %d", primary.GetMedian(), replica.GetMedian())
+	}
+}
+
+func TestReplicaAppliesBatchesExactlyOnce(t *testing.T) {
+	frames := make([]Frame, 0)
+	primary := NewMedianDatabase(WithReplicationSink(func(frame Frame) {
+		frames = append(frames, frame)
+	}))
+	primary.Open()
+	defer primary.Close()
+
+	primary.BulkWrite(buildBulkMetrics(0, 10))
+	snapshot, _ := primary.Snapshot()
+	primary.BulkWrite(buildBulkMetrics(10, 20))
+	primary.BulkWrite(buildBulkMetrics(20, 30))
+	primary.Snapshot()
+
+	if len(frames) != 3 || frames[0].Sequence != 1 || frames[2].Sequence != 3 || snapshot.Sequence != 1 {
+		t.Fatalf("unexpected sequences, snapshot %d and %d frames", snapshot.Sequence, len(frames))
+	}
+
+	encoded := new(bytes.Buffer)
+	WriteSnapshot(encoded, snapshot)
+	replica, err := NewReplica(encoded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer replica.Close()
+
+	// skipping ahead is rejected rather than silently losing a batch
+	if err := replica.Apply(frames[2]); !errors.Is(err, ErrSequenceGap) {
+		t.Fatalf("expected ErrSequenceGap, got %v", err)
+	}
+
+	// resending every frame, twice, only applies the missing ones once
+	for i := 0; i < 2; i++ {
+		for _, frame := range frames {
+			if err := replica.Apply(frame); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		}
+	}
+
+	if _, count := replica.GetMedianAndCount(); count != 30 {
+		t.Fatalf("expected 30 metrics, got %d", count)
+	}
+}
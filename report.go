@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// a Report summarizes a distribution in one go, for printing or shipping
+// somewhere as JSON
+type Report struct {
+	Count     int     `json:"count"`
+	Mean      float64 `json:"mean"`
+	Min       int     `json:"min"`
+	Deciles   [9]int  `json:"deciles"`
+	Quartiles [3]int  `json:"quartiles"`
+	Max       int     `json:"max"`
+}
+
+// Report summarizes the snapshot. Percentiles use the nearest rank, so
+// every value in the report is a value which was actually written.
+func (s Snapshot) Report() Report {
+	report := Report{
+		Count: s.Count(),
+		Min:   s.Min(),
+		Max:   s.Max(),
+	}
+	if report.Count == 0 {
+		return report
+	}
+
+	report.Mean = s.Sum() / float64(report.Count)
+
+	for i := range report.Deciles {
+		report.Deciles[i] = s.GetPercentile(float64(i+1) / 10)
+	}
+	for i := range report.Quartiles {
+		report.Quartiles[i] = s.GetPercentile(float64(i+1) / 4)
+	}
+
+	return report
+}
+
+// Report summarizes the database's current contents, which is cached
+// until the next write with WithQueryCache.
+func (m *MedianDatabase) Report() (Report, error) {
+	result, err := m.cache.get(m.Generation(), "report", func() (interface{}, error) {
+		snapshot, err := m.Snapshot()
+		if err != nil {
+			return nil, err
+		}
+
+		return snapshot.Report(), nil
+	})
+	if err != nil {
+		return Report{}, err
+	}
+
+	return result.(Report), nil
+}
+
+func (r Report) String() string {
+	return r.Format("")
+}
+
+// Format renders the report like String, with every value rendered in the
+// unit, see FormatValue. Without a unit the values are printed as is.
+func (r Report) Format(unit string) string {
+	format := func(value int) string {
+		return FormatValue(float64(value), unit)
+	}
+	mean := FormatValue(r.Mean, unit)
+	if unit == "" {
+		mean = fmt.Sprintf("%.2f", r.Mean)
+	}
+
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "count %d\n", r.Count)
+	fmt.Fprintf(buf, "mean  %s\n", mean)
+	fmt.Fprintf(buf, "min   %s\n", format(r.Min))
+	for i, decile := range r.Deciles {
+		fmt.Fprintf(buf, "d%d    %s\n", i+1, format(decile))
+	}
+	for i, quartile := range r.Quartiles {
+		fmt.Fprintf(buf, "q%d    %s\n", i+1, format(quartile))
+	}
+	fmt.Fprintf(buf, "max   %s\n", format(r.Max))
+
+	return buf.String()
+}
+
+func (r Report) JSON() ([]byte, error) {
+	return json.Marshal(r)
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// 1..100
+	database.BulkWrite(buildBulkMetrics(1, 101))
+	report, err := database.Report()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := Report{
+		Count:     100,
+		Mean:      50.5,
+		Min:       1,
+		Deciles:   [9]int{10, 20, 30, 40, 50, 60, 70, 80, 90},
+		Quartiles: [3]int{25, 50, 75},
+		Max:       100,
+	}
+	if report != expected {
+		t.Fatalf("expected %+v, got %+v", expected, report)
+	}
+
+	if text := report.String(); !strings.Contains(text, "d9    90\n") || !strings.Contains(text, "mean  50.50\n") {
+		t.Fatalf("unexpected text report:\n%s", text)
+	}
+
+	encoded, _ := report.JSON()
+	var decoded Report
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded != expected {
+		t.Fatalf("unexpected JSON report %s", encoded)
+	}
+}
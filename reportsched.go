@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a ReportSink stores rendered reports under their file name, eg: in a
+// directory with DirectorySink. Object stores are supported by
+// implementing it with their client, eg: a PUT to a bucket per name.
+type ReportSink interface {
+	WriteReport(name string, data []byte) error
+}
+
+// a DirectorySink writes each report as a file in the directory, which is
+// created if it doesn't exist. Reports are written to a temporary file
+// and renamed, so a partly written report is never picked up.
+type DirectorySink string
+
+func (d DirectorySink) WriteReport(name string, data []byte) error {
+	if err := os.MkdirAll(string(d), 0755); err != nil {
+		return err
+	}
+
+	path := filepath.Join(string(d), name)
+	if err := os.WriteFile(path+".tmp", data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// a ReportSchedule returns the first time after the given time that
+// reports should be generated
+type ReportSchedule func(after time.Time) time.Time
+
+// Daily schedules reports once a day, at the offset from midnight in the
+// location, eg: Daily(0, time.UTC) for midnight UTC, or
+// Daily(6*time.Hour, local) for six in the morning local time.
+func Daily(at time.Duration, location *time.Location) ReportSchedule {
+	return func(after time.Time) time.Time {
+		after = after.In(location)
+
+		// normalized as a time of day, rather than added to midnight, so
+		// days which are shorter or longer for daylight saving still run
+		// at the same time of day
+		next := time.Time{}
+		for days := 0; !next.After(after); days++ {
+			next = time.Date(after.Year(), after.Month(), after.Day()+days, 0, 0, 0, int(at), location)
+		}
+
+		return next
+	}
+}
+
+var reportFormats = map[string]string{"text": ".txt", "json": ".json", "csv": ".csv"}
+
+type ReportOption func(*ReportScheduler)
+
+// WithReportFormats renders the reports in each of the formats, text,
+// json or csv, rather than only as text.
+func WithReportFormats(formats ...string) ReportOption {
+	return func(r *ReportScheduler) {
+		r.formats = formats
+	}
+}
+
+// WithReportWindow reports on each series over the window before the
+// report is generated, eg: the last 24h for a daily report, rather than
+// in whole. Series which aren't windowed are left out.
+func WithReportWindow(window time.Duration) ReportOption {
+	return func(r *ReportScheduler) {
+		r.window = window
+	}
+}
+
+// WithReportSeries reports on only the series the matcher matches, rather
+// than every registered series.
+func WithReportSeries(matcher SeriesMatcher) ReportOption {
+	return func(r *ReportScheduler) {
+		r.matcher = matcher
+	}
+}
+
+// a ReportScheduler renders the Report of registered series at the times
+// of its schedule, eg: daily at midnight, into files in a sink, for teams
+// which read daily latency summaries rather than live dashboards. Each
+// format is a single file covering every series, named for the time it
+// was scheduled at, eg: report-2024-03-01T0000.csv.
+type ReportScheduler struct {
+	// held while generating, so reports are never generated concurrently
+	sync.Mutex
+
+	registry *Registry
+	sink     ReportSink
+	schedule ReportSchedule
+	formats  []string
+	window   time.Duration
+	matcher  SeriesMatcher
+
+	now     func() time.Time
+	quitCh  chan struct{}
+	doneCh  chan struct{}
+	errCh   chan error
+	started int32
+}
+
+// NewReportScheduler creates a scheduler writing reports to the sink,
+// failing if any of its formats are unknown.
+func NewReportScheduler(registry *Registry, sink ReportSink, schedule ReportSchedule, options ...ReportOption) (*ReportScheduler, error) {
+	r := &ReportScheduler{
+		registry: registry,
+		sink:     sink,
+		schedule: schedule,
+		formats:  []string{"text"},
+		now:      time.Now,
+		quitCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+		errCh:    make(chan error, errorChannelSize),
+	}
+
+	for _, option := range options {
+		option(r)
+	}
+
+	for _, format := range r.formats {
+		if _, ok := reportFormats[format]; !ok {
+			return nil, fmt.Errorf("report format %q: must be text, json or csv", format)
+		}
+	}
+
+	return r, nil
+}
+
+// a ScheduledReport is the report of a single series, as rendered in JSON
+type ScheduledReport struct {
+	Series string `json:"series"`
+	Window string `json:"window,omitempty"`
+	Unit   string `json:"unit,omitempty"`
+	Report Report `json:"report"`
+}
+
+// Generate writes the reports of every matching series now, named for the
+// time they were scheduled at, returning the last error. Series which
+// can't be reported on are left out rather than failing the rest.
+func (r *ReportScheduler) Generate(at time.Time) error {
+	r.Lock()
+	defer r.Unlock()
+
+	names := make([]string, 0)
+	for _, series := range r.registry.ListSeries(r.matcher) {
+		names = append(names, series.Name)
+	}
+
+	reports := make([]*ScheduledReport, len(names))
+	errs := make([]error, len(names))
+	r.registry.each(names, func(i int, name string, database Database) {
+		snapshot, err := querySnapshot(name, database, r.window)
+		if err != nil {
+			errs[i] = err
+			return
+		}
+
+		reports[i] = &ScheduledReport{Series: name, Unit: r.registry.Metadata(name).Unit, Report: snapshot.Report()}
+		if r.window > 0 {
+			reports[i].Window = r.window.String()
+		}
+	})
+
+	var lastErr error
+	generated := make([]ScheduledReport, 0, len(reports))
+	for i, report := range reports {
+		if errs[i] != nil && !errors.Is(errs[i], errUnsupportedQuery) {
+			lastErr = errs[i]
+		}
+		// unregistered since they were listed, or not windowed
+		if report != nil {
+			generated = append(generated, *report)
+		}
+	}
+
+	for _, format := range r.formats {
+		data, err := renderScheduledReports(generated, format)
+		if err == nil {
+			err = r.sink.WriteReport("report-"+at.Format("2006-01-02T1504")+reportFormats[format], data)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s report: %w", format, err)
+		}
+	}
+
+	return lastErr
+}
+
+func renderScheduledReports(reports []ScheduledReport, format string) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(buf)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(reports); err != nil {
+			return nil, err
+		}
+	case "csv":
+		writer := csv.NewWriter(buf)
+		writer.Write([]string{"series", "window", "unit", "count", "mean", "min",
+			"d1", "d2", "d3", "d4", "d5", "d6", "d7", "d8", "d9", "q1", "q2", "q3", "max"})
+		for _, report := range reports {
+			row := []string{report.Series, report.Window, report.Unit, strconv.Itoa(report.Report.Count),
+				strconv.FormatFloat(report.Report.Mean, 'f', 2, 64), strconv.Itoa(report.Report.Min)}
+			for _, decile := range report.Report.Deciles {
+				row = append(row, strconv.Itoa(decile))
+			}
+			for _, quartile := range report.Report.Quartiles {
+				row = append(row, strconv.Itoa(quartile))
+			}
+			writer.Write(append(row, strconv.Itoa(report.Report.Max)))
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return nil, err
+		}
+	default:
+		for i, report := range reports {
+			if i > 0 {
+				buf.WriteString("\n")
+			}
+			if report.Window != "" {
+				fmt.Fprintf(buf, "# %s over %s\n", report.Series, report.Window)
+			} else {
+				fmt.Fprintf(buf, "# %s\n", report.Series)
+			}
+			buf.WriteString(report.Report.Format(report.Unit))
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Start generates reports at every time of the schedule until stopped.
+func (r *ReportScheduler) Start() {
+	atomic.StoreInt32(&r.started, 1)
+	go func() {
+		defer close(r.doneCh)
+
+		// the clock may be a little behind the timer, so a report is
+		// never scheduled before the last one
+		last := time.Time{}
+		for {
+			from := r.now()
+			if from.Before(last) {
+				from = last
+			}
+			next := r.schedule(from)
+			timer := time.NewTimer(next.Sub(r.now()))
+
+			select {
+			case <-timer.C:
+				if err := r.Generate(next); err != nil {
+					reportError(r.errCh, err)
+				}
+				last = next
+			case <-r.quitCh:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops generating reports, waiting for one being generated.
+func (r *ReportScheduler) Stop() {
+	close(r.quitCh)
+	if atomic.LoadInt32(&r.started) == 1 {
+		<-r.doneCh
+	}
+}
+
+// Errors returns a channel of errors from querying series or writing
+// reports. Errors are dropped if the channel isn't drained.
+func (r *ReportScheduler) Errors() <-chan error {
+	return r.errCh
+}
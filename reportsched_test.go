@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type memorySink struct {
+	sync.Mutex
+	reports map[string][]byte
+}
+
+func (m *memorySink) WriteReport(name string, data []byte) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.reports[name] = data
+	return nil
+}
+
+func (m *memorySink) names() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	names := make([]string, 0, len(m.reports))
+	for name := range m.reports {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestDailySchedule(t *testing.T) {
+	utc := Daily(0, time.UTC)
+	at := time.Date(2024, 3, 1, 15, 30, 0, 0, time.UTC)
+	if next := utc(at); !next.Equal(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the next midnight, got %v", next)
+	}
+	if next := utc(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)); !next.Equal(time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected the schedule to move past a report made on time, got %v", next)
+	}
+
+	morning := Daily(6*time.Hour, time.UTC)
+	if next := morning(at.Add(-10 * time.Hour)); !next.Equal(time.Date(2024, 3, 1, 6, 0, 0, 0, time.UTC)) {
+		t.Fatalf("expected six in the morning on the same day, got %v", next)
+	}
+
+	// daylight saving starts on the 31st, which is an hour shorter
+	if london, err := time.LoadLocation("Europe/London"); err == nil {
+		next := Daily(6*time.Hour, london)(time.Date(2024, 3, 30, 12, 0, 0, 0, london))
+		if next.Hour() != 6 || next.Day() != 31 {
+			t.Fatalf("expected six in the morning local time, got %v", next)
+		}
+	}
+}
+
+func TestReportScheduler(t *testing.T) {
+	registry := NewRegistry()
+	api := NewSyncMedianDatabase()
+	api.BulkWrite(buildBulkMetrics(1, 101))
+	registry.Register("api.latency{region=eu}", api)
+	registry.SetMetadata("api.latency{region=eu}", SeriesMetadata{Unit: "ms"})
+	jobs := NewSyncMedianDatabase()
+	jobs.BulkWrite(buildBulkMetrics(1, 11))
+	registry.Register("jobs", jobs)
+	registry.Register("histogram", newTestHistogramDatabase(10))
+
+	if _, err := NewReportScheduler(registry, &memorySink{}, Daily(0, time.UTC), WithReportFormats("xml")); err == nil {
+		t.Fatalf("expected an unknown format to be rejected")
+	}
+
+	dir := filepath.Join(t.TempDir(), "reports")
+	scheduler, err := NewReportScheduler(registry, DirectorySink(dir), Daily(0, time.UTC),
+		WithReportFormats("text", "json", "csv"), WithReportSeries(SeriesMatcher{Prefix: "api."}))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	at := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if err := scheduler.Generate(at); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	text, err := os.ReadFile(filepath.Join(dir, "report-2024-03-01T0000.txt"))
+	if err != nil || !strings.HasPrefix(string(text), "# api.latency{region=eu}\ncount 100\n") || !strings.Contains(string(text), "max   100ms") {
+		t.Fatalf("unexpected text report %q: %v", text, err)
+	}
+
+	var reports []ScheduledReport
+	data, _ := os.ReadFile(filepath.Join(dir, "report-2024-03-01T0000.json"))
+	if err := json.Unmarshal(data, &reports); err != nil || len(reports) != 1 || reports[0].Unit != "ms" || reports[0].Report.Deciles[4] != 50 {
+		t.Fatalf("unexpected json report %+v: %v", reports, err)
+	}
+
+	file, _ := os.Open(filepath.Join(dir, "report-2024-03-01T0000.csv"))
+	rows, err := csv.NewReader(file).ReadAll()
+	file.Close()
+	if err != nil || len(rows) != 2 || rows[0][0] != "series" || rows[1][3] != "100" || rows[1][len(rows[1])-1] != "100" {
+		t.Fatalf("unexpected csv report %v: %v", rows, err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 3 {
+		t.Fatalf("expected only the three reports to be left in the directory, got %d", len(entries))
+	}
+
+	// series which aren't windowed are left out of windowed reports
+	clock := newTestClock()
+	windowed := newTestWindowedDatabase(time.Hour, 24*time.Hour)
+	windowed.now = clock.now
+	windowed.BulkWrite(buildBulkMetrics(1, 5))
+	registry.Register("windowed", windowed)
+
+	sink := &memorySink{reports: make(map[string][]byte)}
+	scheduler, _ = NewReportScheduler(registry, sink, Daily(0, time.UTC), WithReportWindow(24*time.Hour))
+	if err := scheduler.Generate(at); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if report := string(sink.reports["report-2024-03-01T0000.txt"]); !strings.HasPrefix(report, "# windowed over 24h0m0s\ncount 4\n") {
+		t.Fatalf("unexpected windowed report %q", report)
+	}
+}
+
+func TestReportSchedulerStart(t *testing.T) {
+	registry := NewRegistry()
+	database := NewSyncMedianDatabase()
+	database.BulkWrite(buildBulkMetrics(1, 4))
+	registry.Register("api", database)
+
+	sink := &memorySink{reports: make(map[string][]byte)}
+	soon := func(after time.Time) time.Time {
+		return after.Add(20 * time.Millisecond)
+	}
+	scheduler, _ := NewReportScheduler(registry, sink, soon)
+	scheduler.Start()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.names()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	scheduler.Stop()
+
+	if len(sink.names()) == 0 {
+		t.Fatalf("expected a report to be generated on schedule")
+	}
+	select {
+	case err := <-scheduler.Errors():
+		t.Fatalf("unexpected error: %v", err)
+	default:
+	}
+}
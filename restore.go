@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+// a RecoveryReport describes what was restored on startup, so operators
+// can tell whether the restored state can be trusted
+type RecoveryReport struct {
+	SnapshotRestored bool   `json:"snapshot_restored"`
+	SnapshotSequence uint64 `json:"snapshot_sequence"`
+
+	SegmentsReplayed int `json:"segments_replayed"`
+	// segments which were missing their footer, eg: the one being
+	// written when the process died
+	SegmentsIncomplete int `json:"segments_incomplete"`
+	// segments which weren't frame logs at all
+	SegmentsUnreadable int `json:"segments_unreadable"`
+
+	RecordsApplied int `json:"records_applied"`
+	// records which the snapshot, or an earlier segment, already included
+	RecordsDuplicate int `json:"records_duplicate"`
+	// records which were lost to corruption, going by the gaps in the
+	// sequence numbers of the records which survived
+	RecordsSkipped int   `json:"records_skipped"`
+	CorruptBytes   int64 `json:"corrupt_bytes"`
+
+	Sequence uint64        `json:"sequence"`
+	Count    int64         `json:"count"`
+	Median   int64         `json:"median"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Clean reports whether everything was restored without any loss.
+func (r RecoveryReport) Clean() bool {
+	return r.SegmentsIncomplete == 0 && r.SegmentsUnreadable == 0 && r.RecordsSkipped == 0 && r.CorruptBytes == 0
+}
+
+func (r RecoveryReport) String() string {
+	return fmt.Sprintf("restored %d metrics with median %d at sequence %d in %v: snapshot=%v (sequence %d), "+
+		"%d segments replayed (%d incomplete, %d unreadable), %d records applied, %d duplicate, "+
+		"%d skipped as corrupt (%d corrupt bytes)",
+		r.Count, r.Median, r.Sequence, r.Duration, r.SnapshotRestored, r.SnapshotSequence,
+		r.SegmentsReplayed, r.SegmentsIncomplete, r.SegmentsUnreadable, r.RecordsApplied, r.RecordsDuplicate,
+		r.RecordsSkipped, r.CorruptBytes)
+}
+
+// Restore seeds an open, empty database from a snapshot written with
+// WriteSnapshot, which may be nil, and then replays the frame log segments
+// in order. Corrupt regions of a segment are skipped rather than failing
+// the restore, and the records lost to them are skipped over too, so that
+// a single bad frame doesn't hold back everything written after it. The
+// report is logged, and kept for RecoveryReport.
+func (m *MedianDatabase) Restore(snapshot io.Reader, segments ...io.Reader) (RecoveryReport, error) {
+	started := time.Now()
+	report := RecoveryReport{}
+
+	if snapshot != nil {
+		restored, err := ReadSnapshot(snapshot)
+		if err != nil {
+			return report, m.named(fmt.Errorf("restoring snapshot: %w", err))
+		}
+		if err := m.seed(restored); err != nil {
+			return report, err
+		}
+
+		report.SnapshotRestored = true
+		report.SnapshotSequence = restored.Sequence
+	}
+
+	for i, segment := range segments {
+		recovery, err := RecoverFrameLog(segment)
+		if errors.Is(err, ErrSnapshotCorrupt) {
+			report.SegmentsUnreadable++
+			continue
+		} else if err != nil {
+			return report, m.named(fmt.Errorf("reading segment %d: %w", i, err))
+		}
+
+		report.SegmentsReplayed++
+		report.CorruptBytes += recovery.Skipped()
+		if !recovery.Complete {
+			report.SegmentsIncomplete++
+		}
+
+		for _, frame := range recovery.Frames {
+			if err := m.replay(frame, &report); err != nil {
+				return report, err
+			}
+		}
+	}
+
+	report.Sequence = m.Sequence()
+	report.Median, report.Count = m.GetMedianAndCount()
+	report.Duration = time.Since(started)
+
+	m.recovery.Store(report)
+	if m.name != "" {
+		log.Printf("database %s: %s", m.name, report)
+	} else {
+		log.Printf("database: %s", report)
+	}
+
+	return report, nil
+}
+
+// applies a recovered frame, jumping over any records which were lost
+func (m *MedianDatabase) replay(frame Frame, report *RecoveryReport) error {
+	current := m.Sequence()
+
+	switch {
+	case frame.Sequence == 0:
+		// unsequenced frames can't be deduplicated, so are always
+		// applied
+	case frame.Sequence <= current:
+		report.RecordsDuplicate++
+		return nil
+	case frame.Sequence > current+1:
+		report.RecordsSkipped += int(frame.Sequence - current - 1)
+		report.RecordsApplied++
+		return m.applyAndWait(writeRequest{metrics: frame.Metrics, sequence: frame.Sequence, seed: true})
+	}
+
+	report.RecordsApplied++
+	return m.ApplyFrame(frame)
+}
+
+// RecoveryReport returns the report of the last Restore, and false if the
+// database was never restored.
+func (m *MedianDatabase) RecoveryReport() (RecoveryReport, bool) {
+	report, ok := m.recovery.Load().(RecoveryReport)
+	return report, ok
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestRestore(t *testing.T) {
+	snapshot := new(bytes.Buffer)
+	WriteSnapshot(snapshot, Snapshot{FrozenDatabase: newFrozenDatabase(buildBulkMetrics(0, 10), nil), Sequence: 2})
+
+	// frames 1 and 2 are already in the snapshot, and frame 4 is corrupt
+	segment := new(bytes.Buffer)
+	log, _ := NewFrameLogWriter(segment)
+	for sequence := 1; sequence <= 5; sequence++ {
+		log.Append(Frame{Sequence: uint64(sequence), Metrics: buildBulkMetrics(sequence*100, sequence*100+10)})
+	}
+	log.Close()
+	data := segment.Bytes()
+	frameSize := len(EncodeFrame(Frame{Sequence: 1, Metrics: buildBulkMetrics(100, 110)}))
+	data[len(frameLogMagic)+3*frameSize+frameSize/2] ^= 0x01
+
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	if _, ok := database.RecoveryReport(); ok {
+		t.Fatalf("expected no report before restoring")
+	}
+
+	report, err := database.Restore(snapshot, bytes.NewReader(data), bytes.NewReader([]byte("garbage")))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := RecoveryReport{
+		SnapshotRestored:   true,
+		SnapshotSequence:   2,
+		SegmentsReplayed:   1,
+		SegmentsIncomplete: 1,
+		SegmentsUnreadable: 1,
+		RecordsApplied:     2,
+		RecordsDuplicate:   2,
+		RecordsSkipped:     1,
+		CorruptBytes:       int64(frameSize),
+		Sequence:           5,
+		Count:              30,
+		Median:             304,
+		Duration:           report.Duration,
+	}
+	if report != expected {
+		t.Fatalf("expected %+v, got %+v", expected, report)
+	}
+	if report.Clean() {
+		t.Fatalf("expected the report to record the corruption")
+	}
+	if stored, ok := database.RecoveryReport(); !ok || stored != report {
+		t.Fatalf("expected the report to be kept, got %+v", stored)
+	}
+
+	// a corrupt snapshot is never loaded
+	empty := NewMedianDatabase()
+	empty.Open()
+	defer empty.Close()
+	if _, err := empty.Restore(bytes.NewReader(data[:10])); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// an EvictionPolicy decides what a RollingDatabase does with new metrics
+// once it is holding as many metrics as it can
+type EvictionPolicy int
+
+const (
+	// evict the oldest metrics to make room, preferring recency
+	DropOldest EvictionPolicy = iota
+	// reject new metrics with ErrBufferFull, preferring completeness
+	RejectNew
+)
+
+type EvictionStats struct {
+	Evicted  uint64
+	Rejected uint64
+}
+
+// a RollingDatabase holds the most recent capacity metrics, in the order
+// they were written. Writes are applied synchronously, so Open and Close
+// don't start or stop anything.
+type RollingDatabase struct {
+	sync.Mutex
+
+	capacity int
+	policy   EvictionPolicy
+
+	// every write in arrival order, along with the totals per value
+	queue  []BulkMetric
+	counts map[int]int
+	count  int
+	closed bool
+
+	stats EvictionStats
+}
+
+func NewRollingDatabase(capacity int, policy EvictionPolicy) *RollingDatabase {
+	return &RollingDatabase{
+		capacity: capacity,
+		policy:   policy,
+		queue:    make([]BulkMetric, 0),
+		counts:   make(map[int]int),
+	}
+}
+
+func (r *RollingDatabase) Open() {}
+
+func (r *RollingDatabase) Close() {
+	r.Lock()
+	defer r.Unlock()
+	r.closed = true
+}
+
+// BulkWrite adds the metrics in order. Under RejectNew, metrics which don't
+// fit are dropped and ErrBufferFull is returned once the rest are stored.
+func (r *RollingDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	for _, metric := range bulkMetrics {
+		if metric == nil || metric.Count() < 1 {
+			return fmt.Errorf("bulk metric %v: %w", metric, ErrInvalidMetric)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return ErrClosed
+	}
+
+	rejected := 0
+	for _, metric := range bulkMetrics {
+		count := metric.Count()
+
+		if r.policy == RejectNew {
+			if room := r.capacity - r.count; count > room {
+				rejected += count - room
+				count = room
+			}
+		} else {
+			// a single metric can be larger than the whole window
+			if count > r.capacity {
+				r.stats.Evicted += uint64(count - r.capacity)
+				count = r.capacity
+			}
+			r.evict(r.count + count - r.capacity)
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		r.queue = append(r.queue, BulkMetric{value: metric.Value(), count: count})
+		r.counts[metric.Value()] += count
+		r.count += count
+	}
+
+	if rejected > 0 {
+		r.stats.Rejected += uint64(rejected)
+		return fmt.Errorf("rolling database rejected %d metrics: %w", rejected, ErrBufferFull)
+	}
+
+	return nil
+}
+
+// removes the n oldest metrics
+func (r *RollingDatabase) evict(n int) {
+	if n <= 0 {
+		return
+	}
+	r.stats.Evicted += uint64(n)
+
+	for n > 0 {
+		oldest := &r.queue[0]
+		evicted := oldest.count
+		if evicted > n {
+			evicted = n
+		}
+
+		oldest.count -= evicted
+		r.counts[oldest.value] -= evicted
+		if r.counts[oldest.value] == 0 {
+			delete(r.counts, oldest.value)
+		}
+		r.count -= evicted
+		n -= evicted
+
+		if oldest.count == 0 {
+			r.queue = r.queue[1:]
+		}
+	}
+}
+
+func (r *RollingDatabase) EvictionStats() EvictionStats {
+	r.Lock()
+	defer r.Unlock()
+	return r.stats
+}
+
+func (r *RollingDatabase) Snapshot() (Snapshot, error) {
+	r.Lock()
+	defer r.Unlock()
+	return newSnapshotFromCounts(r.counts, time.Now()), nil
+}
+
+func (r *RollingDatabase) GetMedian() int {
+	snapshot, _ := r.Snapshot()
+	return snapshot.GetMedian()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRollingDatabaseDropOldest(t *testing.T) {
+	database := NewRollingDatabase(10, DropOldest)
+
+	database.BulkWrite(buildBulkMetrics(0, 10))
+	// evicts [0, 5) to make room
+	database.BulkWrite(buildBulkMetrics(100, 105))
+
+	snapshot, _ := database.Snapshot()
+	if snapshot.Count() != 10 || snapshot.Min() != 5 || snapshot.Max() != 104 {
+		t.Fatalf("unexpected contents, count %d, min %d, max %d", snapshot.Count(), snapshot.Min(), snapshot.Max())
+	}
+
+	// a metric larger than the whole window only keeps what fits
+	big := NewBulkMetric(7)
+	big.IncrBy(14)
+	database.BulkWrite([]*BulkMetric{big})
+	if snapshot, _ = database.Snapshot(); snapshot.Count() != 10 || snapshot.GetMedian() != 7 {
+		t.Fatalf("expected the window to only hold 7s, got median %d", snapshot.GetMedian())
+	}
+
+	if stats := database.EvictionStats(); stats.Evicted != 20 || stats.Rejected != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestRollingDatabaseRejectNew(t *testing.T) {
+	database := NewRollingDatabase(10, RejectNew)
+
+	if err := database.BulkWrite(buildBulkMetrics(0, 8)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := database.BulkWrite(buildBulkMetrics(100, 105)); !errors.Is(err, ErrBufferFull) {
+		t.Fatalf("expected ErrBufferFull, got %v", err)
+	}
+
+	snapshot, err := database.Snapshot()
+	if err != nil || snapshot.Count() != 10 || snapshot.Max() != 101 {
+		t.Fatalf("expected the oldest metrics to be kept, got max %d", snapshot.Max())
+	}
+	if stats := database.EvictionStats(); stats.Evicted != 0 || stats.Rejected != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// served like any other snapshotter
+	if _, ok := interface{}(database).(Snapshotter); !ok {
+		t.Fatalf("expected the rolling database to be a Snapshotter")
+	}
+}
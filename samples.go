@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+)
+
+// a RawSample is a single write to the current window, kept as written so
+// a suspicious percentile can be inspected sample by sample. Metrics
+// written through a BufferedWorker reach the database aggregated by value
+// for each flush, so their samples are a value and its count in a batch,
+// timed when the batch was applied.
+type RawSample struct {
+	Value          int       `json:"value"`
+	Count          int       `json:"count"`
+	Time           time.Time `json:"time"`
+	CorrelationIDs []string  `json:"correlation_ids,omitempty"`
+}
+
+// the RawSamples of the most recent window
+type RawSampleWindow struct {
+	Start   time.Time   `json:"start"`
+	End     time.Time   `json:"end"`
+	Samples []RawSample `json:"samples"`
+
+	// samples written once the window already held the limit
+	Dropped int `json:"dropped"`
+}
+
+// WithRawSamples keeps up to limit samples written to the most recent
+// window as written, along with the correlation IDs of their batch, see
+// RawSamples. They are released as soon as a later window is written to,
+// so only ever one window's worth is held, and late writes to earlier
+// windows aren't kept.
+func WithRawSamples(limit int) WindowOption {
+	return func(w *WindowedDatabase) {
+		w.rawSamples = limit
+	}
+}
+
+// BulkWriteCorrelated writes the metrics into the current window, keeping
+// the correlation IDs with their raw samples if the database was created
+// WithRawSamples. Writes are applied before it returns.
+func (w *WindowedDatabase) BulkWriteCorrelated(bulkMetrics []*BulkMetric, correlationIDs []string) <-chan error {
+	errCh := make(chan error, 1)
+	errCh <- correlated(w.writeCorrelated(time.Time{}, bulkMetrics, correlationIDs), correlationIDs)
+	return errCh
+}
+
+// keeps the samples of a write to the bucket, if it is the latest, and
+// releases those of the bucket before it, must be called with the lock
+// held
+func (w *WindowedDatabase) keepSamples(bucket *windowBucket, observed time.Time, bulkMetrics []*BulkMetric, correlationIDs []string) {
+	if w.rawSamples <= 0 || bucket != w.buckets[len(w.buckets)-1] {
+		return
+	}
+	if previous := len(w.buckets) - 2; previous >= 0 {
+		w.buckets[previous].samples, w.buckets[previous].samplesDropped = nil, 0
+	}
+
+	for _, metric := range bulkMetrics {
+		if len(bucket.samples) >= w.rawSamples {
+			bucket.samplesDropped++
+			continue
+		}
+
+		bucket.samples = append(bucket.samples, RawSample{
+			Value:          metric.Value(),
+			Count:          metric.Count(),
+			Time:           observed,
+			CorrelationIDs: correlationIDs,
+		})
+	}
+}
+
+// RawSamples returns the samples kept for the most recent window written
+// to, oldest first, and false unless the database was created
+// WithRawSamples.
+func (w *WindowedDatabase) RawSamples() (RawSampleWindow, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.rawSamples <= 0 {
+		return RawSampleWindow{}, false
+	}
+
+	window := RawSampleWindow{Samples: []RawSample{}}
+	if len(w.buckets) == 0 {
+		return window, true
+	}
+
+	latest := w.buckets[len(w.buckets)-1]
+	window.Start, window.End = latest.start, latest.start.Add(w.resolution)
+	window.Samples = append(window.Samples, latest.samples...)
+	window.Dropped = latest.samplesDropped
+
+	return window, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRawSamplesKeepTheLatestWindow(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute, WithRawSamples(3))
+	database.now = clock.now
+
+	database.BulkWrite(buildBulkMetrics(1, 3))
+	clock.advance(time.Minute)
+	if err := <-database.BulkWriteCorrelated(buildBulkMetrics(10, 14), []string{"req-1"}); err != nil {
+		t.Fatalf("expected correlated write, got %v", err)
+	}
+
+	window, ok := database.RawSamples()
+	if !ok {
+		t.Fatalf("expected raw samples to be kept")
+	}
+	if !window.Start.Equal(clock.now()) || !window.End.Equal(clock.now().Add(time.Minute)) {
+		t.Fatalf("expected the latest window, got %v to %v", window.Start, window.End)
+	}
+
+	// the earlier window's samples were released, and the limit drops the
+	// last of the latest window's
+	expected := []RawSample{
+		{Value: 10, Count: 1, Time: clock.now(), CorrelationIDs: []string{"req-1"}},
+		{Value: 11, Count: 1, Time: clock.now(), CorrelationIDs: []string{"req-1"}},
+		{Value: 12, Count: 1, Time: clock.now(), CorrelationIDs: []string{"req-1"}},
+	}
+	if !reflect.DeepEqual(window.Samples, expected) || window.Dropped != 1 {
+		t.Fatalf("expected %+v with 1 dropped, got %+v", expected, window)
+	}
+	if samples := database.buckets[0].samples; samples != nil {
+		t.Fatalf("expected the earlier window's samples released, got %+v", samples)
+	}
+
+	// late writes to an earlier window aren't kept
+	database.WriteAt(clock.now().Add(-time.Minute), buildBulkMetrics(100, 101))
+	if window, _ := database.RawSamples(); len(window.Samples) != 3 {
+		t.Fatalf("expected the latest window unchanged, got %+v", window)
+	}
+
+	if _, ok := newTestWindowedDatabase(time.Minute, time.Hour).RawSamples(); ok {
+		t.Fatalf("expected no raw samples without WithRawSamples")
+	}
+}
+
+func TestRawSamplesHandler(t *testing.T) {
+	database, err := NewBackend("windowed", BackendConfig{"raw_samples": "10"})
+	if err != nil {
+		t.Fatalf("expected backend, got %v", err)
+	}
+	database.BulkWrite(buildBulkMetrics(5, 7))
+
+	recorder := httptest.NewRecorder()
+	NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/samples", nil))
+	window := RawSampleWindow{}
+	if err := json.NewDecoder(recorder.Body).Decode(&window); err != nil || len(window.Samples) != 2 || window.Samples[1].Value != 6 {
+		t.Fatalf("expected both samples, got %+v, %v", window, err)
+	}
+
+	recorder = httptest.NewRecorder()
+	NewHandler(newTestWindowedDatabase(time.Minute, time.Hour)).ServeHTTP(recorder, httptest.NewRequest("GET", "/samples", nil))
+	if recorder.Code != 501 {
+		t.Fatalf("expected 501 without raw samples, got %d", recorder.Code)
+	}
+
+	if _, err := NewBackend("windowed", BackendConfig{"raw_samples": "0"}); err == nil {
+		t.Fatalf("expected a non-positive limit to fail")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math"
+)
+
+// a Scale is the number of decimal places decimal observations are kept
+// to, by storing them as fixed point ints, eg: with a Scale of 3 the
+// observation 1.234 is stored as 1234. Medians of observations with a few
+// decimal places are then exact, without a float backend.
+type Scale int
+
+func (s Scale) factor() float64 {
+	return math.Pow10(int(s))
+}
+
+// ToInt returns the observation as a fixed point int, rounded to the
+// scale's number of decimal places.
+func (s Scale) ToInt(observation float64) int {
+	return int(math.Round(observation * s.factor()))
+}
+
+// FromInt returns the decimal value of a fixed point int, eg: a percentile
+// of the stored values.
+func (s Scale) FromInt(value int) float64 {
+	return float64(value) / s.factor()
+}
+
+// FromFloat returns the decimal value of a fixed point float, eg: a median
+// interpolated between two stored values.
+func (s Scale) FromFloat(value float64) float64 {
+	return value / s.factor()
+}
+
+// Metric returns a metric for the observation, to write to a worker. The
+// scaled observation is kept as the metric's raw value, so aggregates are
+// in the same fixed point units as the stored values.
+func (s Scale) Metric(observation float64) Metric {
+	return NewFloatMetric(observation * s.factor())
+}
+
+// BulkMetric returns a metric for the observation, to write directly to a
+// database.
+func (s Scale) BulkMetric(observation float64) *BulkMetric {
+	return NewAggregateMetric(s.ToInt(observation), observation*s.factor())
+}
+
+// WithScale records the scale the database's values were written with, so
+// that GetMedianScaled can scale the median back.
+func WithScale(scale Scale) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.scale = scale
+	}
+}
+
+// Scale returns the scale the database was created with, for scaling
+// other query results back, eg: snapshot percentiles.
+func (m *MedianDatabase) Scale() Scale {
+	return m.scale
+}
+
+// GetMedianScaled returns the median scaled back to a decimal.
+func (m *MedianDatabase) GetMedianScaled() float64 {
+	return m.scale.FromFloat(m.GetMedianFloat())
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScale(t *testing.T) {
+	scale := Scale(2)
+	database := NewMedianDatabase(WithScale(scale))
+	database.Open()
+	defer database.Close()
+
+	// 0.1 + 0.2 isn't 0.3 as a float, but is as a fixed point int
+	if value := scale.ToInt(0.1 + 0.2); value != 30 {
+		t.Fatalf("expected 30, got %d", value)
+	}
+
+	<-database.BulkWriteAcked([]*BulkMetric{scale.BulkMetric(19.99), scale.BulkMetric(0.01), scale.BulkMetric(5.25), scale.BulkMetric(5.24)})
+	if median := database.GetMedianScaled(); median != 5.245 {
+		t.Fatalf("expected a median of 5.245, got %v", median)
+	}
+
+	snapshot, _ := database.Snapshot()
+	if max := database.Scale().FromInt(snapshot.Max()); max != 19.99 {
+		t.Fatalf("expected a max of 19.99, got %v", max)
+	}
+}
+
+func TestScaleWorker(t *testing.T) {
+	scale := Scale(3)
+	database := NewMedianDatabase(WithScale(scale))
+	database.Open()
+	defer database.Close()
+
+	worker := NewBufferedWorker(3, time.Minute, database)
+	worker.Start()
+	defer worker.Stop()
+
+	var acks []<-chan error
+	for _, observation := range []float64{1.001, 1.002, 1.0034} {
+		acks = append(acks, worker.WriteAcked(scale.Metric(observation)))
+	}
+	for _, ack := range acks {
+		<-ack
+	}
+
+	if median := database.GetMedianScaled(); median != 1.002 {
+		t.Fatalf("expected a median of 1.002, got %v", median)
+	}
+}
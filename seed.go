@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Decay returns a copy of the snapshot with every count scaled by factor,
+// rounded to the nearest whole count. Values whose count rounds down to
+// nothing are dropped, so a heavily decayed snapshot keeps the bulk of the
+// distribution rather than its rarest values.
+func (s Snapshot) Decay(factor float64) Snapshot {
+	counts := make(map[int]int, len(s.values))
+	for i, value := range s.values {
+		if count := int(math.Round(float64(s.countAt(i)) * factor)); count > 0 {
+			counts[value] = count
+		}
+	}
+
+	decayed := newSnapshotFromCounts(counts, s.Time)
+	decayed.Sequence = s.Sequence
+	return decayed
+}
+
+// WithSeed seeds the database from a prior snapshot, eg: one persisted
+// with WriteSnapshot before a restart, when it is opened, with every
+// inherited count scaled by decay. Queries are sensible as soon as the
+// database is open, and a decay below 1, eg: 0.1, lets new observations
+// outweigh the inherited ones quickly. The seed is applied before any
+// write made after Open returns, and a decay of 0 or less seeds nothing.
+func WithSeed(snapshot Snapshot, decay float64) DatabaseOption {
+	return func(m *MedianDatabase) {
+		if decay > 0 && snapshot.FrozenDatabase != nil {
+			seed := snapshot.Decay(min(decay, 1))
+			m.coldStart = &seed
+		}
+	}
+}
+
+// queues the seed, if any, ahead of every other write
+func (m *MedianDatabase) seedColdStart() {
+	if m.coldStart == nil || m.coldStart.Count() == 0 {
+		return
+	}
+
+	seed := writeRequest{metrics: m.coldStart.metrics(), sequence: m.coldStart.Sequence, seed: true}
+	if err := m.enqueue(seed); err != nil {
+		reportError(m.errCh, m.named(fmt.Errorf("seeding from snapshot: %w", err)))
+	}
+	m.coldStart = nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSnapshotDecay(t *testing.T) {
+	snapshot := Snapshot{FrozenDatabase: newFrozenDatabase([]*BulkMetric{{value: 1, count: 20}, {value: 2, count: 4}, {value: 3, count: 1}}, nil), Sequence: 7}
+
+	// the single 3 rounds down to nothing
+	decayed := snapshot.Decay(0.25)
+	if decayed.Count() != 6 || decayed.GetPercentile(1) != 2 || decayed.Sequence != 7 {
+		t.Fatalf("expected 5 ones and a two at sequence 7, got %v at %d", decayed.metrics(), decayed.Sequence)
+	}
+	if snapshot.Count() != 25 {
+		t.Fatalf("expected the snapshot untouched, got %d", snapshot.Count())
+	}
+}
+
+func TestMedianDatabaseSeed(t *testing.T) {
+	persisted := new(bytes.Buffer)
+	metrics := make([]*BulkMetric, 0, 100)
+	for value := 0; value < 100; value++ {
+		metrics = append(metrics, &BulkMetric{value: value, count: 10})
+	}
+	WriteSnapshot(persisted, Snapshot{FrozenDatabase: newFrozenDatabase(metrics, nil)})
+	snapshot, err := ReadSnapshot(persisted)
+	if err != nil {
+		t.Fatalf("expected snapshot, got %v", err)
+	}
+
+	database := NewMedianDatabase(WithSeed(snapshot, 0.1))
+	database.Open()
+	defer database.Close()
+
+	// the seed is applied before any later write
+	if err := <-database.BulkWriteAcked([]*BulkMetric{{value: 1000, count: 150}}); err != nil {
+		t.Fatalf("expected write, got %v", err)
+	}
+	if median, count := database.GetMedianAndCount(); count != 250 || median != 1000 {
+		t.Fatalf("expected new metrics to outweigh the decayed seed, got median %d of %d", median, count)
+	}
+
+	database = NewMedianDatabase(WithSeed(snapshot, 0))
+	database.Open()
+	defer database.Close()
+	if _, count := database.GetMedianAndCount(); count != 0 {
+		t.Fatalf("expected nothing seeded without a decay, got %d", count)
+	}
+}
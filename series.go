@@ -0,0 +1,379 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics for new series are written to this series once a tenant has
+// reached its series limit
+const OverflowSeries = "__overflow__"
+
+type SeriesKey struct {
+	Tenant string
+	Name   string
+}
+
+type CardinalityStats struct {
+	Series int
+	// the number of metrics routed to the overflow series
+	Overflowed uint64
+}
+
+type tenantSeries struct {
+	series     map[string]*seriesEntry
+	overflowed uint64
+}
+
+type seriesEntry struct {
+	// writes hold the read lock, and expiry takes the write lock before
+	// closing the series, so a write is never caught half way
+	sync.RWMutex
+
+	database Database
+
+	// when the series was last written to, in unix nanoseconds
+	lastWrite int64
+
+	// set once the series is expired or closed, so handles holding the
+	// entry look the series up again
+	removed int32
+}
+
+// a SeriesDatabase holds a separate Database per series, created on first
+// write. Each tenant is limited to a maximum number of series; once a
+// tenant reaches it, metrics for any new series are routed into a shared
+// overflow series so that a label explosion can't exhaust memory.
+type SeriesDatabase struct {
+	sync.RWMutex
+
+	factory   func() Database
+	maxSeries int
+	tenants   map[string]*tenantSeries
+
+	// the first matching override configures a new series
+	overrides []SeriesOverride
+
+	// warns as tenants near maxSeries
+	softLimit *softLimiter
+
+	idle     time.Duration
+	onExpire func(SeriesKey, Database)
+	// called before any expired series is closed, eg: so a SeriesWorker
+	// can flush and stop the series' worker
+	expiryHooks []func(SeriesKey, Database)
+	stopExpiry  chan struct{}
+
+	// overridden in tests to control the passing of time
+	now func() time.Time
+}
+
+type SeriesOption func(*SeriesDatabase)
+
+// WithIdleExpiry closes and frees series which haven't been written to for
+// the idle period, so that label churn doesn't leak memory over weeks of
+// uptime. Series are checked every half of the idle period, and onExpire,
+// if set, is passed each expired series before it is closed, eg: to
+// snapshot it. A series written to again after expiring starts empty.
+func WithIdleExpiry(idle time.Duration, onExpire func(SeriesKey, Database)) SeriesOption {
+	return func(s *SeriesDatabase) {
+		s.idle = idle
+		s.onExpire = onExpire
+	}
+}
+
+// NewSeriesDatabase creates a database where each series is created by
+// factory, and each tenant holds at most maxSeries series not counting the
+// overflow series. A maxSeries of zero is unlimited.
+func NewSeriesDatabase(maxSeries int, factory func() Database, options ...SeriesOption) *SeriesDatabase {
+	s := &SeriesDatabase{
+		factory:   factory,
+		maxSeries: maxSeries,
+		tenants:   make(map[string]*tenantSeries),
+		now:       time.Now,
+	}
+
+	for _, option := range options {
+		option(s)
+	}
+
+	if s.idle > 0 {
+		s.stopExpiry = make(chan struct{})
+		go s.expire(s.stopExpiry)
+	}
+
+	return s
+}
+
+func (s *SeriesDatabase) expire(stop chan struct{}) {
+	ticker := time.NewTicker(s.idle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.ExpireIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// ExpireIdle closes every series which has been idle for longer than the
+// idle expiry, returning their keys. It does nothing unless the database
+// was created WithIdleExpiry.
+func (s *SeriesDatabase) ExpireIdle() []SeriesKey {
+	if s.idle <= 0 {
+		return nil
+	}
+
+	type expiredSeries struct {
+		key   SeriesKey
+		entry *seriesEntry
+	}
+	expired := make([]expiredSeries, 0)
+	cutoff := s.now().Add(-s.idle).UnixNano()
+
+	s.Lock()
+	for tenantName, tenant := range s.tenants {
+		for name, entry := range tenant.series {
+			if atomic.LoadInt64(&entry.lastWrite) > cutoff {
+				continue
+			}
+
+			expired = append(expired, expiredSeries{SeriesKey{tenantName, name}, entry})
+			atomic.StoreInt32(&entry.removed, 1)
+			delete(tenant.series, name)
+		}
+		// a tenant which overflowed is kept, so its overflow count
+		// outlives its series
+		if len(tenant.series) == 0 && tenant.overflowed == 0 {
+			delete(s.tenants, tenantName)
+		}
+	}
+	hooks := s.expiryHooks
+	s.Unlock()
+
+	// in a stable order, so consecutive expiries can be compared
+	sort.Slice(expired, func(i, j int) bool {
+		if expired[i].key.Tenant != expired[j].key.Tenant {
+			return expired[i].key.Tenant < expired[j].key.Tenant
+		}
+		return expired[i].key.Name < expired[j].key.Name
+	})
+
+	// the series are closed outside of the lock, so that slow callbacks
+	// don't hold up writes to the rest
+	keys := make([]SeriesKey, 0, len(expired))
+	for _, series := range expired {
+		// writes which got the series before it was removed finish
+		// first, and later ones write to the series afresh
+		series.entry.Lock()
+		series.entry.Unlock()
+
+		database := series.entry.database
+		for _, hook := range hooks {
+			hook(series.key, database)
+		}
+		if s.onExpire != nil {
+			s.onExpire(series.key, database)
+		}
+		database.Close()
+
+		keys = append(keys, series.key)
+	}
+
+	return keys
+}
+
+func (s *SeriesDatabase) addExpiryHook(hook func(SeriesKey, Database)) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.expiryHooks = append(s.expiryHooks, hook)
+}
+
+func (s *SeriesDatabase) tenant(name string) *tenantSeries {
+	tenant, ok := s.tenants[name]
+	if !ok {
+		tenant = &tenantSeries{
+			series: make(map[string]*seriesEntry),
+		}
+		s.tenants[name] = tenant
+	}
+
+	return tenant
+}
+
+// returns the entry of the series to write the key's metrics into,
+// creating the series or routing to the overflow series as needed, and
+// whether it is the overflow series. It fails with ErrSeriesQuota rather
+// than create the series if the tenant already holds quota series, and
+// reports whether the series was created. A quota of 0 is unlimited.
+func (s *SeriesDatabase) entryWithin(key SeriesKey, count, quota int) (*seriesEntry, bool, bool, error) {
+	s.RLock()
+	if tenant, ok := s.tenants[key.Tenant]; ok {
+		if entry, ok := tenant.series[key.Name]; ok {
+			s.touch(entry)
+			s.RUnlock()
+			return entry, key.Name == OverflowSeries, false, nil
+		}
+	}
+	s.RUnlock()
+
+	s.Lock()
+	defer s.Unlock()
+
+	tenant := s.tenant(key.Tenant)
+	name := key.Name
+	if _, ok := tenant.series[name]; !ok {
+		// checked under the same lock the series is created with, so
+		// concurrent writes can't both take the tenant's last series
+		if quota > 0 && s.seriesCount(tenant) >= quota {
+			return nil, false, false, fmt.Errorf("tenant %s is at its quota of %d series: %w", key.Tenant, quota, ErrSeriesQuota)
+		}
+		if s.maxSeries > 0 && s.seriesCount(tenant) >= s.maxSeries {
+			name = OverflowSeries
+			tenant.overflowed += uint64(count)
+		}
+	}
+
+	entry, ok := tenant.series[name]
+	if !ok {
+		entry = &seriesEntry{database: s.create(name)}
+		entry.database.Open()
+		tenant.series[name] = entry
+		if name != OverflowSeries {
+			s.softLimit.check("series", key.Tenant, s.seriesCount(tenant), s.maxSeries)
+		}
+	}
+	s.touch(entry)
+
+	return entry, name == OverflowSeries, !ok, nil
+}
+
+// records a write to the series, if idle series expire
+func (s *SeriesDatabase) touch(entry *seriesEntry) {
+	if s.idle > 0 {
+		atomic.StoreInt64(&entry.lastWrite, s.now().UnixNano())
+	}
+}
+
+// the number of series held by the tenant, not counting the overflow series
+func (s *SeriesDatabase) seriesCount(tenant *tenantSeries) int {
+	if _, ok := tenant.series[OverflowSeries]; ok {
+		return len(tenant.series) - 1
+	}
+
+	return len(tenant.series)
+}
+
+// calls write with the entry of the series to write the key's metrics
+// into, holding the entry's read lock so it can't expire part way through.
+// If the entry expires before write is called, the series is looked up
+// again, and created afresh. It reports whether the series was created, see
+// entryWithin.
+func (s *SeriesDatabase) writeEntry(key SeriesKey, count, quota int, write func(entry *seriesEntry, overflowed bool) error) (bool, error) {
+	for {
+		entry, overflowed, created, err := s.entryWithin(key, count, quota)
+		if err != nil {
+			return false, err
+		}
+
+		entry.RLock()
+		if atomic.LoadInt32(&entry.removed) == 0 {
+			defer entry.RUnlock()
+			return created, write(entry, overflowed)
+		}
+		entry.RUnlock()
+
+		// the overflow was already counted
+		if overflowed {
+			count = 0
+		}
+	}
+}
+
+// the total count of the metrics
+func bulkCount(bulkMetrics []*BulkMetric) int {
+	count := 0
+	for _, metric := range bulkMetrics {
+		if metric != nil {
+			count += metric.Count()
+		}
+	}
+
+	return count
+}
+
+func (s *SeriesDatabase) Write(key SeriesKey, bulkMetrics []*BulkMetric) error {
+	_, err := s.writeEntry(key, bulkCount(bulkMetrics), 0, func(entry *seriesEntry, _ bool) error {
+		return entry.database.BulkWrite(bulkMetrics)
+	})
+	return err
+}
+
+// WriteWithin writes the metrics to the series like Write, but fails with
+// ErrSeriesQuota rather than create the series if its tenant already holds
+// quota series, not counting the overflow series. It reports whether the
+// write created the series.
+func (s *SeriesDatabase) WriteWithin(key SeriesKey, bulkMetrics []*BulkMetric, quota int) (bool, error) {
+	return s.writeEntry(key, bulkCount(bulkMetrics), quota, func(entry *seriesEntry, _ bool) error {
+		return entry.database.BulkWrite(bulkMetrics)
+	})
+}
+
+// Get returns the database holding the series, if it exists.
+func (s *SeriesDatabase) Get(key SeriesKey) (Database, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	tenant, ok := s.tenants[key.Tenant]
+	if !ok {
+		return nil, false
+	}
+
+	entry, ok := tenant.series[key.Name]
+	if !ok {
+		return nil, false
+	}
+
+	return entry.database, true
+}
+
+func (s *SeriesDatabase) CardinalityStats(tenant string) CardinalityStats {
+	s.RLock()
+	defer s.RUnlock()
+
+	series, ok := s.tenants[tenant]
+	if !ok {
+		return CardinalityStats{}
+	}
+
+	return CardinalityStats{
+		Series:     s.seriesCount(series),
+		Overflowed: series.overflowed,
+	}
+}
+
+// Close closes every series.
+func (s *SeriesDatabase) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stopExpiry != nil {
+		close(s.stopExpiry)
+		s.stopExpiry = nil
+	}
+
+	for _, tenant := range s.tenants {
+		for _, entry := range tenant.series {
+			atomic.StoreInt32(&entry.removed, 1)
+			entry.database.Close()
+		}
+	}
+	s.tenants = make(map[string]*tenantSeries)
+}
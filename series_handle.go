@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// a SeriesHandle is bound to a single series of a SeriesDatabase, so hot
+// paths writing the same series over and over skip looking it up by key
+// on every call. Handles are cheap, safe for concurrent use, and follow
+// the series if it expires and is created again.
+type SeriesHandle struct {
+	series *SeriesDatabase
+	key    SeriesKey
+
+	// the *seriesEntry last written to or read, unless it is the
+	// overflow series, which keys are only routed to until their tenant
+	// has room for them
+	entry atomic.Value
+}
+
+// GetSeriesHandle returns a handle bound to the series. The series isn't
+// created until the handle is first written to.
+func (s *SeriesDatabase) GetSeriesHandle(key SeriesKey) *SeriesHandle {
+	return &SeriesHandle{series: s, key: key}
+}
+
+// Key returns the key of the series the handle is bound to.
+func (h *SeriesHandle) Key() SeriesKey {
+	return h.key
+}
+
+// returns the entry the handle holds, if it is still live
+func (h *SeriesHandle) cached() *seriesEntry {
+	entry, _ := h.entry.Load().(*seriesEntry)
+	if entry == nil || atomic.LoadInt32(&entry.removed) == 1 {
+		return nil
+	}
+
+	return entry
+}
+
+// returns the entry the handle holds and records a write to it, under the
+// same lock as entryWithin does so that ExpireIdle can't remove it in between,
+// or forgets the entry if it has already been removed
+func (h *SeriesHandle) live() *seriesEntry {
+	entry, _ := h.entry.Load().(*seriesEntry)
+	if entry == nil {
+		return nil
+	}
+
+	h.series.RLock()
+	defer h.series.RUnlock()
+	if atomic.LoadInt32(&entry.removed) == 1 {
+		h.entry.CompareAndSwap(entry, (*seriesEntry)(nil))
+		return nil
+	}
+	h.series.touch(entry)
+
+	return entry
+}
+
+// Write writes the metrics to the series, see SeriesDatabase.Write.
+func (h *SeriesHandle) Write(bulkMetrics []*BulkMetric) error {
+	if entry := h.live(); entry != nil {
+		// like writeEntry, the entry can't be closed part way through
+		entry.RLock()
+		if atomic.LoadInt32(&entry.removed) == 0 {
+			defer entry.RUnlock()
+			return entry.database.BulkWrite(bulkMetrics)
+		}
+		entry.RUnlock()
+	}
+
+	_, err := h.series.writeEntry(h.key, bulkCount(bulkMetrics), 0, func(entry *seriesEntry, overflowed bool) error {
+		if !overflowed {
+			h.entry.Store(entry)
+		}
+		return entry.database.BulkWrite(bulkMetrics)
+	})
+	return err
+}
+
+// Database returns the database holding the series, if it exists.
+func (h *SeriesHandle) Database() (Database, bool) {
+	if entry := h.cached(); entry != nil {
+		return entry.database, true
+	}
+
+	return h.series.Get(h.key)
+}
+
+// GetMedian returns the median of the series, or 0 if it doesn't exist.
+func (h *SeriesHandle) GetMedian() int {
+	database, ok := h.Database()
+	if !ok {
+		return 0
+	}
+
+	return database.GetMedian()
+}
+
+// Snapshot returns a snapshot of the series, failing with ErrEmpty if it
+// doesn't exist.
+func (h *SeriesHandle) Snapshot() (Snapshot, error) {
+	database, ok := h.Database()
+	if !ok {
+		return Snapshot{}, fmt.Errorf("series %s/%s: %w", h.key.Tenant, h.key.Name, ErrEmpty)
+	}
+
+	return querySnapshot(h.key.Name, database, 0)
+}
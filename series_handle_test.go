@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSeriesHandle(t *testing.T) {
+	now := time.Now()
+	database := NewSeriesDatabase(1, func() Database {
+		return NewSyncMedianDatabase()
+	}, WithIdleExpiry(time.Hour, nil))
+	database.now = func() time.Time { return now }
+	defer database.Close()
+
+	handle := database.GetSeriesHandle(SeriesKey{Tenant: "a", Name: "latency"})
+	if _, err := handle.Snapshot(); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty before the first write, got %v", err)
+	}
+
+	handle.Write(buildBulkMetrics(0, 5))
+	handle.Write(buildBulkMetrics(0, 5))
+	if snapshot, err := handle.Snapshot(); err != nil || snapshot.Count() != 10 || handle.GetMedian() != 2 {
+		t.Fatalf("expected both writes in the series, got %v", err)
+	}
+
+	// a second series overflows, and its handle keeps being counted
+	overflowed := database.GetSeriesHandle(SeriesKey{Tenant: "a", Name: "other"})
+	overflowed.Write(buildBulkMetrics(0, 3))
+	overflowed.Write(buildBulkMetrics(0, 3))
+	if stats := database.CardinalityStats("a"); stats.Overflowed != 6 {
+		t.Fatalf("expected every overflowed write counted, got %+v", stats)
+	}
+
+	// writes through the handle keep the series from expiring
+	now = now.Add(50 * time.Minute)
+	handle.Write(buildBulkMetrics(0, 1))
+	now = now.Add(20 * time.Minute)
+	if keys := database.ExpireIdle(); len(keys) != 1 || keys[0].Name != OverflowSeries {
+		t.Fatalf("expected only the overflow series to expire, got %v", keys)
+	}
+
+	// once expired, the handle starts the series again
+	now = now.Add(2 * time.Hour)
+	expired := handle.cached()
+	database.ExpireIdle()
+	if stats := database.CardinalityStats("a"); stats.Series != 0 || stats.Overflowed != 6 {
+		t.Fatalf("expected the overflow count to outlive the tenant's series, got %+v", stats)
+	}
+	handle.Write(buildBulkMetrics(7, 8))
+	if entry := handle.cached(); entry == nil || entry == expired {
+		t.Fatalf("expected the handle to drop the expired series for the new one")
+	}
+	if median := handle.GetMedian(); median != 7 {
+		t.Fatalf("expected a new series with a median of 7, got %d", median)
+	}
+	if database, ok := database.Get(handle.Key()); !ok || database.GetMedian() != 7 {
+		t.Fatalf("expected the new series to be held by the database")
+	}
+}
+
+func BenchmarkSeriesWrite(b *testing.B) {
+	database := NewSeriesDatabase(0, func() Database {
+		return newTestHistogramDatabase(1)
+	})
+	defer database.Close()
+	for i := 0; i < 1000; i++ {
+		database.Write(SeriesKey{Tenant: "bench", Name: fmt.Sprintf("series.%d", i)}, buildBulkMetrics(0, 1))
+	}
+	key := SeriesKey{Tenant: "bench", Name: "series.500"}
+	metrics := buildBulkMetrics(0, 1)
+
+	b.Run("key", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			database.Write(key, metrics)
+		}
+	})
+	b.Run("handle", func(b *testing.B) {
+		handle := database.GetSeriesHandle(key)
+		for i := 0; i < b.N; i++ {
+			handle.Write(metrics)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestSeriesDatabase(maxSeries int) *SeriesDatabase {
+	return NewSeriesDatabase(maxSeries, func() Database {
+		return newTestHistogramDatabase(1)
+	})
+}
+
+func TestSeriesDatabaseOverflow(t *testing.T) {
+	database := newTestSeriesDatabase(2)
+	defer database.Close()
+
+	for i := 0; i < 5; i++ {
+		key := SeriesKey{Tenant: "noisy", Name: fmt.Sprintf("request.%d", i)}
+		if err := database.Write(key, buildBulkMetrics(0, 10)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	// other tenants have their own limit
+	database.Write(SeriesKey{Tenant: "quiet", Name: "request"}, buildBulkMetrics(0, 10))
+
+	stats := database.CardinalityStats("noisy")
+	if stats.Series != 2 || stats.Overflowed != 30 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats := database.CardinalityStats("quiet"); stats.Series != 1 || stats.Overflowed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// existing series keep being written to directly
+	database.Write(SeriesKey{Tenant: "noisy", Name: "request.0"}, buildBulkMetrics(0, 10))
+	if stats := database.CardinalityStats("noisy"); stats.Overflowed != 30 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	if _, ok := database.Get(SeriesKey{Tenant: "noisy", Name: "request.4"}); ok {
+		t.Fatalf("expected request.4 to have overflowed")
+	}
+	overflow, ok := database.Get(SeriesKey{Tenant: "noisy", Name: OverflowSeries})
+	if !ok {
+		t.Fatalf("expected an overflow series")
+	}
+	if median := overflow.GetMedian(); median != 4 {
+		t.Fatalf("expected overflow median of 4, got %d", median)
+	}
+}
+
+func TestSeriesDatabaseWriteWithin(t *testing.T) {
+	database := newTestSeriesDatabase(0)
+	defer database.Close()
+
+	// concurrent writes to new series can't take more than the quota
+	var wg sync.WaitGroup
+	var created, refused int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := SeriesKey{Tenant: "noisy", Name: fmt.Sprintf("request.%d", i)}
+			ok, err := database.WriteWithin(key, buildBulkMetrics(0, 1), 5)
+			if ok {
+				atomic.AddInt32(&created, 1)
+			} else if errors.Is(err, ErrSeriesQuota) {
+				atomic.AddInt32(&refused, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if created != 5 || refused != 15 || database.CardinalityStats("noisy").Series != 5 {
+		t.Fatalf("expected 5 series created and 15 refused, got %d and %d", created, refused)
+	}
+}
+
+func TestSeriesDatabaseWritesRaceExpiry(t *testing.T) {
+	// an hour passes whenever the time is read, so every series is
+	// expired by each call to ExpireIdle
+	database := NewSeriesDatabase(0, func() Database {
+		return NewSyncMedianDatabase()
+	}, WithIdleExpiry(time.Minute, nil))
+	defer database.Close()
+	var hours int64
+	database.now = func() time.Time {
+		return time.Unix(0, 0).Add(time.Duration(atomic.AddInt64(&hours, 1)) * time.Hour)
+	}
+	worker := NewSeriesWorker(database, 1, time.Hour, nil)
+	defer worker.Stop()
+
+	key := SeriesKey{Tenant: "a", Name: "latency"}
+	handle := database.GetSeriesHandle(key)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			database.ExpireIdle()
+		}
+	}()
+
+	// writes which got a series just before it expired aren't refused
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if err := database.Write(key, buildBulkMetrics(0, 1)); err != nil {
+			t.Fatalf("unexpected error writing: %v", err)
+		}
+		if err := handle.Write(buildBulkMetrics(0, 1)); err != nil {
+			t.Fatalf("unexpected error writing through a handle: %v", err)
+		}
+		if err := worker.Write(key, NewIntMetric(1)); err != nil {
+			t.Fatalf("unexpected error writing through a worker: %v", err)
+		}
+	}
+
+	// and every worker started for an expired series was stopped with it
+	database.ExpireIdle()
+	worker.Lock()
+	workers := len(worker.workers)
+	worker.Unlock()
+	if workers != 0 {
+		t.Fatalf("expected no workers left for expired series, got %d", workers)
+	}
+}
+
+func TestSeriesDatabaseIdleExpiry(t *testing.T) {
+	now := time.Now()
+	expired := make(map[SeriesKey]int)
+	database := NewSeriesDatabase(0, func() Database {
+		return newTestHistogramDatabase(1)
+	}, WithIdleExpiry(time.Hour, func(key SeriesKey, database Database) {
+		expired[key] = database.GetMedian()
+	}))
+	database.now = func() time.Time { return now }
+	defer database.Close()
+
+	// buffered by a worker which won't flush by itself before the expiry
+	worker := NewSeriesWorker(database, 100, time.Hour, nil)
+	defer worker.Stop()
+
+	stale := SeriesKey{Tenant: "a", Name: "stale"}
+	fresh := SeriesKey{Tenant: "a", Name: "fresh"}
+	worker.Write(stale, NewIntMetric(7))
+	database.Write(fresh, buildBulkMetrics(0, 3))
+
+	now = now.Add(50 * time.Minute)
+	database.Write(fresh, buildBulkMetrics(0, 3))
+	if keys := database.ExpireIdle(); len(keys) != 0 {
+		t.Fatalf("expected nothing to expire yet, got %v", keys)
+	}
+
+	now = now.Add(20 * time.Minute)
+	keys := database.ExpireIdle()
+	if len(keys) != 1 || keys[0] != stale {
+		t.Fatalf("expected only the stale series to expire, got %v", keys)
+	}
+	// the worker's buffer was flushed before the series was handed over
+	if median, ok := expired[stale]; !ok || median != 7 {
+		t.Fatalf("expected the stale series with a median of 7, got %v", expired)
+	}
+	if _, ok := database.Get(stale); ok {
+		t.Fatalf("expected the stale series to be freed")
+	}
+	if _, ok := database.Get(fresh); !ok {
+		t.Fatalf("expected the fresh series to be kept")
+	}
+
+	// writing to an expired series starts it again
+	worker.Write(stale, NewIntMetric(1))
+	if _, ok := database.Get(stale); !ok {
+		t.Fatalf("expected the stale series to be recreated")
+	}
+}
+
+func TestSeriesDatabaseExpiryOrder(t *testing.T) {
+	now := time.Now()
+	database := NewSeriesDatabase(0, func() Database {
+		return newTestHistogramDatabase(1)
+	}, WithIdleExpiry(time.Hour, nil))
+	database.now = func() time.Time { return now }
+	defer database.Close()
+
+	for _, tenant := range []string{"b", "a"} {
+		for _, name := range []string{"z", "m", "a"} {
+			database.Write(SeriesKey{Tenant: tenant, Name: name}, buildBulkMetrics(0, 1))
+		}
+	}
+
+	now = now.Add(2 * time.Hour)
+	expected := []SeriesKey{{"a", "a"}, {"a", "m"}, {"a", "z"}, {"b", "a"}, {"b", "m"}, {"b", "z"}}
+	if keys := database.ExpireIdle(); !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("expected %v, got %v", expected, keys)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// a metric which was sampled, and is counted weight times to make up for
+// the metrics which were sampled out
+type weightedMetric struct {
+	Metric
+	weight int
+}
+
+// a SeriesWorker buffers metrics for a SeriesDatabase, with a
+// BufferedWorker per series. Each series can be sampled at its own rate,
+// eg: hot health check endpoints at 1% while payments are kept in full.
+// Sampled metrics are counted as if the metrics which were dropped had the
+// same value, so per-series medians and counts remain representative.
+type SeriesWorker struct {
+	sync.Mutex
+
+	database      *SeriesDatabase
+	bufferSize    int
+	flushInterval time.Duration
+	options       []WorkerOption
+
+	// options for individual series by name, see ConfigureSeries
+	seriesOptions map[string][]WorkerOption
+
+	// the sampling weight by series name; a metric is kept with a
+	// probability of 1/weight
+	weights map[string]int
+	workers map[Database]*BufferedWorker
+	stopped bool
+}
+
+// NewSeriesWorker creates a worker which writes to the series database.
+// sampleRates maps series names, for every tenant, to the fraction of
+// their metrics to keep. Rates are rounded so that each kept metric stands
+// in for a whole number of metrics, eg: 0.3 is sampled as 1 in 3. Series
+// without a rate, or with a rate of 1 or more, are kept in full, and a
+// rate of 0 or less drops the series entirely. Series without a rate are
+// sampled at the rate of their SeriesOverride, if any. The options are
+// applied to the worker of every series.
+func NewSeriesWorker(database *SeriesDatabase, bufferSize int, flushInterval time.Duration, sampleRates map[string]float64, options ...WorkerOption) *SeriesWorker {
+	weights := make(map[string]int, len(sampleRates))
+	for name, rate := range sampleRates {
+		weights[name] = sampleWeight(rate)
+	}
+
+	s := &SeriesWorker{
+		database:      database,
+		bufferSize:    bufferSize,
+		flushInterval: flushInterval,
+		options:       options,
+		seriesOptions: make(map[string][]WorkerOption),
+		weights:       weights,
+		workers:       make(map[Database]*BufferedWorker),
+	}
+
+	// flush whatever is buffered for a series before it expires
+	database.addExpiryHook(func(key SeriesKey, expired Database) {
+		s.Lock()
+		worker, ok := s.workers[expired]
+		delete(s.workers, expired)
+		s.Unlock()
+
+		if ok {
+			worker.Stop()
+		}
+	})
+
+	return s
+}
+
+// the weight of each metric kept when sampling at rate, where 0 drops
+// every metric
+func sampleWeight(rate float64) int {
+	switch {
+	case rate <= 0:
+		return 0
+	case rate < 1:
+		return int(math.Round(1 / rate))
+	default:
+		return 1
+	}
+}
+
+// Write samples the metric according to its series' rate, and buffers it
+// if it is kept.
+func (s *SeriesWorker) Write(key SeriesKey, metric Metric) error {
+	if metric == nil {
+		return ErrInvalidMetric
+	}
+
+	weight, ok := s.weights[key.Name]
+	if !ok {
+		weight = 1
+		if override, ok := s.database.override(key.Name); ok && override.SampleRate != nil {
+			weight = sampleWeight(*override.SampleRate)
+		}
+	}
+	if weight == 0 || (weight > 1 && rand.Intn(weight) != 0) {
+		return nil
+	}
+
+	if weight > 1 {
+		metric = weightedMetric{Metric: metric, weight: weight}
+	}
+
+	// the series can't expire until the metric is buffered, so the
+	// expiry hook always sees the worker it was buffered by
+	_, err := s.database.writeEntry(key, weight, 0, func(entry *seriesEntry, _ bool) error {
+		worker, err := s.worker(key.Name, entry.database)
+		if err != nil {
+			return err
+		}
+
+		return worker.Write(metric)
+	})
+	return err
+}
+
+// ConfigureSeries applies the options, after the worker's own, to the
+// worker of every series with the name, eg: WithSignificantDigits for a
+// series with a particularly wide range. Series whose worker is already
+// running keep their options until it is restarted, eg: after expiring.
+func (s *SeriesWorker) ConfigureSeries(name string, options ...WorkerOption) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.seriesOptions[name] = options
+}
+
+// returns the worker for the series' database, starting it on first use.
+// Series which overflowed share the worker of the overflow series.
+func (s *SeriesWorker) worker(name string, database Database) (*BufferedWorker, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stopped {
+		return nil, ErrClosed
+	}
+
+	worker, ok := s.workers[database]
+	if !ok {
+		options := append(append([]WorkerOption{}, s.options...), s.seriesOptions[name]...)
+		worker = NewBufferedWorker(s.bufferSize, s.flushInterval, database, options...)
+		worker.Start()
+		s.workers[database] = worker
+	}
+
+	return worker, nil
+}
+
+// Stop flushes and stops the worker of every series.
+func (s *SeriesWorker) Stop() {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, worker := range s.workers {
+		worker.Stop()
+	}
+	s.workers = make(map[Database]*BufferedWorker)
+	s.stopped = true
+}
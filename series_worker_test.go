@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeriesWorkerSampling(t *testing.T) {
+	database := NewSeriesDatabase(0, func() Database {
+		return NewMedianDatabase()
+	})
+	defer database.Close()
+
+	// a single flush per series, once the worker is stopped
+	flushed := make(chan FlushInfo, 3)
+	worker := NewSeriesWorker(database, 1000000, time.Minute, map[string]float64{
+		"healthcheck": 0.1,
+		"debug":       0,
+	}, WithAfterFlush(func(info FlushInfo) {
+		flushed <- info
+	}))
+
+	payments := SeriesKey{Tenant: "shop", Name: "payments"}
+	healthcheck := SeriesKey{Tenant: "shop", Name: "healthcheck"}
+	debug := SeriesKey{Tenant: "shop", Name: "debug"}
+	for i := 0; i < 10000; i++ {
+		worker.Write(payments, NewIntMetric(i%100))
+		worker.Write(healthcheck, NewIntMetric(i%100))
+		worker.Write(debug, NewIntMetric(i%100))
+	}
+	worker.Stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-flushed:
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+
+	if _, ok := database.Get(debug); ok {
+		t.Fatalf("expected the debug series to be dropped")
+	}
+
+	series, _ := database.Get(payments)
+	if median, count := series.(*MedianDatabase).GetMedianAndCount(); median != 49 || count != 10000 {
+		t.Fatalf("expected payments to be kept in full, got a median of %d over %d", median, count)
+	}
+
+	// a tenth of the health checks were kept, each counted ten times
+	series, _ = database.Get(healthcheck)
+	median, count := series.(*MedianDatabase).GetMedianAndCount()
+	if count%10 != 0 || count < 8000 || count > 12000 {
+		t.Fatalf("expected a scaled count close to 10000, got %d", count)
+	}
+	if median < 40 || median > 60 {
+		t.Fatalf("expected a median close to 49, got %d", median)
+	}
+
+	if err := worker.Write(payments, NewIntMetric(1)); err != ErrClosed {
+		t.Fatalf("expected ErrClosed after stopping, got %v", err)
+	}
+}
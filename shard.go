@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// a Shard is one partition of a distributed data set which can answer rank
+// queries about its own values. NewLocalShard serves a FrozenDatabase or a
+// Snapshot as a Shard, and remote shards implement it by forwarding each
+// call, returning an error if the call fails or ctx is done.
+type Shard interface {
+	Count(ctx context.Context) (int, error)
+	Min(ctx context.Context) (int, error)
+	Max(ctx context.Context) (int, error)
+	// Rank returns the number of values less than or equal to value
+	Rank(ctx context.Context, value int) (int, error)
+}
+
+// a localShard answers rank queries from values held in memory, which
+// never fail
+type localShard struct {
+	frozen *FrozenDatabase
+}
+
+// NewLocalShard serves the frozen values as a Shard, eg: a snapshot's
+// FrozenDatabase.
+func NewLocalShard(frozen *FrozenDatabase) Shard {
+	return localShard{frozen: frozen}
+}
+
+func (l localShard) Count(context.Context) (int, error) { return l.frozen.Count(), nil }
+func (l localShard) Min(context.Context) (int, error)   { return l.frozen.Min(), nil }
+func (l localShard) Max(context.Context) (int, error)   { return l.frozen.Max(), nil }
+
+func (l localShard) Rank(_ context.Context, value int) (int, error) {
+	return l.frozen.Rank(value), nil
+}
+
+// returns the k-th smallest value (1-indexed) across all shards. Rather than
+// moving any data between shards we pick a pivot value, ask every shard how
+// many of its values are <= the pivot and narrow the range of candidate
+// values until a single value remains. This costs O(log(max - min)) rounds
+// of rank queries, each of which is a single integer per shard. The first
+// shard to fail fails the whole query.
+func selectKth(ctx context.Context, shards []Shard, k int) (int, error) {
+	lo, hi := 0, 0
+	first := true
+	for i, shard := range shards {
+		count, err := shard.Count(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", i, err)
+		}
+		if count == 0 {
+			continue
+		}
+
+		min, err := shard.Min(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", i, err)
+		}
+		max, err := shard.Max(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", i, err)
+		}
+
+		if first || min < lo {
+			lo = min
+		}
+		if first || max > hi {
+			hi = max
+		}
+		first = false
+	}
+
+	// find the smallest value whose global rank is at least k
+	for lo < hi {
+		pivot := floorMidpoint(lo, hi)
+
+		rank := 0
+		for i, shard := range shards {
+			shardRank, err := shard.Rank(ctx, pivot)
+			if err != nil {
+				return 0, fmt.Errorf("shard %d: %w", i, err)
+			}
+			rank += shardRank
+		}
+
+		if rank >= k {
+			hi = pivot
+		} else {
+			lo = pivot + 1
+		}
+	}
+
+	return lo, nil
+}
+
+// the total count of values across all shards
+func shardsCount(ctx context.Context, shards []Shard) (int, error) {
+	total := 0
+	for i, shard := range shards {
+		count, err := shard.Count(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("shard %d: %w", i, err)
+		}
+		total += count
+	}
+
+	return total, nil
+}
+
+// DistributedMedian returns the exact median across all shards, using the
+// same rounding as MedianDatabase.GetMedian for an even number of values,
+// or the error of the first shard which failed.
+func DistributedMedian(ctx context.Context, shards []Shard) (int, error) {
+	count, err := shardsCount(ctx, shards)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	if count%2 == 1 {
+		return selectKth(ctx, shards, (count+1)/2)
+	}
+
+	lower, err := selectKth(ctx, shards, count/2)
+	if err != nil {
+		return 0, err
+	}
+	upper, err := selectKth(ctx, shards, count/2+1)
+	if err != nil {
+		return 0, err
+	}
+
+	return midpoint(lower, upper), nil
+}
+
+// DistributedPercentile returns the exact nearest-rank percentile across all
+// shards, where p is a fraction between 0 and 1, or the error of the first
+// shard which failed.
+func DistributedPercentile(ctx context.Context, shards []Shard, p float64) (int, error) {
+	count, err := shardsCount(ctx, shards)
+	if err != nil || count == 0 {
+		return 0, err
+	}
+
+	return selectKth(ctx, shards, nearestRank(p, count))
+}
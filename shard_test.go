@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func freezeMetrics(metrics ...[]*BulkMetric) *FrozenDatabase {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	for _, batch := range metrics {
+		database.BulkWrite(batch)
+	}
+
+	frozen, _ := database.Freeze()
+	return frozen
+}
+
+// a remote shard whose calls fail once it is down
+type failingShard struct {
+	Shard
+	down bool
+}
+
+func (f *failingShard) Rank(ctx context.Context, value int) (int, error) {
+	if f.down {
+		return 0, ErrTimeout
+	}
+
+	return f.Shard.Rank(ctx, value)
+}
+
+func TestDistributedMedian(t *testing.T) {
+	ctx := context.Background()
+
+	// shards hold interleaved and overlapping ranges; combined they
+	// contain [-10, 30) plus a second copy of [0, 5)
+	remote := &failingShard{Shard: NewLocalShard(freezeMetrics(buildBulkMetrics(20, 30)))}
+	shards := []Shard{
+		NewLocalShard(freezeMetrics(buildBulkMetrics(-10, 0))),
+		NewLocalShard(freezeMetrics(buildBulkMetrics(0, 20), buildBulkMetrics(0, 5))),
+		remote,
+		NewLocalShard(freezeMetrics()),
+	}
+
+	combined := freezeMetrics(buildBulkMetrics(-10, 30), buildBulkMetrics(0, 5))
+	if actual, err := DistributedMedian(ctx, shards); err != nil || actual != combined.GetMedian() {
+		t.Fatalf("expected median of %d, got %d (%v)", combined.GetMedian(), actual, err)
+	}
+
+	for _, p := range []float64{0, 0.1, 0.5, 0.9, 0.99, 1} {
+		if actual, err := DistributedPercentile(ctx, shards, p); err != nil || actual != combined.GetPercentile(p) {
+			t.Fatalf("expected p%v of %d, got %d (%v)", p*100, combined.GetPercentile(p), actual, err)
+		}
+	}
+
+	if median, err := DistributedMedian(ctx, []Shard{NewLocalShard(freezeMetrics())}); err != nil || median != 0 {
+		t.Fatalf("expected an empty median of 0, got %d (%v)", median, err)
+	}
+
+	// a shard which fails fails the query, rather than skewing it
+	remote.down = true
+	if _, err := DistributedMedian(ctx, shards); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the shard's error, got %v", err)
+	}
+	if _, err := DistributedPercentile(ctx, shards, 0.9); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected the shard's error, got %v", err)
+	}
+}
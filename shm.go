@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// the shared stats segment is a single fixed size record, so sibling
+// processes can read the latest stats with a handful of loads. It is
+// guarded by a sequence lock: the version is odd while the stats are
+// being written, and readers retry until they see the same even version
+// on both sides of their read.
+//
+//	[0:4)   magic "MSS1"
+//	[8:16)  version
+//	[16:24) median
+//	[24:32) count
+//	[32:40) generation
+//	[40:48) the median as float64 bits
+//	[48:56) when the median was recalculated, in unix nanoseconds
+const (
+	sharedStatsMagic = "MSS1"
+	sharedStatsSize  = 56
+)
+
+// SharedStats are the stats read from a shared stats segment
+type SharedStats struct {
+	Median      int64
+	MedianFloat float64
+	Count       int64
+	Generation  uint64
+	Updated     time.Time
+}
+
+// WithSharedStats publishes the stats of the database into a small shared
+// memory segment at path, eg: under /dev/shm, each time the median is
+// recalculated, so that sibling processes can read them with
+// OpenSharedStats without a round trip to this one. Failing to create the
+// segment is reported on Errors. It is only supported on unix.
+func WithSharedStats(path string) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.sharedPath = path
+	}
+}
+
+// a mapped shared stats segment, written by a single database
+type sharedStatsSegment struct {
+	data  []byte
+	unmap func() error
+}
+
+// the 8 byte aligned word at offset, accessed atomically since the
+// segment is shared with other processes
+func (s *sharedStatsSegment) word(offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&s.data[offset]))
+}
+
+// publishes the stats, from the database worker
+func (s *sharedStatsSegment) publish(stats *medianStats) {
+	version := s.word(8)
+	atomic.AddUint64(version, 1)
+
+	atomic.StoreUint64(s.word(16), uint64(stats.median))
+	atomic.StoreUint64(s.word(24), uint64(stats.count))
+	atomic.StoreUint64(s.word(32), stats.generation)
+	atomic.StoreUint64(s.word(40), math.Float64bits(stats.medianFloat))
+	atomic.StoreUint64(s.word(48), uint64(stats.updated.UnixNano()))
+
+	atomic.AddUint64(version, 1)
+}
+
+func (s *sharedStatsSegment) close() {
+	s.unmap()
+}
+
+// a SharedStatsReader reads the stats another process publishes
+// WithSharedStats
+type SharedStatsReader struct {
+	segment *sharedStatsSegment
+}
+
+// OpenSharedStats maps the shared stats segment at path for reading.
+func OpenSharedStats(path string) (*SharedStatsReader, error) {
+	segment, err := openSharedStats(path)
+	if err != nil {
+		return nil, err
+	}
+	if string(segment.data[:4]) != sharedStatsMagic {
+		segment.close()
+		return nil, fmt.Errorf("%s isn't a shared stats segment: %w", path, ErrSnapshotCorrupt)
+	}
+
+	return &SharedStatsReader{segment: segment}, nil
+}
+
+// Read returns the latest published stats. It never blocks the publisher,
+// and only retries while the stats are being written, failing with
+// ErrTimeout if they never settle, eg: because the publisher died mid way.
+func (r *SharedStatsReader) Read() (SharedStats, error) {
+	segment := r.segment
+	for attempt := 0; attempt < 1000; attempt++ {
+		before := atomic.LoadUint64(segment.word(8))
+		if before%2 == 1 {
+			continue
+		}
+
+		stats := SharedStats{
+			Median:      int64(atomic.LoadUint64(segment.word(16))),
+			Count:       int64(atomic.LoadUint64(segment.word(24))),
+			Generation:  atomic.LoadUint64(segment.word(32)),
+			MedianFloat: math.Float64frombits(atomic.LoadUint64(segment.word(40))),
+			Updated:     time.Unix(0, int64(atomic.LoadUint64(segment.word(48)))),
+		}
+
+		if atomic.LoadUint64(segment.word(8)) == before {
+			return stats, nil
+		}
+	}
+
+	return SharedStats{}, fmt.Errorf("shared stats kept changing while being read: %w", ErrTimeout)
+}
+
+// Close unmaps the segment.
+func (r *SharedStatsReader) Close() error {
+	return r.segment.unmap()
+}
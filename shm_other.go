@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+)
+
+var errSharedStatsUnsupported = errors.New("shared stats are only supported on unix")
+
+func createSharedStats(path string) (*sharedStatsSegment, error) {
+	return nil, errSharedStatsUnsupported
+}
+
+func openSharedStats(path string) (*sharedStatsSegment, error) {
+	return nil, errSharedStatsUnsupported
+}
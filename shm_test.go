@@ -0,0 +1,45 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "latency.stats")
+
+	database := NewMedianDatabase(WithSharedStats(path))
+	database.Open()
+	defer database.Close()
+
+	reader, err := OpenSharedStats(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer reader.Close()
+
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 101))
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 2))
+
+	stats, err := reader.Read()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if stats.Median != 50 || stats.Count != 101 || stats.Generation != 2 || stats.MedianFloat != 50 {
+		t.Fatalf("unexpected shared stats %+v", stats)
+	}
+	if updated := database.stats.Load().(*medianStats).updated; !stats.Updated.Equal(updated) {
+		t.Fatalf("expected the stats to be updated at %v, got %v", updated, stats.Updated)
+	}
+
+	// anything else is rejected
+	other := filepath.Join(t.TempDir(), "other")
+	os.WriteFile(other, make([]byte, sharedStatsSize), 0644)
+	if _, err := OpenSharedStats(other); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+}
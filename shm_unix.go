@@ -0,0 +1,64 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+)
+
+// creates, or takes over, the segment at path and maps it for writing
+func createSharedStats(path string) (*sharedStatsSegment, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("creating shared stats: %w", err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(sharedStatsSize); err != nil {
+		return nil, fmt.Errorf("sizing shared stats: %w", err)
+	}
+
+	segment, err := mapSharedStats(file, syscall.PROT_READ|syscall.PROT_WRITE)
+	if err != nil {
+		return nil, err
+	}
+	// a publisher which died mid write left the version odd
+	copy(segment.data, sharedStatsMagic)
+	atomic.StoreUint64(segment.word(8), 0)
+
+	return segment, nil
+}
+
+func openSharedStats(path string) (*sharedStatsSegment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening shared stats: %w", err)
+	}
+	defer file.Close()
+
+	if info, err := file.Stat(); err != nil {
+		return nil, err
+	} else if info.Size() < sharedStatsSize {
+		return nil, fmt.Errorf("%s is too small to be a shared stats segment: %w", path, ErrSnapshotCorrupt)
+	}
+
+	return mapSharedStats(file, syscall.PROT_READ)
+}
+
+// the mapping outlives the file, which can be closed straight away
+func mapSharedStats(file *os.File, protection int) (*sharedStatsSegment, error) {
+	data, err := syscall.Mmap(int(file.Fd()), 0, sharedStatsSize, protection, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("mapping shared stats: %w", err)
+	}
+
+	return &sharedStatsSegment{
+		data: data,
+		unmap: func() error {
+			return syscall.Munmap(data)
+		},
+	}, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// a SkewPolicy decides what happens to metrics timestamped further ahead
+// of the database's clock than the skew tolerance, eg: by a host whose
+// clock is wrong, which would otherwise open windows far in the future
+// and, with WithWatermark, finalize every window before them
+type SkewPolicy int
+
+const (
+	// skewed metrics are written at their timestamps, and counted
+	AcceptSkew SkewPolicy = iota
+	// skewed metrics are written at the current time instead
+	ClampSkew
+	// skewed metrics are rejected with ErrClockSkew, or dropped when
+	// backfilled
+	RejectSkew
+)
+
+// SkewStats counts the metrics which were timestamped too far ahead of the
+// clock, by what was done with them.
+type SkewStats struct {
+	Accepted uint64
+	Clamped  uint64
+	Rejected uint64
+}
+
+// WithClockSkew sets how far ahead of the clock metrics written with
+// WriteAt, or backfilled, can be timestamped, and what happens to metrics
+// timestamped further ahead than that. By default every timestamp is
+// accepted as is.
+func WithClockSkew(tolerance time.Duration, policy SkewPolicy) WindowOption {
+	return func(w *WindowedDatabase) {
+		w.skewed = true
+		w.skewTolerance = tolerance
+		w.skewPolicy = policy
+	}
+}
+
+// returns the time count metrics observed at the given time should be
+// written at, or an error if they are rejected. It must be called with the
+// lock held.
+func (w *WindowedDatabase) correctSkew(observed time.Time, count int) (time.Time, error) {
+	if !w.skewed {
+		return observed, nil
+	}
+
+	// always the clock, as the latest observed time may itself be skewed
+	now := w.now()
+	ahead := observed.Sub(now)
+	if ahead <= w.skewTolerance {
+		return observed, nil
+	}
+
+	switch w.skewPolicy {
+	case ClampSkew:
+		w.skewStats.Clamped += uint64(count)
+		return now, nil
+	case RejectSkew:
+		w.skewStats.Rejected += uint64(count)
+		return time.Time{}, fmt.Errorf("observed at %v, %v ahead of the clock: %w", observed, ahead, ErrClockSkew)
+	default:
+		w.skewStats.Accepted += uint64(count)
+		return observed, nil
+	}
+}
+
+// SkewStats reports how many metrics were timestamped too far ahead of the
+// clock, see WithClockSkew.
+func (w *WindowedDatabase) SkewStats() SkewStats {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.skewStats
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestWindowedDatabaseClockSkew(t *testing.T) {
+	clock := newTestClock()
+	future := clock.now().Add(time.Hour)
+
+	cases := []struct {
+		policy   SkewPolicy
+		err      error
+		count    int
+		expected SkewStats
+	}{
+		{AcceptSkew, nil, 0, SkewStats{Accepted: 10}},
+		{ClampSkew, nil, 10, SkewStats{Clamped: 10}},
+		{RejectSkew, ErrClockSkew, 0, SkewStats{Rejected: 10}},
+	}
+
+	for _, c := range cases {
+		database := newTestWindowedDatabase(time.Minute, 10*time.Minute, WithClockSkew(5*time.Second, c.policy))
+		database.now = clock.now
+
+		// within the tolerance, timestamps are left alone
+		if err := database.WriteAt(clock.now().Add(5*time.Second), buildBulkMetrics(0, 5)); err != nil {
+			t.Fatalf("%d: unexpected error: %v", c.policy, err)
+		}
+		if err := database.WriteAt(future, buildBulkMetrics(0, 10)); !errors.Is(err, c.err) {
+			t.Fatalf("%d: expected %v, got %v", c.policy, c.err, err)
+		}
+
+		// only clamped metrics land in the current window
+		if count := database.GetWindow(time.Minute).Count(); count != 5+c.count {
+			t.Fatalf("%d: expected %d metrics in the current window, got %d", c.policy, 5+c.count, count)
+		}
+		if stats := database.SkewStats(); stats != c.expected {
+			t.Fatalf("%d: unexpected stats %+v", c.policy, stats)
+		}
+	}
+}
+
+func TestWindowedDatabaseClockSkewWatermark(t *testing.T) {
+	clock := newTestClock()
+
+	finalized := 0
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute, WithWatermark(func(WindowRollup) { finalized++ }), WithClockSkew(time.Minute, ClampSkew))
+	database.now = clock.now
+
+	database.WriteAt(clock.now(), buildBulkMetrics(0, 10))
+	database.WriteAt(clock.now().Add(24*time.Hour), buildBulkMetrics(0, 10))
+
+	// a skewed host can't move the watermark past the open windows
+	if watermark := database.Watermark(); watermark.After(clock.now()) || finalized != 0 {
+		t.Fatalf("expected the watermark to stay at the clock, got %v with %d finalized", watermark, finalized)
+	}
+
+	clock.advance(time.Minute)
+	iterator := &sliceIterator{err: io.EOF, batches: []TimedBatch{
+		{Time: clock.now(), Metrics: buildBulkMetrics(0, 3)},
+		{Time: clock.now().Add(time.Hour), Metrics: buildBulkMetrics(0, 4)},
+	}}
+	stats, err := database.Backfill(context.Background(), iterator)
+	if err != nil || stats.Applied != 7 || stats.Dropped != 0 {
+		t.Fatalf("expected skewed batches to be clamped when backfilled, got %+v: %v", stats, err)
+	}
+
+	rejecting := newTestWindowedDatabase(time.Minute, 10*time.Minute, WithClockSkew(time.Minute, RejectSkew))
+	rejecting.now = clock.now
+	iterator.batches = []TimedBatch{
+		{Time: clock.now(), Metrics: buildBulkMetrics(0, 3)},
+		{Time: clock.now().Add(time.Hour), Metrics: buildBulkMetrics(0, 4)},
+	}
+	stats, err = rejecting.Backfill(context.Background(), iterator)
+	if err != nil || stats.Applied != 3 || stats.Dropped != 4 || rejecting.SkewStats().Rejected != 4 {
+		t.Fatalf("expected skewed batches to be dropped when backfilled, got %+v: %v", stats, err)
+	}
+}
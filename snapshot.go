@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io"
+	"math"
+	"time"
+)
+
+// the percentiles which are compared when diffing two snapshots
+var diffPercentiles = []float64{0.25, 0.5, 0.75, 0.9, 0.99}
+
+type Snapshot struct {
+	*FrozenDatabase
+	Time time.Time
+
+	// the sequence number of the last batch included in the snapshot
+	Sequence uint64
+}
+
+// returns the snapshot's contents as a sorted batch of metrics
+func (s Snapshot) metrics() []*BulkMetric {
+	metrics := make([]*BulkMetric, 0, len(s.values))
+	for i, value := range s.values {
+		metrics = append(metrics, &BulkMetric{
+			value: value,
+			count: s.countAt(i),
+		})
+	}
+
+	return metrics
+}
+
+// merges the snapshots into one, eg: to answer a query across many series.
+// The merged snapshot is taken at the time of the latest snapshot.
+func mergeSnapshots(snapshots ...Snapshot) Snapshot {
+	metrics := make(BulkMetrics, 0)
+	taken := time.Time{}
+	for _, snapshot := range snapshots {
+		if snapshot.FrozenDatabase != nil {
+			metrics = append(metrics, snapshot.metrics()...)
+		}
+		if snapshot.Time.After(taken) {
+			taken = snapshot.Time
+		}
+	}
+
+	return Snapshot{
+		FrozenDatabase: newFrozenDatabase(metrics.Merge(), nil),
+		Time:           taken,
+	}
+}
+
+// WithSnapshotInterval passes a snapshot of the database to fn every
+// interval while it is open, so applications can persist or forward
+// consistent snapshots however they like, eg: with WriteSnapshot to their
+// own storage. fn is called from its own goroutine, so a slow fn delays
+// the next snapshot rather than any writes, and a panic in fn is reported
+// on Errors.
+func WithSnapshotInterval(interval time.Duration, fn func(Snapshot)) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.snapshotInterval = interval
+		m.onSnapshot = fn
+	}
+}
+
+// takes a snapshot every interval until the database is closed
+func (m *MedianDatabase) snapshotEvery(interval time.Duration, fn func(Snapshot)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.doneCh:
+			return
+		}
+
+		snapshot, err := m.Snapshot()
+		if err != nil {
+			// the database closed or failed, so there won't be another
+			return
+		}
+		if err := recoverPanic(func() { fn(snapshot) }); err != nil {
+			reportError(m.errCh, m.named(err))
+		}
+	}
+}
+
+// WriteSnapshot streams the snapshot to w as a single wire format frame.
+func WriteSnapshot(w io.Writer, snapshot Snapshot) error {
+	return WriteFrame(w, Frame{Sequence: snapshot.Sequence, Metrics: snapshot.metrics()})
+}
+
+// ReadSnapshot reads a snapshot which was written with WriteSnapshot. The
+// time a snapshot was taken isn't streamed, so Time is when it was read.
+func ReadSnapshot(r io.Reader) (Snapshot, error) {
+	frame, err := ReadFrame(r)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	// a snapshot is always sorted with unique values, anything else
+	// would corrupt the prefix sums
+	for i, metric := range frame.Metrics {
+		if metric.Count() < 1 || (i > 0 && metric.Value() <= frame.Metrics[i-1].Value()) {
+			return Snapshot{}, ErrSnapshotCorrupt
+		}
+	}
+
+	return Snapshot{
+		FrozenDatabase: newFrozenDatabase(frame.Metrics, nil),
+		Time:           time.Now(),
+		Sequence:       frame.Sequence,
+	}, nil
+}
+
+type ValueDelta struct {
+	Value int
+	Delta int
+}
+
+type PercentileShift struct {
+	Percentile float64
+	Before     int
+	After      int
+}
+
+func (p PercentileShift) Shift() int {
+	return p.After - p.Before
+}
+
+// PercentChange returns the shift as a percentage of the value before,
+// which is infinite if the value before was zero and the value after
+// wasn't.
+func (p PercentileShift) PercentChange() float64 {
+	return percentChange(p.Before, p.After)
+}
+
+func percentChange(before, after int) float64 {
+	if before == after {
+		return 0
+	}
+	if before == 0 {
+		return math.Inf(after - before)
+	}
+
+	return float64(after-before) / math.Abs(float64(before)) * 100
+}
+
+type SnapshotDiff struct {
+	// per-value count changes in ascending value order; values whose
+	// count didn't change are omitted
+	Deltas      []ValueDelta
+	Count       int
+	Median      PercentileShift
+	Percentiles []PercentileShift
+}
+
+// Diff reports what changed between snapshot a and a later snapshot b. A
+// zero Snapshot is treated as empty.
+func Diff(a, b Snapshot) SnapshotDiff {
+	if a.FrozenDatabase == nil {
+		a.FrozenDatabase = &FrozenDatabase{}
+	}
+	if b.FrozenDatabase == nil {
+		b.FrozenDatabase = &FrozenDatabase{}
+	}
+
+	diff := SnapshotDiff{
+		Deltas: make([]ValueDelta, 0),
+		Count:  b.Count() - a.Count(),
+		Median: PercentileShift{
+			Percentile: 0.5,
+			Before:     a.GetMedian(),
+			After:      b.GetMedian(),
+		},
+		Percentiles: make([]PercentileShift, 0, len(diffPercentiles)),
+	}
+
+	for _, p := range diffPercentiles {
+		diff.Percentiles = append(diff.Percentiles, PercentileShift{
+			Percentile: p,
+			Before:     a.GetPercentile(p),
+			After:      b.GetPercentile(p),
+		})
+	}
+
+	// both snapshots are sorted, so walk them side by side like a merge
+	i, j := 0, 0
+	for i < len(a.values) || j < len(b.values) {
+		switch {
+		case j >= len(b.values) || (i < len(a.values) && a.values[i] < b.values[j]):
+			diff.Deltas = append(diff.Deltas, ValueDelta{a.values[i], -a.countAt(i)})
+			i++
+		case i >= len(a.values) || b.values[j] < a.values[i]:
+			diff.Deltas = append(diff.Deltas, ValueDelta{b.values[j], b.countAt(j)})
+			j++
+		default:
+			if delta := b.countAt(j) - a.countAt(i); delta != 0 {
+				diff.Deltas = append(diff.Deltas, ValueDelta{a.values[i], delta})
+			}
+			i++
+			j++
+		}
+	}
+
+	return diff
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+)
+
+// a SnapshotChunk is one piece of an encoded snapshot. Chunks carry their
+// offset and a checksum, so a receiver which loses its connection can
+// verify what it has and resume from the first byte it is missing rather
+// than restarting a multi-GB transfer.
+type SnapshotChunk struct {
+	Offset   int64
+	Total    int64
+	Data     []byte
+	Checksum uint32
+}
+
+// a SnapshotStream serves an encoded snapshot in chunks. It is transport
+// agnostic: an RPC handler calls Send with the offset the client asked to
+// resume from, and forwards each chunk to the client.
+type SnapshotStream struct {
+	encoded   []byte
+	chunkSize int
+}
+
+func NewSnapshotStream(snapshot Snapshot, chunkSize int) *SnapshotStream {
+	return &SnapshotStream{
+		encoded:   EncodeFrame(Frame{Sequence: snapshot.Sequence, Metrics: snapshot.metrics()}),
+		chunkSize: chunkSize,
+	}
+}
+
+// Size returns the number of bytes in the encoded snapshot.
+func (s *SnapshotStream) Size() int64 {
+	return int64(len(s.encoded))
+}
+
+// Send calls send with every chunk from offset onwards, stopping at the
+// first error.
+func (s *SnapshotStream) Send(offset int64, send func(SnapshotChunk) error) error {
+	if offset < 0 || offset > s.Size() {
+		return fmt.Errorf("offset %d outside of snapshot of %d bytes", offset, s.Size())
+	}
+
+	for offset < s.Size() {
+		end := offset + int64(s.chunkSize)
+		if end > s.Size() {
+			end = s.Size()
+		}
+
+		data := s.encoded[offset:end]
+		err := send(SnapshotChunk{
+			Offset:   offset,
+			Total:    s.Size(),
+			Data:     data,
+			Checksum: crc32.ChecksumIEEE(data),
+		})
+		if err != nil {
+			return err
+		}
+
+		offset = end
+	}
+
+	return nil
+}
+
+// a SnapshotReceiver reassembles chunks from a SnapshotStream.
+type SnapshotReceiver struct {
+	buf   bytes.Buffer
+	total int64
+}
+
+// Offset returns the offset to resume the stream from.
+func (r *SnapshotReceiver) Offset() int64 {
+	return int64(r.buf.Len())
+}
+
+// Receive verifies and appends a chunk. Chunks must arrive in order; a
+// chunk at any other offset is rejected and the stream should be resumed
+// from Offset.
+func (r *SnapshotReceiver) Receive(chunk SnapshotChunk) error {
+	if chunk.Offset != r.Offset() {
+		return fmt.Errorf("expected chunk at offset %d, got %d", r.Offset(), chunk.Offset)
+	}
+	if crc32.ChecksumIEEE(chunk.Data) != chunk.Checksum {
+		return fmt.Errorf("chunk at offset %d: %w", chunk.Offset, ErrSnapshotCorrupt)
+	}
+
+	r.total = chunk.Total
+	r.buf.Write(chunk.Data)
+	return nil
+}
+
+func (r *SnapshotReceiver) Complete() bool {
+	return r.total > 0 && r.Offset() == r.total
+}
+
+// Snapshot decodes the received snapshot once every chunk has arrived.
+func (r *SnapshotReceiver) Snapshot() (Snapshot, error) {
+	if !r.Complete() {
+		return Snapshot{}, fmt.Errorf("snapshot incomplete, received %d of %d bytes", r.Offset(), r.total)
+	}
+
+	return ReadSnapshot(bytes.NewReader(r.buf.Bytes()))
+}
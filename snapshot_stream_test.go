@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestSnapshotStreamResumes(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	database.BulkWrite(buildBulkMetrics(0, 1000))
+	snapshot, _ := database.Snapshot()
+	stream := NewSnapshotStream(snapshot, 64)
+
+	// the connection drops after a few chunks
+	receiver := &SnapshotReceiver{}
+	dropped := errors.New("connection dropped")
+	err := stream.Send(0, func(chunk SnapshotChunk) error {
+		if chunk.Offset >= 256 {
+			return dropped
+		}
+		return receiver.Receive(chunk)
+	})
+	if err != dropped || receiver.Complete() {
+		t.Fatalf("expected the transfer to be interrupted, got %v", err)
+	}
+
+	// a corrupted chunk is rejected without being appended
+	err = stream.Send(receiver.Offset(), func(chunk SnapshotChunk) error {
+		chunk.Data = append([]byte{0xff}, chunk.Data[1:]...)
+		return receiver.Receive(chunk)
+	})
+	if !errors.Is(err, ErrSnapshotCorrupt) || receiver.Offset() != 256 {
+		t.Fatalf("expected ErrSnapshotCorrupt at offset 256, got %v at %d", err, receiver.Offset())
+	}
+
+	if err := stream.Send(receiver.Offset(), receiver.Receive); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	received, err := receiver.Snapshot()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received.Count() != 1000 || received.Sequence != snapshot.Sequence {
+		t.Fatalf("unexpected snapshot with %d metrics", received.Count())
+	}
+}
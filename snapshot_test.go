@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotDiff(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// [0 1 2 3 4 ]
+	database.BulkWrite(buildBulkMetrics(0, 5))
+	before, _ := database.Snapshot()
+
+	// [0 1 2 3 4 4 5 6 7 8 ]
+	database.BulkWrite(buildBulkMetrics(4, 9))
+	after, _ := database.Snapshot()
+
+	diff := Diff(before, after)
+	if diff.Count != 5 {
+		t.Fatalf("expected a count delta of 5, got %d", diff.Count)
+	}
+
+	expected := []ValueDelta{{4, 1}, {5, 1}, {6, 1}, {7, 1}, {8, 1}}
+	if len(diff.Deltas) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, diff.Deltas)
+	}
+	for i, delta := range expected {
+		if diff.Deltas[i] != delta {
+			t.Fatalf("expected %v, got %v", expected, diff.Deltas)
+		}
+	}
+
+	if diff.Median.Before != 2 || diff.Median.After != 4 || diff.Median.Shift() != 2 {
+		t.Fatalf("unexpected median shift %+v", diff.Median)
+	}
+
+	// diffing in reverse reports removals as negative deltas
+	reverse := Diff(after, before)
+	if reverse.Deltas[0] != (ValueDelta{4, -1}) || reverse.Count != -5 {
+		t.Fatalf("unexpected reverse diff %+v", reverse)
+	}
+
+	// a zero snapshot is diffed as empty
+	if first := Diff(Snapshot{}, before); first.Count != 5 || len(first.Deltas) != 5 || first.Median.After != 2 {
+		t.Fatalf("unexpected diff from a zero snapshot %+v", first)
+	}
+}
+
+func TestSnapshotInterval(t *testing.T) {
+	snapshots := make(chan Snapshot, 100)
+	database := NewMedianDatabase(WithSnapshotInterval(10*time.Millisecond, func(snapshot Snapshot) {
+		snapshots <- snapshot
+	}))
+	database.Open()
+
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 101))
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case snapshot := <-snapshots:
+			if snapshot.Count() == 0 {
+				continue
+			}
+			if snapshot.Count() != 100 || snapshot.GetMedian() != 50 || snapshot.Sequence != 1 {
+				t.Fatalf("unexpected snapshot of %d metrics at sequence %d", snapshot.Count(), snapshot.Sequence)
+			}
+		case <-deadline:
+			t.Fatalf("expected a snapshot of the write")
+		}
+		break
+	}
+
+	// no more snapshots are taken once the database is closed
+	database.Close()
+	time.Sleep(20 * time.Millisecond)
+	for len(snapshots) > 0 {
+		<-snapshots
+	}
+	time.Sleep(30 * time.Millisecond)
+	if len(snapshots) != 0 {
+		t.Fatalf("expected no snapshots after closing, got %d", len(snapshots))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// a StalePolicy decides what happens to the median of a database which
+// hasn't applied a batch for longer than its idle period
+type StalePolicy int
+
+const (
+	// the median is still returned, but flagged as stale
+	MarkStale StalePolicy = iota
+	// the median is returned as zero, so dashboards don't show an old
+	// median as if it were current
+	ZeroStale
+)
+
+// WithStaleAfter flags the median as stale once the database has been idle
+// for longer than idle, and applies the policy to it.
+func WithStaleAfter(idle time.Duration, policy StalePolicy) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.staleAfter = idle
+		m.stalePolicy = policy
+	}
+}
+
+// Idle returns how long it has been since the database last applied a
+// batch, or since it was created if it never has.
+func (m *MedianDatabase) Idle() time.Duration {
+	return time.Since(m.stats.Load().(*medianStats).updated)
+}
+
+// Stale reports whether the database has been idle for longer than the
+// period it was created WithStaleAfter. Databases without one are never
+// stale.
+func (m *MedianDatabase) Stale() bool {
+	return m.stale(m.stats.Load().(*medianStats))
+}
+
+func (m *MedianDatabase) stale(stats *medianStats) bool {
+	return m.staleAfter > 0 && time.Since(stats.updated) > m.staleAfter
+}
+
+// the stats block queries are answered from, with the median zeroed if
+// it is stale and the policy says so
+func (m *MedianDatabase) currentStats() *medianStats {
+	stats := m.stats.Load().(*medianStats)
+	if m.stalePolicy != ZeroStale || !m.stale(stats) {
+		return stats
+	}
+
+	zeroed := *stats
+	zeroed.median, zeroed.medianFloat = 0, 0
+	return &zeroed
+}
+
+// a Health is served by the handler at /health
+type Health struct {
+	// ok, stale or closed
+	Status      string  `json:"status"`
+	IdleSeconds float64 `json:"idle_seconds"`
+}
+
+// Health reports whether the database is open, and how long it has been
+// idle.
+func (m *MedianDatabase) Health() Health {
+	health := Health{Status: "ok", IdleSeconds: m.Idle().Seconds()}
+
+	switch {
+	case atomic.LoadInt32(&m.closed) == 1 || atomic.LoadInt32(&m.failed) == 1:
+		health.Status = "closed"
+	case m.Stale():
+		health.Status = "stale"
+	}
+
+	return health
+}
+
+// the status code /health responds with; a stale database is still
+// healthy, it just hasn't been written to
+func (h Health) statusCode() int {
+	if h.Status == "closed" {
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusOK
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStaleMedian(t *testing.T) {
+	marked := NewMedianDatabase(WithStaleAfter(20*time.Millisecond, MarkStale))
+	zeroed := NewMedianDatabase(WithStaleAfter(20*time.Millisecond, ZeroStale))
+	for _, database := range []*MedianDatabase{marked, zeroed} {
+		database.Open()
+		defer database.Close()
+		<-database.BulkWriteAcked(buildBulkMetrics(1, 101))
+
+		if database.Stale() || database.GetMedian() != 50 || database.Health().Status != "ok" {
+			t.Fatalf("expected a fresh median of 50, got %d (%+v)", database.GetMedian(), database.Health())
+		}
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	if !marked.Stale() || marked.GetMedian() != 50 || marked.Idle() < 20*time.Millisecond {
+		t.Fatalf("expected the median to be kept but marked stale, got %d after %v", marked.GetMedian(), marked.Idle())
+	}
+	if median, count := zeroed.GetMedianAndCount(); median != 0 || count != 100 {
+		t.Fatalf("expected the stale median to be zeroed, got median %d and count %d", median, count)
+	}
+
+	recorder := httptest.NewRecorder()
+	NewHandler(marked).ServeHTTP(recorder, httptest.NewRequest("GET", "/median", nil))
+	response := medianResponse{}
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	if !response.Stale || response.Median != 50 || response.IdleSeconds < 0.02 {
+		t.Fatalf("expected the median to be served as stale, got %s", recorder.Body.String())
+	}
+
+	// a new write freshens the median
+	<-zeroed.BulkWriteAcked(buildBulkMetrics(1, 2))
+	if zeroed.Stale() || zeroed.GetMedian() != 50 {
+		t.Fatalf("expected a fresh median after a write, got %d", zeroed.GetMedian())
+	}
+
+	// stale databases are healthy, closed ones aren't
+	recorder = httptest.NewRecorder()
+	NewHandler(marked).ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	if recorder.Code != 200 || marked.Health().Status != "stale" {
+		t.Fatalf("expected a stale database to be healthy, got %d %s", recorder.Code, recorder.Body.String())
+	}
+
+	marked.Close()
+	recorder = httptest.NewRecorder()
+	NewHandler(marked).ServeHTTP(recorder, httptest.NewRequest("GET", "/health", nil))
+	if recorder.Code != 503 || marked.Health().Status != "closed" {
+		t.Fatalf("expected a closed database to be unhealthy, got %d %s", recorder.Code, recorder.Body.String())
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a StatsRecord is a single line written by a StatsLogger
+type StatsRecord struct {
+	Time   time.Time `json:"time"`
+	Series string    `json:"series"`
+	// empty for the whole series
+	Window string `json:"window,omitempty"`
+	Count  int    `json:"count"`
+	Median int    `json:"median"`
+	// keyed by percentile, eg: p99
+	Quantiles map[string]int `json:"quantiles"`
+}
+
+// a StatsLogger periodically writes a single line JSON StatsRecord for
+// every registered series and window, eg: to stdout, for container log
+// pipelines which ship stdout to centralized logging.
+type StatsLogger struct {
+	// held while logging, so records from different intervals never
+	// interleave
+	sync.Mutex
+
+	registry  *Registry
+	encoder   *json.Encoder
+	interval  time.Duration
+	windows   []time.Duration
+	quantiles []float64
+
+	quitCh  chan struct{}
+	doneCh  chan struct{}
+	errCh   chan error
+	started int32
+}
+
+// NewStatsLogger creates a logger writing to w every interval. Without
+// any windows, each series is logged in whole; otherwise it is logged over
+// each window, and series which aren't windowed are skipped.
+func NewStatsLogger(registry *Registry, w io.Writer, interval time.Duration, windows ...time.Duration) *StatsLogger {
+	if len(windows) == 0 {
+		windows = []time.Duration{0}
+	}
+
+	return &StatsLogger{
+		registry:  registry,
+		encoder:   json.NewEncoder(w),
+		interval:  interval,
+		windows:   windows,
+		quantiles: defaultSummaryQuantiles,
+		quitCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+		errCh:     make(chan error, errorChannelSize),
+	}
+}
+
+// Log writes a record for every series and window now, returning the
+// last error. The series are snapshotted concurrently, see
+// WithConcurrency.
+func (s *StatsLogger) Log() error {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	taken := s.registry.snapshotWindows(s.windows)
+
+	// the records are written in order, however the snapshots were taken
+	var lastErr error
+	for _, snapshots := range taken {
+		for i, snapshot := range snapshots {
+			if errors.Is(snapshot.Err, errUnsupportedQuery) {
+				continue
+			} else if snapshot.Err != nil {
+				lastErr = snapshot.Err
+				continue
+			}
+
+			if err := s.encoder.Encode(s.record(now, snapshot.Name, s.windows[i], snapshot.Snapshot)); err != nil {
+				lastErr = err
+			}
+		}
+	}
+
+	return lastErr
+}
+
+// snapshots every registered database over each window, or in whole for
+// a zero window, in the order of their names
+func (r *Registry) snapshotWindows(windows []time.Duration) [][]SeriesSnapshot {
+	names := r.Names()
+	taken := make([][]SeriesSnapshot, len(names))
+	r.each(names, func(i int, name string, database Database) {
+		taken[i] = make([]SeriesSnapshot, 0, len(windows))
+		for _, window := range windows {
+			snapshot, err := querySnapshot(name, database, window)
+			taken[i] = append(taken[i], SeriesSnapshot{Name: name, Snapshot: snapshot, Err: err})
+		}
+	})
+
+	return taken
+}
+
+func (s *StatsLogger) record(now time.Time, name string, window time.Duration, snapshot Snapshot) StatsRecord {
+	return newStatsRecord(now, name, window, snapshot, s.quantiles)
+}
+
+func newStatsRecord(now time.Time, name string, window time.Duration, snapshot Snapshot, quantiles []float64) StatsRecord {
+	record := StatsRecord{
+		Time:      now,
+		Series:    name,
+		Count:     snapshot.Count(),
+		Quantiles: make(map[string]int, len(quantiles)),
+	}
+	if window > 0 {
+		record.Window = window.String()
+	}
+	if record.Count > 0 {
+		record.Median = snapshot.GetMedian()
+	}
+
+	for _, quantile := range quantiles {
+		value := 0
+		if record.Count > 0 {
+			value = snapshot.GetPercentile(quantile)
+		}
+		record.Quantiles[quantileName(quantile)] = value
+	}
+
+	return record
+}
+
+// names the quantile as a percentile, eg: p99
+func quantileName(quantile float64) string {
+	return "p" + formatPrometheusFloat(quantile*100)
+}
+
+// Start logs every interval until stopped.
+func (s *StatsLogger) Start() {
+	atomic.StoreInt32(&s.started, 1)
+	go func() {
+		defer close(s.doneCh)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.Log(); err != nil {
+					reportError(s.errCh, err)
+				}
+			case <-s.quitCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops logging, without logging the partial interval.
+func (s *StatsLogger) Stop() {
+	close(s.quitCh)
+	if atomic.LoadInt32(&s.started) == 1 {
+		<-s.doneCh
+	}
+}
+
+// Errors returns a channel of errors from querying series or writing
+// records. Errors are dropped if the channel isn't drained.
+func (s *StatsLogger) Errors() <-chan error {
+	return s.errCh
+}
+
+func init() {
+	commands["stats"] = command{
+		usage: "print a server's registry stats as a JSON line per series, every -interval",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+			server := flags.String("url", "http://localhost:8080", "where the registry handler is served")
+			interval := flags.Duration("interval", 10*time.Second, "how often to print the stats, or 0 to print them once")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+
+			encoder := json.NewEncoder(os.Stdout)
+			for {
+				stats, err := fetchRegistryStats(strings.TrimSuffix(*server, "/") + "/stats")
+				if err != nil {
+					return err
+				}
+
+				now := time.Now()
+				for _, series := range stats.Series {
+					encoder.Encode(struct {
+						Time time.Time `json:"time"`
+						DatabaseStats
+					}{now, series})
+				}
+
+				if *interval <= 0 {
+					return nil
+				}
+				time.Sleep(*interval)
+			}
+		},
+	}
+}
+
+func fetchRegistryStats(url string) (RegistryStats, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return RegistryStats{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return RegistryStats{}, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	stats := RegistryStats{}
+	err = json.NewDecoder(resp.Body).Decode(&stats)
+	return stats, err
+}
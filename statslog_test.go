@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsLogger(t *testing.T) {
+	registry := NewRegistry()
+
+	api := NewMedianDatabase()
+	api.Open()
+	defer api.Close()
+	<-api.BulkWriteAcked(buildBulkMetrics(1, 101))
+	registry.Register("api", api)
+
+	web := newTestWindowedDatabase(time.Minute, time.Hour)
+	web.BulkWrite(buildBulkMetrics(1, 11))
+	registry.Register("web", web)
+
+	// a line per series
+	out := &bytes.Buffer{}
+	if err := NewStatsLogger(registry, out, time.Minute).Log(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line per series, got %q", out.String())
+	}
+
+	record := StatsRecord{}
+	json.Unmarshal([]byte(lines[0]), &record)
+	if record.Series != "api" || record.Count != 100 || record.Median != 50 || record.Quantiles["p99"] != 99 || record.Window != "" {
+		t.Fatalf("unexpected record %s", lines[0])
+	}
+
+	// and per window, for the series which are windowed
+	out.Reset()
+	if err := NewStatsLogger(registry, out, time.Minute, 5*time.Minute, time.Hour).Log(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected a line per window, got %q", out.String())
+	}
+	json.Unmarshal([]byte(lines[1]), &record)
+	if record.Series != "web" || record.Window != "1h0m0s" || record.Count != 10 {
+		t.Fatalf("unexpected record %s", lines[1])
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// a SyncMedianDatabase applies every write before BulkWrite returns, under
+// a mutex, with no worker goroutine or channels, so tests and low volume
+// callers see their writes immediately and deterministically. Queries
+// sort the stored values once per write, so it is slower than a
+// MedianDatabase under a steady stream of interleaved writes and reads.
+type SyncMedianDatabase struct {
+	sync.Mutex
+
+	counts     map[int]int
+	generation uint64
+	closed     bool
+
+	// the stored values as of the last write, built by the first query
+	// after it
+	frozen *FrozenDatabase
+}
+
+func NewSyncMedianDatabase() *SyncMedianDatabase {
+	return &SyncMedianDatabase{
+		counts: make(map[int]int),
+	}
+}
+
+func (s *SyncMedianDatabase) Open() {}
+
+// Close rejects every later write with ErrClosed, the stored values can
+// still be queried.
+func (s *SyncMedianDatabase) Close() {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closed = true
+}
+
+func (s *SyncMedianDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	for _, metric := range bulkMetrics {
+		if metric == nil || metric.Count() < 1 {
+			return fmt.Errorf("bulk metric %v: %w", metric, ErrInvalidMetric)
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+	if len(bulkMetrics) == 0 {
+		return nil
+	}
+
+	for _, metric := range bulkMetrics {
+		s.counts[metric.Value()] += metric.Count()
+	}
+	s.generation++
+	s.frozen = nil
+
+	return nil
+}
+
+// must be called with the lock held
+func (s *SyncMedianDatabase) freeze() *FrozenDatabase {
+	if s.frozen == nil {
+		s.frozen = newSnapshotFromCounts(s.counts, time.Time{}).FrozenDatabase
+	}
+
+	return s.frozen
+}
+
+func (s *SyncMedianDatabase) GetMedian() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.freeze().GetMedian()
+}
+
+func (s *SyncMedianDatabase) GetMedianAndCount() (int64, int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	frozen := s.freeze()
+	return int64(frozen.GetMedian()), int64(frozen.Count())
+}
+
+func (s *SyncMedianDatabase) GetMedianFloat() float64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.freeze().GetMedianFloat()
+}
+
+// Generation returns the number of non-empty writes applied, see
+// MedianDatabase.Generation.
+func (s *SyncMedianDatabase) Generation() uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.generation
+}
+
+// Snapshot returns the stored values, which are never written to again
+// so the snapshot can be shared.
+func (s *SyncMedianDatabase) Snapshot() (Snapshot, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return Snapshot{FrozenDatabase: s.freeze(), Time: time.Now()}, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestSyncMedianDatabase(t *testing.T) {
+	database := NewSyncMedianDatabase()
+	database.Open()
+	if database.GetMedian() != 0 || database.Generation() != 0 {
+		t.Fatalf("expected an empty database, got median %d", database.GetMedian())
+	}
+
+	reference := NewMedianDatabase()
+	reference.Open()
+	defer reference.Close()
+
+	// writes are visible as soon as they return, and agree with the
+	// asynchronous database
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 50; i++ {
+		low := random.Intn(1000)
+		bulkMetrics := buildBulkMetrics(low, low+1+random.Intn(100))
+		if err := database.BulkWrite(bulkMetrics); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		<-reference.BulkWriteAcked(buildBulkMetrics(bulkMetrics[0].Value(), bulkMetrics[len(bulkMetrics)-1].Value()+1))
+
+		median, count := database.GetMedianAndCount()
+		expectedMedian, expectedCount := reference.GetMedianAndCount()
+		if median != expectedMedian || count != expectedCount || database.GetMedianFloat() != reference.GetMedianFloat() {
+			t.Fatalf("expected %d of %d, got %d of %d", expectedMedian, expectedCount, median, count)
+		}
+	}
+	if database.Generation() != 50 {
+		t.Fatalf("expected generation 50, got %d", database.Generation())
+	}
+
+	snapshot, err := database.Snapshot()
+	if err != nil || snapshot.GetMedian() != database.GetMedian() {
+		t.Fatalf("expected a snapshot of the database, got %v", err)
+	}
+
+	if err := database.BulkWrite([]*BulkMetric{nil}); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+
+	database.Close()
+	if err := database.BulkWrite(buildBulkMetrics(0, 1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
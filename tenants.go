@@ -0,0 +1,282 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TenantQuota bounds what one tenant can do through a tenant handler, so
+// that one noisy client can't degrade a service shared by many. Zero
+// values are unlimited.
+type TenantQuota struct {
+	// metrics written per second, with bursts of up to Burst metrics,
+	// which defaults to a second's worth
+	WritesPerSecond float64
+	Burst           int
+
+	// series the tenant can write to, beyond which writes to new series
+	// are refused rather than routed into the overflow series
+	MaxSeries int
+}
+
+type tenant struct {
+	name  string
+	quota TenantQuota
+
+	// the write rate is limited with a token bucket, refilled as it is
+	// taken from
+	tokens  float64
+	updated time.Time
+}
+
+func (t *tenant) burst() float64 {
+	if t.quota.Burst > 0 {
+		return float64(t.quota.Burst)
+	}
+
+	return t.quota.WritesPerSecond
+}
+
+// takes n metrics from the tenant's rate limit, or returns how long until
+// there would be enough
+func (t *tenant) take(n int, now time.Time) (bool, time.Duration) {
+	if t.quota.WritesPerSecond <= 0 {
+		return true, 0
+	}
+
+	if !t.updated.IsZero() {
+		t.tokens += now.Sub(t.updated).Seconds() * t.quota.WritesPerSecond
+	}
+	t.tokens = min(t.tokens, t.burst())
+	t.updated = now
+
+	// like write credits, a write larger than the burst is let through
+	// once the bucket is full, otherwise it could never be written at all
+	needed := min(float64(n), t.burst())
+	if t.tokens < needed {
+		wait := (needed - t.tokens) / t.quota.WritesPerSecond
+		return false, time.Duration(wait * float64(time.Second))
+	}
+
+	t.tokens -= float64(n)
+	return true, 0
+}
+
+// Tenants maps the bearer tokens clients authenticate with to the tenants
+// they write as, and holds each tenant's quota.
+type Tenants struct {
+	sync.Mutex
+
+	tokens map[string]*tenant
+
+	// warns as tenants near their MaxSeries
+	softLimit *softLimiter
+
+	// overridden in tests to control the passing of time
+	now func() time.Time
+}
+
+func NewTenants() *Tenants {
+	return &Tenants{
+		tokens: make(map[string]*tenant),
+		now:    time.Now,
+	}
+}
+
+// Add authenticates requests bearing token as the named tenant. A tenant
+// can have many tokens, which share the quota it was first added with.
+func (t *Tenants) Add(token, name string, quota TenantQuota) error {
+	if token == "" || name == "" {
+		return fmt.Errorf("tenants need a name and a token")
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	if _, ok := t.tokens[token]; ok {
+		return fmt.Errorf("token already belongs to a tenant")
+	}
+
+	for _, existing := range t.tokens {
+		if existing.name == name {
+			t.tokens[token] = existing
+			return nil
+		}
+	}
+
+	t.tokens[token] = &tenant{name: name, quota: quota, tokens: quota.WritesPerSecond}
+	if quota.Burst > 0 {
+		t.tokens[token].tokens = float64(quota.Burst)
+	}
+
+	return nil
+}
+
+// Revoke stops token authenticating its tenant.
+func (t *Tenants) Revoke(token string) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.tokens, token)
+}
+
+// the tenant the request authenticates as, from its Authorization header
+func (t *Tenants) authenticate(r *http.Request) (*tenant, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	found, ok := t.tokens[strings.TrimSpace(token)]
+	return found, ok
+}
+
+func (t *Tenants) take(tenant *tenant, n int) (bool, time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+
+	return tenant.take(n, t.now())
+}
+
+// hands back n metrics taken from the tenant's rate limit by a write which
+// was refused
+func (t *Tenants) refund(tenant *tenant, n int) {
+	t.Lock()
+	defer t.Unlock()
+
+	if tenant.quota.WritesPerSecond > 0 {
+		tenant.tokens = min(tenant.tokens+float64(n), tenant.burst())
+	}
+}
+
+// NewTenantHandler returns an http.Handler serving the series database to
+// authenticated tenants, each of which only sees its own series. Requests
+// must carry an "Authorization: Bearer <token>" header naming a tenant, and
+// are refused with 401 otherwise. The paths are:
+//
+//	POST /write?series=<name>  writes wire format frames to the series
+//	GET /series/<name>/        any path served by NewHandler, for that series,
+//	                           which is only read, so other methods get 405
+//
+// Writes beyond the tenant's quota are refused with 429 and a Retry-After:
+// for the write rate, when the tenant will have enough quota again, and
+// for the series count, when idle series are next expired if they are.
+func NewTenantHandler(series *SeriesDatabase, tenants *Tenants) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "writes must be POSTed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tenant, ok := authenticated(w, r, tenants)
+		if !ok {
+			return
+		}
+
+		key := SeriesKey{Tenant: tenant.name, Name: r.URL.Query().Get("series")}
+		if key.Name == "" {
+			http.Error(w, "writes must name a series, eg: ?series=latency", http.StatusBadRequest)
+			return
+		}
+
+		body, ok := readableBody(w, r)
+		if !ok {
+			return
+		}
+		defer body.Close()
+
+		// every frame is read and validated before the quota is taken or
+		// anything is written, then written as one batch, so the whole
+		// request is refused or accepted and a client retrying it doesn't
+		// double count the frames already written
+		advertiseEncodings(w)
+		frames, count, err := readFrames(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		metrics := make([]*BulkMetric, 0)
+		for _, frame := range frames {
+			metrics = append(metrics, frame.Metrics...)
+		}
+		if len(metrics) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if ok, wait := tenants.take(tenant, count); !ok {
+			w.Header().Set("Retry-After", retryAfterSeconds(wait))
+			http.Error(w, fmt.Sprintf("%d metrics exceed the write rate of tenant %s", count, tenant.name), http.StatusTooManyRequests)
+			return
+		}
+
+		created, err := series.WriteWithin(key, metrics, tenant.quota.MaxSeries)
+		if errors.Is(err, ErrSeriesQuota) {
+			// nothing was written, so the rate quota is handed back
+			tenants.refund(tenant, count)
+			if series.idle > 0 {
+				w.Header().Set("Retry-After", retryAfterSeconds(series.idle/2))
+			}
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if created && tenant.quota.MaxSeries > 0 {
+			tenants.Lock()
+			softLimit := tenants.softLimit
+			tenants.Unlock()
+
+			softLimit.check("series", tenant.name, series.CardinalityStats(tenant.name).Series, tenant.quota.MaxSeries)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("/series/", func(w http.ResponseWriter, r *http.Request) {
+		tenant, ok := authenticated(w, r, tenants)
+		if !ok {
+			return
+		}
+
+		// series are only read here, writes go through /write so they
+		// are held to the tenant's quota
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "series are written through /write", http.StatusMethodNotAllowed)
+			return
+		}
+
+		name, _, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/series/"), "/")
+		database, found := series.Get(SeriesKey{Tenant: tenant.name, Name: name})
+		if !ok || !found {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.StripPrefix("/series/"+name, NewHandler(database)).ServeHTTP(w, r)
+	})
+
+	return mux
+}
+
+// writes a 401 and returns false if the request doesn't authenticate
+func authenticated(w http.ResponseWriter, r *http.Request, tenants *Tenants) (*tenant, bool) {
+	tenant, ok := tenants.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "a valid bearer token is required", http.StatusUnauthorized)
+		return nil, false
+	}
+
+	return tenant, true
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func tenantWrite(t *testing.T, url, token, series string, bulkMetrics []*BulkMetric) *http.Response {
+	request, err := http.NewRequest(http.MethodPost, url+"/write?series="+series, bytes.NewReader(EncodeFrame(Frame{Metrics: bulkMetrics})))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	return resp
+}
+
+func TestTenantHandler(t *testing.T) {
+	clock := newTestClock()
+	tenants := NewTenants()
+	tenants.now = clock.now
+	tenants.Add("noisy-token", "noisy", TenantQuota{WritesPerSecond: 10, Burst: 20, MaxSeries: 2})
+	tenants.Add("quiet-token", "quiet", TenantQuota{})
+
+	database := newTestSeriesDatabase(0)
+	defer database.Close()
+	server := httptest.NewServer(NewTenantHandler(database, tenants))
+	defer server.Close()
+
+	if resp := tenantWrite(t, server.URL, "", "latency", buildBulkMetrics(0, 1)); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a token, got %d", resp.StatusCode)
+	}
+	if resp := tenantWrite(t, server.URL, "unknown", "latency", buildBulkMetrics(0, 1)); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for an unknown token, got %d", resp.StatusCode)
+	}
+
+	// the burst is written, then the rate limit refuses the next write
+	if resp := tenantWrite(t, server.URL, "noisy-token", "latency", buildBulkMetrics(0, 20)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	resp := tenantWrite(t, server.URL, "noisy-token", "latency", buildBulkMetrics(0, 15))
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "2" {
+		t.Fatalf("expected 429 retrying after 2s, got %d after %q", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+
+	// other tenants aren't held up by a noisy one
+	if resp := tenantWrite(t, server.URL, "quiet-token", "latency", buildBulkMetrics(0, 100)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	clock.advance(2 * time.Second)
+	if resp := tenantWrite(t, server.URL, "noisy-token", "errors", buildBulkMetrics(0, 15)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204 once refilled, got %d", resp.StatusCode)
+	}
+
+	// a third series is over the quota, while existing ones can be
+	// written, with the refused write's rate quota handed back
+	clock.advance(10 * time.Second)
+	if resp := tenantWrite(t, server.URL, "noisy-token", "requests", buildBulkMetrics(0, 20)); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the series quota, got %d", resp.StatusCode)
+	}
+	if resp := tenantWrite(t, server.URL, "noisy-token", "latency", buildBulkMetrics(0, 20)); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+
+	if stats := database.CardinalityStats("noisy"); stats.Series != 2 || stats.Overflowed != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// tenants only see their own series
+	request, _ := http.NewRequest(http.MethodGet, server.URL+"/series/errors/median", nil)
+	request.Header.Set("Authorization", "Bearer quiet-token")
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for another tenant's series, got %d", resp.StatusCode)
+	}
+
+	request.Header.Set("Authorization", "Bearer noisy-token")
+	resp, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// a series' own write paths can't be used to skip the quota
+	for _, path := range []string{"/series/latency/write", "/series/latency/sketch"} {
+		request, _ = http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(EncodeFrame(Frame{Metrics: buildBulkMetrics(0, 1000)})))
+		request.Header.Set("Authorization", "Bearer noisy-token")
+		resp, err = http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("expected 405 writing through %s, got %d", path, resp.StatusCode)
+		}
+	}
+}
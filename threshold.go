@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// a ThresholdPoint is the share of the metrics in a single window which
+// were above the threshold, eg: the share of requests slower than their
+// SLO, from which availability is 1 - Fraction
+type ThresholdPoint struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Count    int       `json:"count"`
+	Above    int       `json:"above"`
+	Fraction float64   `json:"fraction"`
+}
+
+// WithThreshold counts the metrics above threshold in each window as they
+// are written, so ThresholdSeries can be answered without scanning them.
+func WithThreshold(threshold int) WindowOption {
+	return func(w *WindowedDatabase) {
+		w.thresholded = true
+		w.threshold = threshold
+	}
+}
+
+// ThresholdSeries returns a point for each window which had metrics written
+// within the last window, oldest first, and rounded out to the resolution
+// like GetWindow. It is empty unless the database was created
+// WithThreshold.
+func (w *WindowedDatabase) ThresholdSeries(window time.Duration) []ThresholdPoint {
+	w.Lock()
+	defer w.Unlock()
+
+	points := make([]ThresholdPoint, 0)
+	if !w.thresholded {
+		return points
+	}
+
+	since := w.reference().Add(-window)
+	for _, bucket := range w.buckets {
+		end := bucket.start.Add(w.resolution)
+		if !end.After(since) || bucket.count == 0 {
+			continue
+		}
+
+		points = append(points, ThresholdPoint{
+			Start:    bucket.start,
+			End:      end,
+			Count:    bucket.count,
+			Above:    bucket.above,
+			Fraction: float64(bucket.above) / float64(bucket.count),
+		})
+	}
+
+	return points
+}
+
+// a ThresholdCount is the number of metrics at or below a threshold
+type ThresholdCount struct {
+	Threshold int   `json:"threshold"`
+	Count     int64 `json:"count"`
+}
+
+// WithThresholds counts the metrics at or below each of the thresholds as
+// they are written, eg: the requests served within 100ms, 500ms and 1s, so
+// Apdex style scores can be taken without exporting the distribution.
+func WithThresholds(thresholds ...int) DatabaseOption {
+	return func(m *MedianDatabase) {
+		m.thresholds = append([]int(nil), thresholds...)
+		sort.Ints(m.thresholds)
+	}
+}
+
+// GetThresholdCounts returns the cumulative count at each threshold, in
+// ascending order, along with the total count from the same write. It is
+// empty unless the database was created WithThresholds.
+func (m *MedianDatabase) GetThresholdCounts() ([]ThresholdCount, int64) {
+	stats := m.stats.Load().(*medianStats)
+
+	counts := make([]ThresholdCount, 0, len(m.thresholds))
+	for i, threshold := range m.thresholds {
+		count := int64(0)
+		if stats.thresholdCounts != nil {
+			count = stats.thresholdCounts[i]
+		}
+		counts = append(counts, ThresholdCount{threshold, count})
+	}
+
+	return counts, stats.count
+}
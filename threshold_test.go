@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestThresholdSeries(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute, WithThreshold(90))
+	database.now = clock.now
+
+	database.BulkWrite(buildBulkMetrics(1, 101))
+	clock.advance(time.Minute)
+	database.BulkWrite(buildBulkMetrics(51, 101))
+
+	points := database.ThresholdSeries(5 * time.Minute)
+	if len(points) != 2 {
+		t.Fatalf("expected a point per window, got %+v", points)
+	}
+	if points[0].Count != 100 || points[0].Above != 10 || points[0].Fraction != 0.1 {
+		t.Fatalf("unexpected first point %+v", points[0])
+	}
+	if points[1].Above != 10 || points[1].Fraction != 0.2 || !points[1].Start.Equal(points[0].End) {
+		t.Fatalf("unexpected second point %+v", points[1])
+	}
+
+	// served as JSON, and only for windowed databases
+	recorder := httptest.NewRecorder()
+	NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/threshold?window=5m", nil))
+	served := []ThresholdPoint{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil || len(served) != 2 || !served[1].Start.Equal(points[1].Start) || served[1].Fraction != 0.2 {
+		t.Fatalf("expected the points to be served, got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	NewHandler(NewMedianDatabase()).ServeHTTP(recorder, httptest.NewRequest("GET", "/threshold?window=1m", nil))
+	if recorder.Code != 501 {
+		t.Fatalf("expected 501 for an unwindowed database, got %d", recorder.Code)
+	}
+
+	if points := newTestWindowedDatabase(time.Minute, time.Hour).ThresholdSeries(time.Hour); len(points) != 0 {
+		t.Fatalf("expected no points without a threshold, got %+v", points)
+	}
+}
+
+func TestThresholdCounts(t *testing.T) {
+	database := NewMedianDatabase(WithThresholds(500, 100, 1000))
+	database.Open()
+	defer database.Close()
+
+	if counts, count := database.GetThresholdCounts(); len(counts) != 3 || counts[0].Count != 0 || count != 0 {
+		t.Fatalf("expected empty counts before any writes, got %+v of %d", counts, count)
+	}
+
+	<-database.BulkWriteAcked(buildBulkMetrics(1, 801))
+	<-database.BulkWriteAcked(buildBulkMetrics(1000, 1200))
+
+	expected := []ThresholdCount{{100, 100}, {500, 500}, {1000, 801}}
+	counts, count := database.GetThresholdCounts()
+	if count != 1000 || len(counts) != len(expected) {
+		t.Fatalf("unexpected counts %+v of %d", counts, count)
+	}
+	for i := range expected {
+		if counts[i] != expected[i] {
+			t.Fatalf("expected %+v, got %+v", expected[i], counts[i])
+		}
+	}
+
+	if counts, _ := NewMedianDatabase().GetThresholdCounts(); len(counts) != 0 {
+		t.Fatalf("expected no counts without thresholds, got %+v", counts)
+	}
+}
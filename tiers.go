@@ -0,0 +1,71 @@
+package main
+
+import (
+	"time"
+)
+
+// the tiers a range can be answered from: the hot tier is the buckets
+// still in the retention, and the cold tier the downsampled summaries of
+// older buckets
+const (
+	HotTier  = "hot"
+	ColdTier = "cold"
+)
+
+// a RangeSummary summarizes every metric written within a range, along
+// with the tiers which held them. Only ranges answered from the hot tier
+// alone are exact; the cold tier only keeps a few percentiles of each
+// interval, so percentiles merged from it are estimates.
+type RangeSummary struct {
+	WindowSummary
+	Tiers []string `json:"tiers"`
+}
+
+// adds the summary to counts as a distribution with the same median, p90
+// and p99, so that merging a single summary gives it back exactly
+func (s WindowSummary) estimate(counts map[int]int) {
+	// the median is both middle ranks when the count is even
+	median := min(s.Count/2+1, s.Count)
+	p90 := max(nearestRank(0.9, s.Count), median)
+	counts[s.Median] += median
+	counts[s.P90] += p90 - median
+	counts[s.P99] += s.Count - p90
+}
+
+// Range summarizes the metrics written between since and until, merging
+// the buckets still in the retention with the downsampled summaries of
+// any older intervals the range covers, so callers don't need to know
+// which tier holds which part of it. Like Summaries, the range is rounded
+// out to the resolution of each tier it covers.
+func (w *WindowedDatabase) Range(since, until time.Time) RangeSummary {
+	w.Lock()
+	defer w.Unlock()
+
+	counts := make(map[int]int)
+	tiers := make([]string, 0, 2)
+	if w.downsampled != nil {
+		for _, summary := range w.downsampled.since(since) {
+			if !summary.Start.Before(until) || summary.Count == 0 {
+				continue
+			}
+
+			summary.estimate(counts)
+			if len(tiers) == 0 {
+				tiers = append(tiers, ColdTier)
+			}
+		}
+	}
+
+	hot := w.between(since, until, until)
+	for _, metric := range hot.metrics() {
+		counts[metric.Value()] += metric.Count()
+	}
+	if hot.Count() > 0 {
+		tiers = append(tiers, HotTier)
+	}
+
+	return RangeSummary{
+		WindowSummary: summarize(since, until, counts),
+		Tiers:         tiers,
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRangeAcrossTiers(t *testing.T) {
+	clock := newTestClock()
+	clock.advance(3 * time.Minute)
+	start := clock.now()
+
+	database := newTestWindowedDatabase(time.Minute, 5*time.Minute, WithDownsampling(5*time.Minute, time.Hour))
+	database.now = clock.now
+	for i := 0; i < 15; i++ {
+		database.BulkWrite([]*BulkMetric{{value: i, count: 10}})
+		if i < 14 {
+			clock.advance(time.Minute)
+		}
+	}
+
+	// a single summary is given back exactly
+	cold := database.Range(start, start.Add(5*time.Minute))
+	if len(cold.Tiers) != 1 || cold.Tiers[0] != ColdTier || cold.Count != 50 || cold.Median != 2 || cold.P90 != 4 || cold.P99 != 4 {
+		t.Fatalf("unexpected cold range %+v", cold)
+	}
+
+	hot := database.Range(start.Add(10*time.Minute), clock.now())
+	if len(hot.Tiers) != 1 || hot.Tiers[0] != HotTier || hot.Count != 50 || hot.Median != 12 {
+		t.Fatalf("unexpected hot range %+v", hot)
+	}
+
+	// percentiles merged from the cold tier are estimates, of the exact 7
+	both := database.Range(start, clock.now())
+	if len(both.Tiers) != 2 || both.Count != 150 || both.Median < 6 || both.Median > 8 || both.P99 != 14 {
+		t.Fatalf("unexpected range across tiers %+v", both)
+	}
+
+	if empty := database.Range(start.Add(-time.Hour), start.Add(-30*time.Minute)); len(empty.Tiers) != 0 || empty.Count != 0 {
+		t.Fatalf("expected an empty range, got %+v", empty)
+	}
+
+	recorder := httptest.NewRecorder()
+	NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/range?since="+start.Format(time.RFC3339)+"&until="+clock.now().Format(time.RFC3339), nil))
+	served := RangeSummary{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &served); err != nil || served.Count != 150 || len(served.Tiers) != 2 {
+		t.Fatalf("expected the range to be served, got %s", recorder.Body.String())
+	}
+
+	recorder = httptest.NewRecorder()
+	NewHandler(database).ServeHTTP(recorder, httptest.NewRequest("GET", "/range?since=yesterday", nil))
+	if recorder.Code != 400 {
+		t.Fatalf("expected 400 for an invalid since, got %d", recorder.Code)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// a topRow is a single series as shown by the top command
+type topRow struct {
+	DatabaseStats
+
+	// metrics per second since the last refresh, or negative before
+	// there has been one
+	Rate float64
+	P90  int
+	P99  int
+}
+
+// builds a row per series from the latest stats, the stats of the last
+// refresh, and the p90 and p99 of each series
+func topRows(stats, last RegistryStats, elapsed time.Duration, results []BatchResult) []topRow {
+	counts := make(map[string]int64, len(last.Series))
+	for _, series := range last.Series {
+		counts[series.Name] = series.Count
+	}
+
+	quantiles := make(map[string]QueryResult, len(results))
+	for _, result := range results {
+		quantiles[result.Query] = result.QueryResult
+	}
+
+	rows := make([]topRow, 0, len(stats.Series))
+	for _, series := range stats.Series {
+		row := topRow{DatabaseStats: series, Rate: -1}
+		if count, ok := counts[series.Name]; ok && elapsed > 0 && series.Count >= count {
+			row.Rate = float64(series.Count-count) / elapsed.Seconds()
+		}
+		for _, quantile := range quantiles[series.Name].Quantiles {
+			switch quantile.Quantile {
+			case 0.9:
+				row.P90 = quantile.Value
+			case 0.99:
+				row.P99 = quantile.Value
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return rows
+}
+
+// sorts the rows by a column, busiest first, or by name
+func sortTopRows(rows []topRow, by string) error {
+	less := map[string]func(a, b topRow) bool{
+		"name":    func(a, b topRow) bool { return a.Name < b.Name },
+		"rate":    func(a, b topRow) bool { return a.Rate > b.Rate },
+		"count":   func(a, b topRow) bool { return a.Count > b.Count },
+		"median":  func(a, b topRow) bool { return a.Median > b.Median },
+		"p99":     func(a, b topRow) bool { return a.P99 > b.P99 },
+		"backlog": func(a, b topRow) bool { return a.PendingFlushes > b.PendingFlushes },
+	}[by]
+	if less == nil {
+		return fmt.Errorf("can't sort by %q, expected name, rate, count, median, p99 or backlog", by)
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool { return less(rows[i], rows[j]) })
+	return nil
+}
+
+// renders a screen of at most limit rows, or every row if limit is zero
+func renderTop(w io.Writer, server string, at time.Time, stats RegistryStats, rows []topRow, limit int) {
+	fmt.Fprintf(w, "%s  %s  %d series  %d metrics\n\n", server, at.Format(time.TimeOnly), stats.Databases, stats.Count)
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "SERIES\tCOUNT\tRATE/S\tMEDIAN\tP90\tP99\tBACKLOG\t")
+	for i, row := range rows {
+		if limit > 0 && i == limit {
+			break
+		}
+
+		rate := "-"
+		if row.Rate >= 0 {
+			rate = fmt.Sprintf("%.1f", row.Rate)
+		}
+		fmt.Fprintf(table, "%s\t%d\t%s\t%d\t%d\t%d\t%d\t\n", row.Name, row.Count, rate, row.Median, row.P90, row.P99, row.PendingFlushes)
+	}
+	table.Flush()
+
+	if limit > 0 && len(rows) > limit {
+		fmt.Fprintf(w, "... %d more series\n", len(rows)-limit)
+	}
+}
+
+// queries the p90 and p99 of every series in a single batch
+func fetchTopQuantiles(server string, stats RegistryStats) ([]BatchResult, error) {
+	batch := make([]batchQuery, 0, len(stats.Series))
+	for _, series := range stats.Series {
+		batch = append(batch, batchQuery{Series: series.Name, Quantiles: "p90,p99"})
+	}
+	body, _ := json.Marshal(batch)
+
+	resp, err := http.Post(server+"/query/batch", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	results := []BatchResult{}
+	err = json.NewDecoder(resp.Body).Decode(&results)
+	return results, err
+}
+
+func init() {
+	commands["top"] = command{
+		usage: "live display a server's series, their percentiles, ingest rates and backlogs",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("top", flag.ContinueOnError)
+			server := flags.String("url", "http://localhost:8080", "where the registry handler is served")
+			interval := flags.Duration("interval", 2*time.Second, "how often to refresh")
+			by := flags.String("sort", "rate", "the column to sort by: name, rate, count, median, p99 or backlog")
+			limit := flags.Int("n", 20, "the most series to show, or 0 for all of them")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+			if err := sortTopRows(nil, *by); err != nil {
+				return err
+			}
+
+			base := strings.TrimSuffix(*server, "/")
+			last, lastAt := RegistryStats{}, time.Time{}
+			for {
+				stats, err := fetchRegistryStats(base + "/stats")
+				if err != nil {
+					return err
+				}
+				at := time.Now()
+
+				// series which don't support snapshots just go without
+				// percentiles
+				results, _ := fetchTopQuantiles(base, stats)
+
+				elapsed := time.Duration(0)
+				if !lastAt.IsZero() {
+					elapsed = at.Sub(lastAt)
+				}
+				rows := topRows(stats, last, elapsed, results)
+				sortTopRows(rows, *by)
+
+				screen := &bytes.Buffer{}
+				// home the cursor and clear the screen
+				screen.WriteString("\x1b[H\x1b[2J")
+				renderTop(screen, base, at, stats, rows, *limit)
+				screen.WriteTo(os.Stdout)
+
+				last, lastAt = stats, at
+				time.Sleep(*interval)
+			}
+		},
+	}
+}
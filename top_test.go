@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTop(t *testing.T) {
+	registry := NewRegistry()
+	api, batch := NewSyncMedianDatabase(), NewSyncMedianDatabase()
+	registry.Register("api.latency", api)
+	registry.Register("batch.latency", batch)
+	api.BulkWrite(buildBulkMetrics(0, 100))
+	batch.BulkWrite(buildBulkMetrics(0, 10))
+
+	worker := NewBufferedWorker(10, time.Hour, api)
+	if err := registry.AttachWorker("api.latency", worker); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := registry.AttachWorker("missing", worker); err == nil {
+		t.Fatalf("expected attaching to an unregistered series to fail")
+	}
+
+	server := httptest.NewServer(NewRegistryHandler(registry))
+	defer server.Close()
+
+	last, err := fetchRegistryStats(server.URL + "/stats")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	batch.BulkWrite(buildBulkMetrics(0, 20))
+	stats, _ := fetchRegistryStats(server.URL + "/stats")
+	results, err := fetchTopQuantiles(server.URL, stats)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rows := topRows(stats, last, 2*time.Second, results)
+	if err := sortTopRows(rows, "rate"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rows[0].Name != "batch.latency" || rows[0].Rate != 10 || rows[1].Rate != 0 || rows[1].P99 != 98 {
+		t.Fatalf("unexpected rows %+v", rows)
+	}
+
+	screen := &strings.Builder{}
+	renderTop(screen, server.URL, time.Now(), stats, rows, 1)
+	lines := strings.Split(screen.String(), "\n")
+	if !strings.Contains(lines[0], "2 series  130 metrics") || !strings.HasPrefix(lines[2], "SERIES") || !strings.Contains(lines[3], "batch.latency") || lines[4] != "... 1 more series" {
+		t.Fatalf("unexpected screen\n%s", screen)
+	}
+
+	if err := sortTopRows(rows, "latency"); err == nil {
+		t.Fatalf("expected an unknown column to be rejected")
+	}
+}
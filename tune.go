@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"time"
+)
+
+// the batch sizes Tune benchmarks, which are the candidate buffer sizes
+var tuneBufferSizes = []int{100, 1000, 10000}
+
+const (
+	// shards are sized to run at half of their measured capacity
+	tuneHeadroom = 2
+
+	minTunedFlushInterval = 10 * time.Millisecond
+	maxTunedFlushInterval = 10 * time.Second
+)
+
+// a Config is a recommended setup for an ingest pipeline: the buffered
+// worker settings, and how many databases to shard the stream across
+type Config struct {
+	BufferSize    int
+	FlushInterval time.Duration
+	Shards        int
+
+	// the metrics per second a single database applied at the
+	// recommended buffer size, measured on this machine
+	MeasuredRate float64
+}
+
+// the flush interval is written as a duration string, eg: "250ms", so
+// that configs can be read and edited by hand
+type configJSON struct {
+	BufferSize    int     `json:"buffer_size"`
+	FlushInterval string  `json:"flush_interval"`
+	Shards        int     `json:"shards"`
+	MeasuredRate  float64 `json:"measured_rate,omitempty"`
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(configJSON{
+		BufferSize:    c.BufferSize,
+		FlushInterval: c.FlushInterval.String(),
+		Shards:        c.Shards,
+		MeasuredRate:  c.MeasuredRate,
+	})
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	decoded := configJSON{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return err
+	}
+
+	flushInterval, err := time.ParseDuration(decoded.FlushInterval)
+	if err != nil {
+		return fmt.Errorf("flush_interval: %w", err)
+	}
+
+	*c = Config{
+		BufferSize:    decoded.BufferSize,
+		FlushInterval: flushInterval,
+		Shards:        decoded.Shards,
+		MeasuredRate:  decoded.MeasuredRate,
+	}
+	return nil
+}
+
+// Tune runs a short benchmark of this machine, spending about budget on
+// it, and recommends a Config for ingesting targetRate metrics per second.
+// Each candidate buffer size is written to a fresh database as batches of
+// random values, and the size with the best throughput is chosen. Shards
+// are added until each runs at half of the measured throughput, and the
+// flush interval is the time a shard takes to fill its buffer.
+func Tune(targetRate int, budget time.Duration) Config {
+	config := Config{}
+	perSize := budget / time.Duration(len(tuneBufferSizes))
+
+	for _, bufferSize := range tuneBufferSizes {
+		if rate := measureApplyRate(bufferSize, perSize); rate > config.MeasuredRate {
+			config.BufferSize = bufferSize
+			config.MeasuredRate = rate
+		}
+	}
+
+	config.Shards = int(math.Ceil(float64(targetRate) * tuneHeadroom / config.MeasuredRate))
+	if config.Shards < 1 {
+		config.Shards = 1
+	}
+
+	perShard := float64(targetRate) / float64(config.Shards)
+	config.FlushInterval = maxTunedFlushInterval
+	if perShard > 0 {
+		config.FlushInterval = time.Duration(float64(config.BufferSize) / perShard * float64(time.Second))
+	}
+	if config.FlushInterval < minTunedFlushInterval {
+		config.FlushInterval = minTunedFlushInterval
+	} else if config.FlushInterval > maxTunedFlushInterval {
+		config.FlushInterval = maxTunedFlushInterval
+	}
+
+	return config
+}
+
+// returns the metrics per second a database applies in batches of size
+func measureApplyRate(size int, duration time.Duration) float64 {
+	database := NewMedianDatabase(WithHistorySize(0))
+	database.Open()
+	defer database.Close()
+
+	random := rand.New(rand.NewSource(1))
+	batch := func() []*BulkMetric {
+		metrics := make([]*BulkMetric, 0, size)
+		for i := 0; i < size; i++ {
+			metrics = append(metrics, NewBulkMetric(random.Intn(100000)))
+		}
+		return metrics
+	}
+
+	applied := 0
+	start := time.Now()
+	for applied == 0 || time.Since(start) < duration {
+		if err := <-database.BulkWriteAcked(batch()); err != nil {
+			break
+		}
+		applied += size
+	}
+
+	return float64(applied) / time.Since(start).Seconds()
+}
+
+func init() {
+	commands["tune"] = command{
+		usage: "benchmark this machine and recommend a config for an ingest rate",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("tune", flag.ContinueOnError)
+			rate := flags.Int("rate", 100000, "the target ingest rate, in metrics per second")
+			budget := flags.Duration("budget", 3*time.Second, "how long to spend benchmarking")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+			if *rate < 1 {
+				return fmt.Errorf("invalid rate %d", *rate)
+			}
+
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(Tune(*rate, *budget))
+		},
+	}
+}
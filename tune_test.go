@@ -0,0 +1,37 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTune(t *testing.T) {
+	config := Tune(1000000, 150*time.Millisecond)
+
+	if config.MeasuredRate <= 0 || config.BufferSize == 0 {
+		t.Fatalf("expected a measured rate and buffer size, got %+v", config)
+	}
+	if config.FlushInterval < minTunedFlushInterval || config.FlushInterval > maxTunedFlushInterval {
+		t.Fatalf("unexpected flush interval %v", config.FlushInterval)
+	}
+
+	// enough shards that each runs with the headroom
+	if perShard := 1000000 / float64(config.Shards); perShard*tuneHeadroom > config.MeasuredRate*1.01 {
+		t.Fatalf("expected %d shards to have headroom at %v per second each", config.Shards, config.MeasuredRate)
+	}
+}
+
+func TestConfigJSON(t *testing.T) {
+	config := Config{BufferSize: 1000, FlushInterval: 250 * time.Millisecond, Shards: 4}
+
+	encoded, _ := json.Marshal(config)
+	if string(encoded) != `{"buffer_size":1000,"flush_interval":"250ms","shards":4}` {
+		t.Fatalf("unexpected json %s", encoded)
+	}
+
+	var decoded Config
+	if err := json.Unmarshal(encoded, &decoded); err != nil || decoded != config {
+		t.Fatalf("expected %+v, got %+v (%v)", config, decoded, err)
+	}
+}
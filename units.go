@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the size of each step up for byte and count units
+var (
+	byteUnits  = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	countUnits = []string{"", "k", "M", "G", "T", "P"}
+)
+
+// nanoseconds per time unit
+var timeUnits = map[string]float64{
+	"ns": 1,
+	"us": 1e3,
+	"µs": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+}
+
+// FormatValue renders a value for people, scaled according to its unit,
+// eg: 412 in ms is "412ms", 1500 in ms is "1.5s" and 2048 in bytes is
+// "2KiB". Time units are ns, us, ms and s, bytes are B or bytes, and
+// counts are count. Values in any other unit are printed as is, followed
+// by the unit.
+func FormatValue(value float64, unit string) string {
+	if nanos, ok := timeUnits[unit]; ok {
+		return formatDuration(value * nanos)
+	}
+
+	switch unit {
+	case "B", "bytes":
+		return formatScaled(value, 1024, byteUnits)
+	case "count":
+		return formatScaled(value, 1000, countUnits)
+	case "":
+		return formatNumber(value)
+	}
+
+	return formatNumber(value) + " " + unit
+}
+
+func formatDuration(nanos float64) string {
+	switch abs := math.Abs(nanos); {
+	case abs < 1e3:
+		return formatNumber(nanos) + "ns"
+	case abs < 1e6:
+		return formatNumber(nanos/1e3) + "µs"
+	case abs < 1e9:
+		return formatNumber(nanos/1e6) + "ms"
+	case abs < 60e9:
+		return formatNumber(nanos/1e9) + "s"
+	}
+
+	// minutes and up read best the way time.Duration prints them
+	return time.Duration(nanos).Round(time.Second).String()
+}
+
+func formatScaled(value, step float64, units []string) string {
+	i := 0
+	for math.Abs(value) >= step && i < len(units)-1 {
+		value = value / step
+		i++
+	}
+
+	return formatNumber(value) + units[i]
+}
+
+// renders the value with at most two decimal places, and none if they
+// are zero
+func formatNumber(value float64) string {
+	if value == math.Trunc(value) && math.Abs(value) < 1e15 {
+		return strconv.FormatInt(int64(value), 10)
+	}
+
+	formatted := fmt.Sprintf("%.2f", value)
+	return strings.TrimRight(strings.TrimRight(formatted, "0"), ".")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatValue(t *testing.T) {
+	for _, test := range []struct {
+		value    float64
+		unit     string
+		expected string
+	}{
+		{412, "ms", "412ms"},
+		{1500, "ms", "1.5s"},
+		{0.25, "ms", "250µs"},
+		{90000, "ms", "1m30s"},
+		{1234, "us", "1.23ms"},
+		{12, "ns", "12ns"},
+		{2048, "bytes", "2KiB"},
+		{1536 * 1024, "B", "1.5MiB"},
+		{999, "count", "999"},
+		{12345, "count", "12.35k"},
+		{42, "", "42"},
+		{4.5, "", "4.5"},
+		{3, "req", "3 req"},
+	} {
+		if formatted := FormatValue(test.value, test.unit); formatted != test.expected {
+			t.Fatalf("expected %v %s to format as %q, got %q", test.value, test.unit, test.expected, formatted)
+		}
+	}
+}
+
+func TestReportFormat(t *testing.T) {
+	report := Snapshot{FrozenDatabase: newFrozenDatabase(buildBulkMetrics(1000, 2001), nil)}.Report()
+
+	if report.Format("") != report.String() {
+		t.Fatalf("expected a report without a unit to format like String")
+	}
+	if formatted := report.Format("ms"); !strings.Contains(formatted, "max   2s\n") || !strings.Contains(formatted, "mean  1.5s\n") {
+		t.Fatalf("unexpected report:\n%s", formatted)
+	}
+
+	result := QueryResult{
+		Series:    []string{"a", "b"},
+		Count:     10,
+		Quantiles: []QuantileValue{{0.99, 412}},
+		Metadata:  map[string]SeriesMetadata{"a": {Unit: "ms"}, "b": {Unit: "ms"}},
+	}
+	if result.String() != "count = 10\np99 = 412ms\n" {
+		t.Fatalf("unexpected result:\n%s", result)
+	}
+
+	// series in different units can't share one
+	result.Metadata["b"] = SeriesMetadata{Unit: "s"}
+	if result.String() != "count = 10\np99 = 412\n" {
+		t.Fatalf("unexpected result:\n%s", result)
+	}
+}
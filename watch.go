@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+)
+
+// how a stream of values is summarized by the watch command
+type watchOptions struct {
+	name      string
+	quantiles []float64
+	format    string
+
+	// a stats line is emitted every interval, and every lines values,
+	// where either can be zero, as well as once the stream ends
+	interval time.Duration
+	lines    int
+
+	// only summarize the values since the last stats line, rather than
+	// every value seen
+	reset bool
+
+	// the 1-indexed, whitespace separated field of each line holding its
+	// value, or zero for the whole line
+	field int
+}
+
+// watch reads a value per line from r until it ends, writing a stats line
+// to w as the options say, eg: so `tail -f` can be piped through it.
+// Lines which don't hold a value are skipped and counted.
+func watch(r io.Reader, w io.Writer, options watchOptions) error {
+	lines := make(chan string, 1024)
+	readErr := make(chan error, 1)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		readErr <- scanner.Err()
+		close(lines)
+	}()
+
+	var ticks <-chan time.Time
+	if options.interval > 0 {
+		ticker := time.NewTicker(options.interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+
+	encoder := json.NewEncoder(w)
+	database := NewSyncMedianDatabase()
+	pending, skipped, emitted := 0, 0, false
+	emit := func() error {
+		snapshot, _ := database.Snapshot()
+		record := newStatsRecord(time.Now(), options.name, 0, snapshot, options.quantiles)
+
+		var err error
+		if options.format == "json" {
+			err = encoder.Encode(struct {
+				StatsRecord
+				Skipped int `json:"skipped,omitempty"`
+			}{record, skipped})
+		} else {
+			_, err = fmt.Fprintln(w, formatWatchLine(record, options.quantiles, skipped))
+		}
+
+		if options.reset {
+			database = NewSyncMedianDatabase()
+		}
+		pending, emitted = 0, true
+		return err
+	}
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				if pending > 0 || !emitted {
+					if err := emit(); err != nil {
+						return err
+					}
+				}
+				return <-readErr
+			}
+
+			value, err := parseWatchLine(line, options.field)
+			if err != nil {
+				skipped++
+				continue
+			}
+			database.BulkWrite([]*BulkMetric{NewBulkMetric(value)})
+
+			if pending++; options.lines > 0 && pending >= options.lines {
+				if err := emit(); err != nil {
+					return err
+				}
+			}
+		case <-ticks:
+			if err := emit(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// returns the line's value, rounded to the nearest integer
+func parseWatchLine(line string, field int) (int, error) {
+	if field > 0 {
+		fields := strings.Fields(line)
+		if len(fields) < field {
+			return 0, fmt.Errorf("line %q has no field %d", line, field)
+		}
+		line = fields[field-1]
+	}
+
+	value, _, err := parseObservation(line, "")
+	if err != nil {
+		return 0, err
+	}
+
+	return int(math.Round(value)), nil
+}
+
+// renders the record on one line, eg:
+//
+//	2024-03-01T12:00:00Z count=1200 median=38 p50=38 p90=120 p99=412
+func formatWatchLine(record StatsRecord, quantiles []float64, skipped int) string {
+	fields := []string{record.Time.UTC().Format(time.RFC3339), fmt.Sprintf("count=%d", record.Count), fmt.Sprintf("median=%d", record.Median)}
+	for _, quantile := range quantiles {
+		fields = append(fields, fmt.Sprintf("%s=%d", quantileName(quantile), record.Quantiles[quantileName(quantile)]))
+	}
+	if skipped > 0 {
+		fields = append(fields, fmt.Sprintf("skipped=%d", skipped))
+	}
+
+	return strings.Join(fields, " ")
+}
+
+func init() {
+	commands["watch"] = command{
+		usage: "summarize a value per line of stdin, every -interval or -lines, eg: tail -f | watch",
+		run: func(args []string) error {
+			flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+			name := flags.String("name", "stdin", "the series name in json stats lines")
+			interval := flags.Duration("interval", 10*time.Second, "how often to print a stats line, or 0 to only print them every -lines and at the end")
+			lines := flags.Int("lines", 0, "print a stats line every this many values, or 0 to only print them every -interval and at the end")
+			reset := flags.Bool("reset", false, "summarize only the values since the last stats line")
+			field := flags.Int("field", 0, "the whitespace separated field holding the value, counting from 1, or 0 for the whole line")
+			quantiles := flags.String("quantiles", "p50,p90,p99", "the quantiles to print")
+			format := flags.String("format", "text", "text or json")
+			if err := flags.Parse(args); err != nil {
+				return err
+			}
+
+			options := watchOptions{name: *name, format: *format, interval: *interval, lines: *lines, reset: *reset, field: *field}
+			if *format != "text" && *format != "json" {
+				return fmt.Errorf("format %q: must be text or json", *format)
+			}
+			for _, quantile := range strings.Split(*quantiles, ",") {
+				parsed, err := parseQuantile(strings.TrimSpace(quantile))
+				if err != nil {
+					return err
+				}
+				options.quantiles = append(options.quantiles, parsed)
+			}
+
+			return watch(os.Stdin, os.Stdout, options)
+		},
+	}
+}
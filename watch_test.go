@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatch(t *testing.T) {
+	input := strings.NewReader("1\n2\n3\nnot a number\n4\n5.6\n\n-2\n7\n")
+	output := new(bytes.Buffer)
+	options := watchOptions{name: "stdin", quantiles: []float64{0.5, 0.99}, lines: 3}
+	if err := watch(input, output, options); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected a stats line every 3 values and one at the end, got %q", lines)
+	}
+	if !strings.HasSuffix(lines[0], " count=3 median=2 p50=2 p99=3") {
+		t.Fatalf("unexpected first line %q", lines[0])
+	}
+	// the stats are of every value seen so far, and the leftover value
+	// gets a line of its own at the end
+	if !strings.HasSuffix(lines[1], " count=6 median=2 p50=2 p99=6 skipped=2") {
+		t.Fatalf("unexpected second line %q", lines[1])
+	}
+	if !strings.HasSuffix(lines[2], " count=7 median=3 p50=3 p99=7 skipped=2") {
+		t.Fatalf("unexpected last line %q", lines[2])
+	}
+}
+
+func TestWatchReset(t *testing.T) {
+	input := strings.NewReader("latency 10 ms\nlatency 20 ms\nlatency 30 ms\nlatency 1000 ms\n")
+	output := new(bytes.Buffer)
+	options := watchOptions{name: "api", quantiles: []float64{0.5}, lines: 2, reset: true, field: 2, format: "json"}
+	if err := watch(input, output, options); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	records := []StatsRecord{}
+	decoder := json.NewDecoder(output)
+	for {
+		record := StatsRecord{}
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		records = append(records, record)
+	}
+
+	// nothing was left over for a stats line at the end
+	if len(records) != 2 || records[0].Series != "api" || records[0].Quantiles["p50"] != 10 || records[1].Count != 2 || records[1].Quantiles["p50"] != 30 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+}
+
+// a buffer which can be read while it is being written
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(data []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.buf.Write(data)
+}
+
+func (l *lockedBuffer) String() string {
+	l.Lock()
+	defer l.Unlock()
+	return l.buf.String()
+}
+
+func TestWatchInterval(t *testing.T) {
+	reader, writer := io.Pipe()
+	output := &lockedBuffer{}
+	done := make(chan error)
+	go func() {
+		done <- watch(reader, output, watchOptions{quantiles: []float64{0.5}, interval: 10 * time.Millisecond})
+	}()
+
+	// stats lines are printed while the stream is still open
+	io.WriteString(writer, "5\n")
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(output.String(), "count=1 ") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !strings.Contains(output.String(), "count=1 median=5 p50=5") {
+		t.Fatalf("expected a stats line before the stream ended, got %q", output.String())
+	}
+
+	writer.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
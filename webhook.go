@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// an Alert is the payload delivered to webhooks when an alert condition
+// fires, eg: a median crossing a threshold
+type Alert struct {
+	Series    string    `json:"series"`
+	Median    int       `json:"median"`
+	Window    string    `json:"window"`
+	Condition string    `json:"condition"`
+	Time      time.Time `json:"time"`
+}
+
+type AlertSink interface {
+	Notify(Alert) error
+}
+
+// a WebhookSink POSTs alerts as JSON to each of its configured URLs,
+// retrying failed deliveries with an exponential backoff.
+type WebhookSink struct {
+	urls    []string
+	retries int
+	backoff time.Duration
+	client  *http.Client
+}
+
+func NewWebhookSink(retries int, backoff time.Duration, urls ...string) *WebhookSink {
+	return &WebhookSink{
+		urls:    urls,
+		retries: retries,
+		backoff: backoff,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Notify delivers the alert to every URL, returning the last delivery
+// error if any URL could not be reached after all retries.
+func (w *WebhookSink) Notify(alert Alert) error {
+	return w.send(alert)
+}
+
+// EmitBands delivers quantile bands like Notify delivers alerts.
+func (w *WebhookSink) EmitBands(bands Bands) error {
+	return w.send(bands)
+}
+
+func (w *WebhookSink) send(payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, url := range w.urls {
+		if err := w.deliver(url, body); err != nil {
+			lastErr = err
+		}
+	}
+
+	return lastErr
+}
+
+func (w *WebhookSink) deliver(url string, body []byte) error {
+	var err error
+	backoff := w.backoff
+
+	for attempt := 0; attempt <= w.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff = backoff * 2
+		}
+
+		err = w.post(url, body)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("webhook %s failed after %d attempts: %v", url, w.retries+1, err)
+}
+
+func (w *WebhookSink) post(url string, body []byte) error {
+	resp, err := w.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWebhookSinkRetries(t *testing.T) {
+	attempts := 0
+	received := make(chan Alert, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts += 1
+		// fail the first delivery so that the sink has to retry
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var alert Alert
+		if err := json.NewDecoder(r.Body).Decode(&alert); err != nil {
+			t.Errorf("unable to decode alert: %v", err)
+		}
+		received <- alert
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(2, time.Millisecond, server.URL)
+	if err := sink.Notify(Alert{Series: "api.latency", Median: 412, Condition: "median > 400"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	alert := <-received
+	if alert.Series != "api.latency" || alert.Median != 412 {
+		t.Fatalf("unexpected alert %+v", alert)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 attempts, got %d", attempts)
+	}
+}
+
+func TestWebhookSinkGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	sink := NewWebhookSink(1, time.Millisecond, server.URL)
+	if err := sink.Notify(Alert{}); err == nil {
+		t.Fatalf("expected an error after exhausting retries")
+	}
+}
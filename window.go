@@ -0,0 +1,479 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// a windowBucket holds every metric written during [start, start+resolution)
+type windowBucket struct {
+	start  time.Time
+	counts map[int]int
+	count  int
+
+	// the metrics above the threshold, if one is configured
+	above int
+
+	// whether the watermark has passed the end of the bucket
+	finalized bool
+
+	// built by rank queries, see bucketIndex
+	index *bucketIndex
+
+	// the writes kept as written, see WithRawSamples
+	samples        []RawSample
+	samplesDropped int
+}
+
+// a WindowedDatabase keeps metrics in time ordered buckets so that queries
+// can be answered over any recent window, eg: the p99 over the last five
+// minutes. Buckets older than the retention are discarded. Writes are
+// applied synchronously, so Open and Close don't start or stop anything.
+type WindowedDatabase struct {
+	sync.Mutex
+
+	resolution time.Duration
+	retention  time.Duration
+	buckets    []*windowBucket
+	closed     bool
+
+	lateness         time.Duration
+	latePolicy       LatePolicy
+	onLateCorrection func(WindowRollup)
+	lateStats        LatenessStats
+
+	// set when timestamps too far ahead of the clock are corrected
+	skewed        bool
+	skewTolerance time.Duration
+	skewPolicy    SkewPolicy
+	skewStats     SkewStats
+
+	// set when time is taken from the metrics rather than the clock
+	eventTime   bool
+	maxObserved time.Time
+	onFinalize  func(WindowRollup)
+
+	// set when the fraction of metrics above a threshold is tracked
+	thresholded bool
+	threshold   int
+
+	// set when expired buckets are kept as summaries
+	downsampled *downsampler
+
+	// the most samples kept for the latest window, see WithRawSamples
+	rawSamples int
+
+	// overridden in tests to control the passing of time
+	now func() time.Time
+}
+
+// a LatePolicy decides what happens to timestamped metrics which arrive
+// after their window has closed
+type LatePolicy int
+
+const (
+	// late metrics are dropped and counted
+	DropLate LatePolicy = iota
+	// late metrics are applied to their window retroactively, and the
+	// corrected window is passed to the correction callback
+	ApplyLate
+)
+
+type LatenessStats struct {
+	// late metrics which were applied retroactively
+	Applied uint64
+	// late metrics which were dropped, including any which were older
+	// than the retention regardless of the policy
+	Dropped uint64
+}
+
+// a WindowRollup is the contents of a single bucket of a WindowedDatabase
+type WindowRollup struct {
+	Start    time.Time
+	End      time.Time
+	Snapshot Snapshot
+}
+
+type WindowOption func(*WindowedDatabase)
+
+// WithLateness sets how long after a window closes timestamped metrics are
+// still accepted into it as normal, and what happens to metrics which
+// arrive later than that. By default there is no tolerance, and late
+// metrics are dropped.
+func WithLateness(tolerance time.Duration, policy LatePolicy) WindowOption {
+	return func(w *WindowedDatabase) {
+		w.lateness = tolerance
+		w.latePolicy = policy
+	}
+}
+
+// WithLateCorrections registers a callback which is passed the corrected
+// rollup of a window each time late metrics are applied to it. It is
+// called with the database locked, so must not call back into it.
+func WithLateCorrections(callback func(WindowRollup)) WindowOption {
+	return func(w *WindowedDatabase) {
+		w.onLateCorrection = callback
+	}
+}
+
+// WithWatermark takes time from the metrics written with WriteAt rather
+// than from the clock, so that replayed or backfilled streams are windowed
+// the same way every time. The watermark trails the latest observed time by
+// the lateness tolerance, and each window is finalized, in order, once the
+// watermark passes its end: onFinalize is passed its rollup, and any
+// metrics for it which arrive later are handled by the late policy.
+// Retention and queries are relative to the latest observed time too.
+func WithWatermark(onFinalize func(WindowRollup)) WindowOption {
+	return func(w *WindowedDatabase) {
+		w.eventTime = true
+		w.onFinalize = onFinalize
+	}
+}
+
+// NewWindowedDatabase creates a database bucketing metrics by resolution
+// and retaining them for at least retention, which must be at least the
+// resolution.
+func NewWindowedDatabase(resolution, retention time.Duration, options ...WindowOption) (*WindowedDatabase, error) {
+	if resolution <= 0 {
+		return nil, fmt.Errorf("invalid window resolution %v", resolution)
+	}
+	if retention < resolution {
+		return nil, fmt.Errorf("invalid window retention %v: must be at least the resolution %v", retention, resolution)
+	}
+
+	w := &WindowedDatabase{
+		resolution: resolution,
+		retention:  retention,
+		buckets:    make([]*windowBucket, 0, int(retention/resolution)+1),
+		now:        time.Now,
+	}
+
+	for _, option := range options {
+		option(w)
+	}
+
+	return w, nil
+}
+
+func (w *WindowedDatabase) Open() {}
+
+func (w *WindowedDatabase) Close() {
+	w.Lock()
+	defer w.Unlock()
+	w.closed = true
+}
+
+// BulkWrite writes the metrics into the current window.
+func (w *WindowedDatabase) BulkWrite(bulkMetrics []*BulkMetric) error {
+	return w.write(time.Time{}, bulkMetrics)
+}
+
+// WriteAt writes metrics which were observed at the given time into its
+// window. Metrics for a window which closed longer ago than the lateness
+// tolerance are handled by the late policy, metrics older than the
+// retention are always dropped, and metrics too far in the future are
+// handled by the skew policy, see WithClockSkew.
+func (w *WindowedDatabase) WriteAt(observed time.Time, bulkMetrics []*BulkMetric) error {
+	return w.write(observed, bulkMetrics)
+}
+
+// writes the metrics observed at the given time, or now if it is zero
+func (w *WindowedDatabase) write(observed time.Time, bulkMetrics []*BulkMetric) error {
+	return w.writeCorrelated(observed, bulkMetrics, nil)
+}
+
+// writes the metrics like write, keeping the correlation IDs of the batch
+// with any raw samples
+func (w *WindowedDatabase) writeCorrelated(observed time.Time, bulkMetrics []*BulkMetric, correlationIDs []string) error {
+	count := 0
+	for _, metric := range bulkMetrics {
+		if metric == nil || metric.Count() < 1 {
+			return fmt.Errorf("bulk metric %v: %w", metric, ErrInvalidMetric)
+		}
+		count += metric.Count()
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if observed.IsZero() {
+		observed = w.now()
+	} else if corrected, err := w.correctSkew(observed, count); err != nil {
+		return err
+	} else {
+		observed = corrected
+	}
+	if w.eventTime && observed.After(w.maxObserved) {
+		w.maxObserved = observed
+	}
+
+	now := w.reference()
+	watermark := now.Add(-w.lateness)
+	if w.eventTime {
+		w.finalize(watermark)
+	}
+
+	start := observed.Truncate(w.resolution)
+	end := start.Add(w.resolution)
+	if !end.After(now.Add(-w.retention)) {
+		w.lateStats.Dropped += uint64(count)
+		return nil
+	}
+
+	late := !end.After(watermark)
+	if late && w.latePolicy == DropLate {
+		w.lateStats.Dropped += uint64(count)
+		return nil
+	}
+
+	bucket := w.bucket(start, now)
+	for _, metric := range bulkMetrics {
+		bucket.add(metric.Value(), metric.Count())
+		if w.thresholded && metric.Value() > w.threshold {
+			bucket.above += metric.Count()
+		}
+	}
+	w.keepSamples(bucket, observed, bulkMetrics, correlationIDs)
+
+	if late {
+		bucket.finalized = true
+		w.lateStats.Applied += uint64(count)
+		if w.onLateCorrection != nil {
+			w.onLateCorrection(w.rollup(bucket))
+		}
+	}
+
+	return nil
+}
+
+// the time windows and the retention are relative to
+func (w *WindowedDatabase) reference() time.Time {
+	if w.eventTime && !w.maxObserved.IsZero() {
+		return w.maxObserved
+	}
+
+	return w.now()
+}
+
+// finalizes every bucket which ends at or before the watermark
+func (w *WindowedDatabase) finalize(watermark time.Time) {
+	for _, bucket := range w.buckets {
+		if bucket.finalized || bucket.start.Add(w.resolution).After(watermark) {
+			continue
+		}
+
+		bucket.finalized = true
+		if w.onFinalize != nil {
+			w.onFinalize(w.rollup(bucket))
+		}
+	}
+}
+
+// Watermark returns the time up to which every window has been finalized,
+// which is zero unless the database was created WithWatermark.
+func (w *WindowedDatabase) Watermark() time.Time {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.maxObserved.IsZero() {
+		return time.Time{}
+	}
+
+	return w.maxObserved.Add(-w.lateness)
+}
+
+// LatenessStats reports how many timestamped metrics arrived late.
+func (w *WindowedDatabase) LatenessStats() LatenessStats {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.lateStats
+}
+
+func (w *WindowedDatabase) rollup(bucket *windowBucket) WindowRollup {
+	return WindowRollup{
+		Start:    bucket.start,
+		End:      bucket.start.Add(w.resolution),
+		Snapshot: newSnapshotFromCounts(bucket.counts, w.reference()),
+	}
+}
+
+// returns the bucket starting at start, creating it and expiring any
+// buckets which have aged out of the retention as needed
+func (w *WindowedDatabase) bucket(start, now time.Time) *windowBucket {
+	// almost every write lands in the latest bucket
+	if last := len(w.buckets) - 1; last >= 0 && w.buckets[last].start.Equal(start) {
+		return w.buckets[last]
+	}
+
+	index := sort.Search(len(w.buckets), func(i int) bool {
+		return !w.buckets[i].start.Before(start)
+	})
+	if index < len(w.buckets) && w.buckets[index].start.Equal(start) {
+		return w.buckets[index]
+	}
+
+	bucket := &windowBucket{
+		start:  start,
+		counts: make(map[int]int),
+	}
+	w.buckets = append(w.buckets, nil)
+	copy(w.buckets[index+1:], w.buckets[index:])
+	w.buckets[index] = bucket
+
+	expired := 0
+	for expired < len(w.buckets) && !w.buckets[expired].start.Add(w.resolution).After(now.Add(-w.retention)) {
+		if w.downsampled != nil {
+			w.downsampled.add(w.buckets[expired], now)
+		}
+		expired++
+	}
+	w.buckets = append(w.buckets[:0], w.buckets[expired:]...)
+
+	return bucket
+}
+
+// merges every bucket which overlaps the last window into a snapshot
+func (w *WindowedDatabase) window(window time.Duration) Snapshot {
+	now := w.reference()
+	return w.between(now.Add(-window), now, now)
+}
+
+// merges every bucket which ends after since, and no later than the
+// resolution after until, into a snapshot taken at now. Consecutive
+// ranges never share a bucket.
+func (w *WindowedDatabase) between(since, until, now time.Time) Snapshot {
+	counts := make(map[int]int)
+	for _, bucket := range w.buckets {
+		end := bucket.start.Add(w.resolution)
+		if !end.After(since) || end.After(until.Add(w.resolution)) {
+			continue
+		}
+
+		for value, count := range bucket.counts {
+			counts[value] += count
+		}
+	}
+
+	return newSnapshotFromCounts(counts, now)
+}
+
+// GetWindow returns a snapshot of every metric written within the last
+// window. Buckets are only ever partially covered at the start of the
+// window, so the window is rounded out to the database's resolution.
+func (w *WindowedDatabase) GetWindow(window time.Duration) Snapshot {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.window(window)
+}
+
+// a WindowComparison compares the latest window with the one before it
+type WindowComparison struct {
+	Current  Snapshot
+	Previous Snapshot
+
+	Median      PercentileShift
+	Percentiles []PercentileShift
+}
+
+// CountChange returns the percent change in the number of metrics between
+// the windows.
+func (w WindowComparison) CountChange() float64 {
+	return percentChange(w.Previous.Count(), w.Current.Count())
+}
+
+// CompareWindows compares the last window a with the window b before it,
+// eg: the last 5m against the previous 5m, for regression checks. Both
+// windows are rounded out to the resolution like GetWindow, and a bucket
+// on the boundary is only counted in the current window.
+func (w *WindowedDatabase) CompareWindows(a, b time.Duration) WindowComparison {
+	w.Lock()
+	now := w.reference()
+	current := w.window(a)
+	previous := w.between(now.Add(-a-b), now.Add(-a).Add(-w.resolution), now)
+	w.Unlock()
+
+	diff := Diff(previous, current)
+	return WindowComparison{
+		Current:     current,
+		Previous:    previous,
+		Median:      diff.Median,
+		Percentiles: diff.Percentiles,
+	}
+}
+
+// GetWindowedPercentile returns the nearest-rank percentile of the metrics
+// written within the last window, where p is a fraction between 0 and 1.
+// It is found by rank across the window's buckets rather than by merging
+// them, see rankAcross, so it is far cheaper than GetWindow over many
+// buckets.
+func (w *WindowedDatabase) GetWindowedPercentile(p float64, window time.Duration) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	now := w.reference()
+	indexes, total := w.indexesBetween(now.Add(-window), now)
+	if total == 0 {
+		return 0, ErrEmpty
+	}
+
+	return rankAcross(indexes, nearestRank(p, total)), nil
+}
+
+// Snapshot returns a snapshot of the whole retention, so the database can
+// be served and logged like any other.
+func (w *WindowedDatabase) Snapshot() (Snapshot, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return Snapshot{}, ErrClosed
+	}
+
+	return w.window(w.retention), nil
+}
+
+// GetMedian returns the median over the whole retention, found by rank
+// like GetWindowedPercentile.
+func (w *WindowedDatabase) GetMedian() int {
+	w.Lock()
+	defer w.Unlock()
+
+	now := w.reference()
+	indexes, total := w.indexesBetween(now.Add(-w.retention), now)
+	if total == 0 {
+		return 0
+	} else if total%2 == 1 {
+		return rankAcross(indexes, (total+1)/2)
+	}
+
+	return midpoint(rankAcross(indexes, total/2), rankAcross(indexes, total/2+1))
+}
+
+func newSnapshotFromCounts(counts map[int]int, taken time.Time) Snapshot {
+	values := make([]int, 0, len(counts))
+	for value := range counts {
+		values = append(values, value)
+	}
+	sort.Ints(values)
+
+	metrics := make([]*BulkMetric, 0, len(values))
+	for _, value := range values {
+		metrics = append(metrics, &BulkMetric{
+			value: value,
+			count: counts[value],
+		})
+	}
+
+	return Snapshot{
+		FrozenDatabase: newFrozenDatabase(metrics, nil),
+		Time:           taken,
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// a clock which only moves when told to
+type testClock struct {
+	current time.Time
+}
+
+func newTestClock() *testClock {
+	// start on a minute boundary so that buckets line up with advances
+	return &testClock{current: time.Unix(60*16667, 0)}
+}
+
+func (c *testClock) now() time.Time {
+	return c.current
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.current = c.current.Add(d)
+}
+
+func newTestWindowedDatabase(resolution, retention time.Duration, options ...WindowOption) *WindowedDatabase {
+	database, err := NewWindowedDatabase(resolution, retention, options...)
+	if err != nil {
+		panic(err)
+	}
+
+	return database
+}
+
+func TestWindowedDatabaseInvalid(t *testing.T) {
+	for _, c := range []struct {
+		resolution, retention time.Duration
+	}{
+		{0, time.Hour},
+		{-time.Minute, time.Hour},
+		{time.Minute, time.Second},
+		{time.Minute, -time.Hour},
+	} {
+		if database, err := NewWindowedDatabase(c.resolution, c.retention); err == nil || database != nil {
+			t.Fatalf("expected an error for resolution %v and retention %v", c.resolution, c.retention)
+		}
+	}
+}
+
+func TestWindowedPercentile(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute)
+	database.now = clock.now
+
+	if _, err := database.GetWindowedPercentile(0.99, 5*time.Minute); !errors.Is(err, ErrEmpty) {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+
+	// one minute of slow requests, followed by five minutes of fast ones
+	database.BulkWrite(buildBulkMetrics(1000, 1100))
+	for i := 0; i < 5; i++ {
+		clock.advance(time.Minute)
+		database.BulkWrite(buildBulkMetrics(1, 101))
+	}
+
+	// the window is rounded out to whole buckets, so the last four
+	// minutes cover the five buckets holding only the fast requests
+	if p99, _ := database.GetWindowedPercentile(0.99, 4*time.Minute); p99 != 99 {
+		t.Fatalf("expected p99 of 99, got %d", p99)
+	}
+
+	// over five minutes the slow requests are in the tail
+	if p99, _ := database.GetWindowedPercentile(0.99, 5*time.Minute); p99 != 1093 {
+		t.Fatalf("expected p99 of 1093, got %d", p99)
+	}
+
+	// once the slow minute ages out of the retention it is gone for good
+	clock.advance(7 * time.Minute)
+	database.BulkWrite(buildBulkMetrics(1, 2))
+	if count := database.GetWindow(time.Hour).Count(); count != 401 {
+		t.Fatalf("expected 401 retained metrics, got %d", count)
+	}
+}
+
+func TestCompareWindows(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute)
+	database.now = clock.now
+
+	// three minutes of slow requests, followed by three of fast ones
+	for i := 0; i < 6; i++ {
+		if i < 3 {
+			database.BulkWrite(buildBulkMetrics(1000, 1100))
+		} else {
+			database.BulkWrite(buildBulkMetrics(1, 101))
+		}
+		if i < 5 {
+			clock.advance(time.Minute)
+		}
+	}
+
+	// the current window is rounded out to the last slow minute, which
+	// the previous window then leaves out
+	comparison := database.CompareWindows(3*time.Minute, 3*time.Minute)
+	if comparison.Current.Count() != 400 || comparison.Previous.Count() != 200 {
+		t.Fatalf("expected 400 metrics against 200, got %d against %d", comparison.Current.Count(), comparison.Previous.Count())
+	}
+	if comparison.Median.Before != 1049 || comparison.Median.After != 67 {
+		t.Fatalf("unexpected median shift %+v", comparison.Median)
+	}
+	if change := comparison.Median.PercentChange(); change > -93.6 || change < -93.7 {
+		t.Fatalf("expected the median to fall by 93.6%%, got %v", change)
+	}
+	if change := comparison.CountChange(); change != 100 {
+		t.Fatalf("expected the count to double, got %v", change)
+	}
+	if len(comparison.Percentiles) != len(diffPercentiles) {
+		t.Fatalf("expected every diff percentile, got %+v", comparison.Percentiles)
+	}
+}
+
+func TestWindowedDatabaseLateData(t *testing.T) {
+	clock := newTestClock()
+	start := clock.now()
+
+	var corrections []WindowRollup
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute, WithLateness(30*time.Second, ApplyLate), WithLateCorrections(func(rollup WindowRollup) {
+		corrections = append(corrections, rollup)
+	}))
+	database.now = clock.now
+
+	database.WriteAt(start, buildBulkMetrics(0, 10))
+	clock.advance(time.Minute + 20*time.Second)
+
+	// within the tolerance the first window is still open
+	database.WriteAt(start.Add(59*time.Second), buildBulkMetrics(10, 20))
+	if len(corrections) != 0 {
+		t.Fatalf("expected no corrections, got %d", len(corrections))
+	}
+
+	// beyond it the window is corrected retroactively
+	clock.advance(time.Minute)
+	database.WriteAt(start.Add(time.Second), buildBulkMetrics(20, 25))
+	if len(corrections) != 1 || !corrections[0].Start.Equal(start) || corrections[0].Snapshot.Count() != 25 {
+		t.Fatalf("unexpected corrections %+v", corrections)
+	}
+
+	// anything older than the retention is dropped regardless
+	database.WriteAt(start.Add(-time.Hour), buildBulkMetrics(0, 3))
+
+	if stats := database.LatenessStats(); stats.Applied != 5 || stats.Dropped != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if count := database.GetWindow(time.Hour).Count(); count != 25 {
+		t.Fatalf("expected 25 metrics, got %d", count)
+	}
+}
+
+func TestWindowedDatabaseDropLate(t *testing.T) {
+	clock := newTestClock()
+	start := clock.now()
+
+	database := newTestWindowedDatabase(time.Minute, 10*time.Minute)
+	database.now = clock.now
+
+	clock.advance(2 * time.Minute)
+	database.WriteAt(start, buildBulkMetrics(0, 10))
+	database.BulkWrite(buildBulkMetrics(0, 5))
+
+	if stats := database.LatenessStats(); stats.Applied != 0 || stats.Dropped != 10 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if count := database.GetWindow(time.Hour).Count(); count != 5 {
+		t.Fatalf("expected 5 metrics, got %d", count)
+	}
+}
+
+func TestWindowedDatabaseWatermark(t *testing.T) {
+	var finalized []WindowRollup
+	database := newTestWindowedDatabase(time.Minute, time.Hour, WithLateness(30*time.Second, DropLate), WithWatermark(func(rollup WindowRollup) {
+		finalized = append(finalized, rollup)
+	}))
+	// the clock plays no part, as the stream is replayed from long ago
+	database.now = func() time.Time {
+		t.Fatalf("unexpected use of the clock")
+		return time.Time{}
+	}
+
+	start := newTestClock().now().Add(-24 * time.Hour)
+	database.WriteAt(start, buildBulkMetrics(0, 10))
+	database.WriteAt(start.Add(70*time.Second), buildBulkMetrics(0, 5))
+
+	// the watermark is at 0:40, so the first window is still open
+	if len(finalized) != 0 || !database.Watermark().Equal(start.Add(40*time.Second)) {
+		t.Fatalf("unexpected finalized windows %+v at %v", finalized, database.Watermark())
+	}
+	database.WriteAt(start.Add(50*time.Second), buildBulkMetrics(10, 12))
+
+	// moving the watermark to 1:45 finalizes the first window only
+	database.WriteAt(start.Add(135*time.Second), buildBulkMetrics(0, 1))
+	if len(finalized) != 1 || !finalized[0].Start.Equal(start) || finalized[0].Snapshot.Count() != 12 {
+		t.Fatalf("unexpected finalized windows %+v", finalized)
+	}
+
+	// the first window is closed for good
+	database.WriteAt(start.Add(10*time.Second), buildBulkMetrics(0, 4))
+	if stats := database.LatenessStats(); stats.Dropped != 4 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	// queries are relative to the stream's time too
+	if count := database.GetWindow(2 * time.Minute).Count(); count != 18 {
+		t.Fatalf("expected 18 metrics, got %d", count)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// a bucketIndex is a bucket's values in order, with the number of the
+// bucket's metrics at or below each, so that percentiles across many
+// buckets can be found by rank without merging them. It is built by the
+// first query after a write to the bucket, which invalidates it.
+type bucketIndex struct {
+	values     []int
+	cumulative []int
+}
+
+// adds count metrics of value to the bucket, invalidating its index
+func (b *windowBucket) add(value, count int) {
+	b.counts[value] += count
+	b.count += count
+	b.index = nil
+}
+
+func (b *windowBucket) rankIndex() *bucketIndex {
+	if b.index != nil {
+		return b.index
+	}
+
+	index := &bucketIndex{
+		values:     make([]int, 0, len(b.counts)),
+		cumulative: make([]int, len(b.counts)),
+	}
+	for value := range b.counts {
+		index.values = append(index.values, value)
+	}
+	sort.Ints(index.values)
+
+	total := 0
+	for i, value := range index.values {
+		total += b.counts[value]
+		index.cumulative[i] = total
+	}
+	b.index = index
+
+	return index
+}
+
+// the number of the bucket's metrics at or below value
+func (i *bucketIndex) countAtOrBelow(value int) int {
+	j := sort.Search(len(i.values), func(j int) bool { return i.values[j] > value })
+	if j == 0 {
+		return 0
+	}
+
+	return i.cumulative[j-1]
+}
+
+// indexes every bucket between since and until, selected like between,
+// returning them along with their total count
+func (w *WindowedDatabase) indexesBetween(since, until time.Time) ([]*bucketIndex, int) {
+	indexes := make([]*bucketIndex, 0, len(w.buckets))
+	total := 0
+	for _, bucket := range w.buckets {
+		end := bucket.start.Add(w.resolution)
+		if !end.After(since) || end.After(until.Add(w.resolution)) || bucket.count == 0 {
+			continue
+		}
+
+		indexes = append(indexes, bucket.rankIndex())
+		total += bucket.count
+	}
+
+	return indexes, total
+}
+
+// returns the value at the 1-indexed rank across the buckets: the smallest
+// value with at least rank metrics at or below it across all of them.
+// Each step of the search over the values costs a binary search per
+// bucket, so a query over k buckets of n distinct values takes
+// O(k log n log range) rather than the O(k n) of merging them.
+func rankAcross(indexes []*bucketIndex, rank int) int {
+	low, high := 0, 0
+	for i, index := range indexes {
+		first, last := index.values[0], index.values[len(index.values)-1]
+		if i == 0 || first < low {
+			low = first
+		}
+		if i == 0 || last > high {
+			high = last
+		}
+	}
+
+	for low < high {
+		middle := floorMidpoint(low, high)
+		count := 0
+		for _, index := range indexes {
+			count += index.countAtOrBelow(middle)
+		}
+
+		if count >= rank {
+			high = middle
+		} else {
+			low = middle + 1
+		}
+	}
+
+	return low
+}
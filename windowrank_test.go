@@ -0,0 +1,84 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestWindowedPercentileByRank(t *testing.T) {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, time.Hour)
+	database.now = clock.now
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 30; i++ {
+		for j := 0; j < 50; j++ {
+			database.BulkWrite([]*BulkMetric{{value: random.Intn(1000) - 200, count: random.Intn(5) + 1}})
+		}
+		clock.advance(time.Minute)
+	}
+
+	// answered by rank, exactly as merging the buckets would
+	for _, window := range []time.Duration{time.Minute, 5 * time.Minute, 17 * time.Minute, time.Hour} {
+		snapshot := database.GetWindow(window)
+		for _, p := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.99, 1} {
+			value, err := database.GetWindowedPercentile(p, window)
+			if err != nil || value != snapshot.GetPercentile(p) {
+				t.Fatalf("expected the p%v over %s to be %d, got %d, %v", p*100, window, snapshot.GetPercentile(p), value, err)
+			}
+		}
+	}
+	if median := database.GetMedian(); median != database.GetWindow(time.Hour).GetMedian() {
+		t.Fatalf("expected a median of %d, got %d", database.GetWindow(time.Hour).GetMedian(), median)
+	}
+
+	// a write invalidates the index of its bucket
+	database.BulkWrite([]*BulkMetric{{value: 5000, count: 1000}})
+	if value, _ := database.GetWindowedPercentile(0.99, time.Minute); value != 5000 {
+		t.Fatalf("expected the write to be seen, got %d", value)
+	}
+
+	if _, err := newTestWindowedDatabase(time.Minute, time.Hour).GetWindowedPercentile(0.5, time.Hour); err != ErrEmpty {
+		t.Fatalf("expected ErrEmpty, got %v", err)
+	}
+}
+
+// 100 buckets, each of a million metrics over a thousand distinct values
+func newBenchmarkWindowedDatabase() *WindowedDatabase {
+	clock := newTestClock()
+	database := newTestWindowedDatabase(time.Minute, 100*time.Minute)
+	database.now = clock.now
+	for i := 0; i < 100; i++ {
+		metrics := make([]*BulkMetric, 0, 1000)
+		for value := 0; value < 1000; value++ {
+			metrics = append(metrics, &BulkMetric{value: value*100 + i, count: 1000})
+		}
+		database.BulkWrite(metrics)
+		if i < 99 {
+			clock.advance(time.Minute)
+		}
+	}
+
+	return database
+}
+
+func BenchmarkWindowedPercentile(b *testing.B) {
+	database := newBenchmarkWindowedDatabase()
+	// the indexes are built by the first query
+	database.GetWindowedPercentile(0.99, 100*time.Minute)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		database.GetWindowedPercentile(0.99, 100*time.Minute)
+	}
+}
+
+func BenchmarkWindowedPercentileMerged(b *testing.B) {
+	database := newBenchmarkWindowedDatabase()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		database.GetWindow(100 * time.Minute).GetPercentile(0.99)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// the wire format is shared by everything which needs to move or persist
+// batches of metrics. Each frame is laid out as:
+//
+//	uint32  length of the payload (big endian)
+//	[]byte  payload
+//	uint32  crc32 (IEEE) of the payload (big endian)
+//
+// where the payload is:
+//
+//	uvarint sequence
+//	uvarint number of metrics
+//	for each metric: varint delta from the previous value, uvarint count
+//
+// batches are sorted by value, so the deltas (and therefore the encoding)
+// stay small even for large values.
+
+const maxFrameSize = 64 << 20
+
+type Frame struct {
+	Sequence uint64
+	Metrics  []*BulkMetric
+
+	// the correlation IDs of the batch, see WithCorrelationID, which are
+	// only passed to replication sinks and aren't encoded
+	CorrelationIDs []string
+}
+
+func EncodeFrame(frame Frame) []byte {
+	// reserve room for the length header up front, it is filled in once
+	// the payload has been written
+	buf := make([]byte, 4, 4+2*binary.MaxVarintLen64*(len(frame.Metrics)+1)+4)
+	scratch := make([]byte, binary.MaxVarintLen64)
+
+	putUvarint := func(value uint64) {
+		n := binary.PutUvarint(scratch, value)
+		buf = append(buf, scratch[:n]...)
+	}
+
+	putVarint := func(value int64) {
+		n := binary.PutVarint(scratch, value)
+		buf = append(buf, scratch[:n]...)
+	}
+
+	putUvarint(frame.Sequence)
+	putUvarint(uint64(len(frame.Metrics)))
+
+	previous := 0
+	for _, metric := range frame.Metrics {
+		putVarint(int64(metric.Value() - previous))
+		putUvarint(uint64(metric.Count()))
+		previous = metric.Value()
+	}
+
+	payload := buf[4:]
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(scratch[:4], crc32.ChecksumIEEE(payload))
+	return append(buf, scratch[:4]...)
+}
+
+func WriteFrame(w io.Writer, frame Frame) error {
+	_, err := w.Write(EncodeFrame(frame))
+	return err
+}
+
+// ReadFrame reads the next frame from r. io.EOF is returned when r is
+// exhausted on a frame boundary and ErrSnapshotCorrupt when a frame is
+// truncated or its checksum doesn't match.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return Frame{}, ErrSnapshotCorrupt
+		}
+		return Frame{}, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length > maxFrameSize {
+		return Frame{}, ErrSnapshotCorrupt
+	}
+
+	buf := make([]byte, length+4)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return Frame{}, ErrSnapshotCorrupt
+	}
+
+	payload := buf[:length]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[length:]) {
+		return Frame{}, ErrSnapshotCorrupt
+	}
+
+	return decodePayload(payload)
+}
+
+func decodePayload(payload []byte) (Frame, error) {
+	reader := bytes.NewReader(payload)
+
+	sequence, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return Frame{}, ErrSnapshotCorrupt
+	}
+
+	count, err := binary.ReadUvarint(reader)
+	// every metric takes at least two bytes, which bounds the allocation
+	// below for payloads which claim an absurd number of metrics
+	if err != nil || count > uint64(len(payload)) {
+		return Frame{}, ErrSnapshotCorrupt
+	}
+
+	frame := Frame{
+		Sequence: sequence,
+		Metrics:  make([]*BulkMetric, 0, count),
+	}
+
+	previous := 0
+	for i := uint64(0); i < count; i++ {
+		delta, err := binary.ReadVarint(reader)
+		if err != nil {
+			return Frame{}, ErrSnapshotCorrupt
+		}
+
+		metricCount, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return Frame{}, ErrSnapshotCorrupt
+		}
+
+		previous = previous + int(delta)
+		frame.Metrics = append(frame.Metrics, &BulkMetric{
+			value: previous,
+			count: int(metricCount),
+		})
+	}
+
+	return frame, nil
+}
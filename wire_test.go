@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	metrics := append(buildBulkMetrics(-5, 5), NewBulkMetric(1<<40))
+	metrics[3].IncrBy(99)
+
+	buf := new(bytes.Buffer)
+	if err := WriteFrame(buf, Frame{Sequence: 7, Metrics: metrics}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := WriteFrame(buf, Frame{Sequence: 8}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	frame, err := ReadFrame(buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if frame.Sequence != 7 || len(frame.Metrics) != len(metrics) {
+		t.Fatalf("unexpected frame %+v", frame)
+	}
+	for i, metric := range metrics {
+		if *frame.Metrics[i] != *metric {
+			t.Fatalf("expected %v, got %v", *metric, *frame.Metrics[i])
+		}
+	}
+
+	frame, err = ReadFrame(buf)
+	if err != nil || frame.Sequence != 8 || len(frame.Metrics) != 0 {
+		t.Fatalf("unexpected frame %+v: %v", frame, err)
+	}
+
+	if _, err := ReadFrame(buf); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestFrameCorruption(t *testing.T) {
+	encoded := EncodeFrame(Frame{Sequence: 1, Metrics: buildBulkMetrics(0, 10)})
+
+	// flip a bit in the payload
+	corrupt := append([]byte{}, encoded...)
+	corrupt[6] ^= 0x01
+	if _, err := ReadFrame(bytes.NewReader(corrupt)); err != ErrSnapshotCorrupt {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+
+	// truncate the frame
+	if _, err := ReadFrame(bytes.NewReader(encoded[:len(encoded)-2])); err != ErrSnapshotCorrupt {
+		t.Fatalf("expected ErrSnapshotCorrupt, got %v", err)
+	}
+}
@@ -1,56 +1,311 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"runtime/pprof"
+	"sync/atomic"
 	"time"
 )
 
 type Worker interface {
 	Start()
-	Write(Metric)
+	Write(Metric) error
 	Stop()
 }
 
+// an AckedDatabase applies writes asynchronously, and acknowledges each
+// batch once it has been applied
+type AckedDatabase interface {
+	BulkWriteAcked([]*BulkMetric) <-chan error
+}
+
+// a SortedDatabase can skip sorting batches which are already sorted by
+// value with no duplicates, and acknowledges them like an AckedDatabase
+type SortedDatabase interface {
+	BulkWriteSortedAcked([]*BulkMetric) <-chan error
+}
+
+// writes the metrics, which must be sorted with unique values, and waits
+// until the database has applied them. Errors carry the correlation IDs
+// of the batch.
+func applyBulkWrite(database Database, metrics []*BulkMetric, correlationIDs []string) error {
+	if correlating, ok := database.(CorrelatedDatabase); ok && len(correlationIDs) > 0 {
+		return <-correlating.BulkWriteCorrelated(metrics, correlationIDs)
+	}
+	if sorted, ok := database.(SortedDatabase); ok {
+		return correlated(<-sorted.BulkWriteSortedAcked(metrics), correlationIDs)
+	}
+	if acked, ok := database.(AckedDatabase); ok {
+		return correlated(<-acked.BulkWriteAcked(metrics), correlationIDs)
+	}
+
+	// every other database applies the write before BulkWrite returns
+	return correlated(database.BulkWrite(metrics), correlationIDs)
+}
+
+// a metric queued for the worker, along with an optional channel which is
+// sent the result once the flush containing the metric has been applied
+type metricRequest struct {
+	metric Metric
+	ack    chan error
+
+	// the IDs of whatever produced the metric, see WriteContext
+	correlations []string
+}
+
 // a buffered worker is a worker which will buffer metrics and then flush them at once to the database
 type BufferedWorker struct {
-	metricCh      chan Metric
+	metricCh      chan metricRequest
 	quitCh        chan bool
+	doneCh        chan struct{}
+	errCh         chan error
+	failed        int32
 	flushInterval time.Duration
 	bufferSize    int
 	database      Database
+
+	name          string
+	beforeFlush   func(FlushInfo) bool
+	afterFlush    func(FlushInfo)
+	restartPolicy RestartPolicy
+	admission     *admissionController
+	outliers      *outlierFilter
+	exemplars     *exemplarReservoir
+	correlate     func(context.Context) []string
+
+	// values are rounded to this many significant digits, if set
+	significantDigits int
+
+	// set while the flusher is applying a flush, see flushApplying
+	applying int32
+
+	// the longest a metric is buffered before it is applied, if set, and
+	// how long the last flush took to apply, in nanoseconds
+	maxLatency    time.Duration
+	lastFlushTook int64
+
+	flushQueueDepth int
+	flushOverflow   FlushOverflowPolicy
+	softLimit       *softLimiter
+}
+
+// FlushInfo describes a single flush of the worker's buffer to the database
+type FlushInfo struct {
+	// the number of distinct values and the total number of metrics
+	Metrics int
+	Count   int
+
+	// the distinct correlation IDs of the flush's writes, see
+	// WriteContext
+	CorrelationIDs []string
+
+	// only set once the flush has been written to the database
+	Duration time.Duration
+	Err      error
+}
+
+type WorkerOption func(*BufferedWorker)
+
+// WithWorkerName names the worker, prefixing every error it returns or
+// reports and labelling its goroutine in pprof profiles.
+func WithWorkerName(name string) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.name = name
+	}
+}
+
+// WithBeforeFlush registers a hook which is called before each flush. If
+// the hook returns false the flush is skipped and buffered metrics are kept
+// for the next flush, except when the worker is stopping.
+func WithBeforeFlush(hook func(FlushInfo) bool) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.beforeFlush = hook
+	}
+}
+
+// WithAfterFlush registers a hook which is called once a flush has been
+// written to the database.
+func WithAfterFlush(hook func(FlushInfo)) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.afterFlush = hook
+	}
+}
+
+// WithWorkerRestartPolicy configures whether the worker is restarted after
+// a panic, keeping its buffered metrics. By default it is never restarted,
+// and Write returns ErrClosed once the worker has panicked.
+func WithWorkerRestartPolicy(policy RestartPolicy) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.restartPolicy = policy
+	}
+}
+
+// WithAdmissionControl starts sampling or rejecting writes once the
+// database falls behind, as configured by the policy.
+func WithAdmissionControl(policy AdmissionPolicy) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.admission.policy = policy
+		if policy.TailQuantile > 0 {
+			b.admission.tail = newTailEstimator(policy.TailQuantile)
+		}
+	}
+}
+
+// WithMaxLatency bounds how long a metric can take to reach the database,
+// eg: 50ms, for callers which read the median often and need it fresh.
+// Partial buffers are flushed once their oldest metric has waited for the
+// bound, less the time the last flush took to apply, however long the
+// flush interval is.
+func WithMaxLatency(latency time.Duration) WorkerOption {
+	return func(b *BufferedWorker) {
+		b.maxLatency = latency
+	}
 }
 
-func NewBufferedWorker(bufferSize int, flushInterval time.Duration, database Database) *BufferedWorker {
-	return &BufferedWorker{
-		metricCh:      make(chan Metric),
+// how long a metric can wait in the buffer and still meet the latency
+// bound, which always leaves a quarter of the bound to buffer in so a
+// database which slows down doesn't degrade into flushing every metric
+func (b *BufferedWorker) latencyBudget() time.Duration {
+	budget := b.maxLatency - time.Duration(atomic.LoadInt64(&b.lastFlushTook))
+	if budget < b.maxLatency/4 {
+		budget = b.maxLatency / 4
+	}
+
+	return budget
+}
+
+func NewBufferedWorker(bufferSize int, flushInterval time.Duration, database Database, options ...WorkerOption) *BufferedWorker {
+	b := &BufferedWorker{
+		metricCh:      make(chan metricRequest),
 		quitCh:        make(chan bool),
+		doneCh:        make(chan struct{}),
+		errCh:         make(chan error, errorChannelSize),
 		flushInterval: flushInterval,
 		bufferSize:    bufferSize,
 		database:      database,
+		admission:     &admissionController{},
+		correlate:     CorrelationIDs,
+
+		flushQueueDepth: defaultFlushQueueDepth,
+	}
+
+	for _, option := range options {
+		option(b)
 	}
+
+	return b
 }
 
 func (b *BufferedWorker) Start() {
 	// start the background worker
 	go func() {
-		b.worker()
+		if b.name == "" {
+			b.worker()
+			return
+		}
+
+		pprof.Do(context.Background(), pprof.Labels("worker", b.name), func(context.Context) {
+			b.worker()
+		})
 	}()
 }
 
+// Name returns the name the worker was created with, if any.
+func (b *BufferedWorker) Name() string {
+	return b.name
+}
+
+// prefixes the error with the worker's name
+func (b *BufferedWorker) named(err error) error {
+	if err == nil || b.name == "" {
+		return err
+	}
+
+	return fmt.Errorf("worker %s: %w", b.name, err)
+}
+
 func (b *BufferedWorker) Stop() {
-	// dispatch a method to the internal worker to flush any messages found
-	b.quitCh <- true
+	// dispatch a method to the internal worker to flush any messages
+	// found, telling it whether a flush is being applied, which may be
+	// the caller
+	b.quitCh <- b.flushApplying()
 
 	// the internal worker loop will wait for a ping back from the
 	// goroutine to ensure all messages were flushed to the database before
 	<-b.quitCh
 	close(b.quitCh)
-	close(b.metricCh)
+	close(b.doneCh)
+}
+
+// Errors returns a channel of errors which happen in the background, such
+// as a recovered panic. Errors are dropped if the channel isn't drained.
+func (b *BufferedWorker) Errors() <-chan error {
+	return b.errCh
+}
+
+// AdmissionStats reports how many writes were admitted, sampled out or
+// rejected along with the current backlog, and the overload episodes
+// during which writes were shed.
+func (b *BufferedWorker) AdmissionStats() AdmissionStats {
+	return b.admission.stats()
+}
+
+func (b *BufferedWorker) Write(metric Metric) error {
+	return b.submit(metric, nil)
 }
 
-func (b *BufferedWorker) Write(metric Metric) {
+// WriteAcked writes the metric like Write, but returns a channel which
+// receives a single result once the flush containing the metric has been
+// applied to the database, for callers which can't discard the source of
+// the metric until then. Metrics sampled out by admission control are
+// acknowledged immediately.
+func (b *BufferedWorker) WriteAcked(metric Metric) <-chan error {
+	ack := make(chan error, 1)
+	if err := b.submit(metric, ack); err != nil {
+		ack <- err
+	}
+
+	return ack
+}
+
+func (b *BufferedWorker) submit(metric Metric, ack chan error) error {
+	return b.named(b.enqueueRequest(metricRequest{metric: metric, ack: ack}))
+}
+
+// admits the metric and hands it to the worker
+func (b *BufferedWorker) enqueueRequest(request metricRequest) error {
+	metric, ack := request.metric, request.ack
+	if metric == nil {
+		return ErrInvalidMetric
+	}
+	if multi, ok := metric.(MultiMetric); ok {
+		for _, expanded := range multi.Expand() {
+			if expanded == nil || expanded.Count() < 1 {
+				return fmt.Errorf("bulk metric %v: %w", expanded, ErrInvalidMetric)
+			}
+		}
+	}
+	if atomic.LoadInt32(&b.failed) == 1 {
+		return fmt.Errorf("worker failed: %w", ErrClosed)
+	}
+	metric, admit, err := b.admission.admit(metric)
+	if !admit {
+		if err == nil && ack != nil {
+			ack <- nil
+		}
+		return err
+	}
+	request.metric = metric
+
 	// write is a threadsafe method which prevents unsafe access to writing
 	// metrics to the worker
-	b.metricCh <- metric
+	select {
+	case b.metricCh <- request:
+		return nil
+	case <-b.doneCh:
+		return ErrClosed
+	}
 }
 
 func (b *BufferedWorker) worker() {
@@ -60,65 +315,273 @@ func (b *BufferedWorker) worker() {
 	// Once either situation happens, a series of "aggregate" metrics will
 	// be written in bulk to the database.
 
-	// set the first time that data should be flushed. This is reused later for further flushes
-	nextFlush := time.Now().Add(b.flushInterval)
+	// flushes are applied in order by a single flusher, which outlives
+	// any restarts of the loop below and exits once the queue is closed
+	flushQueue := make(chan flushJob, b.flushQueueDepth)
+	flusherDone := make(chan struct{})
+	go func() {
+		defer close(flusherDone)
+		b.flusher(flushQueue)
+	}()
+	closed := false
+	closeFlushes := func() {
+		if !closed {
+			closed = true
+			close(flushQueue)
+		}
+	}
+
+	// set the first time that data should be flushed. This is reset after every flush
+	flushTimer := time.NewTimer(b.flushInterval)
+	defer flushTimer.Stop()
 	buffer := make(map[int]*BulkMetric, b.bufferSize)
 	count := 0
+	// the acks waiting on the metrics in the current buffer, and the
+	// correlation IDs of the writes
+	acks := make([]chan error, 0)
+	correlations := []string(nil)
+
+	resetFlushTimer := func() {
+		// drain the timer if it fired while we were flushing for
+		// another reason, so that it doesn't trigger a second flush
+		if !flushTimer.Stop() {
+			select {
+			case <-flushTimer.C:
+			default:
+			}
+		}
+		flushTimer.Reset(b.flushInterval)
+	}
+
+	// with a latency bound, a timer is armed when the first metric is
+	// buffered and disarmed by the flush which applies it
+	var latencyTimer *time.Timer
+	var latencyCh <-chan time.Time
+	armLatency := func() {
+		if b.maxLatency > 0 && latencyTimer == nil && count > 0 {
+			latencyTimer = time.NewTimer(b.latencyBudget())
+			latencyCh = latencyTimer.C
+		}
+	}
+	disarmLatency := func() {
+		if latencyTimer != nil {
+			latencyTimer.Stop()
+			latencyTimer, latencyCh = nil, nil
+		}
+	}
+	defer disarmLatency()
+
+	// set when Stop was called while the flusher was applying a flush
+	stoppedByFlush := false
 
 	// bulk flushes data to the database
-	flush := func() {
+	flush := func(stopping bool) {
 		// first we build an array of all known bulkMetrics
 		metrics := make([]*BulkMetric, 0, len(buffer))
+		info := FlushInfo{CorrelationIDs: correlations}
 
 		for _, metric := range buffer {
 			metrics = append(metrics, metric)
+			info.Count += metric.Count()
+		}
+		info.Metrics = len(metrics)
+
+		// give the hook a chance to veto the flush. The final flush
+		// can only be vetoed if there is nothing to lose
+		if b.beforeFlush != nil && !b.beforeFlush(info) && (!stopping || len(metrics) == 0) {
+			resetFlushTimer()
+			disarmLatency()
+			armLatency()
+			return
 		}
 
-		// now we have a sorted slice of *BulkMetric objects flush to
-		// the database.
-		// NOTE: we call the write method in another
-		// goroutine to ensure that if the BulkWrite method blocks we
-		// don't block this channel.
-		go func() {
-			b.database.BulkWrite(metrics)
-		}()
+		// hand the buffer to the flusher, so that a database which
+		// blocks doesn't block this loop unless the queue is full
+		job := flushJob{metrics: metrics, acks: acks, info: info, correlations: correlations}
+		if !stopping {
+			b.queueFlush(flushQueue, job)
+		} else if !stoppedByFlush {
+			// Stop promises that everything was written once it
+			// returns, so the flusher applies whatever is queued
+			// before the final flush, keeping them one at a time and
+			// in order
+			closeFlushes()
+			<-flusherDone
+			b.admission.flushStarted()
+			b.apply(job)
+		} else {
+			// the flusher can't finish until Stop returns, so it
+			// applies the final flush after the rest once it does
+			closeFlushes()
+			b.admission.flushStarted()
+			go func() {
+				<-flusherDone
+				b.apply(job)
+			}()
+		}
 
 		// reset the state to start rebuffering metrics again
 		buffer = make(map[int]*BulkMetric, b.bufferSize)
 		count = 0
-		nextFlush = time.Now().Add(b.flushInterval)
+		acks = make([]chan error, 0)
+		correlations = nil
+		resetFlushTimer()
+		disarmLatency()
 	}
 
 	// writes a single metric into the local buffer
 	handle := func(metric Metric) {
-		bulkMetric, ok := buffer[metric.Value()]
+		value := metric.Value()
+
+		// a sampled metric stands in for the ones which were dropped
+		weight := 1
+		if weighted, ok := metric.(weightedMetric); ok {
+			weight = weighted.weight
+			metric = weighted.Metric
+		}
+
+		// flatten metrics which carry many values straight into the
+		// buffer
+		if multi, ok := metric.(MultiMetric); ok {
+			for _, expanded := range multi.Expand() {
+				expanded = copyMetric(expanded)
+				expanded.scale(weight)
+
+				filtered, keep := b.outliers.filter(expanded.Value(), expanded.Count())
+				if !keep {
+					continue
+				}
+				if filtered != expanded.Value() {
+					expanded.value, expanded.aggregate = filtered, nil
+				}
+				if rounded := roundSignificant(filtered, b.significantDigits); rounded != filtered {
+					aggregate := expanded.Aggregate()
+					expanded.value, expanded.aggregate = rounded, &aggregate
+				}
+				count = count + expanded.Count()
+
+				if bulkMetric, ok := buffer[expanded.Value()]; ok {
+					bulkMetric.absorb(expanded)
+				} else {
+					buffer[expanded.Value()] = expanded
+				}
+			}
+			return
+		}
+
+		filtered, keep := b.outliers.filter(value, weight)
+		if !keep {
+			return
+		}
+		count = count + weight
+
+		if traced, ok := metric.(TracedMetric); ok && b.exemplars != nil {
+			b.exemplars.add(Exemplar{Value: value, TraceID: traced.TraceID(), Time: time.Now()})
+		}
+
+		rounded := roundSignificant(filtered, b.significantDigits)
+		bulkMetric, ok := buffer[rounded]
 		if !ok {
-			buffer[metric.Value()] = NewBulkMetric(metric.Value())
+			bulkMetric = &BulkMetric{value: rounded}
+			buffer[rounded] = bulkMetric
+		}
+
+		// keep the raw observation behind a bucketed value
+		if raw, ok := metric.(RawMetric); ok {
+			if filtered != value {
+				bulkMetric.observe(float64(filtered), weight)
+			} else {
+				bulkMetric.observe(raw.Raw(), weight)
+			}
+			return
+		}
+		// once a value has raw observations behind it, every metric at
+		// that value must be observed to keep its aggregate whole
+		if rounded != filtered || bulkMetric.aggregate != nil {
+			bulkMetric.observe(float64(filtered), weight)
 			return
 		}
 
-		bulkMetric.Incr()
+		bulkMetric.IncrBy(weight)
 	}
 
 	// loop and select on both channels until we grab a message, flush or quit
-	for {
-		select {
-		case metric := <-b.metricCh:
-			handle(metric)
-		case <-b.quitCh:
-			flush()
-			// ping the channel back acknowledging that we received
-			// the message and are finished flushing
-			b.quitCh <- true
-			return
-		default:
-			// flush if it has been too long or if we have buffered enough
-			// data
-			if time.Now().After(nextFlush) || count >= b.bufferSize {
-				flush()
+	stopped := false
+	var pendingAck chan error
+	loop := func() {
+		for {
+			select {
+			case request := <-b.metricCh:
+				pendingAck = request.ack
+				handle(request.metric)
+				if request.ack != nil {
+					acks = append(acks, request.ack)
+				}
+				correlations = addCorrelations(correlations, request.correlations)
+				pendingAck = nil
+				// flush early if we have buffered enough data
+				if count >= b.bufferSize {
+					flush(false)
+				}
+				armLatency()
+			case <-flushTimer.C:
+				// flush if it has been too long since the last flush
+				flush(false)
+			case <-latencyCh:
+				// flush before the oldest metric misses the bound
+				latencyTimer, latencyCh = nil, nil
+				flush(false)
+			case fromFlush := <-b.quitCh:
+				stopped, stoppedByFlush = true, fromFlush
+				flush(true)
+				// ping the channel back acknowledging that we received
+				// the message and are finished flushing
+				b.quitCh <- true
+				return
+			}
+		}
+	}
+
+	// restart the loop after a panic if the policy allows it; the buffer
+	// lives outside of the loop so nothing buffered is lost
+	for restarts := 0; ; restarts++ {
+		err := recoverPanic(loop)
+		if stopped {
+			// if the final flush panicked, Stop is still waiting on us
+			if err != nil {
+				reportError(b.errCh, b.named(err))
+				closeFlushes()
+				if !stoppedByFlush {
+					<-flusherDone
+				}
+				b.quitCh <- true
 			}
-			continue
+			return
+		}
+
+		err = b.named(err)
+		reportError(b.errCh, err)
+		// the metric we panicked on was never buffered
+		if pendingAck != nil {
+			pendingAck <- err
+			pendingAck = nil
+		}
+		if !b.restartPolicy.allows(restarts) {
+			break
 		}
+	}
+
+	// nothing buffered will ever be flushed, so release anyone waiting
+	for _, ack := range acks {
+		ack <- b.named(fmt.Errorf("worker failed: %w", ErrClosed))
+	}
 
+	// reject any new writes and wait to be stopped
+	atomic.StoreInt32(&b.failed, 1)
+	fromFlush := <-b.quitCh
+	closeFlushes()
+	if !fromFlush {
+		<-flusherDone
 	}
+	b.quitCh <- true
 }
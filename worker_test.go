@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"testing"
 	"time"
 )
@@ -32,8 +33,9 @@ func (d mockDatabase) GetMedian() int {
 	return 0
 }
 
-func (d mockDatabase) BulkWrite(metrics []*BulkMetric) {
+func (d mockDatabase) BulkWrite(metrics []*BulkMetric) error {
 	d.cb(metrics)
+	return nil
 }
 
 func TestBufferedWorker(t *testing.T) {
@@ -79,3 +81,201 @@ func TestBufferedWorker(t *testing.T) {
 	// block the main thread until the callback has completed
 	<-done
 }
+
+func TestBufferedWorkerFlushHooks(t *testing.T) {
+	flushed := make(chan FlushInfo, 10)
+	vetoed := 0
+
+	db := newMockDatabase(t, func(bulkMetrics []*BulkMetric) {})
+	worker := NewBufferedWorker(10000, 10*time.Millisecond, db,
+		WithBeforeFlush(func(info FlushInfo) bool {
+			// veto empty flushes
+			if info.Count == 0 {
+				vetoed += 1
+				return false
+			}
+			return true
+		}),
+		WithAfterFlush(func(info FlushInfo) {
+			flushed <- info
+		}),
+	)
+	worker.Start()
+
+	for i := 0; i < 10; i++ {
+		worker.Write(NewIntMetric(i % 5))
+	}
+
+	select {
+	case info := <-flushed:
+		if info.Count != 10 || info.Metrics != 5 || info.Err != nil {
+			t.Fatalf("unexpected flush %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// wait for at least one empty flush to be vetoed
+	time.Sleep(30 * time.Millisecond)
+	worker.Stop()
+
+	if vetoed == 0 {
+		t.Fatalf("expected empty flushes to be vetoed")
+	}
+	select {
+	case info := <-flushed:
+		t.Fatalf("unexpected flush %+v", info)
+	default:
+	}
+}
+
+func TestBufferedWorkerWriteAfterStop(t *testing.T) {
+	db := newMockDatabase(t, func(bulkMetrics []*BulkMetric) {})
+	worker := NewBufferedWorker(10, time.Second, db)
+	worker.Start()
+
+	if err := worker.Write(nil); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+
+	worker.Stop()
+	if err := worker.Write(NewIntMetric(1)); !errors.Is(err, ErrClosed) {
+		t.Fatalf("expected ErrClosed, got %v", err)
+	}
+}
+
+func TestBufferedWorkerWriteAcked(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	worker := NewBufferedWorker(10, time.Minute, database)
+	worker.Start()
+	defer worker.Stop()
+
+	acks := make([]<-chan error, 0, 10)
+	for i := 0; i < 10; i++ {
+		acks = append(acks, worker.WriteAcked(NewIntMetric(i)))
+	}
+
+	for _, ack := range acks {
+		select {
+		case err := <-ack:
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+
+	// once acknowledged every metric is in the database
+	if median, count := database.GetMedianAndCount(); median != 4 || count != 10 {
+		t.Fatalf("expected median 4 and count 10, got median %d and count %d", median, count)
+	}
+}
+
+func TestBufferedWorkerMaxLatency(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	// neither the buffer size nor the interval would flush in time
+	worker := NewBufferedWorker(1000, time.Hour, database, WithMaxLatency(20*time.Millisecond))
+	worker.Start()
+	defer worker.Stop()
+
+	for i := 0; i < 3; i++ {
+		start := time.Now()
+		select {
+		case err := <-worker.WriteAcked(NewIntMetric(i)):
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected the partial buffer to be flushed within the bound")
+		}
+
+		if took := time.Since(start); took < 5*time.Millisecond {
+			t.Fatalf("expected the metric to be buffered, but it was applied in %v", took)
+		}
+	}
+
+	if _, count := database.GetMedianAndCount(); count != 3 {
+		t.Fatalf("expected every metric to be applied, got %d", count)
+	}
+}
+
+func TestBufferedWorkerRawMetrics(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	worker := NewBufferedWorker(4, time.Minute, database)
+	worker.Start()
+	defer worker.Stop()
+
+	var acks []<-chan error
+	for _, raw := range []float64{0.6, 1.2, 1.4, 9.8} {
+		acks = append(acks, worker.WriteAcked(NewFloatMetric(raw)))
+	}
+	for _, ack := range acks {
+		<-ack
+	}
+
+	// the values were rounded, but the raw observations weren't lost
+	if median := database.GetMedian(); median != 1 {
+		t.Fatalf("expected a median of 1, got %d", median)
+	}
+
+	aggregate := database.GetAggregate()
+	if aggregate.Count != 4 || aggregate.Mean() != 3.25 || aggregate.Min != 0.6 || aggregate.Max != 9.8 {
+		t.Fatalf("expected a mean of 3.25 between 0.6 and 9.8, got %+v", aggregate)
+	}
+}
+
+func TestBufferedWorkerName(t *testing.T) {
+	database := NewMedianDatabase(WithName("checkout.latency"))
+	database.Open()
+	database.Close()
+
+	worker := NewBufferedWorker(1, time.Minute, database, WithWorkerName("ingest"))
+	worker.Start()
+	defer worker.Stop()
+
+	// the database's error is tagged with both names
+	err := <-worker.WriteAcked(NewIntMetric(1))
+	if !errors.Is(err, ErrClosed) || err.Error() != "worker ingest: database checkout.latency: closed" {
+		t.Fatalf("expected a named ErrClosed, got %v", err)
+	}
+}
+
+func TestBufferedWorkerMultiMetrics(t *testing.T) {
+	database := NewMedianDatabase()
+	database.Open()
+	defer database.Close()
+
+	worker := NewBufferedWorker(1000, time.Minute, database)
+	worker.Start()
+
+	invalid := NewHistogramMetric(map[int]int{10: 0})
+	if err := worker.Write(invalid); !errors.Is(err, ErrInvalidMetric) {
+		t.Fatalf("expected ErrInvalidMetric, got %v", err)
+	}
+
+	// a scraped histogram written in one call, alongside a single metric
+	// for one of its values
+	scrape := NewHistogramMetric(map[int]int{10: 100, 20: 300, 30: 50})
+	acks := []<-chan error{worker.WriteAcked(scrape), worker.WriteAcked(NewIntMetric(10))}
+	worker.Stop()
+	for _, ack := range acks {
+		if err := <-ack; err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	snapshot, _ := database.Snapshot()
+	if snapshot.Count() != 451 || snapshot.GetMedian() != 20 || snapshot.GetPercentile(0.2) != 10 {
+		t.Fatalf("unexpected contents, count %d, median %d", snapshot.Count(), snapshot.GetMedian())
+	}
+}